@@ -0,0 +1,62 @@
+package background
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/faucet"
+	"github.com/thetatoken/vault/indexer"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/rotation"
+	"github.com/thetatoken/vault/tracker"
+	rpcc "github.com/ybbus/jsonrpc"
+)
+
+// Start runs the faucet, key rotations, the transaction tracker and the block
+// indexer, those the database supports, next to the server of vault or
+// vault-signer. It returns the key rotation manager, or nil if the database does
+// not support key rotation.
+func Start(da db.Store, keyManager *keymanager.SqlKeyManager, client *rpcc.RPCClient) *rotation.Manager {
+	rotations := newKeyRotation(da, keyManager, client)
+	go startFaucet(da, client)
+	if rotations != nil {
+		go rotations.Process()
+	}
+	go startTxTracker(da, client)
+	go startIndexer(da, client)
+	return rotations
+}
+
+func startFaucet(da db.Store, client *rpcc.RPCClient) {
+	f := faucet.NewFaucetManager(da, client)
+	f.Process()
+}
+
+// newKeyRotation returns nil if the database does not support key rotation.
+func newKeyRotation(da db.Store, keyManager *keymanager.SqlKeyManager, client *rpcc.RPCClient) *rotation.Manager {
+	store, ok := da.(rotation.Store)
+	if !ok {
+		log.Info("Key rotation is not supported by the database driver")
+		return nil
+	}
+	return rotation.NewManager(store, keyManager, rotation.NewRPCChain(client))
+}
+
+func startTxTracker(da db.Store, client *rpcc.RPCClient) {
+	store, ok := da.(tracker.Store)
+	if !ok {
+		log.Info("Transaction tracking is not supported by the database driver")
+		return
+	}
+	t := tracker.NewTracker(store, tracker.NewRPCChain(client))
+	t.Process()
+}
+
+func startIndexer(da db.Store, client *rpcc.RPCClient) {
+	store, ok := da.(indexer.Store)
+	if !ok {
+		log.Info("Transaction indexing is not supported by the database driver")
+		return
+	}
+	ix := indexer.NewIndexer(store, indexer.NewRPCChain(client))
+	ix.Process()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	tcmn "github.com/thetatoken/ukulele/common"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/policy"
+)
+
+var allowlistAddLabel string
+
+var allowlistCmd = &cobra.Command{
+	Use:   "allowlist",
+	Short: "Manage the withdrawal allowlists of users",
+	Long:  "Manage the withdrawal allowlists the signer checks transactions against, which vault serves itself only without a remote signer.",
+}
+
+var allowlistAddCmd = &cobra.Command{
+	Use:   "add <user_id> <address>",
+	Short: "Allow payments to an address once the allowlist delay has passed",
+	Long:  "Allow payments from the user to an external address once allowlist.delay_secs has passed, and notify allowlist.webhook_url. Adding an allowed address again does not reset its delay.",
+	Args:  cobra.ExactArgs(2),
+	Run:   runAllowlistAdd,
+}
+
+var allowlistListCmd = &cobra.Command{
+	Use:   "list <user_id>",
+	Short: "List the allowed addresses of a user",
+	Args:  cobra.ExactArgs(1),
+	Run:   runAllowlistList,
+}
+
+var allowlistRemoveCmd = &cobra.Command{
+	Use:   "remove <user_id> <address>",
+	Short: "Disallow payments to an address immediately",
+	Args:  cobra.ExactArgs(2),
+	Run:   runAllowlistRemove,
+}
+
+func init() {
+	allowlistAddCmd.Flags().StringVar(&allowlistAddLabel, "label", "", "Note for the user, e.g. the name of an exchange")
+	allowlistCmd.AddCommand(allowlistAddCmd)
+	allowlistCmd.AddCommand(allowlistListCmd)
+	allowlistCmd.AddCommand(allowlistRemoveCmd)
+}
+
+// openAllowlists opens the database, or exits if it does not support allowlists.
+func openAllowlists(logger *log.Entry) (db.Store, db.AllowlistStore) {
+	da, _ := openKeyManager(logger)
+	allowlists, ok := da.(db.AllowlistStore)
+	if !ok {
+		da.Close()
+		logger.Fatal(policy.ErrNoAllowlists)
+	}
+	return da, allowlists
+}
+
+func parseAddress(logger *log.Entry, address string) tcmn.Address {
+	if !tcmn.IsHexAddress(address) {
+		logger.Fatalf("Invalid address: %s", address)
+	}
+	return tcmn.HexToAddress(address)
+}
+
+func runAllowlistAdd(cmd *cobra.Command, args []string) {
+	logger := log.WithFields(log.Fields{"method": "allowlistAdd", "userid": args[0], "address": args[1]})
+
+	address := parseAddress(logger, args[1])
+	da, allowlists := openAllowlists(logger)
+	defer da.Close()
+
+	entry, added, err := policy.AddWithdrawalAddress(allowlists, args[0], address, allowlistAddLabel)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if added {
+		policy.NotifyWithdrawalAddressAdded("", entry)
+	}
+	logger.WithFields(log.Fields{"added": added, "active_at": entry.ActiveAt.UTC()}).Info("Address allowed")
+}
+
+func runAllowlistList(cmd *cobra.Command, args []string) {
+	logger := log.WithFields(log.Fields{"method": "allowlistList", "userid": args[0]})
+
+	da, allowlists := openAllowlists(logger)
+	defer da.Close()
+
+	entries, err := allowlists.ListWithdrawalAddresses(args[0])
+	if err != nil {
+		logger.Fatal(err)
+	}
+	for _, entry := range entries {
+		logger.WithFields(log.Fields{
+			"address":   entry.Address.Hex(),
+			"label":     entry.Label,
+			"active_at": entry.ActiveAt.UTC(),
+			"active":    !time.Now().Before(entry.ActiveAt),
+		}).Info("Allowed address")
+	}
+}
+
+func runAllowlistRemove(cmd *cobra.Command, args []string) {
+	logger := log.WithFields(log.Fields{"method": "allowlistRemove", "userid": args[0], "address": args[1]})
+
+	address := parseAddress(logger, args[1])
+	da, allowlists := openAllowlists(logger)
+	defer da.Close()
+
+	removed, err := allowlists.RemoveWithdrawalAddress(args[0], address)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.WithFields(log.Fields{"removed": removed}).Info("Address disallowed")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/thetatoken/vault/keymanager"
+)
+
+var createAccountsCmd = &cobra.Command{
+	Use:   "create-accounts [user_id...]",
+	Short: "Create the accounts of users",
+	Long:  "Generate the send and receive accounts of the given users. Users that already have an account keep it.",
+	Run:   runCreateAccounts,
+}
+
+func runCreateAccounts(cmd *cobra.Command, args []string) {
+	logger := log.WithFields(log.Fields{"method": "createAccounts"})
+
+	da, keyManager := openKeyManager(logger)
+	defer da.Close()
+
+	for _, userid := range args {
+		created := true
+		record, err := keyManager.CreateAccount(userid)
+		if err == keymanager.ErrAccountExists {
+			created = false
+			record, err = keyManager.FindByUserId(userid)
+		}
+		if err != nil {
+			logger.WithFields(log.Fields{"userid": userid, "error": err}).Error("Failed to create account")
+			continue
+		}
+		logger.WithFields(log.Fields{
+			"userid":       userid,
+			"send_address": record.SaAddress.Hex(),
+			"recv_address": record.RaAddress.Hex(),
+			"created":      created,
+		}).Info("Account ready")
+	}
+}
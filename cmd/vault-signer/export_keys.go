@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/util"
+)
+
+var (
+	exportKeysPasswordFile string
+	exportKeysOut          string
+)
+
+var exportKeysCmd = &cobra.Command{
+	Use:   "export-keys <user_id>",
+	Short: "Export the keys of a user as password-encrypted keystores",
+	Long: "Write the keys of both accounts of a user as keystores in the Theta wallet format, encrypted with the password read from --password-file. " +
+		"The export is recorded in the admin audit trail with the operating system user and host as the actor.",
+	Args: cobra.ExactArgs(1),
+	Run:  runExportKeys,
+}
+
+func init() {
+	exportKeysCmd.Flags().StringVar(&exportKeysPasswordFile, "password-file", "", "File holding the password to encrypt the keystores with")
+	exportKeysCmd.Flags().StringVar(&exportKeysOut, "out", "", "File to write the keystores to, instead of the standard output")
+	exportKeysCmd.MarkFlagRequired("password-file")
+}
+
+func runExportKeys(cmd *cobra.Command, args []string) {
+	userid := args[0]
+	logger := log.WithFields(log.Fields{"method": "exportKeys", "userid": userid})
+
+	password, err := readPassword(exportKeysPasswordFile)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	da, keyManager := openKeyManager(logger)
+	defer da.Close()
+	keys, err := keyManager.ExportKeys(userid, password, util.CLIActor())
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Fatal("Failed to export keys")
+	}
+	raw, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	raw = append(raw, '\n')
+
+	if exportKeysOut == "" {
+		os.Stdout.Write(raw)
+		return
+	}
+	if err := ioutil.WriteFile(exportKeysOut, raw, 0600); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("Exported keys to %v", exportKeysOut)
+}
+
+// readPassword reads a keystore password from a file, ignoring the trailing newline.
+func readPassword(path string) (string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read password file")
+	}
+	password := strings.TrimRight(string(raw), "\r\n")
+	if len(password) < keymanager.MinKeystorePasswordLength {
+		return "", errors.Errorf("Password must be at least %d characters", keymanager.MinKeystorePasswordLength)
+	}
+	return password, nil
+}
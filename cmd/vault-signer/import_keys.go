@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/util"
+)
+
+var (
+	importKeysPasswordFile string
+	importKeysIn           string
+)
+
+var importKeysCmd = &cobra.Command{
+	Use:   "import-keys <user_id>",
+	Short: "Create the account of a new user from password-encrypted keystores",
+	Long: "Read the send_account and recv_account keystores, as written by export-keys, and create the account of a new user with their keys. " +
+		"The import is recorded in the admin audit trail with the operating system user and host as the actor.",
+	Args: cobra.ExactArgs(1),
+	Run:  runImportKeys,
+}
+
+func init() {
+	importKeysCmd.Flags().StringVar(&importKeysPasswordFile, "password-file", "", "File holding the password the keystores are encrypted with")
+	importKeysCmd.Flags().StringVar(&importKeysIn, "in", "", "File to read the keystores from, instead of the standard input")
+	importKeysCmd.MarkFlagRequired("password-file")
+}
+
+func runImportKeys(cmd *cobra.Command, args []string) {
+	userid := args[0]
+	logger := log.WithFields(log.Fields{"method": "importKeys", "userid": userid})
+
+	password, err := readPassword(importKeysPasswordFile)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	var raw []byte
+	if importKeysIn == "" {
+		raw, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		raw, err = ioutil.ReadFile(importKeysIn)
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+	var keys keymanager.ExportedKeys
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		logger.WithFields(log.Fields{"error": err}).Fatal("Failed to parse keystores")
+	}
+	if keys.SendAccount == nil || keys.RecvAccount == nil {
+		logger.Fatal("Both send_account and recv_account keystores are required")
+	}
+
+	da, keyManager := openKeyManager(logger)
+	defer da.Close()
+	record, err := keyManager.ImportKeys(userid, keys, password, util.CLIActor())
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Fatal("Failed to import keys")
+	}
+	logger.WithFields(log.Fields{"send_address": record.SaAddress.Hex(), "recv_address": record.RaAddress.Hex()}).Info("Imported keys")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/util"
+)
+
+var rootCmd = &cobra.Command{
+	Use:   "vault-signer",
+	Short: "Key custody service of vault",
+	Long:  "Vault-signer owns the key database and signs transactions for a vault server connected over a local Unix socket.",
+	Run:   runSigner,
+}
+
+func init() {
+	cobra.OnInitialize(func() {
+		util.SetupLogger()
+		util.ReadConfig()
+	})
+	rootCmd.AddCommand(allowlistCmd)
+	rootCmd.AddCommand(createAccountsCmd)
+	rootCmd.AddCommand(exportKeysCmd)
+	rootCmd.AddCommand(importKeysCmd)
+	rootCmd.AddCommand(setLimitsCmd)
+}
+
+// openKeyManager opens the database, prepares its schema and loads the key
+// manager, or exits.
+func openKeyManager(logger *log.Entry) (db.Store, *keymanager.SqlKeyManager) {
+	da, err := db.NewStore()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if err := da.PrepareSchema(); err != nil {
+		da.Close()
+		logger.Fatal(err)
+	}
+	keyManager, err := keymanager.NewSqlKeyManager(da)
+	if err != nil {
+		da.Close()
+		logger.Fatal(err)
+	}
+	return da, keyManager
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
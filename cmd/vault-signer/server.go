@@ -0,0 +1,48 @@
+package main
+
+import (
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/thetatoken/vault/background"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/signer"
+	"github.com/thetatoken/vault/util"
+	rpcc "github.com/ybbus/jsonrpc"
+)
+
+func runSigner(cmd *cobra.Command, args []string) {
+	logger := log.WithFields(log.Fields{"method": "signer.main"})
+
+	da, err := db.NewStore()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer da.Close()
+
+	if err := da.PrepareSchema(); err != nil {
+		logger.Fatal(err)
+	}
+
+	keyManager, err := keymanager.NewSqlKeyManager(da)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	tlsConfig, err := signer.LoadTLSConfig(viper.GetString(util.CfgSignerTLSCert), viper.GetString(util.CfgSignerTLSKey), viper.GetString(util.CfgSignerTLSCA))
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server, err := signer.NewServer(viper.GetString(util.CfgSignerSocket), tlsConfig, signer.NewService(keyManager, da))
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	client := rpcc.NewRPCClient(viper.GetString(util.CfgThetaRPCEndpoint))
+	background.Start(da, keyManager, client)
+
+	logger.Fatal(server.Serve())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math/big"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/policy"
+	"github.com/thetatoken/vault/util"
+)
+
+var (
+	setLimitsTier             string
+	setLimitsAmounts          = map[string]*string{}
+	setLimitsMaxReservedFunds int64
+)
+
+var setLimitsCmd = &cobra.Command{
+	Use:   "set-limits <user_id>",
+	Short: "Assign a user to a spending limit tier and override its limits",
+	Long:  "Assign a user to a tier, the default tier if --tier is omitted, and replace the overrides of the user with the limits given. Amounts are in wei.",
+	Args:  cobra.ExactArgs(1),
+	Run:   runSetLimits,
+}
+
+func init() {
+	setLimitsCmd.Flags().StringVar(&setLimitsTier, "tier", "", "Tier of the user")
+	for _, name := range []string{"per-tx-thetawei", "per-tx-gammawei", "daily-thetawei", "daily-gammawei", "monthly-thetawei", "monthly-gammawei"} {
+		setLimitsAmounts[name] = setLimitsCmd.Flags().String(name, "", "Override of the "+name+" limit")
+	}
+	setLimitsCmd.Flags().Int64Var(&setLimitsMaxReservedFunds, "max-reserved-funds", 0, "Override of the reserved funds limit")
+}
+
+func runSetLimits(cmd *cobra.Command, args []string) {
+	userid := args[0]
+	logger := log.WithFields(log.Fields{"method": "setLimits", "userid": userid})
+
+	if setLimitsTier != "" {
+		if _, err := policy.TierLimits(setLimitsTier); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	overrides := db.SpendingLimits{}
+	for name, dest := range map[string]**big.Int{
+		"per-tx-thetawei":  &overrides.PerTransaction.ThetaWei,
+		"per-tx-gammawei":  &overrides.PerTransaction.GammaWei,
+		"daily-thetawei":   &overrides.Daily.ThetaWei,
+		"daily-gammawei":   &overrides.Daily.GammaWei,
+		"monthly-thetawei": &overrides.Monthly.ThetaWei,
+		"monthly-gammawei": &overrides.Monthly.GammaWei,
+	} {
+		amount, err := policy.ParseLimit(*setLimitsAmounts[name])
+		if err != nil {
+			logger.Fatalf("Invalid %s: %v", name, err)
+		}
+		*dest = amount
+	}
+	if cmd.Flags().Changed("max-reserved-funds") {
+		if setLimitsMaxReservedFunds < 0 {
+			logger.Fatal("Invalid max-reserved-funds")
+		}
+		overrides.ReservedFunds = &setLimitsMaxReservedFunds
+	}
+
+	da, _ := openKeyManager(logger)
+	defer da.Close()
+	limits, ok := da.(db.LimitStore)
+	if !ok {
+		logger.Fatal(policy.ErrNoSpendingLimits)
+	}
+	if err := limits.SaveUserLimits(db.UserLimits{UserID: userid, Tier: setLimitsTier, Overrides: overrides}); err != nil {
+		logger.Fatal(err)
+	}
+	tier, _, err := policy.UserLimits(limits, userid)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.WithFields(log.Fields{"tier": tier, "actor": util.CLIActor()}).Info("Set spending limits")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/hex"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/thetatoken/vault/db"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Inspect the signing audit log",
+}
+
+var auditVerifyHead string
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the signing audit log for tampering",
+	Long: "Walk the signing audit log and check that no entry was modified, removed or reordered. " +
+		"Pass the head hash printed by an earlier run with --head to also detect entries removed from the end of the log.",
+	Run: runAuditVerify,
+}
+
+func init() {
+	auditVerifyCmd.Flags().StringVar(&auditVerifyHead, "head", "", "Hex encoded hash of an entry the log must still contain")
+	auditCmd.AddCommand(auditVerifyCmd)
+}
+
+func runAuditVerify(cmd *cobra.Command, args []string) {
+	logger := log.WithFields(log.Fields{"method": "auditVerify"})
+
+	da, err := db.NewStore()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer da.Close()
+
+	if err := da.PrepareSchema(); err != nil {
+		logger.Fatal(err)
+	}
+	auditLog, ok := da.(db.SigningAuditLog)
+	if !ok {
+		logger.Fatal("The database driver does not keep a signing audit log")
+	}
+
+	var found bool
+	head, err := db.VerifySigningAudit(auditLog, func(entry db.SigningAuditEntry) {
+		if auditVerifyHead != "" && hex.EncodeToString(entry.Hash) == auditVerifyHead {
+			found = true
+		}
+	})
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err, "last_valid_seq": head.Seq}).Fatal("Signing audit log failed verification")
+	}
+	if auditVerifyHead != "" && !found {
+		logger.WithFields(log.Fields{"head": auditVerifyHead}).Fatal("Signing audit log no longer contains the expected head; entries were removed")
+	}
+	logger.WithFields(log.Fields{"entries": head.Seq, "head": hex.EncodeToString(head.Hash)}).Info("Signing audit log verified")
+}
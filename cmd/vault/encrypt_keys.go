@@ -0,0 +1,30 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/thetatoken/vault/db"
+)
+
+var encryptKeysCmd = &cobra.Command{
+	Use:   "encrypt-keys",
+	Short: "Encrypt plaintext private keys in the database",
+	Long:  "Encrypt in place the private keys of every record written before encryption at rest was enabled. Safe to run repeatedly.",
+	Run:   runEncryptKeys,
+}
+
+func runEncryptKeys(cmd *cobra.Command, args []string) {
+	logger := log.WithFields(log.Fields{"method": "encryptKeys"})
+
+	da, err := db.NewStore()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer da.Close()
+
+	count, err := da.EncryptPlaintextRecords()
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err, "migrated": count}).Fatal("Failed to encrypt records")
+	}
+	logger.Infof("Encrypted keys of %d records", count)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/thetatoken/vault/util"
+)
+
+var rootCmd = &cobra.Command{
+	Use:   "vault",
+	Short: "Managed Theta wallet service",
+	Long:  "Vault runs the managed wallet JSON-RPC server and the faucet service.",
+	Run:   runVault,
+}
+
+func init() {
+	cobra.OnInitialize(func() {
+		util.SetupLogger()
+		util.ReadConfig()
+	})
+	rootCmd.AddCommand(auditCmd)
+	rootCmd.AddCommand(encryptKeysCmd)
+	rootCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(rotateKeysCmd)
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
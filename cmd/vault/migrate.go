@@ -0,0 +1,34 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/thetatoken/vault/db"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Apply pending database schema migrations",
+	Long:  "Apply, in order, every schema migration not yet recorded in the schema version table.",
+	Run:   runMigrate,
+}
+
+func runMigrate(cmd *cobra.Command, args []string) {
+	logger := log.WithFields(log.Fields{"method": "migrate"})
+
+	da, err := db.NewStore()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer da.Close()
+
+	count, err := da.Migrate()
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err, "applied": count}).Fatal("Failed to migrate database")
+	}
+	version, err := da.SchemaVersion()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("Applied %d migrations. Schema is at version %d", count, version)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/rotation"
+	"github.com/thetatoken/vault/util"
+	rpcc "github.com/ybbus/jsonrpc"
+)
+
+var rotateKeysWait bool
+
+var rotateKeysCmd = &cobra.Command{
+	Use:   "rotate-keys [user_id...]",
+	Short: "Rotate the keys of users and sweep their funds to the new keys",
+	Long: "Generate new keys for the given users, retire their old keys and sweep the old balances to the new addresses. " +
+		"Rotations already in progress, including interrupted ones, are resumed. Without --wait, a running vault finishes them in the background.",
+	Run: runRotateKeys,
+}
+
+func init() {
+	rotateKeysCmd.Flags().BoolVar(&rotateKeysWait, "wait", false, "Keep advancing the rotations until all of them are completed")
+}
+
+func runRotateKeys(cmd *cobra.Command, args []string) {
+	logger := log.WithFields(log.Fields{"method": "rotateKeys"})
+
+	da, err := db.NewStore()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer da.Close()
+
+	if err := da.PrepareSchema(); err != nil {
+		logger.Fatal(err)
+	}
+	store, ok := da.(rotation.Store)
+	if !ok {
+		logger.Fatal("Key rotation requires a SQL database")
+	}
+	keyManager, err := keymanager.NewSqlKeyManager(da)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	client := rpcc.NewRPCClient(viper.GetString(util.CfgThetaRPCEndpoint))
+	m := rotation.NewManager(store, keyManager, rotation.NewRPCChain(client))
+
+	actor := util.CLIActor()
+	for _, userid := range args {
+		if _, err := m.StartByAdmin(userid, actor); err != nil {
+			logger.WithFields(log.Fields{"userid": userid, "error": err}).Error("Failed to start key rotation")
+		}
+	}
+
+	for {
+		active, err := m.AdvanceAll()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Infof("%d key rotations in progress", active)
+		if active == 0 || !rotateKeysWait {
+			return
+		}
+		time.Sleep(time.Duration(viper.GetInt64(util.CfgRotationWakeupInterval)) * time.Second)
+	}
+}
@@ -9,16 +9,21 @@ import (
 	"net/http"
 	"strings"
 
+	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/rpc/v2"
 	json "github.com/gorilla/rpc/v2/json2"
 	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/thetatoken/vault/background"
 	"github.com/thetatoken/vault/db"
-	"github.com/thetatoken/vault/faucet"
 	"github.com/thetatoken/vault/handler"
 	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/rotation"
+	"github.com/thetatoken/vault/signer"
 	"github.com/thetatoken/vault/util"
 	rpcc "github.com/ybbus/jsonrpc"
 	"golang.org/x/net/netutil"
@@ -66,23 +71,55 @@ func corsMiddleware(handler http.Handler) http.Handler {
 	})
 }
 
-func startServer(da *db.DAO, client *rpcc.RPCClient) {
+// stores holds the optional features of the database the handlers use. Each is
+// nil if the database does not support the feature, and all of them are nil with
+// a remote signer.
+type stores struct {
+	txs         db.TransactionStore
+	history     db.HistoryStore
+	idempotency db.IdempotencyStore
+	allowlists  db.AllowlistStore
+	limits      db.LimitStore
+}
+
+func newStores(da db.Store) stores {
+	var st stores
+	st.txs, _ = da.(db.TransactionStore)
+	st.history, _ = da.(db.HistoryStore)
+	st.idempotency, _ = da.(db.IdempotencyStore)
+	st.allowlists, _ = da.(db.AllowlistStore)
+	st.limits, _ = da.(db.LimitStore)
+	return st
+}
+
+// startServer serves the RPC services. rotations is nil if the database does not
+// support key rotation, or with a remote signer.
+func startServer(keyManager keymanager.KeyManager, st stores, rotations *rotation.Manager, client *rpcc.RPCClient) {
 	logger := log.WithFields(log.Fields{"method": "rpc.startServer"})
 
 	s := rpc.NewServer()
 	s.RegisterCodec(json.NewCodec(), "application/json")
 	s.RegisterCodec(json.NewCodec(), "application/json;charset=UTF-8")
 
-	keyManager, err := keymanager.NewSqlKeyManager(da)
-
-	if err != nil {
-		logger.Fatal(err)
-	}
 	defer keyManager.Close()
 
-	handler := handler.NewRPCHandler(client, keyManager)
-	s.RegisterService(handler, "theta")
+	h := handler.NewRPCHandler(client, keyManager)
+	h.Txs = st.txs
+	h.History = st.history
+	h.Idempotency = st.idempotency
+	h.Allowlists = st.allowlists
+	h.Limits = st.limits
+	s.RegisterService(h, "theta")
+	if token := viper.GetString(util.CfgAdminToken); token != "" {
+		admin := handler.NewAdminRPCHandler(keyManager, token)
+		admin.Limits = st.limits
+		if rotations != nil {
+			admin.Rotations = rotations
+		}
+		s.RegisterService(admin, "admin")
+	}
 	r := mux.NewRouter()
+	r.Use(util.RequestIDMiddleware)
 	r.Use(util.LoggerMiddleware)
 	r.Use(decompressMiddleware)
 	// r.Use(corsMiddleware)
@@ -101,25 +138,58 @@ func startServer(da *db.DAO, client *rpcc.RPCClient) {
 	return
 }
 
-func startFaucet(da *db.DAO, client *rpcc.RPCClient) {
-	f := faucet.NewFaucetManager(da, client)
-	f.Process()
+// checkRemoteConfig rejects settings vault cannot honor with a remote signer:
+// policies are enforced by vault-signer with its own database, and admin
+// operations are run with its commands on the signer host.
+func checkRemoteConfig() error {
+	if viper.GetString(util.CfgAdminToken) != "" {
+		return errors.Errorf("%s is not supported with a remote signer, run admin operations on the signer host", util.CfgAdminToken)
+	}
+	for _, key := range []string{util.CfgAllowlistEnabled, util.CfgLimitsEnabled} {
+		if viper.GetBool(key) {
+			return errors.Errorf("%s is not supported with a remote signer, set it in the config of vault-signer, which enforces it", key)
+		}
+	}
+	return nil
 }
 
-func main() {
-	util.SetupLogger()
-	util.ReadConfig()
+func runVault(cmd *cobra.Command, args []string) {
+	client := rpcc.NewRPCClient(viper.GetString(util.CfgThetaRPCEndpoint))
 
-	da, err := db.NewDAO()
+	if viper.GetString(util.CfgSignerSocket) != "" {
+		// Keys and database are owned by vault-signer, which also runs the faucet,
+		// key rotations, the transaction tracker and the block indexer.
+		if err := checkRemoteConfig(); err != nil {
+			log.Fatal(err)
+		}
+		keyManager, err := signer.NewRemoteKeyManagerFromConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Info("Using remote signer")
+
+		go startServer(keyManager, stores{}, nil, client)
+
+		select {}
+	}
+
+	da, err := db.NewStore()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer da.Close()
 
-	client := rpcc.NewRPCClient(viper.GetString(util.CfgThetaRPCEndpoint))
+	if err := da.PrepareSchema(); err != nil {
+		log.Fatal(err)
+	}
+
+	keyManager, err := keymanager.NewSqlKeyManager(da)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	go startFaucet(da, client)
-	go startServer(da, client)
+	rotations := background.Start(da, keyManager, client)
+	go startServer(keyManager, newStores(da), rotations, client)
 
 	select {}
 }
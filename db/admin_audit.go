@@ -0,0 +1,51 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"github.com/thetatoken/vault/util"
+)
+
+// AdminAction is an entry of the audit trail of admin operations on user keys.
+type AdminAction struct {
+	Action    string    `json:"action"`
+	UserID    string    `json:"user_id"` // User whose keys were acted on.
+	Actor     string    `json:"actor"`   // Who requested the action.
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (da *DAO) RecordAdminAction(action AdminAction) error {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	sm := da.dialect.rebind(fmt.Sprintf("INSERT INTO %s_admin_audit (action, userid, actor, success, error) VALUES ($1, $2, $3, $4, $5)", tableName))
+	if _, err := da.db.Exec(sm, action.Action, action.UserID, action.Actor, action.Success, action.Error); err != nil {
+		return errors.Wrap(err, "Failed to update database")
+	}
+	return nil
+}
+
+var adminAuditBucket = []byte("admin_audit") // sequence -> AdminAction
+
+func (bs *BoltStore) RecordAdminAction(action AdminAction) error {
+	action.CreatedAt = time.Now()
+	v, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(adminAuditBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(seqKey(seq), v)
+	})
+}
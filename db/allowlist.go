@@ -0,0 +1,121 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/thetatoken/ukulele/common"
+
+	"github.com/thetatoken/vault/util"
+)
+
+// WithdrawalAddress is an external address a user allowed sends to. It can only
+// be sent to from ActiveAt on.
+type WithdrawalAddress struct {
+	UserID    string
+	Address   common.Address
+	Label     string
+	CreatedAt time.Time
+	ActiveAt  time.Time
+}
+
+// AllowlistStore persists the withdrawal allowlists of users. DAO implements it.
+type AllowlistStore interface {
+	// AddWithdrawalAddress stores the address unless the user already allowed it.
+	// It reports whether the address was stored.
+	AddWithdrawalAddress(entry WithdrawalAddress) (bool, error)
+
+	// FindWithdrawalAddress returns ErrNoRecord if the user did not allow the
+	// address.
+	FindWithdrawalAddress(userid string, address common.Address) (WithdrawalAddress, error)
+
+	ListWithdrawalAddresses(userid string) ([]WithdrawalAddress, error)
+
+	// RemoveWithdrawalAddress reports whether the address was allowed.
+	RemoveWithdrawalAddress(userid string, address common.Address) (bool, error)
+
+	// FindUserByAddress returns the user owning the address and the role of the
+	// account, or ErrNoRecord if the address is not managed by vault.
+	FindUserByAddress(address common.Address) (string, string, error)
+}
+
+const withdrawalAddressColumns = "userid, address, label, created_at, active_at"
+
+func (da *DAO) AddWithdrawalAddress(entry WithdrawalAddress) (bool, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	sm := da.dialect.insertIfAbsent(tableName+"_withdrawal_allowlist", withdrawalAddressColumns, "$1, $2, $3, $4, $5", "userid, address")
+	res, err := da.db.Exec(sm, entry.UserID, entry.Address.Bytes(), entry.Label, entry.CreatedAt, entry.ActiveAt)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	return n == 1, nil
+}
+
+func (da *DAO) FindWithdrawalAddress(userid string, address common.Address) (WithdrawalAddress, error) {
+	entries, err := da.findWithdrawalAddresses("userid=$1 AND address=$2", userid, address.Bytes())
+	if err != nil {
+		return WithdrawalAddress{}, err
+	}
+	if len(entries) == 0 {
+		return WithdrawalAddress{}, ErrNoRecord
+	}
+	return entries[0], nil
+}
+
+func (da *DAO) ListWithdrawalAddresses(userid string) ([]WithdrawalAddress, error) {
+	return da.findWithdrawalAddresses("userid=$1 ORDER BY created_at", userid)
+}
+
+func (da *DAO) RemoveWithdrawalAddress(userid string, address common.Address) (bool, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	sm := da.dialect.rebind(fmt.Sprintf("DELETE FROM %s_withdrawal_allowlist WHERE userid=$1 AND address=$2", tableName))
+	res, err := da.db.Exec(sm, userid, address.Bytes())
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	return n == 1, nil
+}
+
+func (da *DAO) findWithdrawalAddresses(where string, args ...interface{}) ([]WithdrawalAddress, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	query := da.dialect.rebind(fmt.Sprintf("SELECT %s FROM %s_withdrawal_allowlist WHERE %s", withdrawalAddressColumns, tableName, where))
+	rows, err := da.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []WithdrawalAddress
+	for rows.Next() {
+		var entry WithdrawalAddress
+		var address []byte
+		var createdAt, activeAt pq.NullTime
+		if err := rows.Scan(&entry.UserID, &address, &entry.Label, &createdAt, &activeAt); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse results from database")
+		}
+		entry.Address = common.BytesToAddress(address)
+		entry.CreatedAt = createdAt.Time
+		entry.ActiveAt = activeAt.Time
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse results from database")
+	}
+	return entries, nil
+}
+
+var _ AllowlistStore = &DAO{}
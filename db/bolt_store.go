@@ -0,0 +1,289 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/thetatoken/ukulele/common"
+	crypto "github.com/thetatoken/ukulele/crypto"
+
+	"github.com/thetatoken/vault/encryption"
+)
+
+var (
+	recordsBucket  = []byte("records")  // userid -> boltRecord
+	saIndexBucket  = []byte("sa_index") // SA address -> userid
+	unfundedBucket = []byte("unfunded") // created_at || userid -> userid, for users not yet funded
+	hdIndexBucket  = []byte("hd_index") // Only used for its sequence.
+)
+
+// boltRecord is the persisted form of a Record. Private keys are sealed the same way
+// as in the SQL store.
+type boltRecord struct {
+	RaAddress    []byte    `json:"ra_address"`
+	RaPubKey     []byte    `json:"ra_pubkey"`
+	RaPrivKey    []byte    `json:"ra_privkey,omitempty"`
+	SaAddress    []byte    `json:"sa_address"`
+	SaPubKey     []byte    `json:"sa_pubkey"`
+	SaPrivKey    []byte    `json:"sa_privkey,omitempty"`
+	WrappedKey   []byte    `json:"wrapped_dek,omitempty"`
+	HDIndex      *uint32   `json:"hd_index,omitempty"`
+	FaucetFunded bool      `json:"faucet_fund_claimed"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// BoltStore is an embedded, single-file Store for local development and small
+// deployments.
+type BoltStore struct {
+	db       *bolt.DB
+	envelope *encryption.Envelope
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	if path == "" {
+		return nil, errors.New("No database path is configured")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{recordsBucket, saIndexBucket, unfundedBucket, hdIndexBucket, adminAuditBucket, signingAuditBucket, txsBucket, txIdempotencyBucket, unsettledTxsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	envelope, err := encryption.NewEnvelopeFromConfig()
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "Failed to set up encryption at rest")
+	}
+	return &BoltStore{db: db, envelope: envelope}, nil
+}
+
+func (bs *BoltStore) Close() {
+	bs.db.Close()
+}
+
+func (bs *BoltStore) FindByUserId(userid string) (Record, error) {
+	var br *boltRecord
+	err := bs.db.View(func(tx *bolt.Tx) (err error) {
+		br, err = getBoltRecord(tx, userid)
+		return
+	})
+	if err != nil {
+		return Record{}, err
+	}
+	if br == nil {
+		return Record{}, ErrNoRecord
+	}
+
+	raPubKey, _ := crypto.PublicKeyFromBytes(br.RaPubKey)
+	saPubKey, _ := crypto.PublicKeyFromBytes(br.SaPubKey)
+	record := Record{
+		UserID:       userid,
+		RaPubKey:     raPubKey,
+		RaAddress:    common.BytesToAddress(br.RaAddress),
+		SaPubKey:     saPubKey,
+		SaAddress:    common.BytesToAddress(br.SaAddress),
+		HDIndex:      br.HDIndex,
+		CreatedAt:    br.CreatedAt,
+		FaucetFunded: br.FaucetFunded,
+	}
+	if br.HDIndex != nil {
+		return record, nil
+	}
+
+	raPrivkeyBytes, saPrivkeyBytes, err := openPrivateKeys(bs.envelope, userid, br.RaPrivKey, br.SaPrivKey, br.WrappedKey)
+	if err != nil {
+		return Record{}, errors.Wrapf(err, "Failed to decrypt keys of user %s", userid)
+	}
+	record.RaPrivateKey, _ = crypto.PrivateKeyFromBytes(raPrivkeyBytes)
+	record.SaPrivateKey, _ = crypto.PrivateKeyFromBytes(saPrivkeyBytes)
+	return record, nil
+}
+
+func (bs *BoltStore) CreateIfAbsent(record Record) (bool, error) {
+	br := &boltRecord{
+		RaAddress: record.RaAddress.Bytes(),
+		RaPubKey:  record.RaPubKey.ToBytes(),
+		SaAddress: record.SaAddress.Bytes(),
+		SaPubKey:  record.SaPubKey.ToBytes(),
+		HDIndex:   record.HDIndex,
+		CreatedAt: time.Now(),
+	}
+	if record.HDIndex == nil {
+		var err error
+		br.RaPrivKey, br.SaPrivKey, br.WrappedKey, err = sealPrivateKeys(bs.envelope, record.UserID, record.RaPrivateKey.ToBytes(), record.SaPrivateKey.ToBytes())
+		if err != nil {
+			return false, errors.Wrap(err, "Failed to encrypt private keys")
+		}
+	}
+
+	created := false
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		existing, err := getBoltRecord(tx, record.UserID)
+		if err != nil || existing != nil {
+			return err
+		}
+		if err := putBoltRecord(tx, record.UserID, br); err != nil {
+			return err
+		}
+		if err := tx.Bucket(saIndexBucket).Put(br.SaAddress, []byte(record.UserID)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(unfundedBucket).Put(unfundedKey(br.CreatedAt, record.UserID), []byte(record.UserID)); err != nil {
+			return err
+		}
+		created = true
+		return nil
+	})
+	return created, err
+}
+
+func (bs *BoltStore) NextHDIndex() (uint32, error) {
+	var index uint64
+	err := bs.db.Update(func(tx *bolt.Tx) (err error) {
+		index, err = tx.Bucket(hdIndexBucket).NextSequence()
+		return
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to allocate HD index")
+	}
+	// Bolt sequences start at 1 while HD indices start at 0.
+	return uint32(index - 1), nil
+}
+
+func (bs *BoltStore) FindUnfundedUsers(limit int) ([]Record, error) {
+	var records []Record
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(unfundedBucket).Cursor()
+		for k, v := c.First(); k != nil && len(records) < limit; k, v = c.Next() {
+			userid := string(v)
+			br, err := getBoltRecord(tx, userid)
+			if err != nil {
+				return errors.Wrap(err, "Failed to parse results from database")
+			}
+			if br == nil {
+				continue
+			}
+			records = append(records, Record{
+				UserID:       userid,
+				SaAddress:    common.BytesToAddress(br.SaAddress),
+				CreatedAt:    br.CreatedAt,
+				FaucetFunded: br.FaucetFunded,
+			})
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (bs *BoltStore) MarkUserFunded(address common.Address) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		userid := tx.Bucket(saIndexBucket).Get(address.Bytes())
+		if userid == nil {
+			return errors.Errorf("Failed to update database: no user with address %v", address)
+		}
+		br, err := getBoltRecord(tx, string(userid))
+		if err != nil {
+			return errors.Wrap(err, "Failed to update database")
+		}
+		if br == nil {
+			return errors.Errorf("Failed to update database: no record of user %s", userid)
+		}
+		br.FaucetFunded = true
+		if err := putBoltRecord(tx, string(userid), br); err != nil {
+			return errors.Wrap(err, "Failed to update database")
+		}
+		return tx.Bucket(unfundedBucket).Delete(unfundedKey(br.CreatedAt, string(userid)))
+	})
+}
+
+func (bs *BoltStore) EncryptPlaintextRecords() (int, error) {
+	if bs.envelope == nil {
+		return 0, errors.New("No encryption provider is configured")
+	}
+	count := 0
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(recordsBucket)
+		var userids []string
+		b.ForEach(func(k, v []byte) error {
+			userids = append(userids, string(k))
+			return nil
+		})
+		for _, userid := range userids {
+			br, err := getBoltRecord(tx, userid)
+			if err != nil {
+				return err
+			}
+			if br.HDIndex != nil || len(br.WrappedKey) != 0 {
+				continue
+			}
+			br.RaPrivKey, br.SaPrivKey, br.WrappedKey, err = sealPrivateKeys(bs.envelope, userid, br.RaPrivKey, br.SaPrivKey)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to encrypt keys of user %s", userid)
+			}
+			if err := putBoltRecord(tx, userid, br); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// The embedded store creates its buckets on open and has no versioned schema, so
+// it always reports the latest version.
+
+func (bs *BoltStore) SchemaVersion() (int, error) {
+	return LatestSchemaVersion(), nil
+}
+
+func (bs *BoltStore) Migrate() (int, error) {
+	return 0, nil
+}
+
+func (bs *BoltStore) PrepareSchema() error {
+	return nil
+}
+
+func getBoltRecord(tx *bolt.Tx, userid string) (*boltRecord, error) {
+	v := tx.Bucket(recordsBucket).Get([]byte(userid))
+	if v == nil {
+		return nil, nil
+	}
+	br := &boltRecord{}
+	if err := json.Unmarshal(v, br); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+func putBoltRecord(tx *bolt.Tx, userid string, br *boltRecord) error {
+	v, err := json.Marshal(br)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(recordsBucket).Put([]byte(userid), v)
+}
+
+// unfundedKey orders unfunded users by creation time, like the SQL store does.
+func unfundedKey(createdAt time.Time, userid string) []byte {
+	key := make([]byte, 8, 8+len(userid))
+	binary.BigEndian.PutUint64(key, uint64(createdAt.UnixNano()))
+	return append(key, userid...)
+}
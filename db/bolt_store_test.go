@@ -0,0 +1,108 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thetatoken/ukulele/common"
+	crypto "github.com/thetatoken/ukulele/crypto"
+)
+
+func newTestBoltStore(t *testing.T) (*BoltStore, func()) {
+	dir, err := ioutil.TempDir("", "vault-bolt")
+	require.Nil(t, err)
+	bs, err := NewBoltStore(filepath.Join(dir, "vault.db"))
+	require.Nil(t, err)
+	return bs, func() {
+		bs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestRecord(t *testing.T, userid string, sa byte) Record {
+	raPrivKey, raPubKey, err := crypto.GenerateKeyPair()
+	require.Nil(t, err)
+	saPrivKey, saPubKey, err := crypto.GenerateKeyPair()
+	require.Nil(t, err)
+	return Record{
+		UserID:       userid,
+		RaPrivateKey: raPrivKey,
+		RaPubKey:     raPubKey,
+		RaAddress:    common.BytesToAddress([]byte{sa, 1}),
+		SaPrivateKey: saPrivKey,
+		SaPubKey:     saPubKey,
+		SaAddress:    common.BytesToAddress([]byte{sa, 2}),
+	}
+}
+
+func TestBoltStoreCreateIfAbsent(t *testing.T) {
+	assert := assert.New(t)
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	_, err := bs.FindByUserId("alice")
+	assert.Equal(ErrNoRecord, err)
+
+	created, err := bs.CreateIfAbsent(newTestRecord(t, "alice", 1))
+	assert.Nil(err)
+	assert.True(created)
+
+	created, err = bs.CreateIfAbsent(newTestRecord(t, "alice", 2))
+	assert.Nil(err)
+	assert.False(created)
+
+	record, err := bs.FindByUserId("alice")
+	assert.Nil(err)
+	assert.Equal("alice", record.UserID)
+	assert.Equal(common.BytesToAddress([]byte{1, 1}), record.RaAddress)
+	assert.Equal(common.BytesToAddress([]byte{1, 2}), record.SaAddress)
+	assert.False(record.FaucetFunded)
+}
+
+func TestBoltStoreFaucetFunding(t *testing.T) {
+	assert := assert.New(t)
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	for i, userid := range []string{"alice", "bob", "carol"} {
+		_, err := bs.CreateIfAbsent(newTestRecord(t, userid, byte(i+1)))
+		assert.Nil(err)
+	}
+
+	records, err := bs.FindUnfundedUsers(2)
+	assert.Nil(err)
+	if assert.Len(records, 2) {
+		assert.Equal("alice", records[0].UserID)
+		assert.Equal("bob", records[1].UserID)
+	}
+
+	assert.Nil(bs.MarkUserFunded(common.BytesToAddress([]byte{1, 2})))
+	assert.NotNil(bs.MarkUserFunded(common.BytesToAddress([]byte{9, 9})))
+
+	records, err = bs.FindUnfundedUsers(10)
+	assert.Nil(err)
+	if assert.Len(records, 2) {
+		assert.Equal("bob", records[0].UserID)
+		assert.Equal("carol", records[1].UserID)
+	}
+
+	record, err := bs.FindByUserId("alice")
+	assert.Nil(err)
+	assert.True(record.FaucetFunded)
+}
+
+func TestBoltStoreHDIndex(t *testing.T) {
+	assert := assert.New(t)
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	for i := uint32(0); i < 3; i++ {
+		index, err := bs.NextHDIndex()
+		assert.Nil(err)
+		assert.Equal(i, index)
+	}
+}
@@ -2,7 +2,6 @@ package db
 
 import (
 	"database/sql"
-	"encoding/hex"
 	"fmt"
 	"time"
 
@@ -14,28 +13,48 @@ import (
 	"github.com/thetatoken/ukulele/common"
 	crypto "github.com/thetatoken/ukulele/crypto"
 
+	"github.com/thetatoken/vault/encryption"
 	"github.com/thetatoken/vault/util"
 )
 
 var ErrNoRecord = errors.New("DAO: no record in database")
 
 type DAO struct {
-	db *sql.DB
+	db       *sql.DB
+	dialect  dialect
+	envelope *encryption.Envelope
 }
 
+// NewDAO connects to the SQL database selected by db.driver, either postgres or
+// mysql.
 func NewDAO() (*DAO, error) {
+	driver := viper.GetString(util.CfgDbDriver)
 	user := viper.GetString(util.CfgDbUser)
 	pass := viper.GetString(util.CfgDbPass)
 	host := viper.GetString(util.CfgDbHost)
 	database := viper.GetString(util.CfgDbDatabase)
 
-	dbURL := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", user, pass, host, database)
-	db, err := sql.Open("postgres", dbURL)
+	var dbURL string
+	switch driver {
+	case DriverPostgres:
+		dbURL = fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", user, pass, host, database)
+	case DriverMySQL:
+		// clientFoundRows makes UPDATE report matched rather than changed rows, as
+		// Postgres does.
+		dbURL = fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true&clientFoundRows=true", user, pass, host, database)
+	default:
+		return nil, errors.Errorf("Unknown SQL database driver: %s", driver)
+	}
+	db, err := sql.Open(driver, dbURL)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err, "dbURL": dbURL}).Fatal("Failed to connect to database")
 		return nil, err
 	}
-	return &DAO{db}, nil
+	envelope, err := encryption.NewEnvelopeFromConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to set up encryption at rest")
+	}
+	return &DAO{db: db, dialect: dialect(driver), envelope: envelope}, nil
 }
 
 func (da *DAO) Close() {
@@ -45,58 +64,157 @@ func (da *DAO) Close() {
 func (da *DAO) FindByUserId(userid string) (Record, error) {
 	tableName := viper.GetString(util.CfgDbTable)
 
-	query := fmt.Sprintf("SELECT ra_privkey::bytea, ra_pubkey::bytea, ra_address::bytea, sa_privkey::bytea, sa_pubkey::bytea, sa_address::bytea, faucet_fund_claimed, created_at FROM %s WHERE userid=$1", tableName)
+	query := da.dialect.rebind(fmt.Sprintf("SELECT ra_privkey, ra_pubkey, ra_address, sa_privkey, sa_pubkey, sa_address, wrapped_dek, hd_index, faucet_fund_claimed, created_at FROM %s WHERE userid=$1", tableName))
 	row := da.db.QueryRow(query, userid)
 
-	var raPrivkeyBytes, raPubkeyBytes, raAddress []byte
-	var saPrivkeyBytes, saPubkeyBytes, saAddress []byte
+	var raSealedBytes, raPubkeyBytes, raAddress []byte
+	var saSealedBytes, saPubkeyBytes, saAddress []byte
+	var wrappedKey []byte
+	var hdIndex sql.NullInt64
 	var faucetFunded sql.NullBool
 	var createAt pq.NullTime
-	err := row.Scan(&raPrivkeyBytes, &raPubkeyBytes, &raAddress, &saPrivkeyBytes, &saPubkeyBytes, &saAddress, &faucetFunded, &createAt)
+	err := row.Scan(&raSealedBytes, &raPubkeyBytes, &raAddress, &saSealedBytes, &saPubkeyBytes, &saAddress, &wrappedKey, &hdIndex, &faucetFunded, &createAt)
 	switch {
 	case err == sql.ErrNoRows:
 		return Record{}, ErrNoRecord
 	case err != nil:
 		return Record{}, err
 	default:
-		raPubKey, _ := crypto.PublicKeyFromBytes(raPubkeyBytes)
-		raPrivKey, _ := crypto.PrivateKeyFromBytes(raPrivkeyBytes)
-		saPubKey, _ := crypto.PublicKeyFromBytes(saPubkeyBytes)
-		saPrivKey, _ := crypto.PrivateKeyFromBytes(saPrivkeyBytes)
-
-		record := Record{
-			UserID:       userid,
-			RaPubKey:     raPubKey,
-			RaPrivateKey: raPrivKey,
-			RaAddress:    common.BytesToAddress(raAddress),
-			SaPubKey:     saPubKey,
-			SaPrivateKey: saPrivKey,
-			SaAddress:    common.BytesToAddress(saAddress),
-			CreatedAt:    createAt.Time,
-			FaucetFunded: faucetFunded.Bool,
+		// Private keys of HD records are derived from the seed and never stored.
+		record, err := da.openRecord(userid, raAddress, raPubkeyBytes, raSealedBytes, saAddress, saPubkeyBytes, saSealedBytes, wrappedKey, hdIndex)
+		if err != nil {
+			return Record{}, err
 		}
+		record.CreatedAt = createAt.Time
+		record.FaucetFunded = faucetFunded.Bool
 		return record, nil
 	}
 }
 
-func (da *DAO) Create(record Record) error {
+// CreateIfAbsent inserts the record unless the user already has one. It reports
+// whether the record was inserted; callers losing a race should re-read the record.
+func (da *DAO) CreateIfAbsent(record Record) (bool, error) {
 	tableName := viper.GetString(util.CfgDbTable)
 
-	sm := fmt.Sprintf("INSERT INTO %s (userid, ra_pubkey, ra_privkey, ra_address, sa_pubkey, sa_privkey, sa_address) VALUES ($1, DECODE($2, 'hex'), DECODE($3, 'hex'), DECODE($4, 'hex'), DECODE($5, 'hex'), DECODE($6, 'hex'), DECODE($7, 'hex'))", tableName)
+	sm := da.dialect.insertIfAbsent(tableName, "userid, ra_pubkey, ra_privkey, ra_address, sa_pubkey, sa_privkey, sa_address, wrapped_dek, hd_index", "$1, $2, $3, $4, $5, $6, $7, $8, $9", "userid")
 
 	raPubkeyBytes := record.RaPubKey.ToBytes()
-	raPrivBytes := record.RaPrivateKey.ToBytes()
 	saPubkeyBytes := record.SaPubKey.ToBytes()
-	saPrivBytes := record.SaPrivateKey.ToBytes()
 
-	_, err := da.db.Exec(sm, record.UserID, hex.EncodeToString(raPubkeyBytes), hex.EncodeToString(raPrivBytes), hex.EncodeToString(record.RaAddress.Bytes()), hex.EncodeToString(saPubkeyBytes), hex.EncodeToString(saPrivBytes), hex.EncodeToString(record.SaAddress.Bytes()))
-	return err
+	var raPrivBytes, saPrivBytes, wrappedKey []byte
+	var hdIndex interface{}
+	if record.HDIndex != nil {
+		hdIndex = int64(*record.HDIndex)
+	} else {
+		var err error
+		raPrivBytes, saPrivBytes, wrappedKey, err = sealPrivateKeys(da.envelope, record.UserID, record.RaPrivateKey.ToBytes(), record.SaPrivateKey.ToBytes())
+		if err != nil {
+			return false, errors.Wrap(err, "Failed to encrypt private keys")
+		}
+	}
+
+	res, err := da.db.Exec(sm, record.UserID, []byte(raPubkeyBytes), nullableBytes(raPrivBytes), record.RaAddress.Bytes(), []byte(saPubkeyBytes), nullableBytes(saPrivBytes), record.SaAddress.Bytes(), nullableBytes(wrappedKey), hdIndex)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// NextHDIndex allocates the derivation index for a new HD record.
+func (da *DAO) NextHDIndex() (uint32, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	index, err := da.dialect.nextHDIndex(da.db, tableName)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to allocate HD index")
+	}
+	return uint32(index), nil
+}
+
+// EncryptPlaintextRecords encrypts in place every record whose private keys were
+// stored before encryption at rest was enabled. It returns the number of records
+// migrated.
+func (da *DAO) EncryptPlaintextRecords() (int, error) {
+	if da.envelope == nil {
+		return 0, errors.New("No encryption provider is configured")
+	}
+	tableName := viper.GetString(util.CfgDbTable)
+
+	query := fmt.Sprintf("SELECT userid FROM %s WHERE wrapped_dek IS NULL AND hd_index IS NULL", tableName)
+	rows, err := da.db.Query(query)
+	if err != nil {
+		return 0, err
+	}
+	var userids []string
+	for rows.Next() {
+		var userid string
+		if err := rows.Scan(&userid); err != nil {
+			rows.Close()
+			return 0, errors.Wrap(err, "Failed to parse results from database")
+		}
+		userids = append(userids, userid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, errors.Wrap(err, "Failed to parse results from database")
+	}
+
+	count := 0
+	for _, userid := range userids {
+		migrated, err := da.encryptRecord(userid)
+		if err != nil {
+			return count, errors.Wrapf(err, "Failed to encrypt keys of user %s", userid)
+		}
+		if migrated {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// encryptRecord seals the plaintext keys of a single record. Rows are locked so a
+// concurrent migration run never encrypts the same keys twice.
+func (da *DAO) encryptRecord(userid string) (bool, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	tx, err := da.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := da.dialect.rebind(fmt.Sprintf("SELECT ra_privkey, sa_privkey FROM %s WHERE userid=$1 AND wrapped_dek IS NULL AND hd_index IS NULL FOR UPDATE", tableName))
+	var raPrivBytes, saPrivBytes []byte
+	err = tx.QueryRow(query, userid).Scan(&raPrivBytes, &saPrivBytes)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	raSealed, saSealed, wrappedKey, err := sealPrivateKeys(da.envelope, userid, raPrivBytes, saPrivBytes)
+	if err != nil {
+		return false, err
+	}
+	sm := da.dialect.rebind(fmt.Sprintf("UPDATE %s SET ra_privkey=$1, sa_privkey=$2, wrapped_dek=$3 WHERE userid=$4", tableName))
+	if _, err := tx.Exec(sm, raSealed, saSealed, wrappedKey, userid); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (da *DAO) FindUnfundedUsers(limit int) ([]Record, error) {
 	tableName := viper.GetString(util.CfgDbTable)
 
-	query := fmt.Sprintf("SELECT userid, sa_address::bytea, faucet_fund_claimed, created_at FROM %s WHERE faucet_fund_claimed=FALSE order by created_at limit %d", tableName, limit)
+	query := fmt.Sprintf("SELECT userid, sa_address, faucet_fund_claimed, created_at FROM %s WHERE faucet_fund_claimed=FALSE order by created_at limit %d", tableName, limit)
 	rows, err := da.db.Query(query)
 	if err != nil {
 		return nil, err
@@ -128,8 +246,8 @@ func (da *DAO) FindUnfundedUsers(limit int) ([]Record, error) {
 func (da *DAO) MarkUserFunded(address common.Address) error {
 	tableName := viper.GetString(util.CfgDbTable)
 
-	sm := fmt.Sprintf("UPDATE %s SET faucet_fund_claimed=TRUE WHERE encode(sa_address::bytea,'hex')=$1", tableName)
-	res, err := da.db.Exec(sm, hex.EncodeToString(address.Bytes()))
+	sm := da.dialect.rebind(fmt.Sprintf("UPDATE %s SET faucet_fund_claimed=TRUE WHERE sa_address=$1", tableName))
+	res, err := da.db.Exec(sm, address.Bytes())
 	if err != nil {
 		return errors.Wrap(err, "Failed to update database")
 	}
@@ -143,6 +261,14 @@ func (da *DAO) MarkUserFunded(address common.Address) error {
 	return nil
 }
 
+// nullableBytes maps an empty slice to SQL NULL.
+func nullableBytes(b []byte) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
 type Record struct {
 	UserID       string
 	RaAddress    common.Address
@@ -151,6 +277,7 @@ type Record struct {
 	SaAddress    common.Address
 	SaPubKey     *crypto.PublicKey
 	SaPrivateKey *crypto.PrivateKey
+	HDIndex      *uint32 // Derivation index of HD records. Nil for randomly generated keys.
 	Type         string
 	CreatedAt    time.Time
 	FaucetFunded bool
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thetatoken/vault/util"
+)
+
+// The SQL tests run against a scratch Postgres or MySQL server, in which each test
+// creates its own database, e.g.
+//
+//	docker run -p 5432:5432 -e POSTGRES_PASSWORD=vault postgres
+//	VAULT_TEST_DB_DRIVER=postgres VAULT_TEST_DB_HOST=localhost:5432 VAULT_TEST_DB_USER=postgres VAULT_TEST_DB_PASS=vault VAULT_TEST_DB_DATABASE=postgres go test ./db
+func newTestDatabase(t *testing.T) *DAO {
+	driver := os.Getenv("VAULT_TEST_DB_DRIVER")
+	if driver == "" {
+		t.Skip("VAULT_TEST_DB_DRIVER is not set")
+	}
+	viper.Set(util.CfgDbDriver, driver)
+	viper.Set(util.CfgDbHost, os.Getenv("VAULT_TEST_DB_HOST"))
+	viper.Set(util.CfgDbUser, os.Getenv("VAULT_TEST_DB_USER"))
+	viper.Set(util.CfgDbPass, os.Getenv("VAULT_TEST_DB_PASS"))
+	viper.Set(util.CfgDbDatabase, os.Getenv("VAULT_TEST_DB_DATABASE"))
+	viper.Set(util.CfgDbTable, "vault")
+
+	server, err := NewDAO()
+	require.Nil(t, err)
+	database := fmt.Sprintf("vault_test_%d", time.Now().UnixNano())
+	_, err = server.db.Exec("CREATE DATABASE " + database)
+	server.Close()
+	require.Nil(t, err)
+
+	viper.Set(util.CfgDbDatabase, database)
+	da, err := NewDAO()
+	require.Nil(t, err)
+	return da
+}
+
+// newTestDAO returns a DAO on a new, fully migrated database.
+func newTestDAO(t *testing.T) *DAO {
+	da := newTestDatabase(t)
+	_, err := da.Migrate()
+	require.Nil(t, err)
+	return da
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+const DriverMySQL = "mysql"
+
+// migrationLockName is the MySQL named lock held while migrating.
+const migrationLockName = "vault_schema_migration"
+
+var placeholderRegexp = regexp.MustCompile(`\$\d+`)
+
+// dialect holds the SQL that differs between the databases supported by DAO.
+// Queries are written with Postgres style $n placeholders, numbered in the order
+// of their arguments, and rebound for the target database.
+type dialect string
+
+func (d dialect) rebind(query string) string {
+	if d == DriverMySQL {
+		return placeholderRegexp.ReplaceAllString(query, "?")
+	}
+	return query
+}
+
+// insertIfAbsent returns an insert statement that silently skips rows conflicting
+// with the given unique key.
+func (d dialect) insertIfAbsent(tableName, columns, values, key string) string {
+	if d == DriverMySQL {
+		return d.rebind(fmt.Sprintf("INSERT IGNORE INTO %s (%s) VALUES (%s)", tableName, columns, values))
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO NOTHING", tableName, columns, values, key)
+}
+
+func (d dialect) createSchemaVersionTable() string {
+	if d == DriverMySQL {
+		return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version integer PRIMARY KEY, description text NOT NULL, applied_at timestamp DEFAULT CURRENT_TIMESTAMP)", schemaVersionTable)
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version integer PRIMARY KEY, description text NOT NULL, applied_at timestamp with time zone DEFAULT now())", schemaVersionTable)
+}
+
+// tableExists returns a query reporting whether the table given as its only
+// argument exists in the current schema.
+func (d dialect) tableExists() string {
+	if d == DriverMySQL {
+		return "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?)"
+	}
+	return "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1)"
+}
+
+// nextHDIndex allocates a value from the HD index sequence. MySQL has no
+// sequences, so an auto-increment table stands in for one.
+func (d dialect) nextHDIndex(db *sql.DB, tableName string) (int64, error) {
+	if d == DriverMySQL {
+		res, err := db.Exec(fmt.Sprintf("INSERT INTO %s_hd_index_seq () VALUES ()", tableName))
+		if err != nil {
+			return 0, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		// Auto-increment starts at 1 while HD indices start at 0.
+		return id - 1, nil
+	}
+	var index int64
+	err := db.QueryRow(fmt.Sprintf("SELECT nextval('%s_hd_index_seq')", tableName)).Scan(&index)
+	return index, err
+}
+
+// lockMigrations serializes migrations across vault instances. The Postgres lock
+// is released with the transaction; the MySQL one is held by the connection until
+// unlockMigrations.
+func (d dialect) lockMigrations(tx *sql.Tx) error {
+	if d == DriverMySQL {
+		var acquired sql.NullInt64
+		if err := tx.QueryRow("SELECT GET_LOCK(?, 60)", migrationLockName).Scan(&acquired); err != nil {
+			return err
+		}
+		if acquired.Int64 != 1 {
+			return errors.New("Timed out waiting for the migration lock")
+		}
+		return nil
+	}
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID)
+	return err
+}
+
+func (d dialect) unlockMigrations(conn *sql.Conn) error {
+	if d == DriverMySQL {
+		_, err := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrationLockName)
+		return err
+	}
+	return nil
+}
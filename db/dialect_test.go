@@ -0,0 +1,23 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebind(t *testing.T) {
+	assert := assert.New(t)
+
+	query := "UPDATE t SET a=$1, b=$2 WHERE c=$10"
+	assert.Equal(query, dialect(DriverPostgres).rebind(query))
+	assert.Equal("UPDATE t SET a=?, b=? WHERE c=?", dialect(DriverMySQL).rebind(query))
+}
+
+func TestMigrationsCoverAllDialects(t *testing.T) {
+	for _, m := range migrations {
+		for _, driver := range []string{DriverPostgres, DriverMySQL} {
+			assert.NotEmpty(t, m.Statements[driver], "migration %d has no %s statements", m.Version, driver)
+		}
+	}
+}
@@ -0,0 +1,543 @@
+package db
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/thetatoken/ukulele/common"
+	crypto "github.com/thetatoken/ukulele/crypto"
+
+	"github.com/thetatoken/vault/encryption"
+	"github.com/thetatoken/vault/util"
+)
+
+const DriverDynamoDB = "dynamodb"
+
+const (
+	// unfundedIndex is a sparse GSI over the users not yet funded by the faucet,
+	// ordered by creation time. Only those users carry the faucet_pending attribute.
+	unfundedIndex = "unfunded-index"
+	// saAddressIndex maps send account addresses back to users.
+	saAddressIndex = "sa-address-index"
+
+	faucetPending = "true"
+	hdIndexName   = "hd_index"
+
+	// Capacity of tables created by Migrate. Production tables may as well be
+	// provisioned beforehand with other settings; existing tables are left alone.
+	dynamoReadCapacity  = 5
+	dynamoWriteCapacity = 5
+)
+
+// DynamoStore keeps user records in a DynamoDB table keyed by user ID. HD indices
+// are allocated from an atomic counter in a second table, named after the first
+// with a _counters suffix. Admin actions and signatures are kept in _admin_audit
+// and _signing_audit tables, and broadcast transactions in a _transactions table.
+type DynamoStore struct {
+	client            *dynamodb.DynamoDB
+	table             string
+	countersTable     string
+	adminAuditTable   string
+	signingAuditTable string
+	txsTable          string
+	envelope          *encryption.Envelope
+}
+
+// NewDynamoStore connects to DynamoDB in the given region. The endpoint may point
+// at a local DynamoDB stand-in and is left empty for AWS. Credentials come from the
+// standard AWS environment variables, shared config or instance role.
+func NewDynamoStore(region, endpoint, table string) (*DynamoStore, error) {
+	config := aws.NewConfig().WithRegion(region)
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create AWS session")
+	}
+	envelope, err := encryption.NewEnvelopeFromConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to set up encryption at rest")
+	}
+	return &DynamoStore{
+		client:            dynamodb.New(sess),
+		table:             table,
+		countersTable:     table + "_counters",
+		adminAuditTable:   table + "_admin_audit",
+		signingAuditTable: table + "_signing_audit",
+		txsTable:          table + "_transactions",
+		envelope:          envelope,
+	}, nil
+}
+
+func (ds *DynamoStore) Close() {}
+
+func (ds *DynamoStore) FindByUserId(userid string) (Record, error) {
+	out, err := ds.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(ds.table),
+		Key:            userKey(userid),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Record{}, err
+	}
+	if len(out.Item) == 0 {
+		return Record{}, ErrNoRecord
+	}
+	item := out.Item
+
+	raPubKey, _ := crypto.PublicKeyFromBytes(bytesAttr(item, "ra_pubkey"))
+	saPubKey, _ := crypto.PublicKeyFromBytes(bytesAttr(item, "sa_pubkey"))
+	record := Record{
+		UserID:       userid,
+		RaPubKey:     raPubKey,
+		RaAddress:    common.BytesToAddress(bytesAttr(item, "ra_address")),
+		SaPubKey:     saPubKey,
+		SaAddress:    common.BytesToAddress(bytesAttr(item, "sa_address")),
+		CreatedAt:    timeAttr(item, "created_at"),
+		FaucetFunded: boolAttr(item, "faucet_fund_claimed"),
+	}
+	if v, ok := item["hd_index"]; ok {
+		index, err := strconv.ParseUint(aws.StringValue(v.N), 10, 32)
+		if err != nil {
+			return Record{}, errors.Wrapf(err, "Invalid HD index of user %s", userid)
+		}
+		hdIndex := uint32(index)
+		record.HDIndex = &hdIndex
+		return record, nil
+	}
+
+	raPrivkeyBytes, saPrivkeyBytes, err := openPrivateKeys(ds.envelope, userid, bytesAttr(item, "ra_privkey"), bytesAttr(item, "sa_privkey"), bytesAttr(item, "wrapped_dek"))
+	if err != nil {
+		return Record{}, errors.Wrapf(err, "Failed to decrypt keys of user %s", userid)
+	}
+	record.RaPrivateKey, _ = crypto.PrivateKeyFromBytes(raPrivkeyBytes)
+	record.SaPrivateKey, _ = crypto.PrivateKeyFromBytes(saPrivkeyBytes)
+	return record, nil
+}
+
+// CreateIfAbsent writes the record with a conditional put, so that only the first
+// of several concurrent writers for a user succeeds.
+func (ds *DynamoStore) CreateIfAbsent(record Record) (bool, error) {
+	item := map[string]*dynamodb.AttributeValue{
+		"userid":              {S: aws.String(record.UserID)},
+		"ra_pubkey":           {B: record.RaPubKey.ToBytes()},
+		"ra_address":          {B: record.RaAddress.Bytes()},
+		"sa_pubkey":           {B: record.SaPubKey.ToBytes()},
+		"sa_address":          {B: record.SaAddress.Bytes()},
+		"faucet_fund_claimed": {BOOL: aws.Bool(false)},
+		"faucet_pending":      {S: aws.String(faucetPending)},
+		"created_at":          {N: aws.String(strconv.FormatInt(time.Now().UnixNano(), 10))},
+	}
+	if record.HDIndex != nil {
+		item["hd_index"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatUint(uint64(*record.HDIndex), 10))}
+	} else {
+		raSealed, saSealed, wrappedKey, err := sealPrivateKeys(ds.envelope, record.UserID, record.RaPrivateKey.ToBytes(), record.SaPrivateKey.ToBytes())
+		if err != nil {
+			return false, errors.Wrap(err, "Failed to encrypt private keys")
+		}
+		item["ra_privkey"] = &dynamodb.AttributeValue{B: raSealed}
+		item["sa_privkey"] = &dynamodb.AttributeValue{B: saSealed}
+		if len(wrappedKey) != 0 {
+			item["wrapped_dek"] = &dynamodb.AttributeValue{B: wrappedKey}
+		}
+	}
+
+	_, err := ds.client.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(ds.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(userid)"),
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (ds *DynamoStore) NextHDIndex() (uint32, error) {
+	out, err := ds.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(ds.countersTable),
+		Key:                       map[string]*dynamodb.AttributeValue{"name": {S: aws.String(hdIndexName)}},
+		UpdateExpression:          aws.String("ADD #value :one"),
+		ExpressionAttributeNames:  map[string]*string{"#value": aws.String("value")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":one": {N: aws.String("1")}},
+		ReturnValues:              aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to allocate HD index")
+	}
+	value, err := strconv.ParseUint(aws.StringValue(out.Attributes["value"].N), 10, 32)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to allocate HD index")
+	}
+	// The counter starts at 1 while HD indices start at 0.
+	return uint32(value - 1), nil
+}
+
+func (ds *DynamoStore) FindUnfundedUsers(limit int) ([]Record, error) {
+	out, err := ds.client.Query(&dynamodb.QueryInput{
+		TableName:                 aws.String(ds.table),
+		IndexName:                 aws.String(unfundedIndex),
+		KeyConditionExpression:    aws.String("faucet_pending = :pending"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":pending": {S: aws.String(faucetPending)}},
+		ScanIndexForward:          aws.Bool(true),
+		Limit:                     aws.Int64(int64(limit)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, item := range out.Items {
+		records = append(records, Record{
+			UserID:       aws.StringValue(item["userid"].S),
+			SaAddress:    common.BytesToAddress(bytesAttr(item, "sa_address")),
+			CreatedAt:    timeAttr(item, "created_at"),
+			FaucetFunded: boolAttr(item, "faucet_fund_claimed"),
+		})
+	}
+	return records, nil
+}
+
+func (ds *DynamoStore) MarkUserFunded(address common.Address) error {
+	out, err := ds.client.Query(&dynamodb.QueryInput{
+		TableName:                 aws.String(ds.table),
+		IndexName:                 aws.String(saAddressIndex),
+		KeyConditionExpression:    aws.String("sa_address = :address"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":address": {B: address.Bytes()}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to update database")
+	}
+	if len(out.Items) != 1 {
+		return errors.Errorf("Failed to update database: matched users = %v", len(out.Items))
+	}
+
+	_, err = ds.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(ds.table),
+		Key:                       userKey(aws.StringValue(out.Items[0]["userid"].S)),
+		UpdateExpression:          aws.String("SET faucet_fund_claimed = :funded REMOVE faucet_pending"),
+		ConditionExpression:       aws.String("attribute_exists(userid)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":funded": {BOOL: aws.Bool(true)}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to update database")
+	}
+	return nil
+}
+
+// RecordAdminAction keeps the action under the user acted on and the time it was
+// recorded.
+func (ds *DynamoStore) RecordAdminAction(action AdminAction) error {
+	item := map[string]*dynamodb.AttributeValue{
+		"userid":     {S: aws.String(action.UserID)},
+		"created_at": {N: aws.String(strconv.FormatInt(time.Now().UnixNano(), 10))},
+		"action":     {S: aws.String(action.Action)},
+		"actor":      {S: aws.String(action.Actor)},
+		"success":    {BOOL: aws.Bool(action.Success)},
+	}
+	if action.Error != "" {
+		item["error"] = &dynamodb.AttributeValue{S: aws.String(action.Error)}
+	}
+	_, err := ds.client.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(ds.adminAuditTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(userid)"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to update database")
+	}
+	return nil
+}
+
+func (ds *DynamoStore) EncryptPlaintextRecords() (int, error) {
+	if ds.envelope == nil {
+		return 0, errors.New("No encryption provider is configured")
+	}
+
+	var userids []string
+	err := ds.client.ScanPages(&dynamodb.ScanInput{
+		TableName:            aws.String(ds.table),
+		ProjectionExpression: aws.String("userid"),
+		FilterExpression:     aws.String("attribute_not_exists(wrapped_dek) AND attribute_not_exists(hd_index)"),
+		ConsistentRead:       aws.Bool(true),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			userids = append(userids, aws.StringValue(item["userid"].S))
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, userid := range userids {
+		migrated, err := ds.encryptRecord(userid)
+		if err != nil {
+			return count, errors.Wrapf(err, "Failed to encrypt keys of user %s", userid)
+		}
+		if migrated {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// encryptRecord seals the plaintext keys of a single record. The update is
+// conditional on the record still being in plaintext, so a concurrent migration
+// run never encrypts the same keys twice.
+func (ds *DynamoStore) encryptRecord(userid string) (bool, error) {
+	out, err := ds.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(ds.table),
+		Key:            userKey(userid),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+	item := out.Item
+	if len(item) == 0 || item["wrapped_dek"] != nil || item["hd_index"] != nil {
+		return false, nil
+	}
+
+	raSealed, saSealed, wrappedKey, err := sealPrivateKeys(ds.envelope, userid, bytesAttr(item, "ra_privkey"), bytesAttr(item, "sa_privkey"))
+	if err != nil {
+		return false, err
+	}
+	_, err = ds.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(ds.table),
+		Key:                 userKey(userid),
+		UpdateExpression:    aws.String("SET ra_privkey = :ra, sa_privkey = :sa, wrapped_dek = :dek"),
+		ConditionExpression: aws.String("attribute_exists(userid) AND attribute_not_exists(wrapped_dek)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":ra":  {B: raSealed},
+			":sa":  {B: saSealed},
+			":dek": {B: wrappedKey},
+		},
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DynamoDB tables have no schema beyond their keys and indices, so there are no
+// versioned migrations. Migrate creates the tables if they are missing.
+
+func (ds *DynamoStore) SchemaVersion() (int, error) {
+	return LatestSchemaVersion(), nil
+}
+
+// Migrate creates the missing tables. It returns the number of tables created.
+func (ds *DynamoStore) Migrate() (int, error) {
+	count := 0
+	for _, input := range ds.tableDefinitions() {
+		exists, err := ds.tableExists(aws.StringValue(input.TableName))
+		if err != nil {
+			return count, err
+		}
+		if exists {
+			continue
+		}
+		if _, err := ds.client.CreateTable(input); err != nil {
+			return count, errors.Wrapf(err, "Failed to create table %s", aws.StringValue(input.TableName))
+		}
+		if err := ds.client.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: input.TableName}); err != nil {
+			return count, err
+		}
+		log.WithFields(log.Fields{"table": aws.StringValue(input.TableName)}).Info("Created table")
+		count++
+	}
+	return count, nil
+}
+
+// PrepareSchema creates the tables if db.auto_migrate is set, and otherwise fails
+// if they are missing.
+func (ds *DynamoStore) PrepareSchema() error {
+	if viper.GetBool(util.CfgDbAutoMigrate) {
+		_, err := ds.Migrate()
+		return err
+	}
+	for _, input := range ds.tableDefinitions() {
+		exists, err := ds.tableExists(aws.StringValue(input.TableName))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.Wrapf(ErrSchemaOutdated, "table %s does not exist; run `vault migrate`", aws.StringValue(input.TableName))
+		}
+	}
+	return nil
+}
+
+func (ds *DynamoStore) tableExists(table string) (bool, error) {
+	_, err := ds.client.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(table)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (ds *DynamoStore) tableDefinitions() []*dynamodb.CreateTableInput {
+	throughput := &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(dynamoReadCapacity),
+		WriteCapacityUnits: aws.Int64(dynamoWriteCapacity),
+	}
+	return []*dynamodb.CreateTableInput{
+		{
+			TableName: aws.String(ds.table),
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{AttributeName: aws.String("userid"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+				{AttributeName: aws.String("sa_address"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeB)},
+				{AttributeName: aws.String("faucet_pending"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+				{AttributeName: aws.String("created_at"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("userid"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			},
+			GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+				{
+					IndexName: aws.String(unfundedIndex),
+					KeySchema: []*dynamodb.KeySchemaElement{
+						{AttributeName: aws.String("faucet_pending"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+						{AttributeName: aws.String("created_at"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+					},
+					Projection: &dynamodb.Projection{
+						ProjectionType:   aws.String(dynamodb.ProjectionTypeInclude),
+						NonKeyAttributes: []*string{aws.String("sa_address"), aws.String("faucet_fund_claimed")},
+					},
+					ProvisionedThroughput: throughput,
+				},
+				{
+					IndexName: aws.String(saAddressIndex),
+					KeySchema: []*dynamodb.KeySchemaElement{
+						{AttributeName: aws.String("sa_address"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+					},
+					Projection:            &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeKeysOnly)},
+					ProvisionedThroughput: throughput,
+				},
+			},
+			ProvisionedThroughput: throughput,
+		},
+		{
+			TableName: aws.String(ds.countersTable),
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{AttributeName: aws.String("name"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("name"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			},
+			ProvisionedThroughput: throughput,
+		},
+		{
+			TableName: aws.String(ds.adminAuditTable),
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{AttributeName: aws.String("userid"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+				{AttributeName: aws.String("created_at"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("userid"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+				{AttributeName: aws.String("created_at"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+			},
+			ProvisionedThroughput: throughput,
+		},
+		{
+			TableName: aws.String(ds.signingAuditTable),
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{AttributeName: aws.String("seq"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("seq"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			},
+			ProvisionedThroughput: throughput,
+		},
+		{
+			TableName: aws.String(ds.txsTable),
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{AttributeName: aws.String("hash"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+				{AttributeName: aws.String("user_key"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+				{AttributeName: aws.String("unsettled"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+				{AttributeName: aws.String("created_at"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("hash"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			},
+			GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+				{
+					IndexName: aws.String(txIdempotencyIndex),
+					KeySchema: []*dynamodb.KeySchemaElement{
+						{AttributeName: aws.String("user_key"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+						{AttributeName: aws.String("created_at"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+					},
+					Projection:            &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+					ProvisionedThroughput: throughput,
+				},
+				{
+					IndexName: aws.String(unsettledIndex),
+					KeySchema: []*dynamodb.KeySchemaElement{
+						{AttributeName: aws.String("unsettled"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+						{AttributeName: aws.String("created_at"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+					},
+					Projection:            &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+					ProvisionedThroughput: throughput,
+				},
+			},
+			ProvisionedThroughput: throughput,
+		},
+	}
+}
+
+func userKey(userid string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{"userid": {S: aws.String(userid)}}
+}
+
+func isConditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+func bytesAttr(item map[string]*dynamodb.AttributeValue, name string) []byte {
+	if v, ok := item[name]; ok {
+		return v.B
+	}
+	return nil
+}
+
+func stringAttr(item map[string]*dynamodb.AttributeValue, name string) string {
+	if v, ok := item[name]; ok {
+		return aws.StringValue(v.S)
+	}
+	return ""
+}
+
+func boolAttr(item map[string]*dynamodb.AttributeValue, name string) bool {
+	if v, ok := item[name]; ok {
+		return aws.BoolValue(v.BOOL)
+	}
+	return false
+}
+
+func timeAttr(item map[string]*dynamodb.AttributeValue, name string) time.Time {
+	if v, ok := item[name]; ok {
+		nanos, _ := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
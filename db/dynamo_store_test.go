@@ -0,0 +1,84 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thetatoken/ukulele/common"
+)
+
+// The DynamoDB tests run against a local DynamoDB stand-in, e.g.
+//
+//	docker run -p 8000:8000 amazon/dynamodb-local
+//	VAULT_TEST_DYNAMODB_ENDPOINT=http://localhost:8000 go test ./db
+func newTestDynamoStore(t *testing.T) *DynamoStore {
+	endpoint := os.Getenv("VAULT_TEST_DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("VAULT_TEST_DYNAMODB_ENDPOINT is not set")
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		os.Setenv("AWS_ACCESS_KEY_ID", "test")
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	}
+	ds, err := NewDynamoStore("us-west-2", endpoint, fmt.Sprintf("vault_test_%d", time.Now().UnixNano()))
+	require.Nil(t, err)
+	_, err = ds.Migrate()
+	require.Nil(t, err)
+	return ds
+}
+
+func TestDynamoStoreCreateIfAbsent(t *testing.T) {
+	assert := assert.New(t)
+	ds := newTestDynamoStore(t)
+
+	_, err := ds.FindByUserId("alice")
+	assert.Equal(ErrNoRecord, err)
+
+	created, err := ds.CreateIfAbsent(newTestRecord(t, "alice", 1))
+	assert.Nil(err)
+	assert.True(created)
+
+	created, err = ds.CreateIfAbsent(newTestRecord(t, "alice", 2))
+	assert.Nil(err)
+	assert.False(created)
+
+	record, err := ds.FindByUserId("alice")
+	assert.Nil(err)
+	assert.Equal(common.BytesToAddress([]byte{1, 2}), record.SaAddress)
+}
+
+func TestDynamoStoreFaucetFunding(t *testing.T) {
+	assert := assert.New(t)
+	ds := newTestDynamoStore(t)
+
+	for i, userid := range []string{"alice", "bob"} {
+		_, err := ds.CreateIfAbsent(newTestRecord(t, userid, byte(i+1)))
+		assert.Nil(err)
+	}
+	assert.Nil(ds.MarkUserFunded(common.BytesToAddress([]byte{1, 2})))
+
+	records, err := ds.FindUnfundedUsers(10)
+	assert.Nil(err)
+	if assert.Len(records, 1) {
+		assert.Equal("bob", records[0].UserID)
+	}
+
+	record, err := ds.FindByUserId("alice")
+	assert.Nil(err)
+	assert.True(record.FaucetFunded)
+}
+
+func TestDynamoStoreHDIndex(t *testing.T) {
+	assert := assert.New(t)
+	ds := newTestDynamoStore(t)
+
+	for i := uint32(0); i < 3; i++ {
+		index, err := ds.NextHDIndex()
+		assert.Nil(err)
+		assert.Equal(i, index)
+	}
+}
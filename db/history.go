@@ -0,0 +1,185 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/thetatoken/ukulele/common"
+
+	"github.com/thetatoken/vault/util"
+)
+
+// Directions of funds in a history entry.
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// HistoryEntry is a finalized transaction touching an account of a user, as found
+// by the block indexer.
+type HistoryEntry struct {
+	ID           int64
+	UserID       string
+	Role         string // Account touched, SA or RA.
+	Address      common.Address
+	TxHash       string
+	TxType       string
+	BlockHeight  uint64
+	BlockTime    time.Time
+	Direction    string // Whether funds moved into or out of the account.
+	ThetaWei     string
+	GammaWei     string
+	Counterparty string // Address on the other side of the transaction, if any.
+	ResourceID   string
+}
+
+// HistoryFilter selects history entries of a user. Zero fields match everything.
+// Entries are returned newest first, starting below BeforeID if set.
+type HistoryFilter struct {
+	UserID     string
+	Role       string
+	TxType     string
+	ResourceID string
+	From       time.Time // Inclusive.
+	To         time.Time // Exclusive.
+	BeforeID   int64
+	Limit      int
+}
+
+// HistoryStore serves the transaction history of users. DAO implements it.
+type HistoryStore interface {
+	ListHistory(filter HistoryFilter) ([]HistoryEntry, error)
+}
+
+// IndexerHeight returns the height of the last block indexed, and false if no
+// block was ever indexed.
+func (da *DAO) IndexerHeight() (uint64, bool, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	var height int64
+	err := da.db.QueryRow(fmt.Sprintf("SELECT height FROM %s_indexer WHERE id=1", tableName)).Scan(&height)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return uint64(height), true, nil
+}
+
+// FindUserByAddress returns the user owning the address and the role of the
+// account, or ErrNoRecord if the address is not managed by vault.
+func (da *DAO) FindUserByAddress(address common.Address) (string, string, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	for _, role := range []string{"SA", "RA"} {
+		column := strings.ToLower(role) + "_address"
+		query := da.dialect.rebind(fmt.Sprintf("SELECT userid FROM %s WHERE %s=$1", tableName, column))
+		var userid string
+		err := da.db.QueryRow(query, address.Bytes()).Scan(&userid)
+		if err == nil {
+			return userid, role, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", "", err
+		}
+	}
+	return "", "", ErrNoRecord
+}
+
+// SaveIndexedBlock stores the history entries found in a block and records the
+// block as indexed, in one transaction.
+func (da *DAO) SaveIndexedBlock(height uint64, entries []HistoryEntry) error {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	tx, err := da.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sm := da.dialect.insertIfAbsent(tableName+"_history",
+		"userid, role, address, tx_hash, tx_type, block_height, block_time, direction, theta_wei, gamma_wei, counterparty, resource_id",
+		"$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12", "tx_hash, userid, role")
+	for _, e := range entries {
+		_, err := tx.Exec(sm, e.UserID, e.Role, e.Address.Bytes(), e.TxHash, e.TxType, int64(e.BlockHeight), e.BlockTime, e.Direction, e.ThetaWei, e.GammaWei, e.Counterparty, e.ResourceID)
+		if err != nil {
+			return errors.Wrap(err, "Failed to save history entry")
+		}
+	}
+
+	sm = da.dialect.insertIfAbsent(tableName+"_indexer", "id, height", "1, $1", "id")
+	if _, err := tx.Exec(sm, int64(height)); err != nil {
+		return errors.Wrap(err, "Failed to save indexer height")
+	}
+	sm = da.dialect.rebind(fmt.Sprintf("UPDATE %s_indexer SET height=$1 WHERE id=1", tableName))
+	if _, err := tx.Exec(sm, int64(height)); err != nil {
+		return errors.Wrap(err, "Failed to save indexer height")
+	}
+	return tx.Commit()
+}
+
+const historyColumns = "id, userid, role, address, tx_hash, tx_type, block_height, block_time, direction, theta_wei, gamma_wei, counterparty, resource_id"
+
+func (da *DAO) ListHistory(filter HistoryFilter) ([]HistoryEntry, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	conditions := []string{"userid=$1"}
+	args := []interface{}{filter.UserID}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.Role != "" {
+		addCondition("role=$%d", filter.Role)
+	}
+	if filter.TxType != "" {
+		addCondition("tx_type=$%d", filter.TxType)
+	}
+	if filter.ResourceID != "" {
+		addCondition("resource_id=$%d", filter.ResourceID)
+	}
+	if !filter.From.IsZero() {
+		addCondition("block_time>=$%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCondition("block_time<$%d", filter.To)
+	}
+	if filter.BeforeID > 0 {
+		addCondition("id<$%d", filter.BeforeID)
+	}
+
+	query := da.dialect.rebind(fmt.Sprintf("SELECT %s FROM %s_history WHERE %s ORDER BY id DESC LIMIT %d", historyColumns, tableName, strings.Join(conditions, " AND "), filter.Limit))
+	rows, err := da.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []HistoryEntry
+	for rows.Next() {
+		var e HistoryEntry
+		var address []byte
+		var blockHeight int64
+		var blockTime pq.NullTime
+		err := rows.Scan(&e.ID, &e.UserID, &e.Role, &address, &e.TxHash, &e.TxType, &blockHeight, &blockTime, &e.Direction, &e.ThetaWei, &e.GammaWei, &e.Counterparty, &e.ResourceID)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse results from database")
+		}
+		e.Address = common.BytesToAddress(address)
+		e.BlockHeight = uint64(blockHeight)
+		e.BlockTime = blockTime.Time
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse results from database")
+	}
+	return entries, nil
+}
+
+var _ HistoryStore = &DAO{}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"github.com/thetatoken/vault/util"
+)
+
+// IdempotencyRecord remembers a request made with an idempotency key, so that
+// retries of the request get its original result.
+type IdempotencyRecord struct {
+	UserID      string
+	Key         string
+	Method      string
+	RequestHash string // Hash of the request parameters the key was first used with.
+	TxHash      string // Transaction broadcast for the request, if any.
+	Result      []byte // JSON result of the request. Empty until it completes.
+	Error       string // Set if the request failed after its transaction may have been broadcast.
+	ClaimedAt   time.Time
+}
+
+// IsComplete reports whether the request finished, successfully or not.
+func (rec IdempotencyRecord) IsComplete() bool {
+	return len(rec.Result) > 0 || rec.Error != ""
+}
+
+// IdempotencyStore persists idempotency keys. DAO implements it.
+type IdempotencyStore interface {
+	// ClaimIdempotencyKey stores rec as in progress unless the user already used
+	// the key. It reports whether rec was stored, and returns the existing record
+	// otherwise.
+	ClaimIdempotencyKey(rec IdempotencyRecord) (IdempotencyRecord, bool, error)
+
+	// CompleteIdempotencyKey saves the transaction hash, result and error of a
+	// claimed request.
+	CompleteIdempotencyKey(rec IdempotencyRecord) error
+
+	// ReleaseIdempotencyKey removes the claim of a request that is not complete,
+	// so that the key can be used again.
+	ReleaseIdempotencyKey(userid, key string) error
+
+	// ReclaimIdempotencyKey takes over the claim of a request that is not complete
+	// and was claimed before claimedBefore. It reports whether the claim was taken.
+	ReclaimIdempotencyKey(userid, key string, claimedBefore time.Time) (bool, error)
+}
+
+// maxClaimAttempts bounds retries of claims racing with releases of the same key.
+const maxClaimAttempts = 3
+
+func (da *DAO) ClaimIdempotencyKey(rec IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	sm := da.dialect.insertIfAbsent(tableName+"_idempotency_keys", "userid, idempotency_key, method, request_hash, claimed_at", "$1, $2, $3, $4, $5", "userid, idempotency_key")
+	query := da.dialect.rebind(fmt.Sprintf("SELECT method, request_hash, tx_hash, result, error, claimed_at FROM %s_idempotency_keys WHERE userid=$1 AND idempotency_key=$2", tableName))
+	rec.ClaimedAt = time.Now().UTC().Truncate(time.Microsecond)
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		res, err := da.db.Exec(sm, rec.UserID, rec.Key, rec.Method, rec.RequestHash, rec.ClaimedAt)
+		if err != nil {
+			return IdempotencyRecord{}, false, errors.Wrap(err, "Failed to update database")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return IdempotencyRecord{}, false, errors.Wrap(err, "Failed to update database")
+		}
+		if n == 1 {
+			return rec, true, nil
+		}
+
+		existing := IdempotencyRecord{UserID: rec.UserID, Key: rec.Key}
+		var txHash, result, recErr sql.NullString
+		err = da.db.QueryRow(query, rec.UserID, rec.Key).Scan(&existing.Method, &existing.RequestHash, &txHash, &result, &recErr, &existing.ClaimedAt)
+		if err == sql.ErrNoRows {
+			// Released since the insert, try again.
+			continue
+		}
+		if err != nil {
+			return IdempotencyRecord{}, false, errors.Wrap(err, "Failed to parse results from database")
+		}
+		existing.TxHash = txHash.String
+		if result.Valid {
+			existing.Result = []byte(result.String)
+		}
+		existing.Error = recErr.String
+		return existing, false, nil
+	}
+	return IdempotencyRecord{}, false, errors.Errorf("Failed to claim idempotency key after %d attempts", maxClaimAttempts)
+}
+
+func (da *DAO) CompleteIdempotencyKey(rec IdempotencyRecord) error {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	var result interface{}
+	if len(rec.Result) > 0 {
+		result = string(rec.Result)
+	}
+	sm := da.dialect.rebind(fmt.Sprintf("UPDATE %s_idempotency_keys SET tx_hash=$1, result=$2, error=$3 WHERE userid=$4 AND idempotency_key=$5", tableName))
+	_, err := da.db.Exec(sm, nullableString(rec.TxHash), result, nullableString(rec.Error), rec.UserID, rec.Key)
+	if err != nil {
+		return errors.Wrap(err, "Failed to update database")
+	}
+	return nil
+}
+
+func (da *DAO) ReleaseIdempotencyKey(userid, key string) error {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	sm := da.dialect.rebind(fmt.Sprintf("DELETE FROM %s_idempotency_keys WHERE userid=$1 AND idempotency_key=$2 AND result IS NULL AND error IS NULL", tableName))
+	if _, err := da.db.Exec(sm, userid, key); err != nil {
+		return errors.Wrap(err, "Failed to update database")
+	}
+	return nil
+}
+
+func (da *DAO) ReclaimIdempotencyKey(userid, key string, claimedBefore time.Time) (bool, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	sm := da.dialect.rebind(fmt.Sprintf("UPDATE %s_idempotency_keys SET claimed_at=$1 WHERE userid=$2 AND idempotency_key=$3 AND result IS NULL AND error IS NULL AND claimed_at < $4", tableName))
+	res, err := da.db.Exec(sm, time.Now().UTC(), userid, key, claimedBefore)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	return n == 1, nil
+}
+
+var _ IdempotencyStore = &DAO{}
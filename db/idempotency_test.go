@@ -0,0 +1,40 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDAOReclaimIdempotencyKey(t *testing.T) {
+	assert := assert.New(t)
+	da := newTestDAO(t)
+	defer da.Close()
+
+	rec := IdempotencyRecord{UserID: "alice", Key: "k1", Method: "Send", RequestHash: "abc"}
+	_, claimed, err := da.ClaimIdempotencyKey(rec)
+	assert.Nil(err)
+	assert.True(claimed)
+
+	existing, claimed, err := da.ClaimIdempotencyKey(rec)
+	assert.Nil(err)
+	assert.False(claimed)
+	assert.False(existing.ClaimedAt.IsZero())
+
+	// Fresh claims are kept, stale ones are taken over.
+	reclaimed, err := da.ReclaimIdempotencyKey("alice", "k1", existing.ClaimedAt.Add(-time.Minute))
+	assert.Nil(err)
+	assert.False(reclaimed)
+	staleBefore := time.Now().Add(time.Minute)
+	reclaimed, err = da.ReclaimIdempotencyKey("alice", "k1", staleBefore)
+	assert.Nil(err)
+	assert.True(reclaimed)
+
+	// Completed requests are never taken over.
+	rec.Result = []byte(`{}`)
+	assert.Nil(da.CompleteIdempotencyKey(rec))
+	reclaimed, err = da.ReclaimIdempotencyKey("alice", "k1", staleBefore.Add(time.Hour))
+	assert.Nil(err)
+	assert.False(reclaimed)
+}
@@ -0,0 +1,402 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"github.com/thetatoken/vault/util"
+)
+
+// Spending limits a request can exceed.
+const (
+	LimitPerTransaction = "per_transaction"
+	LimitDaily          = "daily"
+	LimitMonthly        = "monthly"
+	LimitReservedFunds  = "reserved_funds"
+)
+
+// Amount caps ThetaWei and GammaWei separately. A nil field is not capped.
+type Amount struct {
+	ThetaWei *big.Int
+	GammaWei *big.Int
+}
+
+// SpendingLimits caps what a user can move. Nil fields are not capped.
+type SpendingLimits struct {
+	PerTransaction Amount
+	Daily          Amount // Outflow per UTC day.
+	Monthly        Amount // Outflow per UTC month.
+	ReservedFunds  *int64 // Reserved funds that are not released or expired.
+}
+
+// UserLimits assigns a user to a tier of limits, and overrides some of them.
+type UserLimits struct {
+	UserID    string
+	Tier      string         // Empty for the default tier.
+	Overrides SpendingLimits // Nil fields fall back to the tier.
+}
+
+// Spending is a transaction charged against the limits of a user.
+type Spending struct {
+	UserID   string
+	ThetaWei *big.Int
+	GammaWei *big.Int
+	Time     time.Time
+	Outflow  bool // Whether the amount counts toward the daily and monthly limits.
+
+	// Set for fund reservations, which count toward the reserved funds limit
+	// until released or expired.
+	Reserve          bool
+	ReserveSequence  uint64
+	ReserveExpiresAt time.Time
+}
+
+// SpendingUsage is what a user spent of the limits at some time.
+type SpendingUsage struct {
+	Daily         Amount
+	Monthly       Amount
+	ReservedFunds int64
+}
+
+// LimitExceeded describes a spending rejected by a limit.
+type LimitExceeded struct {
+	Limit    string
+	Currency string   // "thetawei" or "gammawei". Empty for the reserved funds limit.
+	Max      *big.Int // The limit.
+	Used     *big.Int // Spent in the period, or reserved funds held.
+}
+
+// LimitStore persists spending limits of users and what they spent. DAO
+// implements it.
+type LimitStore interface {
+	// FindUserLimits returns ErrNoRecord if the user has no limits of their own.
+	FindUserLimits(userid string) (UserLimits, error)
+
+	SaveUserLimits(limits UserLimits) error
+
+	// ChargeSpending adds the spending to the usage of the user, unless that
+	// exceeds the daily, monthly or reserved funds limits. It returns the limit
+	// exceeded, and charges nothing, in that case.
+	ChargeSpending(spending Spending, limits SpendingLimits) (*LimitExceeded, error)
+
+	// RefundSpending reverts a charge for a transaction that was not sent.
+	RefundSpending(spending Spending) error
+
+	// ReleaseReservedFund stops counting a reserved fund toward the limits.
+	ReleaseReservedFund(userid string, reserveSequence uint64) error
+
+	SpendingUsage(userid string, now time.Time) (SpendingUsage, error)
+}
+
+const userLimitsColumns = "tier, per_tx_thetawei, per_tx_gammawei, daily_thetawei, daily_gammawei, monthly_thetawei, monthly_gammawei, reserved_funds"
+
+func (da *DAO) FindUserLimits(userid string) (UserLimits, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	query := da.dialect.rebind(fmt.Sprintf("SELECT %s FROM %s_spending_limits WHERE userid=$1", userLimitsColumns, tableName))
+	limits := UserLimits{UserID: userid}
+	var amounts [6]sql.NullString
+	var reservedFunds sql.NullInt64
+	err := da.db.QueryRow(query, userid).Scan(&limits.Tier, &amounts[0], &amounts[1], &amounts[2], &amounts[3], &amounts[4], &amounts[5], &reservedFunds)
+	if err == sql.ErrNoRows {
+		return UserLimits{}, ErrNoRecord
+	}
+	if err != nil {
+		return UserLimits{}, err
+	}
+	overrides := &limits.Overrides
+	for i, dest := range []**big.Int{
+		&overrides.PerTransaction.ThetaWei, &overrides.PerTransaction.GammaWei,
+		&overrides.Daily.ThetaWei, &overrides.Daily.GammaWei,
+		&overrides.Monthly.ThetaWei, &overrides.Monthly.GammaWei,
+	} {
+		if *dest, err = parseWei(amounts[i]); err != nil {
+			return UserLimits{}, err
+		}
+	}
+	if reservedFunds.Valid {
+		overrides.ReservedFunds = &reservedFunds.Int64
+	}
+	return limits, nil
+}
+
+func (da *DAO) SaveUserLimits(limits UserLimits) error {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	o := limits.Overrides
+	var reservedFunds sql.NullInt64
+	if o.ReservedFunds != nil {
+		reservedFunds = sql.NullInt64{Int64: *o.ReservedFunds, Valid: true}
+	}
+	values := []interface{}{
+		limits.Tier,
+		weiValue(o.PerTransaction.ThetaWei), weiValue(o.PerTransaction.GammaWei),
+		weiValue(o.Daily.ThetaWei), weiValue(o.Daily.GammaWei),
+		weiValue(o.Monthly.ThetaWei), weiValue(o.Monthly.GammaWei),
+		reservedFunds,
+		limits.UserID,
+	}
+
+	tx, err := da.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sm := da.dialect.insertIfAbsent(tableName+"_spending_limits", "userid", "$1", "userid")
+	if _, err := tx.Exec(sm, limits.UserID); err != nil {
+		return errors.Wrap(err, "Failed to update database")
+	}
+	sm = da.dialect.rebind(fmt.Sprintf("UPDATE %s_spending_limits SET tier=$1, per_tx_thetawei=$2, per_tx_gammawei=$3, daily_thetawei=$4, daily_gammawei=$5, monthly_thetawei=$6, monthly_gammawei=$7, reserved_funds=$8 WHERE userid=$9", tableName))
+	if _, err := tx.Exec(sm, values...); err != nil {
+		return errors.Wrap(err, "Failed to update database")
+	}
+	return tx.Commit()
+}
+
+// Formats of the UTC day and month usage is counted in.
+const (
+	dayFormat   = "2006-01-02"
+	monthFormat = "2006-01"
+)
+
+// spendingRow is the usage of a user in the current day and month, locked for
+// update.
+type spendingRow struct {
+	day, month       string
+	daily, monthly   Amount
+	dayKey, monthKey string // Day and month the usage is counted in.
+}
+
+func (da *DAO) ChargeSpending(spending Spending, limits SpendingLimits) (*LimitExceeded, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	tx, err := da.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row, err := da.lockSpending(tx, spending.UserID, spending.Time)
+	if err != nil {
+		return nil, err
+	}
+
+	if spending.Outflow {
+		for _, check := range []struct {
+			limit string
+			max   Amount
+			used  *Amount
+		}{
+			{LimitDaily, limits.Daily, &row.daily},
+			{LimitMonthly, limits.Monthly, &row.monthly},
+		} {
+			if exceeded := addWithin(check.limit, check.max, check.used, spending); exceeded != nil {
+				return exceeded, nil
+			}
+		}
+	}
+
+	if spending.Reserve {
+		sm := da.dialect.rebind(fmt.Sprintf("DELETE FROM %s_reserved_funds WHERE userid=$1 AND expires_at<=$2", tableName))
+		if _, err := tx.Exec(sm, spending.UserID, spending.Time); err != nil {
+			return nil, errors.Wrap(err, "Failed to update database")
+		}
+		if limits.ReservedFunds != nil {
+			var held int64
+			query := da.dialect.rebind(fmt.Sprintf("SELECT COUNT(*) FROM %s_reserved_funds WHERE userid=$1", tableName))
+			if err := tx.QueryRow(query, spending.UserID).Scan(&held); err != nil {
+				return nil, err
+			}
+			if held >= *limits.ReservedFunds {
+				return &LimitExceeded{
+					Limit: LimitReservedFunds,
+					Max:   big.NewInt(*limits.ReservedFunds),
+					Used:  big.NewInt(held),
+				}, nil
+			}
+		}
+		sm = da.dialect.insertIfAbsent(tableName+"_reserved_funds", "userid, reserve_sequence, expires_at", "$1, $2, $3", "userid, reserve_sequence")
+		if _, err := tx.Exec(sm, spending.UserID, spending.ReserveSequence, spending.ReserveExpiresAt); err != nil {
+			return nil, errors.Wrap(err, "Failed to update database")
+		}
+	}
+
+	if err := da.saveSpending(tx, spending.UserID, row); err != nil {
+		return nil, err
+	}
+	return nil, tx.Commit()
+}
+
+func (da *DAO) RefundSpending(spending Spending) error {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	tx, err := da.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row, err := da.lockSpending(tx, spending.UserID, time.Now())
+	if err != nil {
+		return err
+	}
+	if spending.Outflow {
+		// Charges of past periods were reset already.
+		if spending.Time.UTC().Format(dayFormat) == row.dayKey {
+			subtractFloor(&row.daily, spending)
+		}
+		if spending.Time.UTC().Format(monthFormat) == row.monthKey {
+			subtractFloor(&row.monthly, spending)
+		}
+	}
+	if spending.Reserve {
+		sm := da.dialect.rebind(fmt.Sprintf("DELETE FROM %s_reserved_funds WHERE userid=$1 AND reserve_sequence=$2", tableName))
+		if _, err := tx.Exec(sm, spending.UserID, spending.ReserveSequence); err != nil {
+			return errors.Wrap(err, "Failed to update database")
+		}
+	}
+	if err := da.saveSpending(tx, spending.UserID, row); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (da *DAO) ReleaseReservedFund(userid string, reserveSequence uint64) error {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	sm := da.dialect.rebind(fmt.Sprintf("DELETE FROM %s_reserved_funds WHERE userid=$1 AND reserve_sequence=$2", tableName))
+	if _, err := da.db.Exec(sm, userid, reserveSequence); err != nil {
+		return errors.Wrap(err, "Failed to update database")
+	}
+	return nil
+}
+
+func (da *DAO) SpendingUsage(userid string, now time.Time) (SpendingUsage, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	usage := SpendingUsage{
+		Daily:   Amount{ThetaWei: new(big.Int), GammaWei: new(big.Int)},
+		Monthly: Amount{ThetaWei: new(big.Int), GammaWei: new(big.Int)},
+	}
+	query := da.dialect.rebind(fmt.Sprintf("SELECT day, day_thetawei, day_gammawei, month, month_thetawei, month_gammawei FROM %s_spending WHERE userid=$1", tableName))
+	row, err := scanSpending(da.db.QueryRow(query, userid), now)
+	if err != nil && err != sql.ErrNoRows {
+		return SpendingUsage{}, err
+	}
+	if err == nil {
+		usage.Daily, usage.Monthly = row.daily, row.monthly
+	}
+	query = da.dialect.rebind(fmt.Sprintf("SELECT COUNT(*) FROM %s_reserved_funds WHERE userid=$1 AND expires_at>$2", tableName))
+	if err := da.db.QueryRow(query, userid, now).Scan(&usage.ReservedFunds); err != nil {
+		return SpendingUsage{}, err
+	}
+	return usage, nil
+}
+
+// lockSpending returns the usage of the user at the time given, creating the row
+// if the user never spent anything. Usage of past days and months is reset.
+func (da *DAO) lockSpending(tx *sql.Tx, userid string, now time.Time) (spendingRow, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	sm := da.dialect.insertIfAbsent(tableName+"_spending", "userid, day, day_thetawei, day_gammawei, month, month_thetawei, month_gammawei", "$1, '', '0', '0', '', '0', '0'", "userid")
+	if _, err := tx.Exec(sm, userid); err != nil {
+		return spendingRow{}, errors.Wrap(err, "Failed to update database")
+	}
+	query := da.dialect.rebind(fmt.Sprintf("SELECT day, day_thetawei, day_gammawei, month, month_thetawei, month_gammawei FROM %s_spending WHERE userid=$1 FOR UPDATE", tableName))
+	return scanSpending(tx.QueryRow(query, userid), now)
+}
+
+func scanSpending(row *sql.Row, now time.Time) (spendingRow, error) {
+	var res spendingRow
+	var amounts [4]sql.NullString
+	if err := row.Scan(&res.day, &amounts[0], &amounts[1], &res.month, &amounts[2], &amounts[3]); err != nil {
+		return spendingRow{}, err
+	}
+	var err error
+	for i, dest := range []**big.Int{&res.daily.ThetaWei, &res.daily.GammaWei, &res.monthly.ThetaWei, &res.monthly.GammaWei} {
+		if *dest, err = parseWei(amounts[i]); err != nil {
+			return spendingRow{}, err
+		}
+		if *dest == nil {
+			*dest = new(big.Int)
+		}
+	}
+	res.dayKey = now.UTC().Format(dayFormat)
+	res.monthKey = now.UTC().Format(monthFormat)
+	if res.day != res.dayKey {
+		res.daily = Amount{ThetaWei: new(big.Int), GammaWei: new(big.Int)}
+	}
+	if res.month != res.monthKey {
+		res.monthly = Amount{ThetaWei: new(big.Int), GammaWei: new(big.Int)}
+	}
+	return res, nil
+}
+
+func (da *DAO) saveSpending(tx *sql.Tx, userid string, row spendingRow) error {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	sm := da.dialect.rebind(fmt.Sprintf("UPDATE %s_spending SET day=$1, day_thetawei=$2, day_gammawei=$3, month=$4, month_thetawei=$5, month_gammawei=$6 WHERE userid=$7", tableName))
+	_, err := tx.Exec(sm, row.dayKey, row.daily.ThetaWei.String(), row.daily.GammaWei.String(), row.monthKey, row.monthly.ThetaWei.String(), row.monthly.GammaWei.String(), userid)
+	if err != nil {
+		return errors.Wrap(err, "Failed to update database")
+	}
+	return nil
+}
+
+// addWithin adds the spending to used, unless that exceeds max.
+func addWithin(limit string, max Amount, used *Amount, spending Spending) *LimitExceeded {
+	theta := new(big.Int).Add(used.ThetaWei, nonNil(spending.ThetaWei))
+	gamma := new(big.Int).Add(used.GammaWei, nonNil(spending.GammaWei))
+	if max.ThetaWei != nil && theta.Cmp(max.ThetaWei) > 0 {
+		return &LimitExceeded{Limit: limit, Currency: "thetawei", Max: max.ThetaWei, Used: used.ThetaWei}
+	}
+	if max.GammaWei != nil && gamma.Cmp(max.GammaWei) > 0 {
+		return &LimitExceeded{Limit: limit, Currency: "gammawei", Max: max.GammaWei, Used: used.GammaWei}
+	}
+	used.ThetaWei, used.GammaWei = theta, gamma
+	return nil
+}
+
+func subtractFloor(used *Amount, spending Spending) {
+	used.ThetaWei = new(big.Int).Sub(used.ThetaWei, nonNil(spending.ThetaWei))
+	if used.ThetaWei.Sign() < 0 {
+		used.ThetaWei.SetInt64(0)
+	}
+	used.GammaWei = new(big.Int).Sub(used.GammaWei, nonNil(spending.GammaWei))
+	if used.GammaWei.Sign() < 0 {
+		used.GammaWei.SetInt64(0)
+	}
+}
+
+func nonNil(amount *big.Int) *big.Int {
+	if amount == nil {
+		return new(big.Int)
+	}
+	return amount
+}
+
+func parseWei(value sql.NullString) (*big.Int, error) {
+	if !value.Valid {
+		return nil, nil
+	}
+	amount, ok := new(big.Int).SetString(value.String, 10)
+	if !ok {
+		return nil, errors.Errorf("Invalid amount in database: %s", value.String)
+	}
+	return amount, nil
+}
+
+func weiValue(amount *big.Int) sql.NullString {
+	if amount == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: amount.String(), Valid: true}
+}
+
+var _ LimitStore = &DAO{}
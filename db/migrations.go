@@ -0,0 +1,582 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/thetatoken/vault/util"
+)
+
+// schemaVersionTable records the migrations applied to the database.
+const schemaVersionTable = "vault_schema_version"
+
+// migrationLockID is the Postgres advisory lock held while migrating, so that
+// several vault instances starting at once apply each migration exactly once. See
+// migrationLockName for MySQL.
+const migrationLockID = 7206853
+
+var ErrSchemaOutdated = errors.New("DAO: database schema is outdated")
+
+// Migration is a forward-only schema change. Statements are given per database
+// driver and refer to the key table as %[1]s so the configured table name is
+// honoured.
+type Migration struct {
+	Version     int
+	Description string
+	Statements  map[string][]string
+}
+
+// migrations must only ever be appended to. Early migrations are written to be
+// no-ops on databases created from tools/reset.sql before versioning existed.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Create key table",
+		Statements: map[string][]string{
+			DriverPostgres: {
+				`CREATE TABLE IF NOT EXISTS %[1]s (
+					userid character varying(255) NOT NULL PRIMARY KEY,
+					sa_address bytea NOT NULL,
+					sa_privkey bytea NOT NULL,
+					sa_pubkey bytea NOT NULL,
+					type smallint,
+					faucet_fund_claimed boolean DEFAULT false,
+					created_at timestamp with time zone DEFAULT now(),
+					ra_address bytea NOT NULL,
+					ra_privkey bytea NOT NULL,
+					ra_pubkey bytea NOT NULL
+				)`,
+			},
+			DriverMySQL: {
+				`CREATE TABLE IF NOT EXISTS %[1]s (
+					userid varchar(255) NOT NULL PRIMARY KEY,
+					sa_address varbinary(20) NOT NULL,
+					sa_privkey blob NOT NULL,
+					sa_pubkey blob NOT NULL,
+					type smallint,
+					faucet_fund_claimed boolean DEFAULT false,
+					created_at timestamp(6) DEFAULT CURRENT_TIMESTAMP(6),
+					ra_address varbinary(20) NOT NULL,
+					ra_privkey blob NOT NULL,
+					ra_pubkey blob NOT NULL,
+					INDEX (sa_address),
+					INDEX (faucet_fund_claimed, created_at)
+				)`,
+			},
+		},
+	},
+	{
+		Version:     2,
+		Description: "Add wrapped data keys for encryption at rest",
+		Statements: map[string][]string{
+			DriverPostgres: {
+				`ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS wrapped_dek bytea`,
+			},
+			DriverMySQL: {
+				`ALTER TABLE %[1]s ADD COLUMN wrapped_dek blob`,
+			},
+		},
+	},
+	{
+		Version:     3,
+		Description: "Add HD derivation index",
+		Statements: map[string][]string{
+			DriverPostgres: {
+				`ALTER TABLE %[1]s ALTER COLUMN ra_privkey DROP NOT NULL, ALTER COLUMN sa_privkey DROP NOT NULL`,
+				`ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS hd_index bigint UNIQUE`,
+				`CREATE SEQUENCE IF NOT EXISTS %[1]s_hd_index_seq MINVALUE 0 START 0`,
+			},
+			DriverMySQL: {
+				`ALTER TABLE %[1]s MODIFY ra_privkey blob NULL, MODIFY sa_privkey blob NULL`,
+				`ALTER TABLE %[1]s ADD COLUMN hd_index bigint UNIQUE`,
+				`CREATE TABLE IF NOT EXISTS %[1]s_hd_index_seq (id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY)`,
+			},
+		},
+	},
+	{
+		Version:     4,
+		Description: "Add key rotations and retired keys",
+		Statements: map[string][]string{
+			DriverPostgres: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_rotations (
+					id bigserial PRIMARY KEY,
+					userid character varying(255) NOT NULL,
+					state character varying(32) NOT NULL,
+					active smallint DEFAULT 1,
+					new_ra_address bytea NOT NULL,
+					new_ra_pubkey bytea NOT NULL,
+					new_ra_privkey bytea,
+					new_sa_address bytea NOT NULL,
+					new_sa_pubkey bytea NOT NULL,
+					new_sa_privkey bytea,
+					new_wrapped_dek bytea,
+					new_hd_index bigint,
+					sweep_sequence bigint NOT NULL DEFAULT 0,
+					error text,
+					created_at timestamp with time zone DEFAULT now(),
+					updated_at timestamp with time zone DEFAULT now(),
+					UNIQUE (userid, active)
+				)`,
+				`CREATE TABLE IF NOT EXISTS %[1]s_retired_keys (
+					rotation_id bigint NOT NULL PRIMARY KEY,
+					userid character varying(255) NOT NULL,
+					ra_address bytea NOT NULL,
+					ra_pubkey bytea NOT NULL,
+					ra_privkey bytea,
+					sa_address bytea NOT NULL,
+					sa_pubkey bytea NOT NULL,
+					sa_privkey bytea,
+					wrapped_dek bytea,
+					hd_index bigint,
+					retired_at timestamp with time zone DEFAULT now()
+				)`,
+				`CREATE INDEX IF NOT EXISTS %[1]s_retired_keys_userid_idx ON %[1]s_retired_keys (userid)`,
+			},
+			DriverMySQL: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_rotations (
+					id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+					userid varchar(255) NOT NULL,
+					state varchar(32) NOT NULL,
+					active smallint DEFAULT 1,
+					new_ra_address varbinary(20) NOT NULL,
+					new_ra_pubkey blob NOT NULL,
+					new_ra_privkey blob,
+					new_sa_address varbinary(20) NOT NULL,
+					new_sa_pubkey blob NOT NULL,
+					new_sa_privkey blob,
+					new_wrapped_dek blob,
+					new_hd_index bigint,
+					sweep_sequence bigint NOT NULL DEFAULT 0,
+					error text,
+					created_at timestamp(6) DEFAULT CURRENT_TIMESTAMP(6),
+					updated_at timestamp(6) DEFAULT CURRENT_TIMESTAMP(6),
+					UNIQUE (userid, active)
+				)`,
+				`CREATE TABLE IF NOT EXISTS %[1]s_retired_keys (
+					rotation_id bigint NOT NULL PRIMARY KEY,
+					userid varchar(255) NOT NULL,
+					ra_address varbinary(20) NOT NULL,
+					ra_pubkey blob NOT NULL,
+					ra_privkey blob,
+					sa_address varbinary(20) NOT NULL,
+					sa_pubkey blob NOT NULL,
+					sa_privkey blob,
+					wrapped_dek blob,
+					hd_index bigint,
+					retired_at timestamp(6) DEFAULT CURRENT_TIMESTAMP(6),
+					INDEX (userid)
+				)`,
+			},
+		},
+	},
+	{
+		Version:     5,
+		Description: "Add admin audit trail",
+		Statements: map[string][]string{
+			DriverPostgres: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_admin_audit (
+					id bigserial PRIMARY KEY,
+					action character varying(64) NOT NULL,
+					userid character varying(255) NOT NULL,
+					actor character varying(255) NOT NULL,
+					success boolean NOT NULL,
+					error text,
+					created_at timestamp with time zone DEFAULT now()
+				)`,
+				`CREATE INDEX IF NOT EXISTS %[1]s_admin_audit_userid_idx ON %[1]s_admin_audit (userid)`,
+			},
+			DriverMySQL: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_admin_audit (
+					id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+					action varchar(64) NOT NULL,
+					userid varchar(255) NOT NULL,
+					actor varchar(255) NOT NULL,
+					success boolean NOT NULL,
+					error text,
+					created_at timestamp(6) DEFAULT CURRENT_TIMESTAMP(6),
+					INDEX (userid)
+				)`,
+			},
+		},
+	},
+	{
+		Version:     6,
+		Description: "Add hash-chained signing audit log",
+		Statements: map[string][]string{
+			DriverPostgres: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_signing_audit (
+					seq bigint PRIMARY KEY,
+					userid character varying(255) NOT NULL,
+					role character varying(8) NOT NULL,
+					tx_type character varying(64) NOT NULL,
+					tx_hash character varying(66) NOT NULL,
+					theta_wei character varying(80) NOT NULL,
+					gamma_wei character varying(80) NOT NULL,
+					fee_wei character varying(80) NOT NULL,
+					destination text NOT NULL,
+					request_id character varying(255) NOT NULL,
+					created_at timestamp with time zone NOT NULL,
+					prev_hash bytea,
+					entry_hash bytea NOT NULL
+				)`,
+				`CREATE INDEX IF NOT EXISTS %[1]s_signing_audit_userid_idx ON %[1]s_signing_audit (userid)`,
+			},
+			DriverMySQL: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_signing_audit (
+					seq bigint NOT NULL PRIMARY KEY,
+					userid varchar(255) NOT NULL,
+					role varchar(8) NOT NULL,
+					tx_type varchar(64) NOT NULL,
+					tx_hash varchar(66) NOT NULL,
+					theta_wei varchar(80) NOT NULL,
+					gamma_wei varchar(80) NOT NULL,
+					fee_wei varchar(80) NOT NULL,
+					destination text NOT NULL,
+					request_id varchar(255) NOT NULL,
+					created_at datetime(6) NOT NULL,
+					prev_hash varbinary(32),
+					entry_hash varbinary(32) NOT NULL,
+					INDEX (userid)
+				)`,
+			},
+		},
+	},
+	{
+		Version:     7,
+		Description: "Add transaction tracking",
+		Statements: map[string][]string{
+			DriverPostgres: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_transactions (
+					hash character varying(66) PRIMARY KEY,
+					userid character varying(255) NOT NULL,
+					role character varying(8) NOT NULL,
+					tx_type character varying(64) NOT NULL,
+					raw bytea NOT NULL,
+					status character varying(16) NOT NULL,
+					idempotency_key character varying(255),
+					block_height bigint,
+					error text,
+					created_at timestamp with time zone DEFAULT now(),
+					updated_at timestamp with time zone DEFAULT now()
+				)`,
+				`CREATE INDEX IF NOT EXISTS %[1]s_transactions_status_idx ON %[1]s_transactions (status, created_at)`,
+				`CREATE INDEX IF NOT EXISTS %[1]s_transactions_idempotency_key_idx ON %[1]s_transactions (userid, idempotency_key)`,
+			},
+			DriverMySQL: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_transactions (
+					hash varchar(66) NOT NULL PRIMARY KEY,
+					userid varchar(255) NOT NULL,
+					role varchar(8) NOT NULL,
+					tx_type varchar(64) NOT NULL,
+					raw blob NOT NULL,
+					status varchar(16) NOT NULL,
+					idempotency_key varchar(255),
+					block_height bigint,
+					error text,
+					created_at timestamp(6) DEFAULT CURRENT_TIMESTAMP(6),
+					updated_at timestamp(6) DEFAULT CURRENT_TIMESTAMP(6),
+					INDEX (status, created_at),
+					INDEX (userid, idempotency_key)
+				)`,
+			},
+		},
+	},
+	{
+		Version:     8,
+		Description: "Add transaction history indexed from blocks",
+		Statements: map[string][]string{
+			DriverPostgres: {
+				`CREATE INDEX IF NOT EXISTS %[1]s_ra_address_idx ON %[1]s (ra_address)`,
+				`CREATE TABLE IF NOT EXISTS %[1]s_history (
+					id bigserial PRIMARY KEY,
+					userid character varying(255) NOT NULL,
+					role character varying(8) NOT NULL,
+					address bytea NOT NULL,
+					tx_hash character varying(66) NOT NULL,
+					tx_type character varying(64) NOT NULL,
+					block_height bigint NOT NULL,
+					block_time timestamp with time zone NOT NULL,
+					direction character varying(8) NOT NULL,
+					theta_wei character varying(80) NOT NULL,
+					gamma_wei character varying(80) NOT NULL,
+					counterparty character varying(66) NOT NULL,
+					resource_id character varying(255) NOT NULL,
+					UNIQUE (tx_hash, userid, role)
+				)`,
+				`CREATE INDEX IF NOT EXISTS %[1]s_history_userid_idx ON %[1]s_history (userid, id)`,
+				`CREATE TABLE IF NOT EXISTS %[1]s_indexer (
+					id smallint PRIMARY KEY,
+					height bigint NOT NULL
+				)`,
+			},
+			DriverMySQL: {
+				`CREATE INDEX %[1]s_ra_address_idx ON %[1]s (ra_address)`,
+				`CREATE TABLE IF NOT EXISTS %[1]s_history (
+					id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+					userid varchar(255) NOT NULL,
+					role varchar(8) NOT NULL,
+					address varbinary(20) NOT NULL,
+					tx_hash varchar(66) NOT NULL,
+					tx_type varchar(64) NOT NULL,
+					block_height bigint NOT NULL,
+					block_time datetime(6) NOT NULL,
+					direction varchar(8) NOT NULL,
+					theta_wei varchar(80) NOT NULL,
+					gamma_wei varchar(80) NOT NULL,
+					counterparty varchar(66) NOT NULL,
+					resource_id varchar(255) NOT NULL,
+					UNIQUE (tx_hash, userid, role),
+					INDEX (userid, id)
+				)`,
+				`CREATE TABLE IF NOT EXISTS %[1]s_indexer (
+					id smallint NOT NULL PRIMARY KEY,
+					height bigint NOT NULL
+				)`,
+			},
+		},
+	},
+	{
+		Version:     9,
+		Description: "Add idempotency keys",
+		Statements: map[string][]string{
+			DriverPostgres: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_idempotency_keys (
+					userid character varying(255) NOT NULL,
+					idempotency_key character varying(255) NOT NULL,
+					method character varying(64) NOT NULL,
+					request_hash character varying(64) NOT NULL,
+					tx_hash character varying(66),
+					result text,
+					error text,
+					created_at timestamp with time zone DEFAULT now(),
+					claimed_at timestamp with time zone NOT NULL,
+					PRIMARY KEY (userid, idempotency_key)
+				)`,
+			},
+			DriverMySQL: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_idempotency_keys (
+					userid varchar(255) NOT NULL,
+					idempotency_key varchar(255) NOT NULL,
+					method varchar(64) NOT NULL,
+					request_hash varchar(64) NOT NULL,
+					tx_hash varchar(66),
+					result text,
+					error text,
+					created_at timestamp(6) DEFAULT CURRENT_TIMESTAMP(6),
+					claimed_at timestamp(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+					PRIMARY KEY (userid, idempotency_key)
+				)`,
+			},
+		},
+	},
+	{
+		Version:     10,
+		Description: "Add withdrawal allowlists",
+		Statements: map[string][]string{
+			DriverPostgres: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_withdrawal_allowlist (
+					userid character varying(255) NOT NULL,
+					address bytea NOT NULL,
+					label character varying(255) NOT NULL,
+					created_at timestamp with time zone NOT NULL,
+					active_at timestamp with time zone NOT NULL,
+					PRIMARY KEY (userid, address)
+				)`,
+			},
+			DriverMySQL: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_withdrawal_allowlist (
+					userid varchar(255) NOT NULL,
+					address varbinary(20) NOT NULL,
+					label varchar(255) NOT NULL,
+					created_at datetime(6) NOT NULL,
+					active_at datetime(6) NOT NULL,
+					PRIMARY KEY (userid, address)
+				)`,
+			},
+		},
+	},
+	{
+		Version:     11,
+		Description: "Add spending limits",
+		Statements: map[string][]string{
+			DriverPostgres: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_spending_limits (
+					userid character varying(255) PRIMARY KEY,
+					tier character varying(64) NOT NULL DEFAULT '',
+					per_tx_thetawei character varying(80),
+					per_tx_gammawei character varying(80),
+					daily_thetawei character varying(80),
+					daily_gammawei character varying(80),
+					monthly_thetawei character varying(80),
+					monthly_gammawei character varying(80),
+					reserved_funds bigint
+				)`,
+				`CREATE TABLE IF NOT EXISTS %[1]s_spending (
+					userid character varying(255) PRIMARY KEY,
+					day character varying(10) NOT NULL,
+					day_thetawei character varying(80) NOT NULL,
+					day_gammawei character varying(80) NOT NULL,
+					month character varying(7) NOT NULL,
+					month_thetawei character varying(80) NOT NULL,
+					month_gammawei character varying(80) NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS %[1]s_reserved_funds (
+					userid character varying(255) NOT NULL,
+					reserve_sequence bigint NOT NULL,
+					expires_at timestamp with time zone NOT NULL,
+					PRIMARY KEY (userid, reserve_sequence)
+				)`,
+			},
+			DriverMySQL: {
+				`CREATE TABLE IF NOT EXISTS %[1]s_spending_limits (
+					userid varchar(255) NOT NULL PRIMARY KEY,
+					tier varchar(64) NOT NULL DEFAULT '',
+					per_tx_thetawei varchar(80),
+					per_tx_gammawei varchar(80),
+					daily_thetawei varchar(80),
+					daily_gammawei varchar(80),
+					monthly_thetawei varchar(80),
+					monthly_gammawei varchar(80),
+					reserved_funds bigint
+				)`,
+				`CREATE TABLE IF NOT EXISTS %[1]s_spending (
+					userid varchar(255) NOT NULL PRIMARY KEY,
+					day varchar(10) NOT NULL,
+					day_thetawei varchar(80) NOT NULL,
+					day_gammawei varchar(80) NOT NULL,
+					month varchar(7) NOT NULL,
+					month_thetawei varchar(80) NOT NULL,
+					month_gammawei varchar(80) NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS %[1]s_reserved_funds (
+					userid varchar(255) NOT NULL,
+					reserve_sequence bigint NOT NULL,
+					expires_at datetime(6) NOT NULL,
+					PRIMARY KEY (userid, reserve_sequence)
+				)`,
+			},
+		},
+	},
+}
+
+// LatestSchemaVersion is the version the code expects the database to be at.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the last migration applied, or 0 for a
+// database that was never migrated. It does not change the database.
+func (da *DAO) SchemaVersion() (int, error) {
+	var exists bool
+	if err := da.db.QueryRow(da.dialect.tableExists(), schemaVersionTable).Scan(&exists); err != nil {
+		return 0, errors.Wrap(err, "Failed to read schema version")
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version sql.NullInt64
+	err := da.db.QueryRow(fmt.Sprintf("SELECT MAX(version) FROM %s", schemaVersionTable)).Scan(&version)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to read schema version")
+	}
+	return int(version.Int64), nil
+}
+
+// Migrate applies all pending migrations in order. It returns the number of
+// migrations applied.
+func (da *DAO) Migrate() (int, error) {
+	if err := da.createSchemaVersionTable(); err != nil {
+		return 0, errors.Wrap(err, "Failed to create schema version table")
+	}
+	current, err := da.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		applied, err := da.applyMigration(m)
+		if err != nil {
+			return count, errors.Wrapf(err, "Failed to apply migration %d (%s)", m.Version, m.Description)
+		}
+		if applied {
+			log.WithFields(log.Fields{"version": m.Version, "description": m.Description}).Info("Applied migration")
+			count++
+		}
+	}
+	return count, nil
+}
+
+// PrepareSchema brings the schema up to date if db.auto_migrate is set, and
+// otherwise fails if migrations are pending.
+func (da *DAO) PrepareSchema() error {
+	if viper.GetBool(util.CfgDbAutoMigrate) {
+		_, err := da.Migrate()
+		return err
+	}
+	version, err := da.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version < LatestSchemaVersion() {
+		return errors.Wrapf(ErrSchemaOutdated, "schema version %d, expected %d; run `vault migrate`", version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+func (da *DAO) createSchemaVersionTable() error {
+	_, err := da.db.Exec(da.dialect.createSchemaVersionTable())
+	return err
+}
+
+// applyMigration runs a migration and records it in a single transaction. It
+// reports false if another instance applied the migration first. MySQL commits
+// schema changes implicitly, so there a failed migration may be partially applied.
+func (da *DAO) applyMigration(m Migration) (bool, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+	ctx := context.Background()
+
+	conn, err := da.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	defer da.dialect.unlockMigrations(conn)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if err := da.dialect.lockMigrations(tx); err != nil {
+		return false, err
+	}
+	var exists bool
+	err = tx.QueryRow(da.dialect.rebind(fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE version=$1)", schemaVersionTable)), m.Version).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	for _, statement := range m.Statements[string(da.dialect)] {
+		if _, err := tx.Exec(fmt.Sprintf(statement, tableName)); err != nil {
+			return false, err
+		}
+	}
+	sm := da.dialect.rebind(fmt.Sprintf("INSERT INTO %s (version, description) VALUES ($1, $2)", schemaVersionTable))
+	if _, err := tx.Exec(sm, m.Version, m.Description); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thetatoken/vault/util"
+)
+
+func TestMigrationVersionsAreSequential(t *testing.T) {
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version, "migration %s is out of order", m.Description)
+	}
+}
+
+func TestDAOMigrate(t *testing.T) {
+	assert := assert.New(t)
+	da := newTestDatabase(t)
+	defer da.Close()
+	defer viper.Set(util.CfgDbAutoMigrate, false)
+
+	// Without auto_migrate, vault refuses to start on a database that was never
+	// migrated, and leaves it untouched.
+	viper.Set(util.CfgDbAutoMigrate, false)
+	assert.Equal(ErrSchemaOutdated, errors.Cause(da.PrepareSchema()))
+	version, err := da.SchemaVersion()
+	assert.Nil(err)
+	assert.Equal(0, version)
+	var exists bool
+	require.Nil(t, da.db.QueryRow(da.dialect.tableExists(), schemaVersionTable).Scan(&exists))
+	assert.False(exists)
+
+	count, err := da.Migrate()
+	assert.Nil(err)
+	assert.Equal(LatestSchemaVersion(), count)
+	version, err = da.SchemaVersion()
+	assert.Nil(err)
+	assert.Equal(LatestSchemaVersion(), version)
+
+	// Every migration is recorded once, in order.
+	rows, err := da.db.Query(fmt.Sprintf("SELECT version FROM %s ORDER BY applied_at, version", schemaVersionTable))
+	require.Nil(t, err)
+	defer rows.Close()
+	var versions []int
+	for rows.Next() {
+		var v int
+		require.Nil(t, rows.Scan(&v))
+		versions = append(versions, v)
+	}
+	for i, v := range versions {
+		assert.Equal(i+1, v)
+	}
+	assert.Len(versions, LatestSchemaVersion())
+
+	// Running migrations again applies nothing.
+	count, err = da.Migrate()
+	assert.Nil(err)
+	assert.Equal(0, count)
+	assert.Nil(da.PrepareSchema())
+}
+
+func TestDAOPrepareSchemaAutoMigrates(t *testing.T) {
+	assert := assert.New(t)
+	da := newTestDatabase(t)
+	defer da.Close()
+	defer viper.Set(util.CfgDbAutoMigrate, false)
+
+	viper.Set(util.CfgDbAutoMigrate, true)
+	assert.Nil(da.PrepareSchema())
+	version, err := da.SchemaVersion()
+	assert.Nil(err)
+	assert.Equal(LatestSchemaVersion(), version)
+}
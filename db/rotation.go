@@ -0,0 +1,246 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/thetatoken/ukulele/common"
+	crypto "github.com/thetatoken/ukulele/crypto"
+
+	"github.com/thetatoken/vault/util"
+)
+
+// States of a key rotation. See the rotation package for the transitions.
+const (
+	RotationPending   = "pending"
+	RotationSwitched  = "switched"
+	RotationRaSwept   = "ra_swept"
+	RotationCompleted = "completed"
+	RotationFailed    = "failed"
+)
+
+// Rotation is a key rotation of a user. Until it completes, the user has exactly
+// one active rotation.
+type Rotation struct {
+	ID            int64
+	UserID        string
+	State         string
+	NewKeys       Record // Replacement keys. Private keys are left out of HD keys.
+	SweepSequence uint64 // Sequence of the sweep transaction awaiting confirmation, or 0.
+	Error         string // Last error holding the rotation back.
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+const rotationColumns = "id, userid, state, new_ra_address, new_ra_pubkey, new_ra_privkey, new_sa_address, new_sa_pubkey, new_sa_privkey, new_wrapped_dek, new_hd_index, sweep_sequence, error, created_at, updated_at"
+
+// Done reports whether the rotation reached a final state.
+func (r Rotation) Done() bool {
+	return r.State == RotationCompleted || r.State == RotationFailed
+}
+
+// CreateRotation stores the replacement keys of a user in a new pending rotation.
+// It reports false, and stores nothing, if the user already has an active
+// rotation.
+func (da *DAO) CreateRotation(userid string, newKeys Record) (Rotation, bool, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	var raPrivBytes, saPrivBytes, wrappedKey []byte
+	var hdIndex interface{}
+	if newKeys.HDIndex != nil {
+		hdIndex = int64(*newKeys.HDIndex)
+	} else {
+		var err error
+		raPrivBytes, saPrivBytes, wrappedKey, err = sealPrivateKeys(da.envelope, userid, newKeys.RaPrivateKey.ToBytes(), newKeys.SaPrivateKey.ToBytes())
+		if err != nil {
+			return Rotation{}, false, errors.Wrap(err, "Failed to encrypt private keys")
+		}
+	}
+
+	sm := da.dialect.insertIfAbsent(tableName+"_rotations",
+		"userid, state, new_ra_address, new_ra_pubkey, new_ra_privkey, new_sa_address, new_sa_pubkey, new_sa_privkey, new_wrapped_dek, new_hd_index",
+		"$1, $2, $3, $4, $5, $6, $7, $8, $9, $10", "userid, active")
+	res, err := da.db.Exec(sm, userid, RotationPending, newKeys.RaAddress.Bytes(), []byte(newKeys.RaPubKey.ToBytes()), nullableBytes(raPrivBytes),
+		newKeys.SaAddress.Bytes(), []byte(newKeys.SaPubKey.ToBytes()), nullableBytes(saPrivBytes), nullableBytes(wrappedKey), hdIndex)
+	if err != nil {
+		return Rotation{}, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Rotation{}, false, err
+	}
+
+	rotations, err := da.findRotations("userid=$1 AND active IS NOT NULL", userid)
+	if err != nil {
+		return Rotation{}, false, err
+	}
+	if len(rotations) == 0 {
+		return Rotation{}, false, errors.Errorf("No active rotation of user %s", userid)
+	}
+	return rotations[0], n == 1, nil
+}
+
+// FindActiveRotations returns the rotations not yet done, oldest first.
+func (da *DAO) FindActiveRotations() ([]Rotation, error) {
+	return da.findRotations("active IS NOT NULL")
+}
+
+// UpdateRotation saves the state, sweep sequence and error of a rotation, provided
+// it is still in fromState. It reports whether the rotation was updated.
+func (da *DAO) UpdateRotation(rotation Rotation, fromState string) (bool, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	var active interface{} = 1
+	if rotation.Done() {
+		active = nil
+	}
+	sm := da.dialect.rebind(fmt.Sprintf("UPDATE %s_rotations SET state=$1, active=$2, sweep_sequence=$3, error=$4, updated_at=CURRENT_TIMESTAMP WHERE id=$5 AND state=$6", tableName))
+	res, err := da.db.Exec(sm, rotation.State, active, int64(rotation.SweepSequence), rotation.Error, rotation.ID, fromState)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	return n == 1, nil
+}
+
+// SwitchRotatedKeys retires the current keys of the user and replaces them with
+// the keys of the pending rotation, all in one transaction. It reports false if
+// the rotation is no longer pending.
+func (da *DAO) SwitchRotatedKeys(rotationID int64) (bool, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	tx, err := da.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := da.dialect.rebind(fmt.Sprintf("SELECT userid, state, new_ra_address, new_ra_pubkey, new_ra_privkey, new_sa_address, new_sa_pubkey, new_sa_privkey, new_wrapped_dek, new_hd_index FROM %s_rotations WHERE id=$1 FOR UPDATE", tableName))
+	var userid, state string
+	var raAddress, raPubkey, raPrivkey, saAddress, saPubkey, saPrivkey, wrappedKey []byte
+	var hdIndex sql.NullInt64
+	err = tx.QueryRow(query, rotationID).Scan(&userid, &state, &raAddress, &raPubkey, &raPrivkey, &saAddress, &saPubkey, &saPrivkey, &wrappedKey, &hdIndex)
+	if err != nil {
+		return false, err
+	}
+	if state != RotationPending {
+		return false, nil
+	}
+
+	sm := da.dialect.rebind(fmt.Sprintf("INSERT INTO %[1]s_retired_keys (rotation_id, userid, ra_address, ra_pubkey, ra_privkey, sa_address, sa_pubkey, sa_privkey, wrapped_dek, hd_index) SELECT $1, userid, ra_address, ra_pubkey, ra_privkey, sa_address, sa_pubkey, sa_privkey, wrapped_dek, hd_index FROM %[1]s WHERE userid=$2", tableName))
+	res, err := tx.Exec(sm, rotationID, userid)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to retire keys")
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false, errors.Errorf("Failed to retire keys of user %s: %v", userid, err)
+	}
+
+	var newHDIndex interface{}
+	if hdIndex.Valid {
+		newHDIndex = hdIndex.Int64
+	}
+	sm = da.dialect.rebind(fmt.Sprintf("UPDATE %s SET ra_address=$1, ra_pubkey=$2, ra_privkey=$3, sa_address=$4, sa_pubkey=$5, sa_privkey=$6, wrapped_dek=$7, hd_index=$8 WHERE userid=$9", tableName))
+	if _, err := tx.Exec(sm, raAddress, raPubkey, raPrivkey, saAddress, saPubkey, saPrivkey, wrappedKey, newHDIndex, userid); err != nil {
+		return false, errors.Wrap(err, "Failed to replace keys")
+	}
+
+	sm = da.dialect.rebind(fmt.Sprintf("UPDATE %s_rotations SET state=$1, updated_at=CURRENT_TIMESTAMP WHERE id=$2", tableName))
+	if _, err := tx.Exec(sm, RotationSwitched, rotationID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// FindRetiredKeys returns the keys retired by a rotation. Private keys of HD
+// records are left out, as in FindByUserId.
+func (da *DAO) FindRetiredKeys(rotationID int64) (Record, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	query := da.dialect.rebind(fmt.Sprintf("SELECT userid, ra_address, ra_pubkey, ra_privkey, sa_address, sa_pubkey, sa_privkey, wrapped_dek, hd_index FROM %s_retired_keys WHERE rotation_id=$1", tableName))
+	var userid string
+	var raAddress, raPubkey, raPrivkey, saAddress, saPubkey, saPrivkey, wrappedKey []byte
+	var hdIndex sql.NullInt64
+	err := da.db.QueryRow(query, rotationID).Scan(&userid, &raAddress, &raPubkey, &raPrivkey, &saAddress, &saPubkey, &saPrivkey, &wrappedKey, &hdIndex)
+	if err == sql.ErrNoRows {
+		return Record{}, ErrNoRecord
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	return da.openRecord(userid, raAddress, raPubkey, raPrivkey, saAddress, saPubkey, saPrivkey, wrappedKey, hdIndex)
+}
+
+func (da *DAO) findRotations(where string, args ...interface{}) ([]Rotation, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	query := da.dialect.rebind(fmt.Sprintf("SELECT %s FROM %s_rotations WHERE %s ORDER BY id", rotationColumns, tableName, where))
+	rows, err := da.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rotations []Rotation
+	for rows.Next() {
+		var rotation Rotation
+		var raAddress, raPubkey, raPrivkey, saAddress, saPubkey, saPrivkey, wrappedKey []byte
+		var hdIndex, sweepSequence sql.NullInt64
+		var rotationErr sql.NullString
+		var createdAt, updatedAt pq.NullTime
+		err := rows.Scan(&rotation.ID, &rotation.UserID, &rotation.State, &raAddress, &raPubkey, &raPrivkey, &saAddress, &saPubkey, &saPrivkey, &wrappedKey, &hdIndex, &sweepSequence, &rotationErr, &createdAt, &updatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse results from database")
+		}
+		rotation.NewKeys, err = da.openRecord(rotation.UserID, raAddress, raPubkey, raPrivkey, saAddress, saPubkey, saPrivkey, wrappedKey, hdIndex)
+		if err != nil {
+			return nil, err
+		}
+		rotation.SweepSequence = uint64(sweepSequence.Int64)
+		rotation.Error = rotationErr.String
+		rotation.CreatedAt = createdAt.Time
+		rotation.UpdatedAt = updatedAt.Time
+		rotations = append(rotations, rotation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse results from database")
+	}
+	return rotations, nil
+}
+
+// openRecord builds a record from stored key columns, decrypting the private keys
+// unless the record is derived from the HD seed.
+func (da *DAO) openRecord(userid string, raAddress, raPubkey, raSealed, saAddress, saPubkey, saSealed, wrappedKey []byte, hdIndex sql.NullInt64) (Record, error) {
+	raPubKey, _ := crypto.PublicKeyFromBytes(raPubkey)
+	saPubKey, _ := crypto.PublicKeyFromBytes(saPubkey)
+	record := Record{
+		UserID:    userid,
+		RaPubKey:  raPubKey,
+		RaAddress: common.BytesToAddress(raAddress),
+		SaPubKey:  saPubKey,
+		SaAddress: common.BytesToAddress(saAddress),
+	}
+	if hdIndex.Valid {
+		index := uint32(hdIndex.Int64)
+		record.HDIndex = &index
+		return record, nil
+	}
+
+	raPrivkeyBytes, saPrivkeyBytes, err := openPrivateKeys(da.envelope, userid, raSealed, saSealed, wrappedKey)
+	if err != nil {
+		return Record{}, errors.Wrapf(err, "Failed to decrypt keys of user %s", userid)
+	}
+	record.RaPrivateKey, _ = crypto.PrivateKeyFromBytes(raPrivkeyBytes)
+	record.SaPrivateKey, _ = crypto.PrivateKeyFromBytes(saPrivkeyBytes)
+	return record, nil
+}
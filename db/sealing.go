@@ -0,0 +1,61 @@
+package db
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/thetatoken/vault/encryption"
+)
+
+var ErrEncryptionNotConfigured = errors.New("DAO: record is encrypted but no encryption provider is configured")
+
+// sealPrivateKeys encrypts the private keys of a record under a fresh data key,
+// each bound to the user and account role, so that sealed keys cannot be swapped
+// between accounts or users in the database. The returned wrapped key is nil if
+// encryption at rest is disabled.
+func sealPrivateKeys(envelope *encryption.Envelope, userid string, raPrivkey, saPrivkey []byte) (raSealed, saSealed, wrappedKey []byte, err error) {
+	if envelope == nil {
+		return raPrivkey, saPrivkey, nil, nil
+	}
+	dek, wrappedKey, err := envelope.NewDataKey()
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "Failed to generate data key")
+	}
+	raSealed, err = encryption.Seal(dek, raPrivkey, sealingData(userid, "RA"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	saSealed, err = encryption.Seal(dek, saPrivkey, sealingData(userid, "SA"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return raSealed, saSealed, wrappedKey, nil
+}
+
+// openPrivateKeys reverses sealPrivateKeys. Records without a wrapped key were
+// written before encryption was enabled and are returned as is.
+func openPrivateKeys(envelope *encryption.Envelope, userid string, raSealed, saSealed, wrappedKey []byte) (raPrivkey, saPrivkey []byte, err error) {
+	if len(wrappedKey) == 0 {
+		return raSealed, saSealed, nil
+	}
+	if envelope == nil {
+		return nil, nil, ErrEncryptionNotConfigured
+	}
+	dek, err := envelope.UnwrapDataKey(wrappedKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to unwrap data key")
+	}
+	raPrivkey, err = encryption.Open(dek, raSealed, sealingData(userid, "RA"))
+	if err != nil {
+		return nil, nil, err
+	}
+	saPrivkey, err = encryption.Open(dek, saSealed, sealingData(userid, "SA"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return raPrivkey, saPrivkey, nil
+}
+
+// sealingData is the additional data a private key is sealed with.
+func sealingData(userid, role string) []byte {
+	return []byte(userid + "|" + role)
+}
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thetatoken/vault/encryption"
+)
+
+func TestSealedKeysAreBoundToUserAndRole(t *testing.T) {
+	assert := assert.New(t)
+
+	envelope, err := encryption.NewEnvelope(encryption.PassphraseKeyProvider{Passphrase: "qwertyuiop", Salt: []byte("salt")})
+	require.Nil(t, err)
+	raSealed, saSealed, wrappedKey, err := sealPrivateKeys(envelope, "alice", []byte("ra key"), []byte("sa key"))
+	require.Nil(t, err)
+
+	raPrivkey, saPrivkey, err := openPrivateKeys(envelope, "alice", raSealed, saSealed, wrappedKey)
+	assert.Nil(err)
+	assert.Equal([]byte("ra key"), raPrivkey)
+	assert.Equal([]byte("sa key"), saPrivkey)
+
+	// Keys moved to another user, or between the accounts of the user, do not open.
+	_, _, err = openPrivateKeys(envelope, "bob", raSealed, saSealed, wrappedKey)
+	assert.Equal(encryption.ErrInvalidCiphertext, errors.Cause(err))
+	_, _, err = openPrivateKeys(envelope, "alice", saSealed, raSealed, wrappedKey)
+	assert.Equal(encryption.ErrInvalidCiphertext, errors.Cause(err))
+}
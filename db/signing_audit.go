@@ -0,0 +1,396 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/thetatoken/vault/util"
+)
+
+// SigningAuditEntry records a transaction signed on behalf of a user. Entries are
+// numbered from 1 without gaps, and each one is chained to the previous one by
+// hash, so any modified, removed or reordered entry breaks the chain.
+type SigningAuditEntry struct {
+	Seq         uint64    `json:"seq"`
+	UserID      string    `json:"user_id"`
+	Role        string    `json:"role"` // Account that signed, SA or RA.
+	TxType      string    `json:"tx_type"`
+	TxHash      string    `json:"tx_hash"`
+	ThetaWei    string    `json:"theta_wei"`
+	GammaWei    string    `json:"gamma_wei"`
+	FeeWei      string    `json:"fee_wei"`     // Fee in GammaWei.
+	Destination string    `json:"destination"` // Receiving addresses, if any, comma separated.
+	RequestID   string    `json:"request_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	PrevHash    []byte    `json:"prev_hash"` // Empty for the first entry.
+	Hash        []byte    `json:"hash"`
+}
+
+// ComputeHash returns the hash of the entry, covering every field but Hash.
+func (e SigningAuditEntry) ComputeHash() []byte {
+	h := sha256.New()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], e.Seq)
+	h.Write(buf[:])
+	fields := []string{e.UserID, e.Role, e.TxType, e.TxHash, e.ThetaWei, e.GammaWei, e.FeeWei, e.Destination, e.RequestID, e.CreatedAt.UTC().Format(time.RFC3339Nano)}
+	for _, field := range fields {
+		// Length prefixes keep field boundaries unambiguous.
+		binary.BigEndian.PutUint64(buf[:], uint64(len(field)))
+		h.Write(buf[:])
+		h.Write([]byte(field))
+	}
+	h.Write(e.PrevHash)
+	return h.Sum(nil)
+}
+
+// chainTo fills in the position of the entry after prev and seals it.
+func (e *SigningAuditEntry) chainTo(prev SigningAuditEntry) {
+	e.Seq = prev.Seq + 1
+	e.PrevHash = prev.Hash
+	// Databases keep microseconds, so hash what will be read back.
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	e.Hash = e.ComputeHash()
+}
+
+// SigningAuditLog is implemented by stores that keep the signing audit log.
+type SigningAuditLog interface {
+	// AppendSigningAudit chains the entry to the end of the log. Seq, PrevHash,
+	// CreatedAt and Hash are assigned by the store.
+	AppendSigningAudit(entry SigningAuditEntry) (SigningAuditEntry, error)
+
+	// ListSigningAudit returns up to limit entries following afterSeq, in order.
+	ListSigningAudit(afterSeq uint64, limit int) ([]SigningAuditEntry, error)
+}
+
+const verifyBatchSize = 1000
+
+// VerifySigningAudit walks the whole signing audit log and checks that entries are
+// contiguous, unmodified and chained, calling visit, if not nil, on every valid
+// entry. It returns the last valid entry, whose hash can be kept elsewhere to
+// also detect truncation of the log later.
+func VerifySigningAudit(auditLog SigningAuditLog, visit func(entry SigningAuditEntry)) (SigningAuditEntry, error) {
+	var prev SigningAuditEntry
+	for {
+		entries, err := auditLog.ListSigningAudit(prev.Seq, verifyBatchSize)
+		if err != nil {
+			return prev, err
+		}
+		if len(entries) == 0 {
+			return prev, nil
+		}
+		for _, entry := range entries {
+			if entry.Seq != prev.Seq+1 {
+				return prev, errors.Errorf("Signing audit log is missing entries %d to %d", prev.Seq+1, entry.Seq-1)
+			}
+			if !bytes.Equal(entry.PrevHash, prev.Hash) {
+				return prev, errors.Errorf("Signing audit entry %d is not chained to entry %d", entry.Seq, prev.Seq)
+			}
+			if !bytes.Equal(entry.ComputeHash(), entry.Hash) {
+				return prev, errors.Errorf("Signing audit entry %d has been modified", entry.Seq)
+			}
+			if visit != nil {
+				visit(entry)
+			}
+			prev = entry
+		}
+	}
+}
+
+// ----------------- SQL ---------------------
+
+// maxAuditAppendAttempts bounds retries when concurrent appends claim the same
+// sequence number.
+const maxAuditAppendAttempts = 20
+
+const signingAuditColumns = "seq, userid, role, tx_type, tx_hash, theta_wei, gamma_wei, fee_wei, destination, request_id, created_at, prev_hash, entry_hash"
+
+func (da *DAO) AppendSigningAudit(entry SigningAuditEntry) (SigningAuditEntry, error) {
+	tableName := viper.GetString(util.CfgDbTable) + "_signing_audit"
+
+	sm := da.dialect.insertIfAbsent(tableName, signingAuditColumns, "$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13", "seq")
+	for attempt := 0; attempt < maxAuditAppendAttempts; attempt++ {
+		var last SigningAuditEntry
+		query := fmt.Sprintf("SELECT seq, entry_hash FROM %s ORDER BY seq DESC LIMIT 1", tableName)
+		err := da.db.QueryRow(query).Scan(&last.Seq, &last.Hash)
+		if err != nil && err != sql.ErrNoRows {
+			return SigningAuditEntry{}, errors.Wrap(err, "Failed to read signing audit log")
+		}
+
+		entry.chainTo(last)
+		res, err := da.db.Exec(sm, entry.Seq, entry.UserID, entry.Role, entry.TxType, entry.TxHash, entry.ThetaWei, entry.GammaWei, entry.FeeWei, entry.Destination, entry.RequestID, entry.CreatedAt, nullableBytes(entry.PrevHash), entry.Hash)
+		if err != nil {
+			return SigningAuditEntry{}, errors.Wrap(err, "Failed to update database")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return SigningAuditEntry{}, errors.Wrap(err, "Failed to update database")
+		}
+		if n == 1 {
+			return entry, nil
+		}
+		// Another append took this sequence number. Chain to it instead.
+	}
+	return SigningAuditEntry{}, errors.New("Failed to append to signing audit log: too many concurrent appends")
+}
+
+func (da *DAO) ListSigningAudit(afterSeq uint64, limit int) ([]SigningAuditEntry, error) {
+	tableName := viper.GetString(util.CfgDbTable) + "_signing_audit"
+
+	query := da.dialect.rebind(fmt.Sprintf("SELECT %s FROM %s WHERE seq > $1 ORDER BY seq LIMIT %d", signingAuditColumns, tableName, limit))
+	rows, err := da.db.Query(query, afterSeq)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []SigningAuditEntry
+	for rows.Next() {
+		var e SigningAuditEntry
+		if err := rows.Scan(&e.Seq, &e.UserID, &e.Role, &e.TxType, &e.TxHash, &e.ThetaWei, &e.GammaWei, &e.FeeWei, &e.Destination, &e.RequestID, &e.CreatedAt, &e.PrevHash, &e.Hash); err != nil {
+			return entries, errors.Wrap(err, "Failed to parse results from database")
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return entries, errors.Wrap(err, "Failed to parse results from database")
+	}
+	return entries, nil
+}
+
+// ----------------- Bolt ---------------------
+
+var signingAuditBucket = []byte("signing_audit") // seq -> SigningAuditEntry
+
+func (bs *BoltStore) AppendSigningAudit(entry SigningAuditEntry) (SigningAuditEntry, error) {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(signingAuditBucket)
+		var last SigningAuditEntry
+		if _, v := b.Cursor().Last(); v != nil {
+			if err := json.Unmarshal(v, &last); err != nil {
+				return err
+			}
+		}
+		entry.chainTo(last)
+		v, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put(seqKey(entry.Seq), v)
+	})
+	if err != nil {
+		return SigningAuditEntry{}, errors.Wrap(err, "Failed to append to signing audit log")
+	}
+	return entry, nil
+}
+
+func (bs *BoltStore) ListSigningAudit(afterSeq uint64, limit int) ([]SigningAuditEntry, error) {
+	var entries []SigningAuditEntry
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(signingAuditBucket).Cursor()
+		for k, v := c.Seek(seqKey(afterSeq + 1)); k != nil && len(entries) < limit; k, v = c.Next() {
+			var e SigningAuditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// ----------------- DynamoDB ---------------------
+
+// signingAuditHead names the item of the counters table pointing at the last
+// entry of the signing audit log. Appends that fail before moving it leave it
+// behind, so readers probe past it.
+const signingAuditHead = "signing_audit_head"
+
+// AppendSigningAudit puts the entry under the next sequence number if no other
+// append took it first, then moves the head to it.
+func (ds *DynamoStore) AppendSigningAudit(entry SigningAuditEntry) (SigningAuditEntry, error) {
+	for attempt := 0; attempt < maxAuditAppendAttempts; attempt++ {
+		last, err := ds.lastSigningAudit()
+		if err != nil {
+			return SigningAuditEntry{}, errors.Wrap(err, "Failed to read signing audit log")
+		}
+
+		entry.chainTo(last)
+		_, err = ds.client.PutItem(&dynamodb.PutItemInput{
+			TableName:           aws.String(ds.signingAuditTable),
+			Item:                signingAuditItem(entry),
+			ConditionExpression: aws.String("attribute_not_exists(seq)"),
+		})
+		if isConditionFailed(err) {
+			// Another append took this sequence number. Chain to it instead.
+			continue
+		}
+		if err != nil {
+			return SigningAuditEntry{}, errors.Wrap(err, "Failed to update database")
+		}
+		if err := ds.moveSigningAuditHead(entry); err != nil {
+			log.WithFields(log.Fields{"method": "AppendSigningAudit", "seq": entry.Seq, "error": err}).Warn("Failed to move signing audit head")
+		}
+		return entry, nil
+	}
+	return SigningAuditEntry{}, errors.New("Failed to append to signing audit log: too many concurrent appends")
+}
+
+// ListSigningAudit reads entries one by one up to the head, skipping missing ones
+// so that VerifySigningAudit reports them, then past the head while entries exist.
+func (ds *DynamoStore) ListSigningAudit(afterSeq uint64, limit int) ([]SigningAuditEntry, error) {
+	head, err := ds.signingAuditHead()
+	if err != nil {
+		return nil, err
+	}
+	var entries []SigningAuditEntry
+	for seq := afterSeq + 1; len(entries) < limit; seq++ {
+		entry, err := ds.getSigningAudit(seq)
+		if err == ErrNoRecord {
+			if seq > head.Seq {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// lastSigningAudit returns the last entry of the log, or an empty entry if the log
+// is empty.
+func (ds *DynamoStore) lastSigningAudit() (SigningAuditEntry, error) {
+	last, err := ds.signingAuditHead()
+	if err != nil {
+		return SigningAuditEntry{}, err
+	}
+	for {
+		next, err := ds.getSigningAudit(last.Seq + 1)
+		if err == ErrNoRecord {
+			return last, nil
+		}
+		if err != nil {
+			return SigningAuditEntry{}, err
+		}
+		last = next
+	}
+}
+
+// signingAuditHead returns the sequence number and hash the head points at.
+func (ds *DynamoStore) signingAuditHead() (SigningAuditEntry, error) {
+	out, err := ds.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(ds.countersTable),
+		Key:            map[string]*dynamodb.AttributeValue{"name": {S: aws.String(signingAuditHead)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return SigningAuditEntry{}, err
+	}
+	if len(out.Item) == 0 {
+		return SigningAuditEntry{}, nil
+	}
+	seq, err := strconv.ParseUint(aws.StringValue(out.Item["value"].N), 10, 64)
+	if err != nil {
+		return SigningAuditEntry{}, errors.Wrap(err, "Invalid signing audit head")
+	}
+	return SigningAuditEntry{Seq: seq, Hash: bytesAttr(out.Item, "hash")}, nil
+}
+
+// moveSigningAuditHead points the head at the entry unless it is already further.
+func (ds *DynamoStore) moveSigningAuditHead(entry SigningAuditEntry) error {
+	_, err := ds.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                aws.String(ds.countersTable),
+		Key:                      map[string]*dynamodb.AttributeValue{"name": {S: aws.String(signingAuditHead)}},
+		UpdateExpression:         aws.String("SET #value = :seq, #hash = :hash"),
+		ConditionExpression:      aws.String("attribute_not_exists(#value) OR #value < :seq"),
+		ExpressionAttributeNames: map[string]*string{"#value": aws.String("value"), "#hash": aws.String("hash")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":seq":  {N: aws.String(strconv.FormatUint(entry.Seq, 10))},
+			":hash": {B: entry.Hash},
+		},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+func (ds *DynamoStore) getSigningAudit(seq uint64) (SigningAuditEntry, error) {
+	out, err := ds.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(ds.signingAuditTable),
+		Key:            map[string]*dynamodb.AttributeValue{"seq": {N: aws.String(strconv.FormatUint(seq, 10))}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return SigningAuditEntry{}, err
+	}
+	if len(out.Item) == 0 {
+		return SigningAuditEntry{}, ErrNoRecord
+	}
+	item := out.Item
+	return SigningAuditEntry{
+		Seq:         seq,
+		UserID:      stringAttr(item, "userid"),
+		Role:        stringAttr(item, "role"),
+		TxType:      stringAttr(item, "tx_type"),
+		TxHash:      stringAttr(item, "tx_hash"),
+		ThetaWei:    stringAttr(item, "theta_wei"),
+		GammaWei:    stringAttr(item, "gamma_wei"),
+		FeeWei:      stringAttr(item, "fee_wei"),
+		Destination: stringAttr(item, "destination"),
+		RequestID:   stringAttr(item, "request_id"),
+		CreatedAt:   timeAttr(item, "created_at").UTC(),
+		PrevHash:    bytesAttr(item, "prev_hash"),
+		Hash:        bytesAttr(item, "entry_hash"),
+	}, nil
+}
+
+func signingAuditItem(entry SigningAuditEntry) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"seq":         {N: aws.String(strconv.FormatUint(entry.Seq, 10))},
+		"userid":      {S: aws.String(entry.UserID)},
+		"role":        {S: aws.String(entry.Role)},
+		"tx_type":     {S: aws.String(entry.TxType)},
+		"tx_hash":     {S: aws.String(entry.TxHash)},
+		"theta_wei":   {S: aws.String(entry.ThetaWei)},
+		"gamma_wei":   {S: aws.String(entry.GammaWei)},
+		"fee_wei":     {S: aws.String(entry.FeeWei)},
+		"destination": {S: aws.String(entry.Destination)},
+		"request_id":  {S: aws.String(entry.RequestID)},
+		"created_at":  {N: aws.String(strconv.FormatInt(entry.CreatedAt.UnixNano(), 10))},
+		"entry_hash":  {B: entry.Hash},
+	}
+	// Binary attributes cannot be empty.
+	if len(entry.PrevHash) != 0 {
+		item["prev_hash"] = &dynamodb.AttributeValue{B: entry.PrevHash}
+	}
+	return item
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+var (
+	_ SigningAuditLog = &DAO{}
+	_ SigningAuditLog = &BoltStore{}
+	_ SigningAuditLog = &DynamoStore{}
+)
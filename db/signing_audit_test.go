@@ -0,0 +1,97 @@
+package db
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifySigningAudit(t *testing.T) {
+	assert := assert.New(t)
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	for _, userid := range []string{"alice", "bob", "carol"} {
+		_, err := bs.AppendSigningAudit(SigningAuditEntry{UserID: userid, Role: "SA", TxType: "send", GammaWei: "100"})
+		require.Nil(t, err)
+	}
+	head, err := VerifySigningAudit(bs, nil)
+	assert.Nil(err)
+	assert.Equal(uint64(3), head.Seq)
+
+	// Rewrite the amount of the second entry in place.
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(signingAuditBucket)
+		var e SigningAuditEntry
+		require.Nil(t, json.Unmarshal(b.Get(seqKey(2)), &e))
+		e.GammaWei = "1000000"
+		v, _ := json.Marshal(e)
+		return b.Put(seqKey(2), v)
+	})
+	require.Nil(t, err)
+	head, err = VerifySigningAudit(bs, nil)
+	assert.EqualError(err, "Signing audit entry 2 has been modified")
+	assert.Equal(uint64(1), head.Seq)
+
+	// Drop the second entry altogether.
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(signingAuditBucket).Delete(seqKey(2))
+	})
+	require.Nil(t, err)
+	_, err = VerifySigningAudit(bs, nil)
+	assert.EqualError(err, "Signing audit log is missing entries 2 to 2")
+}
+
+func testSigningAuditAppends(t *testing.T, auditLog SigningAuditLog) {
+	assert := assert.New(t)
+
+	const appends = 10
+	var wg sync.WaitGroup
+	errs := make([]error, appends)
+	for i := 0; i < appends; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = auditLog.AppendSigningAudit(SigningAuditEntry{UserID: "alice", Role: "SA", TxType: "send", GammaWei: strconv.Itoa(i)})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.Nil(err)
+	}
+
+	// Concurrent appends are chained one after the other.
+	visited := 0
+	head, err := VerifySigningAudit(auditLog, func(entry SigningAuditEntry) { visited++ })
+	assert.Nil(err)
+	assert.Equal(uint64(appends), head.Seq)
+	assert.Equal(appends, visited)
+
+	entries, err := auditLog.ListSigningAudit(appends-2, 10)
+	assert.Nil(err)
+	if assert.Len(entries, 2) {
+		assert.Equal(uint64(appends-1), entries[0].Seq)
+		assert.Equal(entries[0].Hash, entries[1].PrevHash)
+	}
+}
+
+func TestDAOSigningAudit(t *testing.T) {
+	da := newTestDAO(t)
+	defer da.Close()
+	testSigningAuditAppends(t, da)
+}
+
+func TestDynamoStoreSigningAudit(t *testing.T) {
+	testSigningAuditAppends(t, newTestDynamoStore(t))
+}
+
+func TestBoltStoreSigningAudit(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+	testSigningAuditAppends(t, bs)
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/thetatoken/ukulele/common"
+
+	"github.com/thetatoken/vault/util"
+)
+
+const (
+	DriverPostgres = "postgres"
+	DriverBolt     = "bolt"
+)
+
+// Store persists user records. DAO implements it on top of Postgres or MySQL,
+// DynamoStore on top of DynamoDB, and BoltStore in a single embedded file.
+type Store interface {
+	Close()
+
+	FindByUserId(userid string) (Record, error)
+	CreateIfAbsent(record Record) (bool, error)
+	NextHDIndex() (uint32, error)
+
+	FindUnfundedUsers(limit int) ([]Record, error)
+	MarkUserFunded(address common.Address) error
+
+	EncryptPlaintextRecords() (int, error)
+
+	SchemaVersion() (int, error)
+	Migrate() (int, error)
+	PrepareSchema() error
+}
+
+var _ Store = &DAO{}
+var _ Store = &BoltStore{}
+var _ Store = &DynamoStore{}
+
+// NewStore opens the store selected by db.driver.
+func NewStore() (Store, error) {
+	var store Store
+	var err error
+	switch driver := viper.GetString(util.CfgDbDriver); driver {
+	case DriverPostgres, DriverMySQL:
+		store, err = NewDAO()
+	case DriverBolt:
+		store, err = NewBoltStore(viper.GetString(util.CfgDbPath))
+	case DriverDynamoDB:
+		store, err = NewDynamoStore(viper.GetString(util.CfgDbDynamoDBRegion), viper.GetString(util.CfgDbDynamoDBEndpoint), viper.GetString(util.CfgDbTable))
+	default:
+		return nil, errors.Errorf("Unknown database driver: %s", driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
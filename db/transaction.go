@@ -0,0 +1,511 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/boltdb/bolt"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"github.com/thetatoken/vault/util"
+)
+
+// Statuses of a transaction broadcast by vault.
+const (
+	TxPending   = "pending"   // Broadcast, not yet in a block.
+	TxIncluded  = "included"  // In a block that is not finalized yet.
+	TxFinalized = "finalized" // In a finalized block.
+	TxFailed    = "failed"    // Rejected by the node, abandoned or dropped.
+)
+
+// Transaction is a transaction vault broadcast on behalf of a user.
+type Transaction struct {
+	Hash           string // Hex encoded with 0x prefix.
+	UserID         string
+	Role           string // Account that signed, SA or RA.
+	TxType         string
+	Raw            []byte
+	Status         string
+	IdempotencyKey string // Key of the request that produced the transaction, if any.
+	BlockHeight    uint64 // Height of the block including the transaction, once included.
+	Error          string // Reason of the failure.
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// IsSettled reports whether the transaction reached a final status.
+func (tx Transaction) IsSettled() bool {
+	return tx.Status == TxFinalized || tx.Status == TxFailed
+}
+
+// TransactionStore persists the transactions vault broadcasts. DAO, BoltStore and
+// DynamoStore implement it.
+type TransactionStore interface {
+	// CreateTransaction stores a new transaction unless one with the same hash
+	// exists. It reports whether the transaction was stored.
+	CreateTransaction(tx Transaction) (bool, error)
+
+	// FindTransaction returns ErrNoRecord if no transaction has the hash.
+	FindTransaction(hash string) (Transaction, error)
+
+	// FindTransactionByIdempotencyKey returns the latest transaction of the user
+	// created for the key, or ErrNoRecord.
+	FindTransactionByIdempotencyKey(userid, key string) (Transaction, error)
+
+	// UpdateTransactionStatus saves the status, block height and error of the
+	// transaction, provided it is still in fromStatus. It reports whether the
+	// transaction was updated.
+	UpdateTransactionStatus(tx Transaction, fromStatus string) (bool, error)
+}
+
+const transactionColumns = "hash, userid, role, tx_type, raw, status, idempotency_key, block_height, error, created_at, updated_at"
+
+func (da *DAO) CreateTransaction(tx Transaction) (bool, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	sm := da.dialect.insertIfAbsent(tableName+"_transactions", "hash, userid, role, tx_type, raw, status, idempotency_key", "$1, $2, $3, $4, $5, $6, $7", "hash")
+	res, err := da.db.Exec(sm, tx.Hash, tx.UserID, tx.Role, tx.TxType, tx.Raw, tx.Status, nullableString(tx.IdempotencyKey))
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	return n == 1, nil
+}
+
+func (da *DAO) FindTransaction(hash string) (Transaction, error) {
+	txs, err := da.findTransactions("hash=$1 LIMIT 1", strings.ToLower(hash))
+	if err != nil {
+		return Transaction{}, err
+	}
+	if len(txs) == 0 {
+		return Transaction{}, ErrNoRecord
+	}
+	return txs[0], nil
+}
+
+func (da *DAO) FindTransactionByIdempotencyKey(userid, key string) (Transaction, error) {
+	txs, err := da.findTransactions("userid=$1 AND idempotency_key=$2 ORDER BY created_at DESC LIMIT 1", userid, key)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if len(txs) == 0 {
+		return Transaction{}, ErrNoRecord
+	}
+	return txs[0], nil
+}
+
+// FindUnsettledTransactions returns up to limit transactions still pending or
+// included, ordered by creation time and hash, that come after the given one. The
+// first page is returned after a zero Transaction.
+func (da *DAO) FindUnsettledTransactions(after Transaction, limit int) ([]Transaction, error) {
+	if after.Hash == "" {
+		return da.findTransactions(fmt.Sprintf("status IN ($1, $2) ORDER BY created_at, hash LIMIT %d", limit), TxPending, TxIncluded)
+	}
+	return da.findTransactions(fmt.Sprintf("status IN ($1, $2) AND (created_at > $3 OR (created_at = $3 AND hash > $4)) ORDER BY created_at, hash LIMIT %d", limit), TxPending, TxIncluded, after.CreatedAt, after.Hash)
+}
+
+func (da *DAO) UpdateTransactionStatus(tx Transaction, fromStatus string) (bool, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	sm := da.dialect.rebind(fmt.Sprintf("UPDATE %s_transactions SET status=$1, block_height=$2, error=$3, updated_at=CURRENT_TIMESTAMP WHERE hash=$4 AND status=$5", tableName))
+	res, err := da.db.Exec(sm, tx.Status, int64(tx.BlockHeight), tx.Error, tx.Hash, fromStatus)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	return n == 1, nil
+}
+
+func (da *DAO) findTransactions(where string, args ...interface{}) ([]Transaction, error) {
+	tableName := viper.GetString(util.CfgDbTable)
+
+	query := da.dialect.rebind(fmt.Sprintf("SELECT %s FROM %s_transactions WHERE %s", transactionColumns, tableName, where))
+	rows, err := da.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var txs []Transaction
+	for rows.Next() {
+		var tx Transaction
+		var idempotencyKey, txErr sql.NullString
+		var blockHeight sql.NullInt64
+		var createdAt, updatedAt pq.NullTime
+		err := rows.Scan(&tx.Hash, &tx.UserID, &tx.Role, &tx.TxType, &tx.Raw, &tx.Status, &idempotencyKey, &blockHeight, &txErr, &createdAt, &updatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse results from database")
+		}
+		tx.IdempotencyKey = idempotencyKey.String
+		tx.BlockHeight = uint64(blockHeight.Int64)
+		tx.Error = txErr.String
+		tx.CreatedAt = createdAt.Time
+		tx.UpdatedAt = updatedAt.Time
+		txs = append(txs, tx)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse results from database")
+	}
+	return txs, nil
+}
+
+// nullableString maps an empty string to SQL NULL.
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// ----------------- Bolt ---------------------
+
+var (
+	txsBucket           = []byte("transactions")   // hash -> Transaction
+	txIdempotencyBucket = []byte("tx_idempotency") // userid \x00 key -> hash of the latest transaction
+	unsettledTxsBucket  = []byte("unsettled_txs")  // created_at || hash -> hash, for unsettled transactions
+)
+
+func (bs *BoltStore) CreateTransaction(t Transaction) (bool, error) {
+	t.Hash = strings.ToLower(t.Hash)
+	t.CreatedAt = time.Now().UTC()
+	t.UpdatedAt = t.CreatedAt
+	created := false
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(txsBucket)
+		if b.Get([]byte(t.Hash)) != nil {
+			return nil
+		}
+		if err := putBoltTransaction(tx, t); err != nil {
+			return err
+		}
+		if t.IdempotencyKey != "" {
+			if err := tx.Bucket(txIdempotencyBucket).Put(txIdempotencyKey(t.UserID, t.IdempotencyKey), []byte(t.Hash)); err != nil {
+				return err
+			}
+		}
+		if !t.IsSettled() {
+			if err := tx.Bucket(unsettledTxsBucket).Put(unsettledTxKey(t), []byte(t.Hash)); err != nil {
+				return err
+			}
+		}
+		created = true
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	return created, nil
+}
+
+func (bs *BoltStore) FindTransaction(hash string) (Transaction, error) {
+	var t *Transaction
+	err := bs.db.View(func(tx *bolt.Tx) (err error) {
+		t, err = getBoltTransaction(tx, []byte(strings.ToLower(hash)))
+		return
+	})
+	if err != nil {
+		return Transaction{}, err
+	}
+	if t == nil {
+		return Transaction{}, ErrNoRecord
+	}
+	return *t, nil
+}
+
+func (bs *BoltStore) FindTransactionByIdempotencyKey(userid, key string) (Transaction, error) {
+	var t *Transaction
+	err := bs.db.View(func(tx *bolt.Tx) (err error) {
+		hash := tx.Bucket(txIdempotencyBucket).Get(txIdempotencyKey(userid, key))
+		if hash == nil {
+			return nil
+		}
+		t, err = getBoltTransaction(tx, hash)
+		return
+	})
+	if err != nil {
+		return Transaction{}, err
+	}
+	if t == nil {
+		return Transaction{}, ErrNoRecord
+	}
+	return *t, nil
+}
+
+func (bs *BoltStore) FindUnsettledTransactions(after Transaction, limit int) ([]Transaction, error) {
+	var txs []Transaction
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(unsettledTxsBucket).Cursor()
+		k, v := c.First()
+		if after.Hash != "" {
+			start := unsettledTxKey(after)
+			for k, v = c.Seek(start); k != nil && bytes.Equal(k, start); k, v = c.Next() {
+			}
+		}
+		for ; k != nil && len(txs) < limit; k, v = c.Next() {
+			t, err := getBoltTransaction(tx, v)
+			if err != nil {
+				return errors.Wrap(err, "Failed to parse results from database")
+			}
+			if t != nil {
+				txs = append(txs, *t)
+			}
+		}
+		return nil
+	})
+	return txs, err
+}
+
+func (bs *BoltStore) UpdateTransactionStatus(t Transaction, fromStatus string) (bool, error) {
+	updated := false
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		existing, err := getBoltTransaction(tx, []byte(strings.ToLower(t.Hash)))
+		if err != nil || existing == nil || existing.Status != fromStatus {
+			return err
+		}
+		existing.Status = t.Status
+		existing.BlockHeight = t.BlockHeight
+		existing.Error = t.Error
+		existing.UpdatedAt = time.Now().UTC()
+		if err := putBoltTransaction(tx, *existing); err != nil {
+			return err
+		}
+		if existing.IsSettled() {
+			if err := tx.Bucket(unsettledTxsBucket).Delete(unsettledTxKey(*existing)); err != nil {
+				return err
+			}
+		}
+		updated = true
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	return updated, nil
+}
+
+func getBoltTransaction(tx *bolt.Tx, hash []byte) (*Transaction, error) {
+	v := tx.Bucket(txsBucket).Get(hash)
+	if v == nil {
+		return nil, nil
+	}
+	t := &Transaction{}
+	if err := json.Unmarshal(v, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func putBoltTransaction(tx *bolt.Tx, t Transaction) error {
+	v, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(txsBucket).Put([]byte(t.Hash), v)
+}
+
+func txIdempotencyKey(userid, key string) []byte {
+	return []byte(userid + "\x00" + key)
+}
+
+func unsettledTxKey(t Transaction) []byte {
+	key := make([]byte, 8, 8+len(t.Hash))
+	binary.BigEndian.PutUint64(key, uint64(t.CreatedAt.UnixNano()))
+	return append(key, t.Hash...)
+}
+
+// ----------------- DynamoDB ---------------------
+
+const (
+	// unsettledIndex is a sparse GSI over the transactions not settled yet, ordered
+	// by creation time. Only those transactions carry the unsettled attribute.
+	unsettledIndex = "unsettled-index"
+	// txIdempotencyIndex maps userid/idempotency_key to the transactions of the
+	// request.
+	txIdempotencyIndex = "idempotency-index"
+
+	txUnsettled = "true"
+)
+
+func (ds *DynamoStore) CreateTransaction(t Transaction) (bool, error) {
+	t.Hash = strings.ToLower(t.Hash)
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	item := map[string]*dynamodb.AttributeValue{
+		"hash":         {S: aws.String(t.Hash)},
+		"userid":       {S: aws.String(t.UserID)},
+		"role":         {S: aws.String(t.Role)},
+		"tx_type":      {S: aws.String(t.TxType)},
+		"raw":          {B: t.Raw},
+		"status":       {S: aws.String(t.Status)},
+		"block_height": {N: aws.String(strconv.FormatUint(t.BlockHeight, 10))},
+		"created_at":   {N: aws.String(now)},
+		"updated_at":   {N: aws.String(now)},
+	}
+	if t.IdempotencyKey != "" {
+		item["idempotency_key"] = &dynamodb.AttributeValue{S: aws.String(t.IdempotencyKey)}
+		item["user_key"] = &dynamodb.AttributeValue{S: aws.String(t.UserID + "/" + t.IdempotencyKey)}
+	}
+	if t.Error != "" {
+		item["error"] = &dynamodb.AttributeValue{S: aws.String(t.Error)}
+	}
+	if !t.IsSettled() {
+		item["unsettled"] = &dynamodb.AttributeValue{S: aws.String(txUnsettled)}
+	}
+	_, err := ds.client.PutItem(&dynamodb.PutItemInput{
+		TableName:                aws.String(ds.txsTable),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#hash)"),
+		ExpressionAttributeNames: map[string]*string{"#hash": aws.String("hash")},
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	return true, nil
+}
+
+func (ds *DynamoStore) FindTransaction(hash string) (Transaction, error) {
+	out, err := ds.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(ds.txsTable),
+		Key:            map[string]*dynamodb.AttributeValue{"hash": {S: aws.String(strings.ToLower(hash))}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Transaction{}, err
+	}
+	if len(out.Item) == 0 {
+		return Transaction{}, ErrNoRecord
+	}
+	return dynamoTransaction(out.Item), nil
+}
+
+// FindTransactionByIdempotencyKey reads a global secondary index, which may lag
+// behind writes of the last moments.
+func (ds *DynamoStore) FindTransactionByIdempotencyKey(userid, key string) (Transaction, error) {
+	out, err := ds.client.Query(&dynamodb.QueryInput{
+		TableName:                 aws.String(ds.txsTable),
+		IndexName:                 aws.String(txIdempotencyIndex),
+		KeyConditionExpression:    aws.String("user_key = :key"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":key": {S: aws.String(userid + "/" + key)}},
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int64(1),
+	})
+	if err != nil {
+		return Transaction{}, err
+	}
+	if len(out.Items) == 0 {
+		return Transaction{}, ErrNoRecord
+	}
+	return dynamoTransaction(out.Items[0]), nil
+}
+
+func (ds *DynamoStore) FindUnsettledTransactions(after Transaction, limit int) ([]Transaction, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(ds.txsTable),
+		IndexName:                 aws.String(unsettledIndex),
+		KeyConditionExpression:    aws.String("unsettled = :unsettled"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":unsettled": {S: aws.String(txUnsettled)}},
+		ScanIndexForward:          aws.Bool(true),
+	}
+	if after.Hash != "" {
+		input.KeyConditionExpression = aws.String("unsettled = :unsettled AND created_at >= :after")
+		input.ExpressionAttributeValues[":after"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(after.CreatedAt.UnixNano(), 10))}
+	}
+
+	var txs []Transaction
+	err := ds.client.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			t := dynamoTransaction(item)
+			// The index is ordered by creation time only; ties are ordered by hash.
+			if after.Hash != "" && t.CreatedAt.Equal(after.CreatedAt) && t.Hash <= after.Hash {
+				continue
+			}
+			txs = append(txs, t)
+			if len(txs) == limit {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+func (ds *DynamoStore) UpdateTransactionStatus(t Transaction, fromStatus string) (bool, error) {
+	update := "SET #status = :status, block_height = :height, updated_at = :now"
+	names := map[string]*string{"#status": aws.String("status")}
+	values := map[string]*dynamodb.AttributeValue{
+		":status": {S: aws.String(t.Status)},
+		":from":   {S: aws.String(fromStatus)},
+		":height": {N: aws.String(strconv.FormatUint(t.BlockHeight, 10))},
+		":now":    {N: aws.String(strconv.FormatInt(time.Now().UnixNano(), 10))},
+	}
+	if t.Error != "" {
+		update += ", #error = :error"
+		names["#error"] = aws.String("error")
+		values[":error"] = &dynamodb.AttributeValue{S: aws.String(t.Error)}
+	}
+	if t.IsSettled() {
+		update += " REMOVE unsettled"
+	}
+	_, err := ds.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(ds.txsTable),
+		Key:                       map[string]*dynamodb.AttributeValue{"hash": {S: aws.String(strings.ToLower(t.Hash))}},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("#status = :from"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to update database")
+	}
+	return true, nil
+}
+
+func dynamoTransaction(item map[string]*dynamodb.AttributeValue) Transaction {
+	var blockHeight uint64
+	if v, ok := item["block_height"]; ok {
+		blockHeight, _ = strconv.ParseUint(aws.StringValue(v.N), 10, 64)
+	}
+	return Transaction{
+		Hash:           stringAttr(item, "hash"),
+		UserID:         stringAttr(item, "userid"),
+		Role:           stringAttr(item, "role"),
+		TxType:         stringAttr(item, "tx_type"),
+		Raw:            bytesAttr(item, "raw"),
+		Status:         stringAttr(item, "status"),
+		IdempotencyKey: stringAttr(item, "idempotency_key"),
+		BlockHeight:    blockHeight,
+		Error:          stringAttr(item, "error"),
+		CreatedAt:      timeAttr(item, "created_at"),
+		UpdatedAt:      timeAttr(item, "updated_at"),
+	}
+}
+
+var (
+	_ TransactionStore = &DAO{}
+	_ TransactionStore = &BoltStore{}
+	_ TransactionStore = &DynamoStore{}
+)
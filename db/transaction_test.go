@@ -0,0 +1,84 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTransactionStore(t *testing.T, store TransactionStore) {
+	assert := assert.New(t)
+
+	hashes := []string{"0x01", "0x02", "0x03"}
+	for i, hash := range hashes {
+		created, err := store.CreateTransaction(Transaction{Hash: hash, UserID: "alice", Role: "SA", TxType: "send", Raw: []byte{byte(i)}, Status: TxPending, IdempotencyKey: hash + "-key"})
+		require.Nil(t, err)
+		assert.True(created)
+	}
+	created, err := store.CreateTransaction(Transaction{Hash: "0x01", UserID: "bob", Status: TxPending})
+	assert.Nil(err)
+	assert.False(created)
+
+	tx, err := store.FindTransaction("0x02")
+	assert.Nil(err)
+	assert.Equal("alice", tx.UserID)
+	assert.Equal([]byte{1}, tx.Raw)
+	assert.Equal(TxPending, tx.Status)
+	tx, err = store.FindTransactionByIdempotencyKey("alice", "0x03-key")
+	assert.Nil(err)
+	assert.Equal("0x03", tx.Hash)
+	_, err = store.FindTransactionByIdempotencyKey("bob", "0x03-key")
+	assert.Equal(ErrNoRecord, err)
+	_, err = store.FindTransaction("0x04")
+	assert.Equal(ErrNoRecord, err)
+
+	// Status changes apply only from the expected status.
+	updated, err := store.UpdateTransactionStatus(Transaction{Hash: "0x02", Status: TxFinalized, BlockHeight: 10}, TxIncluded)
+	assert.Nil(err)
+	assert.False(updated)
+	updated, err = store.UpdateTransactionStatus(Transaction{Hash: "0x02", Status: TxIncluded, BlockHeight: 10}, TxPending)
+	assert.Nil(err)
+	assert.True(updated)
+	updated, err = store.UpdateTransactionStatus(Transaction{Hash: "0x01", Status: TxFailed, Error: "dropped by the node"}, TxPending)
+	assert.Nil(err)
+	assert.True(updated)
+	tx, err = store.FindTransaction("0x01")
+	assert.Nil(err)
+	assert.Equal(TxFailed, tx.Status)
+	assert.Equal("dropped by the node", tx.Error)
+
+	// Settled transactions are no longer listed; the others are paged through.
+	lister, ok := store.(interface {
+		FindUnsettledTransactions(after Transaction, limit int) ([]Transaction, error)
+	})
+	require.True(t, ok)
+	var unsettled []string
+	var after Transaction
+	for {
+		txs, err := lister.FindUnsettledTransactions(after, 1)
+		require.Nil(t, err)
+		if len(txs) == 0 {
+			break
+		}
+		unsettled = append(unsettled, txs[0].Hash)
+		after = txs[0]
+	}
+	assert.ElementsMatch([]string{"0x02", "0x03"}, unsettled)
+}
+
+func TestDAOTransactions(t *testing.T) {
+	da := newTestDAO(t)
+	defer da.Close()
+	testTransactionStore(t, da)
+}
+
+func TestDynamoStoreTransactions(t *testing.T) {
+	testTransactionStore(t, newTestDynamoStore(t))
+}
+
+func TestBoltStoreTransactions(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+	testTransactionStore(t, bs)
+}
@@ -0,0 +1,101 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DataKeySize is the size in bytes of the per-record AES-256 data key.
+	DataKeySize = 32
+
+	// envelopeVersion is prepended to every wrapped data key so the format can evolve.
+	envelopeVersion byte = 1
+)
+
+var ErrInvalidCiphertext = errors.New("encryption: invalid ciphertext")
+
+// Envelope implements envelope encryption: every record is sealed with its own
+// random data key, and the data key is stored wrapped by the master key-encryption
+// key (KEK) obtained from a KeyProvider.
+type Envelope struct {
+	kek []byte
+}
+
+func NewEnvelope(provider KeyProvider) (*Envelope, error) {
+	kek, err := provider.MasterKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load master key")
+	}
+	if len(kek) != DataKeySize {
+		return nil, errors.Errorf("Master key must be %d bytes, got %d", DataKeySize, len(kek))
+	}
+	return &Envelope{kek: kek}, nil
+}
+
+// NewDataKey generates a fresh data key. It returns both the plaintext key, which
+// should only be held in memory, and the wrapped key to be persisted with the record.
+func (e *Envelope) NewDataKey() (dek []byte, wrapped []byte, err error) {
+	dek = make([]byte, DataKeySize)
+	if _, err = io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, nil, err
+	}
+	sealed, err := Seal(e.kek, dek, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped = append([]byte{envelopeVersion}, sealed...)
+	return dek, wrapped, nil
+}
+
+// UnwrapDataKey recovers the plaintext data key from its wrapped form.
+func (e *Envelope) UnwrapDataKey(wrapped []byte) ([]byte, error) {
+	if len(wrapped) == 0 || wrapped[0] != envelopeVersion {
+		return nil, ErrInvalidCiphertext
+	}
+	return Open(e.kek, wrapped[1:], nil)
+}
+
+// Seal encrypts plaintext with AES-256-GCM, authenticating additionalData along
+// with it: Open fails unless given the same additional data. The random nonce is
+// prepended to the output.
+func Seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypts a ciphertext produced by Seal with the same additional data.
+func Open(key, ciphertext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,40 @@
+package encryption
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	envelope, err := NewEnvelope(PassphraseKeyProvider{Passphrase: "qwertyuiop", Salt: []byte("salt")})
+	assert.Nil(err)
+
+	dek, wrapped, err := envelope.NewDataKey()
+	assert.Nil(err)
+	assert.Equal(DataKeySize, len(dek))
+
+	unwrapped, err := envelope.UnwrapDataKey(wrapped)
+	assert.Nil(err)
+	assert.Equal(dek, unwrapped)
+
+	sealed, err := Seal(dek, []byte("private key"), []byte("alice|SA"))
+	assert.Nil(err)
+	opened, err := Open(dek, sealed, []byte("alice|SA"))
+	assert.Nil(err)
+	assert.Equal([]byte("private key"), opened)
+
+	// Sealed data only opens with the additional data it was sealed with.
+	_, err = Open(dek, sealed, []byte("bob|SA"))
+	assert.Equal(ErrInvalidCiphertext, err)
+	_, err = Open(dek, sealed, nil)
+	assert.Equal(ErrInvalidCiphertext, err)
+
+	// A different master key must not unwrap the data key.
+	other, err := NewEnvelope(PassphraseKeyProvider{Passphrase: "asdfghjkl", Salt: []byte("salt")})
+	assert.Nil(err)
+	_, err = other.UnwrapDataKey(wrapped)
+	assert.Equal(ErrInvalidCiphertext, err)
+}
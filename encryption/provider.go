@@ -0,0 +1,92 @@
+package encryption
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/thetatoken/vault/util"
+)
+
+const (
+	ProviderNone       = "none"
+	ProviderFile       = "file"
+	ProviderPassphrase = "passphrase"
+)
+
+// KeyProvider supplies the master key-encryption key used to wrap data keys.
+type KeyProvider interface {
+	MasterKey() ([]byte, error)
+}
+
+// ----------------- File KeyProvider ---------------------
+
+var _ KeyProvider = FileKeyProvider{}
+
+// FileKeyProvider reads a hex encoded 32-byte master key from a local file.
+type FileKeyProvider struct {
+	Path string
+}
+
+func (p FileKeyProvider) MasterKey() ([]byte, error) {
+	content, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Master key file %s is not hex encoded", p.Path)
+	}
+	return key, nil
+}
+
+// ----------------- Passphrase KeyProvider ---------------------
+
+var _ KeyProvider = PassphraseKeyProvider{}
+
+// PassphraseKeyProvider derives the master key from a passphrase and salt with scrypt.
+type PassphraseKeyProvider struct {
+	Passphrase string
+	Salt       []byte
+}
+
+func (p PassphraseKeyProvider) MasterKey() ([]byte, error) {
+	if p.Passphrase == "" {
+		return nil, errors.New("Passphrase is empty")
+	}
+	if len(p.Salt) == 0 {
+		return nil, errors.New("Salt is empty")
+	}
+	return scrypt.Key([]byte(p.Passphrase), p.Salt, 1<<15, 8, 1, DataKeySize)
+}
+
+// NewEnvelopeFromConfig creates the Envelope for the configured key provider. It
+// returns nil if encryption at rest is disabled.
+func NewEnvelopeFromConfig() (*Envelope, error) {
+	var provider KeyProvider
+
+	switch name := viper.GetString(util.CfgEncryptionProvider); name {
+	case "", ProviderNone:
+		log.Warn("Encryption at rest is disabled. Private keys are stored in plaintext.")
+		return nil, nil
+	case ProviderFile:
+		provider = FileKeyProvider{Path: viper.GetString(util.CfgEncryptionKeyFile)}
+	case ProviderPassphrase:
+		salt, err := hex.DecodeString(viper.GetString(util.CfgEncryptionSalt))
+		if err != nil {
+			return nil, errors.Wrap(err, "Salt is not hex encoded")
+		}
+		provider = PassphraseKeyProvider{
+			Passphrase: viper.GetString(util.CfgEncryptionPassphrase),
+			Salt:       salt,
+		}
+	default:
+		return nil, errors.Errorf("Unknown encryption provider: %s", name)
+	}
+	return NewEnvelope(provider)
+}
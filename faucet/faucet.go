@@ -14,12 +14,12 @@ import (
 )
 
 type FaucetManager struct {
-	da                   *db.DAO
+	da                   db.Store
 	client               *rpcc.RPCClient
 	processedUserInBatch int
 }
 
-func NewFaucetManager(da *db.DAO, client *rpcc.RPCClient) *FaucetManager {
+func NewFaucetManager(da db.Store, client *rpcc.RPCClient) *FaucetManager {
 	return &FaucetManager{
 		da:                   da,
 		client:               client,
@@ -0,0 +1,259 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	json "github.com/gorilla/rpc/v2/json2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/policy"
+)
+
+var errNoKeyRotation = errors.New("Key rotation is not supported by the database")
+
+// KeyRotator starts key rotations requested by admins. *rotation.Manager
+// implements it.
+type KeyRotator interface {
+	StartByAdmin(userid, actor string) (db.Rotation, error)
+}
+
+// AdminRPCHandler serves operations on user keys reserved to admins. Every request
+// must carry the configured admin token in the X-Admin-Token header.
+type AdminRPCHandler struct {
+	KeyManager keymanager.KeyManager
+	Limits     db.LimitStore // Nil if the database does not support spending limits.
+	Rotations  KeyRotator    // Nil if the database does not support key rotation.
+	token      string
+}
+
+func NewAdminRPCHandler(km keymanager.KeyManager, token string) *AdminRPCHandler {
+	return &AdminRPCHandler{
+		KeyManager: km,
+		token:      token,
+	}
+}
+
+// authorize checks the admin token of the request and returns the actor recorded
+// in the audit trail.
+func (h *AdminRPCHandler) authorize(r *http.Request) (string, error) {
+	token := r.Header.Get("X-Admin-Token")
+	if h.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		log.WithFields(log.Fields{"method": "admin.authorize", "remote_addr": r.RemoteAddr}).Warn("Rejected admin request")
+		return "", &json.Error{
+			Code:    ErrCodeUnauthorized,
+			Message: "unauthorized",
+		}
+	}
+	actor := r.Header.Get("X-Admin-User")
+	if actor == "" {
+		actor = "unknown"
+	}
+	return actor + "@" + r.RemoteAddr, nil
+}
+
+// ------------------------------- BatchCreateAccounts -----------------------------------
+
+// maxBatchCreateAccounts caps the number of accounts created in one BatchCreateAccounts call.
+const maxBatchCreateAccounts = 1000
+
+type BatchCreateAccountsArgs struct {
+	UserIDs []string `json:"user_ids"` // Required. Users to create accounts for.
+}
+
+type BatchCreateAccountResult struct {
+	CreateAccountResult
+	Error string `json:"error,omitempty"` // Reason the account could not be created.
+}
+
+type BatchCreateAccountsResult struct {
+	Accounts []BatchCreateAccountResult `json:"accounts"`
+}
+
+func (h *AdminRPCHandler) BatchCreateAccounts(r *http.Request, args *BatchCreateAccountsArgs, result *BatchCreateAccountsResult) error {
+	actor, err := h.authorize(r)
+	if err != nil {
+		return err
+	}
+	if len(args.UserIDs) == 0 {
+		return errors.New("No user_ids are passed in")
+	}
+	if len(args.UserIDs) > maxBatchCreateAccounts {
+		return errors.Errorf("Too many user_ids: %d, max %d", len(args.UserIDs), maxBatchCreateAccounts)
+	}
+	log.WithFields(log.Fields{"method": "admin.BatchCreateAccounts", "actor": actor, "count": len(args.UserIDs)}).Info("Creating accounts")
+
+	// Failures are reported per user so one bad ID doesn't fail the whole batch.
+	for _, userid := range args.UserIDs {
+		item := BatchCreateAccountResult{}
+		if userid == "" {
+			item.Error = "empty user_id"
+		} else if res, err := createAccount(h.KeyManager, userid); err != nil {
+			item.UserID = userid
+			item.Error = err.Error()
+		} else {
+			item.CreateAccountResult = res
+		}
+		result.Accounts = append(result.Accounts, item)
+	}
+	return nil
+}
+
+// ------------------------------- ExportKeys -----------------------------------
+
+type ExportKeysArgs struct {
+	UserID   string `json:"user_id"`  // Required. User whose keys are exported.
+	Password string `json:"password"` // Required. Password the keystores are encrypted with.
+}
+
+type ExportKeysResult struct {
+	UserID string `json:"user_id"`
+	keymanager.ExportedKeys
+}
+
+func (h *AdminRPCHandler) ExportKeys(r *http.Request, args *ExportKeysArgs, result *ExportKeysResult) error {
+	actor, err := h.authorize(r)
+	if err != nil {
+		return err
+	}
+	if args.UserID == "" {
+		return errors.New("No user_id is passed in")
+	}
+	if len(args.Password) < keymanager.MinKeystorePasswordLength {
+		return errors.Errorf("Password must be at least %d characters", keymanager.MinKeystorePasswordLength)
+	}
+	keys, err := h.KeyManager.ExportKeys(args.UserID, args.Password, actor)
+	if err != nil {
+		return keyManagerError(args.UserID, err)
+	}
+	result.UserID = args.UserID
+	result.ExportedKeys = keys
+	return nil
+}
+
+// ------------------------------- ImportKeys -----------------------------------
+
+type ImportKeysArgs struct {
+	UserID   string `json:"user_id"`  // Required. User to create the account for.
+	Password string `json:"password"` // Required. Password the keystores are encrypted with.
+	keymanager.ExportedKeys
+}
+
+type ImportKeysResult struct {
+	UserID      string `json:"user_id"`
+	SendAddress string `json:"send_address"`
+	RecvAddress string `json:"recv_address"`
+}
+
+func (h *AdminRPCHandler) ImportKeys(r *http.Request, args *ImportKeysArgs, result *ImportKeysResult) error {
+	actor, err := h.authorize(r)
+	if err != nil {
+		return err
+	}
+	if args.UserID == "" {
+		return errors.New("No user_id is passed in")
+	}
+	if args.SendAccount == nil || args.RecvAccount == nil {
+		return errors.New("Both send_account and recv_account keystores are required")
+	}
+	record, err := h.KeyManager.ImportKeys(args.UserID, args.ExportedKeys, args.Password, actor)
+	if err != nil {
+		return keyManagerError(args.UserID, err)
+	}
+	result.UserID = record.UserID
+	result.SendAddress = record.SaAddress.String()
+	result.RecvAddress = record.RaAddress.String()
+	return nil
+}
+
+// ------------------------------- RotateKeys -----------------------------------
+
+type RotateKeysArgs struct {
+	UserID string `json:"user_id"` // Required. User whose keys are replaced.
+}
+
+type RotateKeysResult struct {
+	UserID      string `json:"user_id"`
+	RotationID  int64  `json:"rotation_id"`
+	State       string `json:"state"`
+	SendAddress string `json:"send_address"` // Address of the new send account.
+	RecvAddress string `json:"recv_address"` // Address of the new receive account.
+}
+
+// RotateKeys starts a rotation of the keys of a user, which vault then carries out
+// in the background like those started with `vault rotate-keys`.
+func (h *AdminRPCHandler) RotateKeys(r *http.Request, args *RotateKeysArgs, result *RotateKeysResult) error {
+	actor, err := h.authorize(r)
+	if err != nil {
+		return err
+	}
+	if h.Rotations == nil {
+		return errNoKeyRotation
+	}
+	if args.UserID == "" {
+		return errors.New("No user_id is passed in")
+	}
+	rotation, err := h.Rotations.StartByAdmin(args.UserID, actor)
+	if err != nil {
+		return keyManagerError(args.UserID, err)
+	}
+	result.UserID = rotation.UserID
+	result.RotationID = rotation.ID
+	result.State = rotation.State
+	result.SendAddress = rotation.NewKeys.SaAddress.String()
+	result.RecvAddress = rotation.NewKeys.RaAddress.String()
+	return nil
+}
+
+// ------------------------------- SetSpendingLimits -----------------------------------
+
+type SetSpendingLimitsArgs struct {
+	UserID         string `json:"user_id"` // Required. User whose limits are set.
+	Tier           string `json:"tier"`    // Optional. Tier of the user. Default to the default tier.
+	SpendingLimits        // Optional. Limits of the user overriding those of the tier.
+}
+
+type SetSpendingLimitsResult struct {
+	UserID string         `json:"user_id"`
+	Tier   string         `json:"tier"`
+	Limits SpendingLimits `json:"limits"` // Limits of the user, overrides applied.
+}
+
+// SetSpendingLimits assigns a user to a tier and replaces the overrides of the
+// user.
+func (h *AdminRPCHandler) SetSpendingLimits(r *http.Request, args *SetSpendingLimitsArgs, result *SetSpendingLimitsResult) error {
+	actor, err := h.authorize(r)
+	if err != nil {
+		return err
+	}
+	if h.Limits == nil {
+		return errNoSpendingLimits
+	}
+	if args.UserID == "" {
+		return errors.New("No user_id is passed in")
+	}
+	if args.Tier != "" {
+		if _, err := policy.TierLimits(args.Tier); err != nil {
+			return err
+		}
+	}
+	overrides, err := dbLimits(args.SpendingLimits)
+	if err != nil {
+		return err
+	}
+	if err := h.Limits.SaveUserLimits(db.UserLimits{UserID: args.UserID, Tier: args.Tier, Overrides: overrides}); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"method": "admin.SetSpendingLimits", "userid": args.UserID, "tier": args.Tier, "actor": actor}).Info("Set spending limits")
+
+	tier, limits, err := policy.UserLimits(h.Limits, args.UserID)
+	if err != nil {
+		return err
+	}
+	result.UserID = args.UserID
+	result.Tier = tier
+	result.Limits = spendingLimits(limits)
+	return nil
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/policy"
+	"github.com/thetatoken/vault/util"
+)
+
+var errNoAllowlists = policy.ErrNoAllowlists
+
+// ------------------------------- AddWithdrawalAddress -----------------------------------
+
+type AddWithdrawalAddressArgs struct {
+	Address string `json:"address"` // Required. External address to allow sends to.
+	Label   string `json:"label"`   // Optional. Note for the user, e.g. the name of an exchange.
+}
+
+type WithdrawalAddress struct {
+	Address   string `json:"address"`
+	Label     string `json:"label"`
+	CreatedAt int64  `json:"created_at"` // Unix time the address was added.
+	ActiveAt  int64  `json:"active_at"`  // Unix time from which the address can be sent to.
+	Active    bool   `json:"active"`
+}
+
+type AddWithdrawalAddressResult struct {
+	WithdrawalAddress
+	Added bool `json:"added"` // False if the address was already allowed.
+}
+
+// AddWithdrawalAddress allows sends to an external address once the configured
+// delay has passed, and notifies the configured webhook. Adding an allowed address
+// again does not reset its delay.
+func (h *ThetaRPCHandler) AddWithdrawalAddress(r *http.Request, args *AddWithdrawalAddressArgs, result *AddWithdrawalAddressResult) error {
+	if h.Allowlists == nil {
+		return errNoAllowlists
+	}
+	if !tcmn.IsHexAddress(args.Address) {
+		return errors.Errorf("Invalid address: %s", args.Address)
+	}
+	record, err := h.getRecord(r)
+	if err != nil {
+		return err
+	}
+
+	entry, added, err := policy.AddWithdrawalAddress(h.Allowlists, record.UserID, tcmn.HexToAddress(args.Address), args.Label)
+	if err != nil {
+		return err
+	}
+	result.WithdrawalAddress = withdrawalAddress(entry)
+	result.Added = added
+	if added {
+		go policy.NotifyWithdrawalAddressAdded(r.Header.Get(util.RequestIDHeader), entry)
+	}
+	return nil
+}
+
+// ------------------------------- ListWithdrawalAddresses -----------------------------------
+
+type ListWithdrawalAddressesArgs struct{}
+
+type ListWithdrawalAddressesResult struct {
+	Addresses []WithdrawalAddress `json:"addresses"`
+}
+
+func (h *ThetaRPCHandler) ListWithdrawalAddresses(r *http.Request, args *ListWithdrawalAddressesArgs, result *ListWithdrawalAddressesResult) error {
+	if h.Allowlists == nil {
+		return errNoAllowlists
+	}
+	record, err := h.getRecord(r)
+	if err != nil {
+		return err
+	}
+	entries, err := h.Allowlists.ListWithdrawalAddresses(record.UserID)
+	if err != nil {
+		return err
+	}
+	result.Addresses = []WithdrawalAddress{}
+	for _, entry := range entries {
+		result.Addresses = append(result.Addresses, withdrawalAddress(entry))
+	}
+	return nil
+}
+
+// ------------------------------- RemoveWithdrawalAddress -----------------------------------
+
+type RemoveWithdrawalAddressArgs struct {
+	Address string `json:"address"` // Required.
+}
+
+type RemoveWithdrawalAddressResult struct {
+	Removed bool `json:"removed"` // False if the address was not allowed.
+}
+
+// RemoveWithdrawalAddress disallows sends to an address immediately.
+func (h *ThetaRPCHandler) RemoveWithdrawalAddress(r *http.Request, args *RemoveWithdrawalAddressArgs, result *RemoveWithdrawalAddressResult) error {
+	if h.Allowlists == nil {
+		return errNoAllowlists
+	}
+	if !tcmn.IsHexAddress(args.Address) {
+		return errors.Errorf("Invalid address: %s", args.Address)
+	}
+	record, err := h.getRecord(r)
+	if err != nil {
+		return err
+	}
+	result.Removed, err = h.Allowlists.RemoveWithdrawalAddress(record.UserID, tcmn.HexToAddress(args.Address))
+	return err
+}
+
+// checkWithdrawalAddress returns an error unless the user may send to the address.
+// See policy.CheckWithdrawalAddress.
+func (h *ThetaRPCHandler) checkWithdrawalAddress(userid, to string) error {
+	return policyError(policy.CheckWithdrawalAddress(h.Allowlists, userid, tcmn.HexToAddress(to)))
+}
+
+// checkTxDestinations checks every address tx pays against the allowlist of the
+// user.
+func (h *ThetaRPCHandler) checkTxDestinations(userid string, tx ttypes.Tx) error {
+	return policyError(policy.CheckTxDestinations(h.Allowlists, userid, tx))
+}
+
+func withdrawalAddress(entry db.WithdrawalAddress) WithdrawalAddress {
+	return WithdrawalAddress{
+		Address:   entry.Address.Hex(),
+		Label:     entry.Label,
+		CreatedAt: entry.CreatedAt.Unix(),
+		ActiveAt:  entry.ActiveAt.Unix(),
+		Active:    !time.Now().Before(entry.ActiveAt),
+	}
+}
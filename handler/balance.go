@@ -0,0 +1,39 @@
+package handler
+
+import (
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+)
+
+// checkBalance returns the amount tx takes from the balance of address, or an
+// insufficient funds error if that exceeds the available balance.
+func checkBalance(address tcmn.Address, tx ttypes.Tx, available ttypes.Coins) (ttypes.Coins, error) {
+	required := spending(address, tx)
+	if !available.NoNil().IsGTE(required) {
+		return ttypes.Coins{}, insufficientFundsError(address, required, available)
+	}
+	return required, nil
+}
+
+// spending returns the amount tx takes from the balance of address, fee included.
+func spending(address tcmn.Address, tx ttypes.Tx) ttypes.Coins {
+	spent := ttypes.Coins{}.NoNil()
+	switch tx := tx.(type) {
+	case *ttypes.SendTx:
+		// Inputs include the fee.
+		for _, input := range tx.Inputs {
+			if input.Address == address {
+				spent = spent.Plus(input.Coins.NoNil())
+			}
+		}
+	case *ttypes.ReserveFundTx:
+		spent = spent.Plus(tx.Source.Coins.NoNil()).Plus(tx.Collateral.NoNil()).Plus(tx.Fee.NoNil())
+	case *ttypes.ReleaseFundTx:
+		spent = spent.Plus(tx.Fee.NoNil())
+	case *ttypes.SplitRuleTx:
+		spent = spent.Plus(tx.Fee.NoNil())
+	case *ttypes.ServicePaymentTx:
+		// The fee comes out of the payment received.
+	}
+	return spent
+}
@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"math"
+	"math/big"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	tcmn "github.com/thetatoken/ukulele/common"
+	crypto "github.com/thetatoken/ukulele/crypto"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/sequence"
+	"github.com/thetatoken/vault/util"
+)
+
+// ------------------------------- BatchSend -----------------------------------
+
+// signatureSize is the size of the recoverable secp256k1 signatures of inputs.
+const signatureSize = 65
+
+type Recipient struct {
+	To     string       `json:"to"`     // Required. Address to pay.
+	Amount ttypes.Coins `json:"amount"` // Required. The amount to send.
+}
+
+type BatchSendArgs struct {
+	Role           string        `json:"role"`            // Optional. Account to send from, RA (default) or SA.
+	Recipients     []Recipient   `json:"recipients"`      // Required.
+	Total          *ttypes.Coins `json:"total"`           // Optional. Checked against the sum of the amounts if set.
+	Fee            *tcmn.JSONBig `json:"fee"`             // Optional. Fee of each transaction. Default to the minimum.
+	IdempotencyKey string        `json:"idempotency_key"` // Optional. Replays of the request with the same key return the original result.
+	DryRun         bool          `json:"dry_run"`         // Optional. Sign the transactions and return them without broadcasting them.
+}
+
+// BatchSendTx is one of the transactions a batch is split into.
+type BatchSendTx struct {
+	BroadcastResult
+	First    int             `json:"first"` // Index of the first recipient paid by the transaction.
+	Count    int             `json:"count"` // Number of recipients paid by the transaction.
+	Sequence tcmn.JSONUint64 `json:"sequence"`
+}
+
+type BatchSendResult struct {
+	Transactions []BatchSendTx `json:"transactions"`
+}
+
+// BatchSend pays many recipients with multi-output send transactions, split so that
+// no signed transaction is larger than the configured size. Transactions are
+// sent in order; if one fails, the ones sent before it are reported in the error
+// data.
+func (h *ThetaRPCHandler) BatchSend(r *http.Request, args *BatchSendArgs, result *BatchSendResult) (err error) {
+	role := keymanager.RecvAccount
+	switch args.Role {
+	case "", string(keymanager.RecvAccount):
+	case string(keymanager.SendAccount):
+		role = keymanager.SendAccount
+	default:
+		return errors.Errorf("Invalid role: %s", args.Role)
+	}
+	outputs, total, err := batchOutputs(args)
+	if err != nil {
+		return err
+	}
+	signer, err := h.getSigner(r, role)
+	if err != nil {
+		return err
+	}
+	userid := r.Header.Get("X-Auth-User")
+
+	feeAmount := new(big.Int).SetUint64(ttypes.MinimumTransactionFeeGammaWei)
+	if args.Fee != nil {
+		feeAmount = (*big.Int)(args.Fee)
+	}
+	fee := ttypes.Coins{ThetaWei: ttypes.Zero, GammaWei: feeAmount}
+
+	batches, err := splitOutputs(outputs, fee, signer, viper.GetInt(util.CfgBatchSendMaxTxBytes))
+	if err != nil {
+		return err
+	}
+
+	required := total.Plus(ttypes.Coins{
+		ThetaWei: ttypes.Zero,
+		GammaWei: new(big.Int).Mul(feeAmount, big.NewInt(int64(len(batches)))),
+	})
+	// checkTotal makes sure the whole batch is affordable before any part of it
+	// is signed.
+	checkTotal := func() (sequence.Allocation, error) {
+		alloc, err := h.Sequences.Peek(signer.Address())
+		if err != nil {
+			return alloc, err
+		}
+		if !alloc.Available.NoNil().IsGTE(required) {
+			return alloc, insufficientFundsError(signer.Address(), required, alloc.Available)
+		}
+		return alloc, nil
+	}
+
+	// checkRecipients rejects the whole batch if any recipient is not allowed.
+	checkRecipients := func() error {
+		for _, output := range outputs {
+			if err := h.checkWithdrawalAddress(userid, output.Address.Hex()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	result.Transactions = []BatchSendTx{}
+	if args.DryRun {
+		if err := checkRecipients(); err != nil {
+			return err
+		}
+		alloc, err := checkTotal()
+		if err != nil {
+			return err
+		}
+		seq := tcmn.JSONUint64(alloc.Sequence)
+		first := 0
+		for _, batch := range batches {
+			item := BatchSendTx{First: first, Count: len(batch), Sequence: seq}
+			item.DryRun, err = h.dryRunTx(r, userid, role, signer, &item.Sequence, func() (ttypes.Tx, error) {
+				return prepareBatchSendTx(batch, fee, signer, uint64(item.Sequence))
+			})
+			if err != nil {
+				return err
+			}
+			result.Transactions = append(result.Transactions, item)
+			first += len(batch)
+			seq++
+		}
+		return nil
+	}
+
+	return h.idempotent(r, userid, "BatchSend", args.IdempotencyKey, args, result, func(r *http.Request) (err error) {
+		if err := checkRecipients(); err != nil {
+			return err
+		}
+		if _, err := checkTotal(); err != nil {
+			return err
+		}
+		first := 0
+		for _, batch := range batches {
+			item := BatchSendTx{First: first, Count: len(batch)}
+			item.Retries, err = h.submitTx(r, userid, role, signer, &item.Sequence, func() (ttypes.Tx, error) {
+				return prepareBatchSendTx(batch, fee, signer, uint64(item.Sequence))
+			}, &item.BroadcastResult)
+			if err != nil {
+				if len(result.Transactions) > 0 {
+					return batchIncompleteError(err, result.Transactions)
+				}
+				return err
+			}
+			result.Transactions = append(result.Transactions, item)
+			first += len(batch)
+			if req := idempotentRequestFrom(r); req != nil {
+				// Part of the batch is on its way, replays must not send it again.
+				req.mayBeBroadcast = true
+			}
+		}
+		return nil
+	})
+}
+
+// splitOutputs splits outputs, in order, into as few send transactions of at most
+// maxBytes each. Sizes are measured on transactions encoded with the public key, a
+// signature and the largest sequence, so the transactions signed are no larger.
+func splitOutputs(outputs []ttypes.TxOutput, fee ttypes.Coins, signer keymanager.Signer, maxBytes int) ([][]ttypes.TxOutput, error) {
+	if maxBytes <= 0 {
+		return nil, errors.Errorf("%s must be positive, got %d", util.CfgBatchSendMaxTxBytes, maxBytes)
+	}
+	var batches [][]ttypes.TxOutput
+	for start := 0; start < len(outputs); {
+		end := start
+		for end < len(outputs) {
+			size, err := batchTxSize(outputs[start:end+1], fee, signer)
+			if err != nil {
+				return nil, err
+			}
+			if size > maxBytes {
+				break
+			}
+			end++
+		}
+		if end == start {
+			return nil, errors.Errorf("Recipient %d does not fit in a transaction of %s bytes", start, util.CfgBatchSendMaxTxBytes)
+		}
+		batches = append(batches, outputs[start:end])
+		start = end
+	}
+	return batches, nil
+}
+
+// batchTxSize returns the largest size the send transaction paying outputs can be
+// once signed.
+func batchTxSize(outputs []ttypes.TxOutput, fee ttypes.Coins, signer keymanager.Signer) (int, error) {
+	sig, err := crypto.SignatureFromBytes(make([]byte, signatureSize))
+	if err != nil {
+		return 0, err
+	}
+	amount := fee
+	for _, output := range outputs {
+		amount = amount.Plus(output.Coins)
+	}
+	raw, err := ttypes.TxToBytes(&ttypes.SendTx{
+		Fee: fee,
+		Inputs: []ttypes.TxInput{{
+			Address:   signer.Address(),
+			Coins:     amount,
+			Sequence:  math.MaxUint64,
+			Signature: sig,
+			PubKey:    signer.PublicKey(),
+		}},
+		Outputs: outputs,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(raw), nil
+}
+
+// batchOutputs validates the recipients of a batch and returns the outputs paying
+// them, with their total.
+func batchOutputs(args *BatchSendArgs) ([]ttypes.TxOutput, ttypes.Coins, error) {
+	if len(args.Recipients) == 0 {
+		return nil, ttypes.Coins{}, errors.New("No recipients are passed in")
+	}
+	total := ttypes.Coins{}.NoNil()
+	outputs := make([]ttypes.TxOutput, 0, len(args.Recipients))
+	for idx, recipient := range args.Recipients {
+		if !tcmn.IsHexAddress(recipient.To) {
+			return nil, ttypes.Coins{}, errors.Errorf("Invalid address of recipient %d: %s", idx, recipient.To)
+		}
+		amount := recipient.Amount.NoNil()
+		if !amount.IsPositive() {
+			return nil, ttypes.Coins{}, errors.Errorf("Invalid amount of recipient %d", idx)
+		}
+		total = total.Plus(amount)
+		outputs = append(outputs, ttypes.TxOutput{
+			Address: tcmn.HexToAddress(recipient.To),
+			Coins:   amount,
+		})
+	}
+	if args.Total != nil {
+		expected := args.Total.NoNil()
+		if expected.ThetaWei.Cmp(total.ThetaWei) != 0 || expected.GammaWei.Cmp(total.GammaWei) != 0 {
+			return nil, ttypes.Coins{}, errors.Errorf("Total %v doesn't match the sum of the amounts %v", expected, total)
+		}
+	}
+	return outputs, total, nil
+}
+
+func prepareBatchSendTx(outputs []ttypes.TxOutput, fee ttypes.Coins, signer keymanager.Signer, sequence uint64) (*ttypes.SendTx, error) {
+	amount := fee
+	for _, output := range outputs {
+		amount = amount.Plus(output.Coins)
+	}
+	inputs := []ttypes.TxInput{{
+		Address:  signer.Address(),
+		Coins:    amount,
+		Sequence: sequence,
+	}}
+	if sequence == 1 {
+		inputs[0].PubKey = signer.PublicKey()
+	}
+	sendTx := &ttypes.SendTx{
+		Fee:     fee,
+		Inputs:  inputs,
+		Outputs: outputs,
+	}
+
+	return sendTx, nil
+}
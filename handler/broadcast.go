@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tcmn "github.com/thetatoken/ukulele/common"
+	crypto "github.com/thetatoken/ukulele/crypto"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	ukulele "github.com/thetatoken/ukulele/rpc"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/sequence"
+	"github.com/thetatoken/vault/util"
+	rpcc "github.com/ybbus/jsonrpc"
+)
+
+// sequenceMismatchRegexp matches the errors Theta nodes return for transactions
+// with a stale or future sequence.
+var sequenceMismatchRegexp = regexp.MustCompile(`(?i)invalid sequence|got \d+, expected \d+`)
+
+type BroadcastResult struct {
+	*ukulele.BroadcastRawTransactionResult
+	Retries *BroadcastRetries `json:"retries,omitempty"` // Set if the transaction had to be retried.
+	DryRun  *DryRunResult     `json:"dry_run,omitempty"` // Set instead of the broadcast result for dry runs.
+}
+
+// BroadcastRetries reports how a transaction got accepted after failed attempts.
+type BroadcastRetries struct {
+	SequenceMismatches int             `json:"sequence_mismatches"` // Times the transaction was re-signed with a refreshed sequence.
+	NetworkErrors      int             `json:"network_errors"`      // Times broadcasting failed to reach the node.
+	Sequence           tcmn.JSONUint64 `json:"sequence"`            // Sequence of the transaction accepted.
+}
+
+// networkError marks failures to reach the Theta node, as opposed to errors
+// returned by the node.
+type networkError struct {
+	error
+}
+
+func isSequenceMismatch(err error) bool {
+	rpcErr, ok := err.(*rpcc.RPCError)
+	return ok && sequenceMismatchRegexp.MatchString(rpcErr.Message)
+}
+
+// submitTx signs and broadcasts a transaction from the account of the signer.
+// prepare returns the transaction unsigned. A zero sequence is replaced with the
+// next one allocated for the account before prepare is called; submissions from
+// the same account are serialized. Transactions the account cannot pay for, or
+// paying addresses off the allowlist of the user, are rejected before being
+// signed. The SA is topped up from the RA afterwards if the top-up policy asks for
+// it.
+//
+// Broadcasts failing to reach the node are retried with exponential backoff. A
+// transaction rejected for its sequence is re-signed with the sequence following
+// the one confirmed on chain, unless the caller chose the sequence or an earlier
+// attempt may have reached the node: the rejection may then come from the same
+// payment being committed already. The retries are returned if any were needed.
+func (h *ThetaRPCHandler) submitTx(r *http.Request, userid string, role keymanager.AccountRole, signer keymanager.Signer, seq *tcmn.JSONUint64, prepare func() (ttypes.Tx, error), result interface{}) (*BroadcastRetries, error) {
+	logger := log.WithFields(log.Fields{"method": "submitTx", "userid": userid, "role": role, "request_id": r.Header.Get(util.RequestIDHeader)})
+
+	maxAttempts := viper.GetInt(util.CfgBroadcastMaxAttempts)
+	retries := &BroadcastRetries{}
+	explicit := uint64(*seq)
+	callerChose := explicit != 0
+	for {
+		_, err := h.Sequences.Submit(signer.Address(), explicit, func(alloc sequence.Allocation) (spent ttypes.Coins, err error) {
+			*seq = tcmn.JSONUint64(alloc.Sequence)
+			tx, err := prepare()
+			if err != nil {
+				return ttypes.Coins{}, err
+			}
+			if err := h.checkTxDestinations(userid, tx); err != nil {
+				return ttypes.Coins{}, err
+			}
+			spent, err = checkBalance(signer.Address(), tx, alloc.Available)
+			if err != nil {
+				return ttypes.Coins{}, err
+			}
+			charged, err := h.txSpending(userid, tx)
+			if err != nil {
+				return ttypes.Coins{}, err
+			}
+			if err := h.chargeLimits(charged); err != nil {
+				return ttypes.Coins{}, err
+			}
+			defer func() {
+				// Transactions that may have reached the node stay charged.
+				if _, ok := err.(networkError); err != nil && !ok && retries.NetworkErrors == 0 {
+					h.refundLimits(r, charged)
+				}
+			}()
+			if err := signer.SignTx(tx, r.Header.Get(util.RequestIDHeader)); err != nil {
+				// Remote signers enforce the policies of their own database.
+				return ttypes.Coins{}, policyError(err)
+			}
+			tracked, err := h.trackTx(r, userid, role, tx)
+			if err != nil {
+				return ttypes.Coins{}, err
+			}
+			if req := idempotentRequestFrom(r); req != nil {
+				if req.txHash, err = txHash(tx); err != nil {
+					return ttypes.Coins{}, err
+				}
+			}
+			err = h.broadcastWithBackoff(tx, result, retries, maxAttempts)
+			if _, ok := err.(*rpcc.RPCError); ok && tracked != nil {
+				// Rejected by the node. Transactions that failed to reach it stay
+				// pending until the tracker finds them or gives up.
+				tracked.Status = db.TxFailed
+				tracked.Error = err.Error()
+				if _, updateErr := h.Txs.UpdateTransactionStatus(*tracked, db.TxPending); updateErr != nil {
+					logger.WithFields(log.Fields{"hash": tracked.Hash, "error": updateErr}).Error("Failed to mark transaction failed")
+				}
+			}
+			return spent, err
+		})
+		if err == nil {
+			break
+		}
+		if _, ok := err.(networkError); ok || retries.NetworkErrors > 0 {
+			if req := idempotentRequestFrom(r); req != nil {
+				req.mayBeBroadcast = true
+			}
+		}
+		if !isSequenceMismatch(err) {
+			return nil, err
+		}
+		// Pending sequences vault tracks for the account are off too.
+		h.Sequences.Reset(signer.Address())
+		if callerChose || retries.NetworkErrors > 0 || retries.SequenceMismatches+1 >= maxAttempts {
+			return nil, err
+		}
+
+		confirmed, fetchErr := util.GetSequence(h.Client, signer.Address())
+		if fetchErr != nil && !util.IsAccountNotFound(fetchErr) {
+			logger.WithFields(log.Fields{"error": fetchErr}).Error("Failed to refresh sequence")
+			return nil, err
+		}
+		retries.SequenceMismatches++
+		logger.WithFields(log.Fields{"sequence": *seq, "confirmed": confirmed, "error": err}).Warn("Sequence mismatch, re-signing")
+		explicit = confirmed + 1
+	}
+
+	if role == keymanager.SendAccount {
+		// The top-up is a request of its own, not part of an idempotent one.
+		go h.topUpSendAccount(r.WithContext(context.Background()), userid)
+	}
+	if retries.SequenceMismatches == 0 && retries.NetworkErrors == 0 {
+		return nil, nil
+	}
+	retries.Sequence = *seq
+	return retries, nil
+}
+
+// trackTx stores a transaction about to be broadcast as pending. It returns nil if
+// transaction tracking is disabled.
+func (h *ThetaRPCHandler) trackTx(r *http.Request, userid string, role keymanager.AccountRole, tx ttypes.Tx) (*db.Transaction, error) {
+	if h.Txs == nil {
+		return nil, nil
+	}
+	raw, err := ttypes.TxToBytes(tx)
+	if err != nil {
+		return nil, err
+	}
+	txType, err := keymanager.TxType(tx)
+	if err != nil {
+		return nil, err
+	}
+	tracked := &db.Transaction{
+		Hash:   crypto.Keccak256Hash(raw).Hex(),
+		UserID: userid,
+		Role:   string(role),
+		TxType: txType,
+		Raw:    raw,
+		Status: db.TxPending,
+	}
+	if req := idempotentRequestFrom(r); req != nil {
+		tracked.IdempotencyKey = req.key
+	}
+	if _, err := h.Txs.CreateTransaction(*tracked); err != nil {
+		return nil, errors.Wrap(err, "Failed to record transaction")
+	}
+	return tracked, nil
+}
+
+func txHash(tx ttypes.Tx) (string, error) {
+	raw, err := ttypes.TxToBytes(tx)
+	if err != nil {
+		return "", err
+	}
+	return crypto.Keccak256Hash(raw).Hex(), nil
+}
+
+// broadcastWithBackoff broadcasts the transaction, retrying with exponential
+// backoff while the node cannot be reached.
+func (h *ThetaRPCHandler) broadcastWithBackoff(tx ttypes.Tx, result interface{}, retries *BroadcastRetries, maxAttempts int) error {
+	backoff := time.Duration(viper.GetInt(util.CfgBroadcastBackoffMs)) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := h.broadcastTx(tx, result)
+		if _, ok := err.(networkError); !ok || attempt >= maxAttempts {
+			return err
+		}
+		retries.NetworkErrors++
+		log.WithFields(log.Fields{"method": "broadcastWithBackoff", "attempt": attempt, "backoff": backoff, "error": err}).Warn("Failed to reach node, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
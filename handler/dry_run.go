@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"encoding/hex"
+	"net/http"
+
+	tcmn "github.com/thetatoken/ukulele/common"
+	crypto "github.com/thetatoken/ukulele/crypto"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/util"
+)
+
+// DryRunResult describes a transaction signed but not broadcast.
+type DryRunResult struct {
+	Tx       string          `json:"tx"` // Hex of the signed transaction, as it would be broadcast.
+	TxHash   string          `json:"tx_hash"`
+	Type     string          `json:"type"`
+	Sequence tcmn.JSONUint64 `json:"sequence"`
+	Fee      ttypes.Coins    `json:"fee"`
+	Inputs   []DryRunIO      `json:"inputs"`
+	Outputs  []DryRunIO      `json:"outputs"`
+}
+
+type DryRunIO struct {
+	Address string       `json:"address"`
+	Coins   ttypes.Coins `json:"coins"`
+}
+
+// dryRunTx signs a transaction from the account of the signer and describes it
+// without broadcasting it. A zero sequence is replaced with the one the next
+// transaction from the account would get, which is not consumed. The balance and
+// destinations are checked as for broadcast transactions, and the transaction is
+// recorded in the signing audit log like any other signed transaction. Since the
+// caller can broadcast it, it is charged against the spending limits of the user,
+// and the charge is kept.
+func (h *ThetaRPCHandler) dryRunTx(r *http.Request, userid string, role keymanager.AccountRole, signer keymanager.Signer, sequence *tcmn.JSONUint64, prepare func() (ttypes.Tx, error)) (*DryRunResult, error) {
+	alloc, err := h.Sequences.Peek(signer.Address())
+	if err != nil {
+		return nil, err
+	}
+	if *sequence == 0 {
+		*sequence = tcmn.JSONUint64(alloc.Sequence)
+	}
+	tx, err := prepare()
+	if err != nil {
+		return nil, err
+	}
+	if err := h.checkTxDestinations(userid, tx); err != nil {
+		return nil, err
+	}
+	if _, err := checkBalance(signer.Address(), tx, alloc.Available); err != nil {
+		return nil, err
+	}
+	charged, err := h.txSpending(userid, tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.chargeLimits(charged); err != nil {
+		return nil, err
+	}
+	if err := signer.SignTx(tx, r.Header.Get(util.RequestIDHeader)); err != nil {
+		h.refundLimits(r, charged)
+		return nil, policyError(err)
+	}
+
+	raw, err := ttypes.TxToBytes(tx)
+	if err != nil {
+		return nil, err
+	}
+	txType, err := keymanager.TxType(tx)
+	if err != nil {
+		return nil, err
+	}
+	result := &DryRunResult{
+		Tx:       hex.EncodeToString(raw),
+		TxHash:   crypto.Keccak256Hash(raw).Hex(),
+		Type:     txType,
+		Sequence: *sequence,
+		Inputs:   []DryRunIO{},
+		Outputs:  []DryRunIO{},
+	}
+	addInput := func(input ttypes.TxInput) {
+		result.Inputs = append(result.Inputs, DryRunIO{Address: input.Address.Hex(), Coins: input.Coins.NoNil()})
+	}
+	switch tx := tx.(type) {
+	case *ttypes.SendTx:
+		result.Fee = tx.Fee
+		for _, input := range tx.Inputs {
+			addInput(input)
+		}
+		for _, output := range tx.Outputs {
+			result.Outputs = append(result.Outputs, DryRunIO{Address: output.Address.Hex(), Coins: output.Coins.NoNil()})
+		}
+	case *ttypes.ReserveFundTx:
+		result.Fee = tx.Fee
+		addInput(tx.Source)
+	case *ttypes.ReleaseFundTx:
+		result.Fee = tx.Fee
+		addInput(tx.Source)
+	case *ttypes.ServicePaymentTx:
+		result.Fee = tx.Fee
+		addInput(tx.Source)
+		addInput(tx.Target)
+		result.Outputs = append(result.Outputs, DryRunIO{Address: tx.Target.Address.Hex(), Coins: tx.Source.Coins.NoNil()})
+	case *ttypes.SplitRuleTx:
+		result.Fee = tx.Fee
+		addInput(tx.Initiator)
+	}
+	result.Fee = result.Fee.NoNil()
+	return result, nil
+}
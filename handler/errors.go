@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"math/big"
+	"time"
+
+	json "github.com/gorilla/rpc/v2/json2"
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/policy"
+)
+
+// Error codes of vault specific failures, within the range JSON-RPC 2.0 reserves for
+// implementation-defined server errors.
+const (
+	ErrCodeAccountNotFound     json.ErrorCode = -32001
+	ErrCodeUnauthorized        json.ErrorCode = -32002
+	ErrCodeTransactionNotFound json.ErrorCode = -32003
+	ErrCodeIdempotencyConflict json.ErrorCode = -32004
+	ErrCodeInsufficientFunds   json.ErrorCode = -32005
+	ErrCodeBatchIncomplete     json.ErrorCode = -32006
+	ErrCodeAddressNotAllowed   json.ErrorCode = -32007
+	ErrCodeTransactionLimit    json.ErrorCode = -32008
+	ErrCodeDailyLimit          json.ErrorCode = -32009
+	ErrCodeMonthlyLimit        json.ErrorCode = -32010
+	ErrCodeReservedFundsLimit  json.ErrorCode = -32011
+)
+
+// keyManagerError converts KeyManager errors into structured JSON-RPC errors.
+func keyManagerError(userid string, err error) error {
+	if err == keymanager.ErrAccountNotFound {
+		return &json.Error{
+			Code:    ErrCodeAccountNotFound,
+			Message: "account not found",
+			Data:    map[string]string{"user_id": userid},
+		}
+	}
+	return err
+}
+
+func transactionNotFoundError(txHash, idempotencyKey string) error {
+	data := map[string]string{}
+	if txHash != "" {
+		data["tx_hash"] = txHash
+	}
+	if idempotencyKey != "" {
+		data["idempotency_key"] = idempotencyKey
+	}
+	return &json.Error{
+		Code:    ErrCodeTransactionNotFound,
+		Message: "transaction not found",
+		Data:    data,
+	}
+}
+
+func idempotencyConflictError(key, message, txHash string) error {
+	data := map[string]string{"idempotency_key": key}
+	if txHash != "" {
+		data["tx_hash"] = txHash
+	}
+	return &json.Error{
+		Code:    ErrCodeIdempotencyConflict,
+		Message: message,
+		Data:    data,
+	}
+}
+
+// insufficientFundsError reports the amounts a transaction needs and the balance
+// of the account net of its pending transactions.
+func insufficientFundsError(address tcmn.Address, required, available ttypes.Coins) error {
+	required, available = required.NoNil(), available.NoNil()
+	return &json.Error{
+		Code:    ErrCodeInsufficientFunds,
+		Message: "insufficient funds",
+		Data: map[string]interface{}{
+			"address": address.Hex(),
+			"required": map[string]string{
+				"thetawei": required.ThetaWei.String(),
+				"gammawei": required.GammaWei.String(),
+			},
+			"available": map[string]string{
+				"thetawei": available.ThetaWei.String(),
+				"gammawei": available.GammaWei.String(),
+			},
+		},
+	}
+}
+
+// batchIncompleteError reports a batch that failed after some of its transactions
+// were sent.
+func batchIncompleteError(err error, sent []BatchSendTx) error {
+	return &json.Error{
+		Code:    ErrCodeBatchIncomplete,
+		Message: "batch incomplete: " + err.Error(),
+		Data:    map[string]interface{}{"transactions": sent},
+	}
+}
+
+// withdrawalAddressNotAllowedError reports a send to an external address that is
+// not on the allowlist of the user, or not yet usable if activeAt is set.
+func withdrawalAddressNotAllowedError(address tcmn.Address, activeAt *time.Time) error {
+	data := map[string]interface{}{"address": address.Hex()}
+	message := "withdrawal address not allowed"
+	if activeAt != nil {
+		data["active_at"] = activeAt.Unix()
+		message = "withdrawal address not active yet"
+	}
+	return &json.Error{
+		Code:    ErrCodeAddressNotAllowed,
+		Message: message,
+		Data:    data,
+	}
+}
+
+// policyError converts errors of the policy checks into their RPC errors. Other
+// errors are returned as is.
+func policyError(err error) error {
+	switch err := err.(type) {
+	case *policy.AddressNotAllowed:
+		return withdrawalAddressNotAllowedError(err.Address, err.ActiveAt)
+	case *policy.LimitExceeded:
+		return limitExceededError(&err.LimitExceeded, err.Requested)
+	}
+	return err
+}
+
+var limitErrors = map[string]struct {
+	code    json.ErrorCode
+	message string
+}{
+	db.LimitPerTransaction: {ErrCodeTransactionLimit, "transaction limit exceeded"},
+	db.LimitDaily:          {ErrCodeDailyLimit, "daily limit exceeded"},
+	db.LimitMonthly:        {ErrCodeMonthlyLimit, "monthly limit exceeded"},
+	db.LimitReservedFunds:  {ErrCodeReservedFundsLimit, "reserved funds limit exceeded"},
+}
+
+// limitExceededError reports a spending limit a request would exceed, with the
+// amount requested if the limit is on amounts.
+func limitExceededError(exceeded *db.LimitExceeded, requested *big.Int) error {
+	data := map[string]string{
+		"limit": exceeded.Limit,
+		"max":   exceeded.Max.String(),
+	}
+	if exceeded.Currency != "" {
+		data["currency"] = exceeded.Currency
+	}
+	if exceeded.Used != nil {
+		data["used"] = exceeded.Used.String()
+	}
+	if requested != nil {
+		data["requested"] = requested.String()
+	}
+	return &json.Error{
+		Code:    limitErrors[exceeded.Limit].code,
+		Message: limitErrors[exceeded.Limit].message,
+		Data:    data,
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/hex"
 	"math/big"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
@@ -12,18 +14,28 @@ import (
 	ukulele "github.com/thetatoken/ukulele/rpc"
 	"github.com/thetatoken/vault/db"
 	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/sequence"
 	"github.com/thetatoken/vault/util"
 )
 
 type ThetaRPCHandler struct {
-	Client     util.RPCClient
-	KeyManager keymanager.KeyManager
+	Client      util.RPCClient
+	KeyManager  keymanager.KeyManager
+	Sequences   *sequence.Manager
+	Txs         db.TransactionStore // Nil if transaction tracking is disabled.
+	History     db.HistoryStore     // Nil if the block indexer is disabled.
+	Idempotency db.IdempotencyStore // Nil if the database does not support idempotency keys.
+	Allowlists  db.AllowlistStore   // Nil if the database does not support withdrawal allowlists.
+	Limits      db.LimitStore       // Nil if the database does not support spending limits.
+
+	topUps topUps
 }
 
 func NewRPCHandler(client util.RPCClient, km keymanager.KeyManager) *ThetaRPCHandler {
 	return &ThetaRPCHandler{
 		Client:     client,
 		KeyManager: km,
+		Sequences:  sequence.NewManager(client),
 	}
 }
 
@@ -71,7 +83,7 @@ func (h *ThetaRPCHandler) getAccount(address string) Account {
 func (h *ThetaRPCHandler) GetAccount(r *http.Request, args *GetAccountArgs, result *GetAccountResult) error {
 	record, err := h.getRecord(r)
 	if err != nil {
-		return errors.Wrapf(err, "Failed to find userid: %v", record.UserID)
+		return err
 	}
 	userid := record.UserID
 
@@ -87,29 +99,92 @@ func (h *ThetaRPCHandler) GetAccount(r *http.Request, args *GetAccountArgs, resu
 	return nil
 }
 
+// ------------------------------- CreateAccount -----------------------------------
+
+type CreateAccountArgs struct{}
+
+type CreateAccountResult struct {
+	UserID      string `json:"user_id"`
+	SendAddress string `json:"send_address"`
+	RecvAddress string `json:"recv_address"`
+	Created     bool   `json:"created"` // False if the account already existed.
+}
+
+// CreateAccount creates the account of the user in request header. Accounts of
+// other users are created with admin.BatchCreateAccounts.
+func (h *ThetaRPCHandler) CreateAccount(r *http.Request, args *CreateAccountArgs, result *CreateAccountResult) error {
+	userid := r.Header.Get("X-Auth-User")
+	if userid == "" {
+		return errors.New("No userid is passed in")
+	}
+	res, err := createAccount(h.KeyManager, userid)
+	if err != nil {
+		return err
+	}
+	*result = res
+	return nil
+}
+
+// createAccount creates the account of a user, or returns the existing one.
+func createAccount(km keymanager.KeyManager, userid string) (CreateAccountResult, error) {
+	created := true
+	record, err := km.CreateAccount(userid)
+	if err == keymanager.ErrAccountExists {
+		created = false
+		record, err = km.FindByUserId(userid)
+	}
+	if err != nil {
+		return CreateAccountResult{}, err
+	}
+	return CreateAccountResult{
+		UserID:      userid,
+		SendAddress: record.SaAddress.String(),
+		RecvAddress: record.RaAddress.String(),
+		Created:     created,
+	}, nil
+}
+
 // ------------------------------- Send -----------------------------------
 
 type SendArgs struct {
-	To       string          `json:"to"`       // Required. Outputs including addresses and amount.
-	Amount   ttypes.Coins    `json:"amount"`   // Required. The amount to send.
-	Fee      *tcmn.JSONBig   `json:"fee"`      // Optional. Transaction fee. Default to 0.
-	Sequence tcmn.JSONUint64 `json:"sequence"` // Required. Sequence number of this transaction.
+	To             string          `json:"to"`              // Address to send to. Either this or to_user_id is required.
+	ToUserID       string          `json:"to_user_id"`      // User ID of a vault user to send to, into their RA.
+	Amount         ttypes.Coins    `json:"amount"`          // Required. The amount to send.
+	Fee            *tcmn.JSONBig   `json:"fee"`             // Optional. Transaction fee. Default to 0.
+	Sequence       tcmn.JSONUint64 `json:"sequence"`        // Optional. Sequence number of this transaction. Allocated by vault if omitted.
+	IdempotencyKey string          `json:"idempotency_key"` // Optional. Replays of the request with the same key return the original result.
+	DryRun         bool            `json:"dry_run"`         // Optional. Sign the transaction and return it without broadcasting it.
 }
 
-func (h *ThetaRPCHandler) Send(r *http.Request, args *SendArgs, result *ukulele.BroadcastRawTransactionResult) (err error) {
-	record, err := h.getRecord(r)
+func (h *ThetaRPCHandler) Send(r *http.Request, args *SendArgs, result *BroadcastResult) (err error) {
+	signer, err := h.getSigner(r, keymanager.RecvAccount)
 	if err != nil {
 		return
 	}
 
-	signedTx, err := prepareSendTx(args, record, viper.GetString(util.CfgThetaChainId))
+	// Idempotency keys are matched against the request as sent, so the recipient
+	// is resolved into a copy.
+	sendArgs := *args
+	sendArgs.To, err = h.recipientAddress(args.To, args.ToUserID)
 	if err != nil {
 		return err
 	}
-	return h.broadcastTx(signedTx, result)
+
+	userid := r.Header.Get("X-Auth-User")
+	prepare := func() (ttypes.Tx, error) {
+		return prepareSendTx(&sendArgs, signer)
+	}
+	if args.DryRun {
+		result.DryRun, err = h.dryRunTx(r, userid, keymanager.RecvAccount, signer, &sendArgs.Sequence, prepare)
+		return err
+	}
+	return h.idempotent(r, userid, "Send", args.IdempotencyKey, args, result, func(r *http.Request) (err error) {
+		result.Retries, err = h.submitTx(r, userid, keymanager.RecvAccount, signer, &sendArgs.Sequence, prepare, result)
+		return err
+	})
 }
 
-func prepareSendTx(args *SendArgs, record db.Record, chainID string) (*ttypes.SendTx, error) {
+func prepareSendTx(args *SendArgs, signer keymanager.Signer) (*ttypes.SendTx, error) {
 	amount := args.Amount.NoNil()
 
 	// Add minimal fee.
@@ -125,12 +200,12 @@ func prepareSendTx(args *SendArgs, record db.Record, chainID string) (*ttypes.Se
 		GammaWei: feeAmount,
 	}
 	inputs := []ttypes.TxInput{{
-		Address:  record.RaAddress,
+		Address:  signer.Address(),
 		Coins:    amount.Plus(fee),
 		Sequence: (uint64)(args.Sequence),
 	}}
 	if args.Sequence == 1 {
-		inputs[0].PubKey = record.RaPubKey
+		inputs[0].PubKey = signer.PublicKey()
 	}
 	outputs := []ttypes.TxOutput{{
 		Address: tcmn.HexToAddress(args.To),
@@ -142,11 +217,6 @@ func prepareSendTx(args *SendArgs, record db.Record, chainID string) (*ttypes.Se
 		Outputs: outputs,
 	}
 
-	sig, err := record.RaPrivateKey.Sign(sendTx.SignBytes(chainID))
-	if err != nil {
-		return nil, err
-	}
-	sendTx.SetSignature(record.RaAddress, sig)
 	return sendTx, nil
 }
 
@@ -169,39 +239,53 @@ func (h *ThetaRPCHandler) BroadcastRawTransaction(r *http.Request, args *ukulele
 // --------------------------- Reserve -------------------------------
 
 type ReserveFundArgs struct {
-	Fee         *tcmn.JSONBig   `json:"fee"`          // Optional. Transaction fee. Default to 0.
-	Collateral  *tcmn.JSONBig   `json:"collateral"`   // Required. Amount in GammaWei as the collateral
-	Fund        *tcmn.JSONBig   `json:"fund"`         // Required. Amount in GammaWei to reserve.
-	ResourceIds []string        `json:"resource_ids"` // List of resource ID
-	Duration    tcmn.JSONUint64 `json:"duration"`     // Optional. Number of blocks to lock the fund.
-	Sequence    tcmn.JSONUint64 `json:"sequence"`     // Required. Sequence number of this transaction.
+	Fee            *tcmn.JSONBig   `json:"fee"`             // Optional. Transaction fee. Default to 0.
+	Collateral     *tcmn.JSONBig   `json:"collateral"`      // Required. Amount in GammaWei as the collateral
+	Fund           *tcmn.JSONBig   `json:"fund"`            // Required. Amount in GammaWei to reserve.
+	ResourceIds    []string        `json:"resource_ids"`    // List of resource ID
+	Duration       tcmn.JSONUint64 `json:"duration"`        // Optional. Number of blocks to lock the fund.
+	Sequence       tcmn.JSONUint64 `json:"sequence"`        // Optional. Sequence number of this transaction. Allocated by vault if omitted.
+	IdempotencyKey string          `json:"idempotency_key"` // Optional. Replays of the request with the same key return the original result.
+	DryRun         bool            `json:"dry_run"`         // Optional. Sign the transaction and return it without broadcasting it.
 }
 
 type ReserveFundResult struct {
 	*ukulele.BroadcastRawTransactionResult
-	ReserveSequence tcmn.JSONUint64 `json:"reserve_sequence"` // Sequence number of the reserved fund.
+	ReserveSequence tcmn.JSONUint64   `json:"reserve_sequence"`  // Sequence number of the reserved fund.
+	Retries         *BroadcastRetries `json:"retries,omitempty"` // Set if the transaction had to be retried.
+	DryRun          *DryRunResult     `json:"dry_run,omitempty"` // Set instead of the broadcast result for dry runs.
 }
 
 func (h *ThetaRPCHandler) ReserveFund(r *http.Request, args *ReserveFundArgs, result *ReserveFundResult) (err error) {
-	record, err := h.getRecord(r)
+	signer, err := h.getSigner(r, keymanager.SendAccount)
 	if err != nil {
 		return
 	}
 
-	signedTx, err := prepareReserveFundTx(args, record, viper.GetString(util.CfgThetaChainId))
-	if err != nil {
-		return err
+	userid := r.Header.Get("X-Auth-User")
+	prepare := func() (ttypes.Tx, error) {
+		return prepareReserveFundTx(args, signer)
 	}
-	err = h.broadcastTx(signedTx, result)
-	if err != nil {
-		return err
+	if args.DryRun {
+		result.DryRun, err = h.dryRunTx(r, userid, keymanager.SendAccount, signer, &args.Sequence, prepare)
+		if err != nil {
+			return err
+		}
+		result.ReserveSequence = args.Sequence
+		return nil
 	}
+	return h.idempotent(r, userid, "ReserveFund", args.IdempotencyKey, args, result, func(r *http.Request) (err error) {
+		result.Retries, err = h.submitTx(r, userid, keymanager.SendAccount, signer, &args.Sequence, prepare, result)
+		if err != nil {
+			return err
+		}
 
-	result.ReserveSequence = args.Sequence
-	return nil
+		result.ReserveSequence = args.Sequence
+		return nil
+	})
 }
 
-func prepareReserveFundTx(args *ReserveFundArgs, record db.Record, chainID string) (*ttypes.ReserveFundTx, error) {
+func prepareReserveFundTx(args *ReserveFundArgs, signer keymanager.Signer) (*ttypes.ReserveFundTx, error) {
 	if args.Duration == 0 {
 		args.Duration = tcmn.JSONUint64(viper.GetInt64(util.CfgThetaDefaultReserveDurationSecs))
 	}
@@ -221,10 +305,10 @@ func prepareReserveFundTx(args *ReserveFundArgs, record db.Record, chainID strin
 			GammaWei: (*big.Int)(args.Fund),
 		},
 		Sequence: uint64(args.Sequence),
-		Address:  record.SaAddress,
+		Address:  signer.Address(),
 	}
 	if args.Sequence == 1 {
-		input.PubKey = record.SaPubKey
+		input.PubKey = signer.PublicKey()
 	}
 
 	var resourceIds []string
@@ -247,12 +331,6 @@ func prepareReserveFundTx(args *ReserveFundArgs, record db.Record, chainID strin
 		Duration:    uint64(args.Duration),
 	}
 
-	sig, err := record.SaPrivateKey.Sign(tx.SignBytes(chainID))
-	if err != nil {
-		return nil, err
-	}
-	tx.SetSignature(record.SaAddress, sig)
-
 	return tx, nil
 }
 
@@ -260,29 +338,44 @@ func prepareReserveFundTx(args *ReserveFundArgs, record db.Record, chainID strin
 
 type ReleaseFundArgs struct {
 	Fee             *tcmn.JSONBig   `json:"fee"`              // Optional. Transaction fee. Default to 0.
-	Sequence        tcmn.JSONUint64 `json:"sequence"`         // Required. Sequence number of this transaction.
+	Sequence        tcmn.JSONUint64 `json:"sequence"`         // Optional. Sequence number of this transaction. Allocated by vault if omitted.
 	ReserveSequence tcmn.JSONUint64 `json:"reserve_sequence"` // Required. Sequence number of the fund to release.
+	IdempotencyKey  string          `json:"idempotency_key"`  // Optional. Replays of the request with the same key return the original result.
+	DryRun          bool            `json:"dry_run"`          // Optional. Sign the transaction and return it without broadcasting it.
 }
 
 type ReleaseFundResult struct {
 	*ukulele.BroadcastRawTransactionResult
-	ReserveSequence uint64 `json:"reserve_sequence"` // Sequence number of the reserved fund.
+	ReserveSequence uint64            `json:"reserve_sequence"`  // Sequence number of the reserved fund.
+	Retries         *BroadcastRetries `json:"retries,omitempty"` // Set if the transaction had to be retried.
+	DryRun          *DryRunResult     `json:"dry_run,omitempty"` // Set instead of the broadcast result for dry runs.
 }
 
 func (h *ThetaRPCHandler) ReleaseFund(r *http.Request, args *ReleaseFundArgs, result *ReleaseFundResult) (err error) {
-	record, err := h.getRecord(r)
+	signer, err := h.getSigner(r, keymanager.SendAccount)
 	if err != nil {
 		return
 	}
 
-	signedTx, err := prepareReleaseFundTx(args, record, viper.GetString(util.CfgThetaChainId))
-	if err != nil {
+	userid := r.Header.Get("X-Auth-User")
+	prepare := func() (ttypes.Tx, error) {
+		return prepareReleaseFundTx(args, signer)
+	}
+	if args.DryRun {
+		result.DryRun, err = h.dryRunTx(r, userid, keymanager.SendAccount, signer, &args.Sequence, prepare)
 		return err
 	}
-	return h.broadcastTx(signedTx, result)
+	return h.idempotent(r, userid, "ReleaseFund", args.IdempotencyKey, args, result, func(r *http.Request) (err error) {
+		result.Retries, err = h.submitTx(r, userid, keymanager.SendAccount, signer, &args.Sequence, prepare, result)
+		if err != nil {
+			return err
+		}
+		h.releaseReservedFund(r, userid, uint64(args.ReserveSequence))
+		return nil
+	})
 }
 
-func prepareReleaseFundTx(args *ReleaseFundArgs, record db.Record, chainID string) (*ttypes.ReleaseFundTx, error) {
+func prepareReleaseFundTx(args *ReleaseFundArgs, signer keymanager.Signer) (*ttypes.ReleaseFundTx, error) {
 	// Add minimal fee.
 	feeAmount := new(big.Int)
 	if args.Fee == nil {
@@ -294,10 +387,10 @@ func prepareReleaseFundTx(args *ReleaseFundArgs, record db.Record, chainID strin
 	// Wrap and add signer
 	input := ttypes.TxInput{
 		Sequence: uint64(args.Sequence),
-		Address:  record.SaAddress,
+		Address:  signer.Address(),
 	}
 	if args.Sequence == 1 {
-		input.PubKey = record.SaPubKey
+		input.PubKey = signer.PublicKey()
 	}
 
 	tx := &ttypes.ReleaseFundTx{
@@ -309,18 +402,14 @@ func prepareReleaseFundTx(args *ReleaseFundArgs, record db.Record, chainID strin
 		ReserveSequence: uint64(args.ReserveSequence),
 	}
 
-	sig, err := record.RaPrivateKey.Sign(tx.SignBytes(chainID))
-	if err != nil {
-		return nil, err
-	}
-	tx.SetSignature(record.SaAddress, sig)
 	return tx, nil
 }
 
 // --------------------------- CreateServicePayment -------------------------------
 
 type CreateServicePaymentArgs struct {
-	To              string          `json:"to"`               // Required. Address to target account.
+	To              string          `json:"to"`               // Address to target account. Either this or to_user_id is required.
+	ToUserID        string          `json:"to_user_id"`       // User ID of a vault user to pay, into their RA.
 	Amount          *tcmn.JSONBig   `json:"amount"`           // Required. Amount of payment in GammaWei
 	ResourceId      string          `json:"resource_id"`      // Required. Resource ID the payment is for.
 	PaymentSequence tcmn.JSONUint64 `json:"payment_sequence"` // Required. each on-chain settlement needs to increase the payment sequence by 1
@@ -331,31 +420,63 @@ type CreateServicePaymentResult struct {
 	Payment string `json:"payment"` // Hex encoded half-signed payment tx bytes.
 }
 
+// CreateServicePayment signs a payment from the SA of the user for the target to
+// submit. The payment is charged against the spending limits of the user when it
+// is signed, since the target can submit it to the chain without going through
+// the vault. The charge is kept even if the payment is never submitted.
 func (h *ThetaRPCHandler) CreateServicePayment(r *http.Request, args *CreateServicePaymentArgs, result *CreateServicePaymentResult) (err error) {
 	record, err := h.getRecord(r)
 	if err != nil {
 		return
 	}
-	signedTx, err := prepareCreateServicePaymentTx(args, record, viper.GetString(util.CfgThetaChainId))
+	signer, err := h.KeyManager.GetSigner(record.UserID, keymanager.SendAccount)
 	if err != nil {
+		return keyManagerError(record.UserID, err)
+	}
+	args.To, err = h.recipientAddress(args.To, args.ToUserID)
+	if err != nil {
+		return err
+	}
+	if err := h.checkWithdrawalAddress(record.UserID, args.To); err != nil {
+		return err
+	}
+	tx, err := prepareCreateServicePaymentTx(args, record, signer)
+	if err != nil || tx == nil {
 		return
 	}
-	result.Payment = signedTx
+	charged, err := h.txSpending(record.UserID, tx)
+	if err != nil {
+		return err
+	}
+	if err := h.chargeLimits(charged); err != nil {
+		return err
+	}
+	if err := signer.SignTx(tx, r.Header.Get(util.RequestIDHeader)); err != nil {
+		h.refundLimits(r, charged)
+		return policyError(err)
+	}
+	raw, err := ttypes.TxToBytes(tx)
+	if err != nil {
+		return err
+	}
+	result.Payment = hex.EncodeToString(raw)
 	return nil
 }
 
-func prepareCreateServicePaymentTx(args *CreateServicePaymentArgs, record db.Record, chainID string) (string, error) {
+// prepareCreateServicePaymentTx returns the payment to sign, or nil if the user
+// would pay themselves.
+func prepareCreateServicePaymentTx(args *CreateServicePaymentArgs, record db.Record, signer keymanager.Signer) (*ttypes.ServicePaymentTx, error) {
 	if args.ResourceId == "" {
-		return "", errors.New("No resource_id is provided")
+		return nil, errors.New("No resource_id is provided")
 	}
 
 	if args.To == record.RaAddress.String() || args.To == record.SaAddress.String() {
 		// You don't need to pay yourself.
-		return "", nil
+		return nil, nil
 	}
 
 	// Send from SendAccount
-	address := record.SaAddress
+	address := signer.Address()
 
 	// Wrap and add signer
 	sourceInput := ttypes.TxInput{}
@@ -378,48 +499,48 @@ func prepareCreateServicePaymentTx(args *CreateServicePaymentArgs, record db.Rec
 		ResourceID:      args.ResourceId,
 	}
 
-	sig, err := record.SaPrivateKey.Sign(tx.SourceSignBytes(chainID))
-	if err != nil {
-		return "", err
-	}
-	tx.SetSourceSignature(sig)
-	signedTx, err := ttypes.TxToBytes(tx)
-	if err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(signedTx), nil
+	return tx, nil
 }
 
 // --------------------------- SubmitServicePayment -------------------------------
 
 type SubmitServicePaymentArgs struct {
-	Fee      *tcmn.JSONBig   `json:"fee"`      // Optional. Transaction fee. Default to 0.
-	Payment  string          `json:"payment"`  // Required. Hex of sender-signed payment stub.
-	Sequence tcmn.JSONUint64 `json:"sequence"` // Required. Sequence number of this transaction.
+	Fee            *tcmn.JSONBig   `json:"fee"`             // Optional. Transaction fee. Default to 0.
+	Payment        string          `json:"payment"`         // Required. Hex of sender-signed payment stub.
+	Sequence       tcmn.JSONUint64 `json:"sequence"`        // Optional. Sequence number of this transaction. Allocated by vault if omitted.
+	IdempotencyKey string          `json:"idempotency_key"` // Optional. Replays of the request with the same key return the original result.
+	DryRun         bool            `json:"dry_run"`         // Optional. Sign the transaction and return it without broadcasting it.
 }
 
-func (h *ThetaRPCHandler) SubmitServicePayment(r *http.Request, args *SubmitServicePaymentArgs, result *ukulele.BroadcastRawTransactionResult) (err error) {
-	record, err := h.getRecord(r)
+func (h *ThetaRPCHandler) SubmitServicePayment(r *http.Request, args *SubmitServicePaymentArgs, result *BroadcastResult) (err error) {
+	signer, err := h.getSigner(r, keymanager.RecvAccount)
 	if err != nil {
 		return
 	}
-	signedTx, err := prepareSubmitServicePaymentTx(args, record, viper.GetString(util.CfgThetaChainId))
-	if err != nil {
+	userid := r.Header.Get("X-Auth-User")
+	prepare := func() (ttypes.Tx, error) {
+		return prepareSubmitServicePaymentTx(args, signer)
+	}
+	if args.DryRun {
+		result.DryRun, err = h.dryRunTx(r, userid, keymanager.RecvAccount, signer, &args.Sequence, prepare)
 		return err
 	}
-	return h.broadcastTx(signedTx, result)
+	return h.idempotent(r, userid, "SubmitServicePayment", args.IdempotencyKey, args, result, func(r *http.Request) (err error) {
+		result.Retries, err = h.submitTx(r, userid, keymanager.RecvAccount, signer, &args.Sequence, prepare, result)
+		return err
+	})
 }
 
-func prepareSubmitServicePaymentTx(args *SubmitServicePaymentArgs, record db.Record, chainID string) (*ttypes.ServicePaymentTx, error) {
+func prepareSubmitServicePaymentTx(args *SubmitServicePaymentArgs, signer keymanager.Signer) (*ttypes.ServicePaymentTx, error) {
 	// Receive into RecvAccount
-	address := record.RaAddress
+	address := signer.Address()
 
 	input := ttypes.TxInput{
 		Sequence: uint64(args.Sequence),
 	}
 	input.Address = address
 	if args.Sequence == 1 {
-		input.PubKey = record.RaPubKey
+		input.PubKey = signer.PublicKey()
 	}
 
 	if args.Payment == "" {
@@ -451,52 +572,53 @@ func prepareSubmitServicePaymentTx(args *SubmitServicePaymentArgs, record db.Rec
 		GammaWei: feeAmount,
 	}
 
-	// Sign the tx
-	sig, err := record.RaPrivateKey.Sign(paymentTx.TargetSignBytes(chainID))
-	if err != nil {
-		return nil, err
-	}
-	paymentTx.SetTargetSignature(sig)
 	return paymentTx, nil
 }
 
 // --------------------------- InstantiateSplitContract -------------------------------
 
 type InstantiateSplitContractArgs struct {
-	Fee          *tcmn.JSONBig   `json:"fee"`          // Optional. Transaction fee. Default to 0.
-	ResourceId   string          `json:"resource_id"`  // Required. The resourceId.
-	Initiator    string          `json:"initiator"`    // Required. Name of initiator account.
-	Participants []string        `json:"participants"` // Required. User IDs participating in the split.
-	Percentages  []uint          `json:"percentages"`  // Required. The split percentage for each corresponding user.
-	Duration     tcmn.JSONUint64 `json:"duration"`     // Optional. Number of blocks before the contract expires.
-	Sequence     tcmn.JSONUint64 `json:"sequence"`     // Optional. Sequence number of this transaction.
+	Fee            *tcmn.JSONBig   `json:"fee"`             // Optional. Transaction fee. Default to 0.
+	ResourceId     string          `json:"resource_id"`     // Required. The resourceId.
+	Initiator      string          `json:"initiator"`       // Required. Name of initiator account.
+	Participants   []string        `json:"participants"`    // Required. User IDs participating in the split.
+	Percentages    []uint          `json:"percentages"`     // Required. The split percentage for each corresponding user.
+	Duration       tcmn.JSONUint64 `json:"duration"`        // Optional. Number of blocks before the contract expires.
+	Sequence       tcmn.JSONUint64 `json:"sequence"`        // Optional. Sequence number of this transaction.
+	IdempotencyKey string          `json:"idempotency_key"` // Optional. Replays of the request with the same key return the original result.
+	DryRun         bool            `json:"dry_run"`         // Optional. Sign the transaction and return it without broadcasting it.
 }
 
-func (h *ThetaRPCHandler) InstantiateSplitContract(r *http.Request, args *InstantiateSplitContractArgs, result *ukulele.BroadcastRawTransactionResult) (err error) {
+func (h *ThetaRPCHandler) InstantiateSplitContract(r *http.Request, args *InstantiateSplitContractArgs, result *BroadcastResult) (err error) {
 	if args.Initiator == "" {
 		return errors.New("No initiator is passed in")
 	}
-	initiator, err := h.KeyManager.FindByUserId(args.Initiator)
+	initiator, err := h.KeyManager.GetSigner(args.Initiator, keymanager.SendAccount)
 	if err != nil {
-		return
+		return keyManagerError(args.Initiator, err)
 	}
 	participants := []db.Record{}
 	for _, userid := range args.Participants {
 		record, err := h.KeyManager.FindByUserId(userid)
 		if err != nil {
-			return err
+			return keyManagerError(userid, err)
 		}
 		participants = append(participants, record)
 	}
-	sequence, err := util.GetSequence(h.Client, initiator.SaAddress)
-	signedTx, err := prepareInstantiateSplitContractTx(args, initiator, sequence, participants, viper.GetString(util.CfgThetaChainId))
-	if err != nil {
+	prepare := func() (ttypes.Tx, error) {
+		return prepareInstantiateSplitContractTx(args, initiator, participants)
+	}
+	if args.DryRun {
+		result.DryRun, err = h.dryRunTx(r, args.Initiator, keymanager.SendAccount, initiator, &args.Sequence, prepare)
 		return err
 	}
-	return h.broadcastTx(signedTx, result)
+	return h.idempotent(r, args.Initiator, "InstantiateSplitContract", args.IdempotencyKey, args, result, func(r *http.Request) (err error) {
+		result.Retries, err = h.submitTx(r, args.Initiator, keymanager.SendAccount, initiator, &args.Sequence, prepare, result)
+		return err
+	})
 }
 
-func prepareInstantiateSplitContractTx(args *InstantiateSplitContractArgs, initiator db.Record, initiatorSeq uint64, participants []db.Record, chainID string) (*ttypes.SplitRuleTx, error) {
+func prepareInstantiateSplitContractTx(args *InstantiateSplitContractArgs, initiator keymanager.Signer, participants []db.Record) (*ttypes.SplitRuleTx, error) {
 	if args.ResourceId == "" {
 		return nil, errors.New("No resource_id is passed in")
 	}
@@ -513,14 +635,14 @@ func prepareInstantiateSplitContractTx(args *InstantiateSplitContractArgs, initi
 	}
 
 	// Use SendAccount to fund tx fee.
-	initiatorAddress := initiator.SaAddress
+	initiatorAddress := initiator.Address()
 
 	initiatorInput := ttypes.TxInput{
 		Address:  initiatorAddress,
-		Sequence: initiatorSeq + 1,
+		Sequence: uint64(args.Sequence),
 	}
 	if args.Sequence == 1 {
-		initiatorInput.PubKey = initiator.SaPubKey
+		initiatorInput.PubKey = initiator.PublicKey()
 	}
 
 	splits := []ttypes.Split{}
@@ -549,12 +671,169 @@ func prepareInstantiateSplitContractTx(args *InstantiateSplitContractArgs, initi
 		Duration:   duration,
 	}
 
-	sig, err := initiator.RaPrivateKey.Sign(tx.SignBytes(chainID))
+	return tx, nil
+}
+
+// --------------------------- GetTransactionStatus -------------------------------
+
+type GetTransactionStatusArgs struct {
+	TxHash         string `json:"tx_hash"`         // Hash of the transaction. Either this or idempotency_key is required.
+	IdempotencyKey string `json:"idempotency_key"` // Idempotency key of the request that sent the transaction.
+}
+
+type GetTransactionStatusResult struct {
+	TxHash         string          `json:"tx_hash"`
+	UserID         string          `json:"user_id"`
+	Type           string          `json:"type"`
+	Status         string          `json:"status"` // One of pending, included, finalized or failed.
+	BlockHeight    tcmn.JSONUint64 `json:"block_height,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+func (h *ThetaRPCHandler) GetTransactionStatus(r *http.Request, args *GetTransactionStatusArgs, result *GetTransactionStatusResult) error {
+	if h.Txs == nil {
+		return errors.New("Transaction tracking is not enabled")
+	}
+	userid := r.Header.Get("X-Auth-User")
+	if userid == "" {
+		return errors.New("No userid is passed in")
+	}
+
+	var tx db.Transaction
+	var err error
+	switch {
+	case args.TxHash != "":
+		tx, err = h.Txs.FindTransaction(args.TxHash)
+	case args.IdempotencyKey != "":
+		tx, err = h.Txs.FindTransactionByIdempotencyKey(userid, args.IdempotencyKey)
+	default:
+		return errors.New("Either tx_hash or idempotency_key is required")
+	}
+	// Users only see their own transactions.
+	if err == db.ErrNoRecord || (err == nil && tx.UserID != userid) {
+		return transactionNotFoundError(args.TxHash, args.IdempotencyKey)
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
-	tx.SetSignature(initiator.RaAddress, sig)
-	return tx, nil
+
+	*result = GetTransactionStatusResult{
+		TxHash:         tx.Hash,
+		UserID:         tx.UserID,
+		Type:           tx.TxType,
+		Status:         tx.Status,
+		BlockHeight:    tcmn.JSONUint64(tx.BlockHeight),
+		Error:          tx.Error,
+		IdempotencyKey: tx.IdempotencyKey,
+		CreatedAt:      tx.CreatedAt,
+		UpdatedAt:      tx.UpdatedAt,
+	}
+	return nil
+}
+
+// ----------------------------- ListTransactions ---------------------------------
+
+const (
+	defaultListTransactionsLimit = 50
+	maxListTransactionsLimit     = 500
+)
+
+type ListTransactionsArgs struct {
+	Role       string          `json:"role"`        // Optional. Account to list transactions of, SA or RA. Both if empty.
+	Type       string          `json:"type"`        // Optional. One of send, reserve_fund, release_fund, service_payment or split_rule.
+	ResourceId string          `json:"resource_id"` // Optional.
+	From       tcmn.JSONUint64 `json:"from"`        // Optional. Unix time of the earliest block, inclusive.
+	To         tcmn.JSONUint64 `json:"to"`          // Optional. Unix time of the latest block, exclusive.
+	Cursor     string          `json:"cursor"`      // Optional. next_cursor of the previous page.
+	Limit      int             `json:"limit"`       // Optional. Defaults to 50, at most 500.
+}
+
+type TransactionItem struct {
+	TxHash       string          `json:"tx_hash"`
+	Type         string          `json:"type"`
+	Role         string          `json:"role"`
+	Address      string          `json:"address"`
+	Direction    string          `json:"direction"` // in or out of the account.
+	ThetaWei     string          `json:"thetawei"`
+	GammaWei     string          `json:"gammawei"`
+	Counterparty string          `json:"counterparty,omitempty"`
+	ResourceId   string          `json:"resource_id,omitempty"`
+	BlockHeight  tcmn.JSONUint64 `json:"block_height"`
+	BlockTime    time.Time       `json:"block_time"`
+}
+
+type ListTransactionsResult struct {
+	Transactions []TransactionItem `json:"transactions"` // Newest first.
+	NextCursor   string            `json:"next_cursor,omitempty"`
+}
+
+func (h *ThetaRPCHandler) ListTransactions(r *http.Request, args *ListTransactionsArgs, result *ListTransactionsResult) error {
+	if h.History == nil {
+		return errors.New("Transaction indexing is not enabled")
+	}
+	userid := r.Header.Get("X-Auth-User")
+	if userid == "" {
+		return errors.New("No userid is passed in")
+	}
+
+	filter := db.HistoryFilter{
+		UserID:     userid,
+		Role:       args.Role,
+		TxType:     args.Type,
+		ResourceID: args.ResourceId,
+		Limit:      args.Limit,
+	}
+	if filter.Role != "" && filter.Role != string(keymanager.SendAccount) && filter.Role != string(keymanager.RecvAccount) {
+		return errors.Errorf("Invalid role: %s", args.Role)
+	}
+	if args.From != 0 {
+		filter.From = time.Unix(int64(args.From), 0)
+	}
+	if args.To != 0 {
+		filter.To = time.Unix(int64(args.To), 0)
+	}
+	if args.Cursor != "" {
+		id, err := strconv.ParseInt(args.Cursor, 10, 64)
+		if err != nil || id <= 0 {
+			return errors.Errorf("Invalid cursor: %s", args.Cursor)
+		}
+		filter.BeforeID = id
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultListTransactionsLimit
+	}
+	if filter.Limit > maxListTransactionsLimit {
+		filter.Limit = maxListTransactionsLimit
+	}
+
+	entries, err := h.History.ListHistory(filter)
+	if err != nil {
+		return err
+	}
+
+	result.Transactions = []TransactionItem{}
+	for _, e := range entries {
+		result.Transactions = append(result.Transactions, TransactionItem{
+			TxHash:       e.TxHash,
+			Type:         e.TxType,
+			Role:         e.Role,
+			Address:      e.Address.Hex(),
+			Direction:    e.Direction,
+			ThetaWei:     e.ThetaWei,
+			GammaWei:     e.GammaWei,
+			Counterparty: e.Counterparty,
+			ResourceId:   e.ResourceID,
+			BlockHeight:  tcmn.JSONUint64(e.BlockHeight),
+			BlockTime:    e.BlockTime,
+		})
+	}
+	if len(entries) == filter.Limit {
+		result.NextCursor = strconv.FormatInt(entries[len(entries)-1].ID, 10)
+	}
+	return nil
 }
 
 //
@@ -569,7 +848,39 @@ func (h *ThetaRPCHandler) getRecord(r *http.Request) (record db.Record, err erro
 		err = errors.New("No userid is passed in")
 		return
 	}
-	return h.KeyManager.FindByUserId(userid)
+	record, err = h.KeyManager.FindByUserId(userid)
+	return record, keyManagerError(userid, err)
+}
+
+// recipientAddress returns the address to pay, given either as an address or as
+// the user ID of a vault user, whose RA collects the payment.
+func (h *ThetaRPCHandler) recipientAddress(to, toUserID string) (string, error) {
+	switch {
+	case to != "" && toUserID != "":
+		return "", errors.New("Only one of to and to_user_id can be passed in")
+	case toUserID != "":
+		record, err := h.KeyManager.FindByUserId(toUserID)
+		if err != nil {
+			return "", keyManagerError(toUserID, err)
+		}
+		return record.RaAddress.Hex(), nil
+	case to == "":
+		return "", errors.New("Either to or to_user_id is required")
+	}
+	return to, nil
+}
+
+// getSigner returns the signer of the given account of the user in request header.
+func (h *ThetaRPCHandler) getSigner(r *http.Request, role keymanager.AccountRole) (keymanager.Signer, error) {
+	userid := r.Header.Get("X-Auth-User")
+	if userid == "" {
+		return nil, errors.New("No userid is passed in")
+	}
+	signer, err := h.KeyManager.GetSigner(userid, role)
+	if err != nil {
+		return nil, keyManagerError(userid, err)
+	}
+	return signer, nil
 }
 
 // broadcastTx takes a signed TX and broadcast to Theta backend. The response is filled into
@@ -583,7 +894,7 @@ func (h *ThetaRPCHandler) broadcastTx(tx ttypes.Tx, result interface{}) error {
 	broadcastArgs := &ukulele.BroadcastRawTransactionArgs{TxBytes: signedTx}
 	resp, err := h.Client.Call("theta.BroadcastRawTransaction", broadcastArgs)
 	if err != nil {
-		return err
+		return networkError{err}
 	}
 	if resp.Error != nil {
 		return resp.Error
@@ -1,5 +1,232 @@
 package handler
 
+import (
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	json "github.com/gorilla/rpc/v2/json2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	tcmn "github.com/thetatoken/ukulele/common"
+	crypto "github.com/thetatoken/ukulele/crypto"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	ukulele "github.com/thetatoken/ukulele/rpc"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/util"
+	rpcc "github.com/ybbus/jsonrpc"
+)
+
+func accountResponse(balance ttypes.Coins) *rpcc.RPCResponse {
+	return &rpcc.RPCResponse{Result: ukulele.GetAccountResult{Account: &ttypes.Account{Balance: balance}}}
+}
+
+// memAuditLog keeps the signing audit log in memory.
+type memAuditLog struct {
+	entries []db.SigningAuditEntry
+}
+
+func (l *memAuditLog) AppendSigningAudit(entry db.SigningAuditEntry) (db.SigningAuditEntry, error) {
+	entry.Seq = uint64(len(l.entries)) + 1
+	l.entries = append(l.entries, entry)
+	return entry, nil
+}
+
+func (l *memAuditLog) ListSigningAudit(afterSeq uint64, limit int) ([]db.SigningAuditEntry, error) {
+	return nil, nil
+}
+
+func TestBatchCreateAccounts(t *testing.T) {
+	assert := assert.New(t)
+
+	km := &keymanager.MockKeyManager{}
+	km.On("CreateAccount", "alice").Return(db.Record{UserID: "alice"}, nil)
+	km.On("CreateAccount", "bob").Return(db.Record{}, keymanager.ErrAccountExists)
+	km.On("FindByUserId", "bob").Return(db.Record{UserID: "bob"}, nil)
+
+	h := NewAdminRPCHandler(km, "secret")
+	args := &BatchCreateAccountsArgs{UserIDs: []string{"alice", "bob", ""}}
+	result := &BatchCreateAccountsResult{}
+	err := h.BatchCreateAccounts(httptest.NewRequest("POST", "/rpc", nil), args, result)
+	assert.Equal(ErrCodeUnauthorized, err.(*json.Error).Code)
+	assert.Equal(0, len(result.Accounts))
+
+	req := httptest.NewRequest("POST", "/rpc", nil)
+	req.Header.Set("X-Admin-Token", "secret")
+	err = h.BatchCreateAccounts(req, args, result)
+	assert.Nil(err)
+	assert.Equal(3, len(result.Accounts))
+	assert.True(result.Accounts[0].Created)
+	assert.False(result.Accounts[1].Created)
+	assert.Equal("", result.Accounts[1].Error)
+	assert.Equal("empty user_id", result.Accounts[2].Error)
+	km.AssertExpectations(t)
+}
+
+func TestExportKeysRequiresAdminToken(t *testing.T) {
+	assert := assert.New(t)
+
+	km := &keymanager.MockKeyManager{}
+	km.On("ExportKeys", "alice", "correct horse", "ops@192.0.2.1:1234").Return(keymanager.ExportedKeys{}, nil).Once()
+	h := NewAdminRPCHandler(km, "secret")
+	args := &ExportKeysArgs{UserID: "alice", Password: "correct horse"}
+
+	for _, token := range []string{"", "wrong"} {
+		req := httptest.NewRequest("POST", "/rpc", nil)
+		req.Header.Set("X-Admin-Token", token)
+		err := h.ExportKeys(req, args, &ExportKeysResult{})
+		assert.Equal(ErrCodeUnauthorized, err.(*json.Error).Code)
+	}
+
+	// The admin user and address are passed on for the audit trail.
+	req := httptest.NewRequest("POST", "/rpc", nil)
+	req.Header.Set("X-Admin-Token", "secret")
+	req.Header.Set("X-Admin-User", "ops")
+	result := &ExportKeysResult{}
+	err := h.ExportKeys(req, args, result)
+	assert.Nil(err)
+	assert.Equal("alice", result.UserID)
+	km.AssertExpectations(t)
+}
+
+// fakeRotator records the rotations it is asked to start.
+type fakeRotator struct {
+	actors map[string]string
+}
+
+func (f *fakeRotator) StartByAdmin(userid, actor string) (db.Rotation, error) {
+	if userid != "alice" {
+		return db.Rotation{}, keymanager.ErrAccountNotFound
+	}
+	f.actors[userid] = actor
+	return db.Rotation{ID: 1, UserID: userid, State: db.RotationPending}, nil
+}
+
+func TestRotateKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	h := NewAdminRPCHandler(&keymanager.MockKeyManager{}, "secret")
+	args := &RotateKeysArgs{UserID: "alice"}
+	req := httptest.NewRequest("POST", "/rpc", nil)
+	req.Header.Set("X-Admin-Token", "secret")
+	req.Header.Set("X-Admin-User", "ops")
+	assert.Equal(errNoKeyRotation, h.RotateKeys(req, args, &RotateKeysResult{}))
+
+	rotator := &fakeRotator{actors: map[string]string{}}
+	h.Rotations = rotator
+	unauthorized := httptest.NewRequest("POST", "/rpc", nil)
+	err := h.RotateKeys(unauthorized, args, &RotateKeysResult{})
+	assert.Equal(ErrCodeUnauthorized, err.(*json.Error).Code)
+	assert.Empty(rotator.actors)
+
+	result := &RotateKeysResult{}
+	assert.Nil(h.RotateKeys(req, args, result))
+	assert.Equal(int64(1), result.RotationID)
+	assert.Equal(db.RotationPending, result.State)
+	assert.Equal("ops@192.0.2.1:1234", rotator.actors["alice"])
+
+	err = h.RotateKeys(req, &RotateKeysArgs{UserID: "bob"}, &RotateKeysResult{})
+	assert.Equal(ErrCodeAccountNotFound, err.(*json.Error).Code)
+}
+
+func TestSendSignsWithRecvAccount(t *testing.T) {
+	assert := assert.New(t)
+
+	raPrivKey, _, err := crypto.GenerateKeyPair()
+	assert.Nil(err)
+	auditLog := &memAuditLog{}
+	raSigner := keymanager.NewAuditedSigner(raPrivKey, "alice", keymanager.RecvAccount, auditLog)
+
+	km := &keymanager.MockKeyManager{}
+	km.On("GetSigner", "alice", keymanager.RecvAccount).Return(raSigner, nil)
+	client := &MockRPCClient{}
+	client.On("Call", "theta.GetAccount", mock.Anything).Return(accountResponse(ttypes.NewCoins(1000, 1000)), nil)
+	client.On("Call", "theta.BroadcastRawTransaction", mock.Anything).Return(&rpcc.RPCResponse{Result: map[string]interface{}{}}, nil)
+
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	r.Header.Set("X-Auth-User", "alice")
+	r.Header.Set("X-Request-Id", "req-1")
+	args := &SendArgs{
+		To:       "0x0000000000000000000000000000000000000001",
+		Amount:   ttypes.NewCoins(123, 456),
+		Sequence: 1,
+	}
+	h := NewRPCHandler(client, km)
+	err = h.Send(r, args, &BroadcastResult{})
+	assert.Nil(err)
+	km.AssertExpectations(t)
+	client.AssertExpectations(t)
+	if assert.Len(auditLog.entries, 1) {
+		entry := auditLog.entries[0]
+		assert.Equal("alice", entry.UserID)
+		assert.Equal("RA", entry.Role)
+		assert.Equal("send", entry.TxType)
+		assert.Equal("req-1", entry.RequestID)
+	}
+
+	tx, err := prepareSendTx(args, raSigner)
+	assert.Nil(err)
+	assert.Equal(raSigner.Address(), tx.Inputs[0].Address)
+	assert.Equal(raSigner.PublicKey(), tx.Inputs[0].PubKey)
+}
+
+func TestSendRetriesSequenceMismatch(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set(util.CfgBroadcastMaxAttempts, 3)
+	viper.Set(util.CfgBroadcastBackoffMs, 0)
+	defer viper.Reset()
+
+	raPrivKey, _, err := crypto.GenerateKeyPair()
+	assert.Nil(err)
+	auditLog := &memAuditLog{}
+	raSigner := keymanager.NewAuditedSigner(raPrivKey, "alice", keymanager.RecvAccount, auditLog)
+
+	km := &keymanager.MockKeyManager{}
+	km.On("GetSigner", "alice", keymanager.RecvAccount).Return(raSigner, nil)
+	client := &MockRPCClient{}
+	client.On("Call", "theta.GetAccount", mock.Anything).Return(accountResponse(ttypes.NewCoins(1000, 1000)), nil)
+	client.On("Call", "theta.BroadcastRawTransaction", mock.Anything).Return(nil, errors.New("connection refused")).Once()
+	client.On("Call", "theta.BroadcastRawTransaction", mock.Anything).Return(&rpcc.RPCResponse{Result: map[string]interface{}{}}, nil).Once()
+
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	r.Header.Set("X-Auth-User", "alice")
+	h := NewRPCHandler(client, km)
+	result := &BroadcastResult{}
+	err = h.Send(r, &SendArgs{To: "0x01", Amount: ttypes.NewCoins(1, 1), Sequence: 7}, result)
+	assert.Nil(err)
+	assert.Equal(1, result.Retries.NetworkErrors)
+	assert.Equal(0, result.Retries.SequenceMismatches)
+	assert.Len(auditLog.entries, 1)
+
+	// A sequence chosen by the caller is never re-signed: the transaction may be a
+	// retry of one committed already.
+	client.On("Call", "theta.BroadcastRawTransaction", mock.Anything).Return(&rpcc.RPCResponse{Error: &rpcc.RPCError{Message: "ValidateInputAdvanced: Got 8, expected 9. (acc: ...)"}}, nil).Once()
+	result = &BroadcastResult{}
+	err = h.Send(r, &SendArgs{To: "0x01", Amount: ttypes.NewCoins(1, 1), Sequence: 8}, result)
+	assert.NotNil(err)
+	assert.True(isSequenceMismatch(err))
+	assert.Len(auditLog.entries, 2)
+
+	// A stale sequence allocated by vault is refreshed from the chain and the
+	// transaction re-signed.
+	client.On("Call", "theta.BroadcastRawTransaction", mock.Anything).Return(&rpcc.RPCResponse{Error: &rpcc.RPCError{Message: "ValidateInputAdvanced: Got 1, expected 10. (acc: ...)"}}, nil).Once()
+	client.On("Call", "theta.BroadcastRawTransaction", mock.Anything).Return(&rpcc.RPCResponse{Result: map[string]interface{}{}}, nil).Once()
+	result = &BroadcastResult{}
+	err = h.Send(r, &SendArgs{To: "0x01", Amount: ttypes.NewCoins(1, 1)}, result)
+	assert.Nil(err)
+	assert.Equal(1, result.Retries.SequenceMismatches)
+	assert.Len(auditLog.entries, 4)
+	km.AssertExpectations(t)
+	client.AssertExpectations(t)
+}
+
 // func TestSend(t *testing.T) {
 // 	assert := assert.New(t)
 // 	et := execution.NewExecTest()
@@ -18,16 +245,7 @@ package handler
 // 		},
 // 		Sequence: 1,
 // 	}
-// 	alice := db.Record{
-// 		UserID:       "alice",
-// 		RaAddress:    aliceRa.PubKey.Address(),
-// 		RaPrivateKey: aliceRa.PrivKey,
-// 		RaPubKey:     aliceRa.PubKey,
-// 		SaAddress:    aliceSa.PubKey.Address(),
-// 		SaPrivateKey: aliceSa.PrivKey,
-// 		SaPubKey:     aliceSa.PubKey,
-// 	}
-// 	signedTx, err := prepareSendTx(sendArgs, alice, "test_chain_id")
+// 	signedTx, err := prepareSendTx(sendArgs, keymanager.NewLocalSigner(aliceRa.PrivKey), "test_chain_id")
 // 	assert.Nil(err)
 // 	assert.Equal(int64(0), signedTx.Fee.ThetaWei.Int64())
 // 	assert.Equal(ttypes.MinimumTransactionFeeGammaWei, signedTx.Fee.GammaWei.Uint64())
@@ -66,16 +284,7 @@ package handler
 // 		Sequence:    1,
 // 		Duration:    500,
 // 	}
-// 	alice := db.Record{
-// 		UserID:       "alice",
-// 		RaAddress:    aliceRa.PubKey.Address(),
-// 		RaPrivateKey: aliceRa.PrivKey,
-// 		RaPubKey:     aliceRa.PubKey,
-// 		SaAddress:    aliceSa.PubKey.Address(),
-// 		SaPrivateKey: aliceSa.PrivKey,
-// 		SaPubKey:     aliceSa.PubKey,
-// 	}
-// 	signedTx, err := prepareReserveFundTx(reserveFundArgs, alice, "test_chain_id")
+// 	signedTx, err := prepareReserveFundTx(reserveFundArgs, keymanager.NewLocalSigner(aliceSa.PrivKey), "test_chain_id")
 // 	assert.Nil(err)
 // 	assert.Equal(int64(0), signedTx.Fee.ThetaWei.Int64())
 // 	assert.Equal(ttypes.MinimumTransactionFeeGammaWei, signedTx.Fee.GammaWei.Uint64())
@@ -113,25 +322,16 @@ package handler
 // 		Duration:    500,
 // 	}
 // 	alice := db.Record{
-// 		UserID:       "alice",
-// 		RaAddress:    aliceRa.PubKey.Address(),
-// 		RaPrivateKey: aliceRa.PrivKey,
-// 		RaPubKey:     aliceRa.PubKey,
-// 		SaAddress:    aliceSa.PubKey.Address(),
-// 		SaPrivateKey: aliceSa.PrivKey,
-// 		SaPubKey:     aliceSa.PubKey,
-// 	}
-// 	bob := db.Record{
-// 		UserID:       "bob",
-// 		RaAddress:    bobRa.PubKey.Address(),
-// 		RaPrivateKey: bobRa.PrivKey,
-// 		RaPubKey:     bobRa.PubKey,
-// 		SaAddress:    bobSa.PubKey.Address(),
-// 		SaPrivateKey: bobSa.PrivKey,
-// 		SaPubKey:     bobSa.PubKey,
+// 		UserID:    "alice",
+// 		RaAddress: aliceRa.PubKey.Address(),
+// 		RaPubKey:  aliceRa.PubKey,
+// 		SaAddress: aliceSa.PubKey.Address(),
+// 		SaPubKey:  aliceSa.PubKey,
 // 	}
+// 	aliceSaSigner := keymanager.NewLocalSigner(aliceSa.PrivKey)
+// 	bobRaSigner := keymanager.NewLocalSigner(bobRa.PrivKey)
 
-// 	signedTx, err := prepareReserveFundTx(reserveFundArgs, alice, "test_chain_id")
+// 	signedTx, err := prepareReserveFundTx(reserveFundArgs, aliceSaSigner, "test_chain_id")
 // 	assert.Nil(err)
 // 	_, res := et.Executor().ExecuteTx(signedTx)
 // 	assert.True(res.IsOK())
@@ -154,7 +354,7 @@ package handler
 // 		PaymentSequence: 1,
 // 		ReserveSequence: 1,
 // 	}
-// 	paymentTx, err := prepareCreateServicePaymentTx(createServicePaymentArgs, alice, "test_chain_id")
+// 	paymentTx, err := prepareCreateServicePaymentTx(createServicePaymentArgs, alice, aliceSaSigner, "test_chain_id")
 // 	assert.Nil(err)
 
 // 	// 3. Submit service payment.
@@ -162,7 +362,7 @@ package handler
 // 		Payment:  paymentTx,
 // 		Sequence: 1,
 // 	}
-// 	submitPaymentTx, err := prepareSubmitServicePaymentTx(submitServiePaymentArgs, bob, "test_chain_id")
+// 	submitPaymentTx, err := prepareSubmitServicePaymentTx(submitServiePaymentArgs, bobRaSigner, "test_chain_id")
 // 	assert.Nil(err)
 
 // 	_, res = et.Executor().ExecuteTx(submitPaymentTx)
@@ -174,3 +374,626 @@ package handler
 // 	expected.Sub(expected, new(big.Int).SetUint64(ttypes.MinimumTransactionFeeGammaWei))
 // 	assert.Equal(0, expected.Cmp(endBobRABalance.GammaWei))
 // }
+
+type memIdempotencyStore struct {
+	records    map[string]db.IdempotencyRecord
+	failWrites bool // Fail completions and releases, as if vault stopped.
+}
+
+func (s *memIdempotencyStore) ClaimIdempotencyKey(rec db.IdempotencyRecord) (db.IdempotencyRecord, bool, error) {
+	if existing, ok := s.records[rec.UserID+"/"+rec.Key]; ok {
+		return existing, false, nil
+	}
+	rec.ClaimedAt = time.Now()
+	s.records[rec.UserID+"/"+rec.Key] = rec
+	return rec, true, nil
+}
+
+func (s *memIdempotencyStore) CompleteIdempotencyKey(rec db.IdempotencyRecord) error {
+	if s.failWrites {
+		return errors.New("database unavailable")
+	}
+	s.records[rec.UserID+"/"+rec.Key] = rec
+	return nil
+}
+
+func (s *memIdempotencyStore) ReleaseIdempotencyKey(userid, key string) error {
+	if s.failWrites {
+		return errors.New("database unavailable")
+	}
+	delete(s.records, userid+"/"+key)
+	return nil
+}
+
+func (s *memIdempotencyStore) ReclaimIdempotencyKey(userid, key string, claimedBefore time.Time) (bool, error) {
+	rec, ok := s.records[userid+"/"+key]
+	if !ok || rec.IsComplete() || !rec.ClaimedAt.Before(claimedBefore) {
+		return false, nil
+	}
+	rec.ClaimedAt = time.Now()
+	s.records[userid+"/"+key] = rec
+	return true, nil
+}
+
+type memTransactionStore struct {
+	txs []db.Transaction
+}
+
+func (s *memTransactionStore) CreateTransaction(tx db.Transaction) (bool, error) {
+	if _, err := s.FindTransaction(tx.Hash); err == nil {
+		return false, nil
+	}
+	s.txs = append(s.txs, tx)
+	return true, nil
+}
+
+func (s *memTransactionStore) FindTransaction(hash string) (db.Transaction, error) {
+	for _, tx := range s.txs {
+		if tx.Hash == hash {
+			return tx, nil
+		}
+	}
+	return db.Transaction{}, db.ErrNoRecord
+}
+
+func (s *memTransactionStore) FindTransactionByIdempotencyKey(userid, key string) (db.Transaction, error) {
+	for i := len(s.txs) - 1; i >= 0; i-- {
+		if s.txs[i].UserID == userid && s.txs[i].IdempotencyKey == key {
+			return s.txs[i], nil
+		}
+	}
+	return db.Transaction{}, db.ErrNoRecord
+}
+
+func (s *memTransactionStore) UpdateTransactionStatus(tx db.Transaction, fromStatus string) (bool, error) {
+	for i := range s.txs {
+		if s.txs[i].Hash == tx.Hash && s.txs[i].Status == fromStatus {
+			s.txs[i].Status, s.txs[i].BlockHeight, s.txs[i].Error = tx.Status, tx.BlockHeight, tx.Error
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestSendReplaysIdempotentRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	raPrivKey, _, err := crypto.GenerateKeyPair()
+	assert.Nil(err)
+	auditLog := &memAuditLog{}
+	raSigner := keymanager.NewAuditedSigner(raPrivKey, "alice", keymanager.RecvAccount, auditLog)
+
+	km := &keymanager.MockKeyManager{}
+	km.On("GetSigner", "alice", keymanager.RecvAccount).Return(raSigner, nil)
+	client := &MockRPCClient{}
+	client.On("Call", "theta.GetAccount", mock.Anything).Return(accountResponse(ttypes.NewCoins(1000, 1000)), nil)
+	client.On("Call", "theta.BroadcastRawTransaction", mock.Anything).Return(&rpcc.RPCResponse{Result: map[string]interface{}{}}, nil).Once()
+
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	r.Header.Set("X-Auth-User", "alice")
+	h := NewRPCHandler(client, km)
+	h.Idempotency = &memIdempotencyStore{records: map[string]db.IdempotencyRecord{}}
+
+	args := SendArgs{To: "0x01", Amount: ttypes.NewCoins(1, 1), Sequence: 7, IdempotencyKey: "k1"}
+	first := &BroadcastResult{}
+	replayArgs := args
+	assert.Nil(h.Send(r, &args, first))
+
+	// The replay is answered from the store without signing again.
+	replay := &BroadcastResult{}
+	assert.Nil(h.Send(r, &replayArgs, replay))
+	assert.Equal(first, replay)
+	assert.Len(auditLog.entries, 1)
+
+	// Reusing the key for another request is rejected.
+	args = SendArgs{To: "0x02", Amount: ttypes.NewCoins(1, 1), Sequence: 7, IdempotencyKey: "k1"}
+	err = h.Send(r, &args, &BroadcastResult{})
+	assert.Equal(ErrCodeIdempotencyConflict, err.(*json.Error).Code)
+
+	km.AssertExpectations(t)
+	client.AssertExpectations(t)
+}
+
+func TestIdempotentRequestRecoversStaleClaim(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set(util.CfgIdempotencyClaimTimeout, 60)
+	defer viper.Set(util.CfgIdempotencyClaimTimeout, 0)
+
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	h := NewRPCHandler(&MockRPCClient{}, &keymanager.MockKeyManager{})
+	store := &memIdempotencyStore{records: map[string]db.IdempotencyRecord{}}
+	txs := &memTransactionStore{}
+	h.Idempotency = store
+	h.Txs = txs
+	age := func(key string) {
+		rec := store.records["alice/"+key]
+		rec.ClaimedAt = time.Now().Add(-2 * time.Minute)
+		store.records["alice/"+key] = rec
+	}
+
+	runs := 0
+	fail := func(r *http.Request) error {
+		runs++
+		return errors.New("node unreachable")
+	}
+	succeed := func(r *http.Request) error {
+		runs++
+		return nil
+	}
+	args := &SendArgs{To: "0x01", Amount: ttypes.NewCoins(1, 1)}
+
+	// The key cannot be released, so the claim is left in progress.
+	store.failWrites = true
+	assert.EqualError(h.idempotent(r, "alice", "Send", "k1", args, &BroadcastResult{}, fail), "node unreachable")
+	store.failWrites = false
+	err := h.idempotent(r, "alice", "Send", "k1", args, &BroadcastResult{}, succeed)
+	assert.Equal(ErrCodeIdempotencyConflict, err.(*json.Error).Code)
+	assert.Equal(1, runs)
+
+	// Once stale, a claim without a transaction is taken over.
+	age("k1")
+	assert.Nil(h.idempotent(r, "alice", "Send", "k1", args, &BroadcastResult{}, succeed))
+	assert.Equal(2, runs)
+	assert.True(store.records["alice/k1"].IsComplete())
+
+	// A stale claim whose transaction was recorded is never run again.
+	store.failWrites = true
+	assert.NotNil(h.idempotent(r, "alice", "Send", "k2", args, &BroadcastResult{}, fail))
+	store.failWrites = false
+	txs.txs = append(txs.txs, db.Transaction{Hash: "0xabc", UserID: "alice", IdempotencyKey: "k2", Status: db.TxPending})
+	age("k2")
+	err = h.idempotent(r, "alice", "Send", "k2", args, &BroadcastResult{}, succeed)
+	assert.Equal(ErrCodeIdempotencyConflict, err.(*json.Error).Code)
+	assert.Equal(3, runs)
+	assert.Equal("0xabc", store.records["alice/k2"].TxHash)
+	assert.NotEqual("", store.records["alice/k2"].Error)
+}
+
+func TestGetTransactionStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	h := NewRPCHandler(&MockRPCClient{}, &keymanager.MockKeyManager{})
+	h.Txs = &memTransactionStore{txs: []db.Transaction{
+		{Hash: "0xaaa", UserID: "alice", TxType: "send", Status: db.TxIncluded, BlockHeight: 10, IdempotencyKey: "k1"},
+		{Hash: "0xbbb", UserID: "bob", TxType: "send", Status: db.TxPending, IdempotencyKey: "k1"},
+	}}
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	r.Header.Set("X-Auth-User", "alice")
+
+	result := &GetTransactionStatusResult{}
+	assert.Nil(h.GetTransactionStatus(r, &GetTransactionStatusArgs{TxHash: "0xaaa"}, result))
+	assert.Equal("alice", result.UserID)
+	assert.Equal(db.TxIncluded, result.Status)
+	assert.Equal(tcmn.JSONUint64(10), result.BlockHeight)
+
+	result = &GetTransactionStatusResult{}
+	assert.Nil(h.GetTransactionStatus(r, &GetTransactionStatusArgs{IdempotencyKey: "k1"}, result))
+	assert.Equal("0xaaa", result.TxHash)
+
+	// Transactions of other users are not found.
+	err := h.GetTransactionStatus(r, &GetTransactionStatusArgs{TxHash: "0xbbb"}, &GetTransactionStatusResult{})
+	assert.Equal(ErrCodeTransactionNotFound, err.(*json.Error).Code)
+	err = h.GetTransactionStatus(r, &GetTransactionStatusArgs{TxHash: "0xccc"}, &GetTransactionStatusResult{})
+	assert.Equal(ErrCodeTransactionNotFound, err.(*json.Error).Code)
+	err = h.GetTransactionStatus(r, &GetTransactionStatusArgs{IdempotencyKey: "k2"}, &GetTransactionStatusResult{})
+	assert.Equal(ErrCodeTransactionNotFound, err.(*json.Error).Code)
+}
+
+func TestSendDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	raPrivKey, _, err := crypto.GenerateKeyPair()
+	assert.Nil(err)
+	auditLog := &memAuditLog{}
+	raSigner := keymanager.NewAuditedSigner(raPrivKey, "alice", keymanager.RecvAccount, auditLog)
+
+	km := &keymanager.MockKeyManager{}
+	km.On("GetSigner", "alice", keymanager.RecvAccount).Return(raSigner, nil)
+	client := &MockRPCClient{}
+	client.On("Call", "theta.GetAccount", mock.Anything).Return(accountResponse(ttypes.NewCoins(1000, 1000)), nil).Twice()
+
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	r.Header.Set("X-Auth-User", "alice")
+	h := NewRPCHandler(client, km)
+
+	// Dry runs do not consume the sequence they are signed with.
+	var result *BroadcastResult
+	for i := 0; i < 2; i++ {
+		result = &BroadcastResult{}
+		err = h.Send(r, &SendArgs{To: "0x01", Amount: ttypes.NewCoins(1, 1), DryRun: true}, result)
+		assert.Nil(err)
+		assert.Nil(result.BroadcastRawTransactionResult)
+		assert.Equal("send", result.DryRun.Type)
+		assert.Equal(tcmn.JSONUint64(1), result.DryRun.Sequence)
+		assert.Equal(raSigner.Address().Hex(), result.DryRun.Inputs[0].Address)
+		assert.Equal(1, len(result.DryRun.Outputs))
+		assert.Equal("0", result.DryRun.Fee.ThetaWei.String())
+		assert.Equal(strconv.FormatUint(ttypes.MinimumTransactionFeeGammaWei, 10), result.DryRun.Fee.GammaWei.String())
+
+		// The transaction is returned signed, as it would be broadcast.
+		raw, err := hex.DecodeString(result.DryRun.Tx)
+		assert.Nil(err)
+		assert.Equal(crypto.Keccak256Hash(raw).Hex(), result.DryRun.TxHash)
+		tx, err := ttypes.TxFromBytes(raw)
+		assert.Nil(err)
+		sendTx, ok := tx.(*ttypes.SendTx)
+		if assert.True(ok) {
+			assert.NotNil(sendTx.Inputs[0].Signature)
+		}
+	}
+
+	// Each dry run is in the signing audit log.
+	if assert.Len(auditLog.entries, 2) {
+		assert.Equal(result.DryRun.TxHash, auditLog.entries[1].TxHash)
+	}
+
+	km.AssertExpectations(t)
+	client.AssertExpectations(t)
+}
+
+func TestSendRejectsInsufficientFunds(t *testing.T) {
+	assert := assert.New(t)
+
+	raPrivKey, _, err := crypto.GenerateKeyPair()
+	assert.Nil(err)
+	auditLog := &memAuditLog{}
+	raSigner := keymanager.NewAuditedSigner(raPrivKey, "alice", keymanager.RecvAccount, auditLog)
+
+	km := &keymanager.MockKeyManager{}
+	km.On("GetSigner", "alice", keymanager.RecvAccount).Return(raSigner, nil)
+	client := &MockRPCClient{}
+	client.On("Call", "theta.GetAccount", mock.Anything).Return(accountResponse(ttypes.NewCoins(10, 10)), nil)
+
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	r.Header.Set("X-Auth-User", "alice")
+	h := NewRPCHandler(client, km)
+	err = h.Send(r, &SendArgs{To: "0x01", Amount: ttypes.NewCoins(20, 5)}, &BroadcastResult{})
+	rpcErr, ok := err.(*json.Error)
+	assert.True(ok)
+	assert.Equal(ErrCodeInsufficientFunds, rpcErr.Code)
+	data := rpcErr.Data.(map[string]interface{})
+	assert.Equal("20", data["required"].(map[string]string)["thetawei"])
+	assert.Equal("10", data["available"].(map[string]string)["thetawei"])
+
+	// Nothing is signed or broadcast.
+	assert.Empty(auditLog.entries)
+	client.AssertNotCalled(t, "Call", "theta.BroadcastRawTransaction", mock.Anything)
+}
+
+func TestBatchSendSplitsOutputs(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set(util.CfgSequencePendingTimeout, 60)
+	defer viper.Reset()
+
+	raPrivKey, _, err := crypto.GenerateKeyPair()
+	assert.Nil(err)
+	auditLog := &memAuditLog{}
+	raSigner := keymanager.NewAuditedSigner(raPrivKey, "alice", keymanager.RecvAccount, auditLog)
+
+	km := &keymanager.MockKeyManager{}
+	km.On("GetSigner", "alice", keymanager.RecvAccount).Return(raSigner, nil)
+	client := &MockRPCClient{}
+	client.On("Call", "theta.GetAccount", mock.Anything).Return(accountResponse(ttypes.NewCoins(1000, 1000)), nil)
+	client.On("Call", "theta.BroadcastRawTransaction", mock.Anything).Return(&rpcc.RPCResponse{Result: map[string]interface{}{}}, nil).Times(3)
+
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	r.Header.Set("X-Auth-User", "alice")
+	h := NewRPCHandler(client, km)
+
+	args := &BatchSendArgs{}
+	for i := 1; i <= 5; i++ {
+		args.Recipients = append(args.Recipients, Recipient{
+			To:     tcmn.BytesToAddress([]byte{byte(i)}).Hex(),
+			Amount: ttypes.NewCoins(int64(i), 0),
+		})
+	}
+	// Transactions are split once they would exceed the size of one paying two
+	// recipients.
+	outputs, _, err := batchOutputs(args)
+	assert.Nil(err)
+	fee := ttypes.NewCoins(0, int64(ttypes.MinimumTransactionFeeGammaWei))
+	size, err := batchTxSize(outputs[:2], fee, raSigner)
+	assert.Nil(err)
+	viper.Set(util.CfgBatchSendMaxTxBytes, size)
+
+	total := ttypes.NewCoins(16, 0)
+	args.Total = &total
+	err = h.BatchSend(r, args, &BatchSendResult{})
+	assert.NotNil(err)
+
+	total = ttypes.NewCoins(15, 0)
+	result := &BatchSendResult{}
+	err = h.BatchSend(r, args, result)
+	assert.Nil(err)
+	assert.Equal(3, len(result.Transactions))
+	for i, tx := range result.Transactions {
+		assert.Equal(i*2, tx.First)
+		assert.Equal(tcmn.JSONUint64(i+1), tx.Sequence)
+	}
+	assert.Equal(1, result.Transactions[2].Count)
+	assert.Len(auditLog.entries, 3)
+
+	// A limit no transaction fits in is refused.
+	viper.Set(util.CfgBatchSendMaxTxBytes, 0)
+	err = h.BatchSend(r, args, &BatchSendResult{})
+	assert.NotNil(err)
+
+	km.AssertExpectations(t)
+	client.AssertExpectations(t)
+}
+
+func TestTopUpSendAccount(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set(util.CfgTopUpEnabled, true)
+	viper.Set(util.CfgTopUpThresholdThetaWei, "0")
+	viper.Set(util.CfgTopUpThresholdGammaWei, "100")
+	viper.Set(util.CfgTopUpTargetThetaWei, "0")
+	viper.Set(util.CfgTopUpTargetGammaWei, "500")
+	viper.Set(util.CfgTopUpCooldown, 60)
+	defer viper.Reset()
+
+	saPrivKey, _, err := crypto.GenerateKeyPair()
+	assert.Nil(err)
+	auditLog := &memAuditLog{}
+	saSigner := keymanager.NewAuditedSigner(saPrivKey, "alice", keymanager.SendAccount, auditLog)
+	raPrivKey, _, err := crypto.GenerateKeyPair()
+	assert.Nil(err)
+	raSigner := keymanager.NewAuditedSigner(raPrivKey, "alice", keymanager.RecvAccount, auditLog)
+
+	km := &keymanager.MockKeyManager{}
+	km.On("GetSigner", "alice", keymanager.SendAccount).Return(saSigner, nil)
+	km.On("GetSigner", "alice", keymanager.RecvAccount).Return(raSigner, nil)
+	client := &MockRPCClient{}
+	client.On("Call", "theta.GetAccount", ukulele.GetAccountArgs{Address: saSigner.Address().String()}).Return(accountResponse(ttypes.NewCoins(0, 50)), nil)
+	client.On("Call", "theta.GetAccount", ukulele.GetAccountArgs{Address: raSigner.Address().String()}).Return(accountResponse(ttypes.NewCoins(0, 1000)), nil)
+	client.On("Call", "theta.BroadcastRawTransaction", mock.Anything).Return(&rpcc.RPCResponse{Result: map[string]interface{}{}}, nil).Once()
+
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	h := NewRPCHandler(client, km)
+	h.topUpSendAccount(r, "alice")
+
+	// Top-ups wait for the cooldown.
+	h.topUpSendAccount(r, "alice")
+
+	if assert.Len(auditLog.entries, 1) {
+		entry := auditLog.entries[0]
+		assert.Equal("RA", entry.Role)
+		assert.Equal(saSigner.Address().Hex(), entry.Destination)
+		assert.Equal("450", entry.GammaWei)
+	}
+	km.AssertExpectations(t)
+	client.AssertExpectations(t)
+}
+
+func TestSendToUserID(t *testing.T) {
+	assert := assert.New(t)
+
+	raPrivKey, _, err := crypto.GenerateKeyPair()
+	assert.Nil(err)
+	auditLog := &memAuditLog{}
+	raSigner := keymanager.NewAuditedSigner(raPrivKey, "alice", keymanager.RecvAccount, auditLog)
+	bobRA := tcmn.HexToAddress("0x00000000000000000000000000000000000000b0")
+
+	km := &keymanager.MockKeyManager{}
+	km.On("GetSigner", "alice", keymanager.RecvAccount).Return(raSigner, nil)
+	km.On("FindByUserId", "bob").Return(db.Record{UserID: "bob", RaAddress: bobRA}, nil)
+	km.On("FindByUserId", "carol").Return(db.Record{}, keymanager.ErrAccountNotFound)
+	client := &MockRPCClient{}
+	client.On("Call", "theta.GetAccount", mock.Anything).Return(accountResponse(ttypes.NewCoins(1000, 1000)), nil)
+	client.On("Call", "theta.BroadcastRawTransaction", mock.Anything).Return(&rpcc.RPCResponse{Result: map[string]interface{}{}}, nil).Once()
+
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	r.Header.Set("X-Auth-User", "alice")
+	h := NewRPCHandler(client, km)
+	err = h.Send(r, &SendArgs{ToUserID: "bob", Amount: ttypes.NewCoins(1, 1)}, &BroadcastResult{})
+	assert.Nil(err)
+	if assert.Len(auditLog.entries, 1) {
+		assert.Equal(bobRA.Hex(), auditLog.entries[0].Destination)
+	}
+
+	err = h.Send(r, &SendArgs{ToUserID: "carol", Amount: ttypes.NewCoins(1, 1)}, &BroadcastResult{})
+	assert.Equal(ErrCodeAccountNotFound, err.(*json.Error).Code)
+
+	err = h.Send(r, &SendArgs{To: bobRA.Hex(), ToUserID: "bob", Amount: ttypes.NewCoins(1, 1)}, &BroadcastResult{})
+	assert.NotNil(err)
+
+	km.AssertExpectations(t)
+	client.AssertExpectations(t)
+}
+
+type memAllowlistStore struct {
+	entries map[string]db.WithdrawalAddress
+	managed map[tcmn.Address]string
+}
+
+func (s *memAllowlistStore) AddWithdrawalAddress(entry db.WithdrawalAddress) (bool, error) {
+	if _, ok := s.entries[entry.UserID+"/"+entry.Address.Hex()]; ok {
+		return false, nil
+	}
+	s.entries[entry.UserID+"/"+entry.Address.Hex()] = entry
+	return true, nil
+}
+
+func (s *memAllowlistStore) FindWithdrawalAddress(userid string, address tcmn.Address) (db.WithdrawalAddress, error) {
+	entry, ok := s.entries[userid+"/"+address.Hex()]
+	if !ok {
+		return db.WithdrawalAddress{}, db.ErrNoRecord
+	}
+	return entry, nil
+}
+
+func (s *memAllowlistStore) ListWithdrawalAddresses(userid string) ([]db.WithdrawalAddress, error) {
+	var entries []db.WithdrawalAddress
+	for _, entry := range s.entries {
+		if entry.UserID == userid {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (s *memAllowlistStore) RemoveWithdrawalAddress(userid string, address tcmn.Address) (bool, error) {
+	_, ok := s.entries[userid+"/"+address.Hex()]
+	delete(s.entries, userid+"/"+address.Hex())
+	return ok, nil
+}
+
+func (s *memAllowlistStore) FindUserByAddress(address tcmn.Address) (string, string, error) {
+	userid, ok := s.managed[address]
+	if !ok {
+		return "", "", db.ErrNoRecord
+	}
+	return userid, "RA", nil
+}
+
+func TestSendRequiresActiveWithdrawalAddress(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set(util.CfgAllowlistEnabled, true)
+	viper.Set(util.CfgAllowlistDelay, 3600)
+	defer viper.Set(util.CfgAllowlistEnabled, false)
+
+	raPrivKey, _, err := crypto.GenerateKeyPair()
+	assert.Nil(err)
+	auditLog := &memAuditLog{}
+	raSigner := keymanager.NewAuditedSigner(raPrivKey, "alice", keymanager.RecvAccount, auditLog)
+	external := tcmn.HexToAddress("0x00000000000000000000000000000000000000e0")
+	bobRA := tcmn.HexToAddress("0x00000000000000000000000000000000000000b0")
+
+	km := &keymanager.MockKeyManager{}
+	km.On("GetSigner", "alice", keymanager.RecvAccount).Return(raSigner, nil)
+	km.On("GetSigner", "alice", keymanager.SendAccount).Return(raSigner, nil)
+	km.On("FindByUserId", "alice").Return(db.Record{UserID: "alice", RaAddress: raSigner.Address()}, nil)
+	client := &MockRPCClient{}
+	client.On("Call", "theta.GetAccount", mock.Anything).Return(accountResponse(ttypes.NewCoins(1000, 1000)), nil)
+	client.On("Call", "theta.BroadcastRawTransaction", mock.Anything).Return(&rpcc.RPCResponse{Result: map[string]interface{}{}}, nil).Twice()
+
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	r.Header.Set("X-Auth-User", "alice")
+	h := NewRPCHandler(client, km)
+	store := &memAllowlistStore{entries: map[string]db.WithdrawalAddress{}, managed: map[tcmn.Address]string{bobRA: "bob"}}
+	h.Allowlists = store
+
+	// Addresses of vault users are exempt.
+	err = h.Send(r, &SendArgs{To: bobRA.Hex(), Amount: ttypes.NewCoins(1, 1)}, &BroadcastResult{})
+	assert.Nil(err)
+
+	err = h.Send(r, &SendArgs{To: external.Hex(), Amount: ttypes.NewCoins(1, 1)}, &BroadcastResult{})
+	assert.Equal(ErrCodeAddressNotAllowed, err.(*json.Error).Code)
+
+	// Dry runs are signed, so they are checked too.
+	err = h.Send(r, &SendArgs{To: external.Hex(), Amount: ttypes.NewCoins(1, 1), DryRun: true}, &BroadcastResult{})
+	assert.Equal(ErrCodeAddressNotAllowed, err.(*json.Error).Code)
+
+	payment := &CreateServicePaymentArgs{To: external.Hex(), Amount: (*tcmn.JSONBig)(big.NewInt(1)), ResourceId: "video", PaymentSequence: 1, ReserveSequence: 1}
+	err = h.CreateServicePayment(r, payment, &CreateServicePaymentResult{})
+	assert.Equal(ErrCodeAddressNotAllowed, err.(*json.Error).Code)
+
+	added := &AddWithdrawalAddressResult{}
+	err = h.AddWithdrawalAddress(r, &AddWithdrawalAddressArgs{Address: external.Hex(), Label: "exchange"}, added)
+	assert.Nil(err)
+	assert.True(added.Added)
+	assert.False(added.Active)
+	assert.Equal(added.CreatedAt+3600, added.ActiveAt)
+
+	err = h.Send(r, &SendArgs{To: external.Hex(), Amount: ttypes.NewCoins(1, 1)}, &BroadcastResult{})
+	assert.Equal(ErrCodeAddressNotAllowed, err.(*json.Error).Code)
+
+	entry := store.entries["alice/"+external.Hex()]
+	entry.ActiveAt = time.Now().Add(-time.Second)
+	store.entries["alice/"+external.Hex()] = entry
+	err = h.Send(r, &SendArgs{To: external.Hex(), Amount: ttypes.NewCoins(1, 1)}, &BroadcastResult{})
+	assert.Nil(err)
+	assert.Len(auditLog.entries, 2)
+
+	km.AssertExpectations(t)
+	client.AssertExpectations(t)
+}
+
+type memLimitStore struct {
+	daily *big.Int
+}
+
+func (s *memLimitStore) FindUserLimits(userid string) (db.UserLimits, error) {
+	return db.UserLimits{}, db.ErrNoRecord
+}
+
+func (s *memLimitStore) SaveUserLimits(limits db.UserLimits) error {
+	return nil
+}
+
+func (s *memLimitStore) ChargeSpending(spending db.Spending, limits db.SpendingLimits) (*db.LimitExceeded, error) {
+	spent := new(big.Int).Add(s.daily, spending.GammaWei)
+	if limits.Daily.GammaWei != nil && spent.Cmp(limits.Daily.GammaWei) > 0 {
+		return &db.LimitExceeded{Limit: db.LimitDaily, Currency: "gammawei", Max: limits.Daily.GammaWei, Used: s.daily}, nil
+	}
+	s.daily = spent
+	return nil, nil
+}
+
+func (s *memLimitStore) RefundSpending(spending db.Spending) error {
+	s.daily = new(big.Int).Sub(s.daily, spending.GammaWei)
+	return nil
+}
+
+func (s *memLimitStore) ReleaseReservedFund(userid string, reserveSequence uint64) error {
+	return nil
+}
+
+func (s *memLimitStore) SpendingUsage(userid string, now time.Time) (db.SpendingUsage, error) {
+	return db.SpendingUsage{Daily: db.Amount{ThetaWei: new(big.Int), GammaWei: s.daily}}, nil
+}
+
+func TestSendEnforcesSpendingLimits(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set(util.CfgLimitsEnabled, true)
+	viper.Set(util.CfgLimitsDefaultTier, "default")
+	viper.Set(util.CfgLimitsTiers+".default.per_tx_gammawei", "500")
+	viper.Set(util.CfgLimitsTiers+".default.daily_gammawei", "800")
+	defer viper.Set(util.CfgLimitsEnabled, false)
+
+	raPrivKey, _, err := crypto.GenerateKeyPair()
+	assert.Nil(err)
+	auditLog := &memAuditLog{}
+	raSigner := keymanager.NewAuditedSigner(raPrivKey, "alice", keymanager.RecvAccount, auditLog)
+	saAddress := tcmn.HexToAddress("0x00000000000000000000000000000000000000a0")
+	external := tcmn.HexToAddress("0x00000000000000000000000000000000000000e0")
+
+	km := &keymanager.MockKeyManager{}
+	km.On("GetSigner", "alice", keymanager.RecvAccount).Return(raSigner, nil)
+	km.On("FindByUserId", "alice").Return(db.Record{UserID: "alice", RaAddress: raSigner.Address(), SaAddress: saAddress}, nil)
+	client := &MockRPCClient{}
+	client.On("Call", "theta.GetAccount", mock.Anything).Return(accountResponse(ttypes.NewCoins(1000, 10000)), nil)
+	client.On("Call", "theta.BroadcastRawTransaction", mock.Anything).Return(&rpcc.RPCResponse{Result: map[string]interface{}{}}, nil).Twice()
+
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	r.Header.Set("X-Auth-User", "alice")
+	h := NewRPCHandler(client, km)
+	store := &memLimitStore{daily: new(big.Int)}
+	h.Limits = store
+
+	err = h.Send(r, &SendArgs{To: external.Hex(), Amount: ttypes.NewCoins(0, 600)}, &BroadcastResult{})
+	assert.Equal(ErrCodeTransactionLimit, err.(*json.Error).Code)
+
+	err = h.Send(r, &SendArgs{To: external.Hex(), Amount: ttypes.NewCoins(0, 400)}, &BroadcastResult{})
+	assert.Nil(err)
+
+	err = h.Send(r, &SendArgs{To: external.Hex(), Amount: ttypes.NewCoins(0, 401)}, &BroadcastResult{})
+	assert.Equal(ErrCodeDailyLimit, err.(*json.Error).Code)
+	assert.Equal("400", err.(*json.Error).Data.(map[string]string)["used"])
+
+	// Transfers to the other account of the user are not outflow.
+	err = h.Send(r, &SendArgs{To: saAddress.Hex(), Amount: ttypes.NewCoins(0, 450)}, &BroadcastResult{})
+	assert.Nil(err)
+	assert.Equal(int64(400), store.daily.Int64())
+
+	// Dry runs can be broadcast by the caller, so they are charged too.
+	err = h.Send(r, &SendArgs{To: external.Hex(), Amount: ttypes.NewCoins(0, 401), DryRun: true}, &BroadcastResult{})
+	assert.Equal(ErrCodeDailyLimit, err.(*json.Error).Code)
+	err = h.Send(r, &SendArgs{To: external.Hex(), Amount: ttypes.NewCoins(0, 300), DryRun: true}, &BroadcastResult{})
+	assert.Nil(err)
+	assert.Equal(int64(700), store.daily.Int64())
+	assert.Len(auditLog.entries, 3)
+
+	km.AssertExpectations(t)
+	client.AssertExpectations(t)
+}
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/util"
+)
+
+// idempotentRequest carries the idempotency key of a request down to submitTx,
+// which reports back the transaction it broadcast.
+type idempotentRequest struct {
+	key            string
+	txHash         string // Last transaction broadcast for the request.
+	mayBeBroadcast bool   // Set if the request failed after txHash may have reached the node.
+}
+
+type idempotentRequestKey struct{}
+
+func idempotentRequestFrom(r *http.Request) *idempotentRequest {
+	req, _ := r.Context().Value(idempotentRequestKey{}).(*idempotentRequest)
+	return req
+}
+
+// idempotent runs a state changing request of the user at most once per
+// idempotency key. Replays of a completed request get the result of the original
+// one, unmarshalled into result. Requests without a key always run.
+//
+// The key is released if the request fails before its transaction could reach
+// the node, so that it can be retried. Requests failing after that are kept as
+// failed with an unknown outcome; clients should look up their transaction with
+// GetTransactionStatus instead of retrying. Claims left in progress longer than
+// the claim timeout are recovered by reclaimIdempotencyKey.
+func (h *ThetaRPCHandler) idempotent(r *http.Request, userid, method, key string, args, result interface{}, run func(r *http.Request) error) error {
+	if key == "" {
+		return run(r)
+	}
+	if h.Idempotency == nil {
+		return errors.New("Idempotency keys are not supported by the database")
+	}
+	logger := log.WithFields(log.Fields{"method": "idempotent", "userid": userid, "idempotency_key": key, "request_id": r.Header.Get(util.RequestIDHeader)})
+
+	params, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	requestHash := sha256.Sum256(append([]byte(method+"\n"), params...))
+	rec := db.IdempotencyRecord{
+		UserID:      userid,
+		Key:         key,
+		Method:      method,
+		RequestHash: hex.EncodeToString(requestHash[:]),
+	}
+	existing, claimed, err := h.Idempotency.ClaimIdempotencyKey(rec)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		switch {
+		case existing.Method != rec.Method || existing.RequestHash != rec.RequestHash:
+			return idempotencyConflictError(key, "idempotency key already used with different parameters", "")
+		case !existing.IsComplete():
+			if claimed, err = h.reclaimIdempotencyKey(r, existing); err != nil {
+				return err
+			}
+			if !claimed {
+				return idempotencyConflictError(key, "request with the idempotency key is in progress", "")
+			}
+			logger.Warn("Retrying idempotent request abandoned before its transaction was recorded")
+		case existing.Error != "":
+			return idempotencyConflictError(key, "request with the idempotency key failed with an unknown outcome: "+existing.Error, existing.TxHash)
+		default:
+			logger.Info("Replaying result of idempotent request")
+			return json.Unmarshal(existing.Result, result)
+		}
+	}
+
+	req := &idempotentRequest{key: key}
+	err = run(r.WithContext(context.WithValue(r.Context(), idempotentRequestKey{}, req)))
+	if err != nil && !req.mayBeBroadcast {
+		if releaseErr := h.Idempotency.ReleaseIdempotencyKey(userid, key); releaseErr != nil {
+			logger.WithFields(log.Fields{"error": releaseErr}).Error("Failed to release idempotency key")
+		}
+		return err
+	}
+
+	rec.TxHash = req.txHash
+	if err != nil {
+		rec.Error = err.Error()
+	} else if rec.Result, err = json.Marshal(result); err != nil {
+		return err
+	}
+	if completeErr := h.Idempotency.CompleteIdempotencyKey(rec); completeErr != nil {
+		// The request went through, the key stays claimed and replays are rejected
+		// as in progress rather than signing again.
+		logger.WithFields(log.Fields{"hash": rec.TxHash, "error": completeErr}).Error("Failed to save result of idempotent request")
+	}
+	return err
+}
+
+// reclaimIdempotencyKey takes over the claim of a request that has not completed
+// within the claim timeout, e.g. because vault stopped while serving it. The claim
+// is only taken over if the request recorded no transaction, so that nothing is
+// signed twice; otherwise the request is completed as failed with an unknown
+// outcome. Without transaction tracking, claims are never taken over.
+func (h *ThetaRPCHandler) reclaimIdempotencyKey(r *http.Request, existing db.IdempotencyRecord) (bool, error) {
+	timeout := time.Duration(viper.GetInt64(util.CfgIdempotencyClaimTimeout)) * time.Second
+	claimedBefore := time.Now().Add(-timeout)
+	if h.Txs == nil || timeout <= 0 || existing.ClaimedAt.After(claimedBefore) {
+		return false, nil
+	}
+
+	tx, err := h.Txs.FindTransactionByIdempotencyKey(existing.UserID, existing.Key)
+	if err == db.ErrNoRecord {
+		return h.Idempotency.ReclaimIdempotencyKey(existing.UserID, existing.Key, claimedBefore)
+	}
+	if err != nil {
+		return false, err
+	}
+	existing.TxHash = tx.Hash
+	existing.Error = "request was interrupted after its transaction was recorded"
+	if err := h.Idempotency.CompleteIdempotencyKey(existing); err != nil {
+		return false, err
+	}
+	log.WithFields(log.Fields{"method": "reclaimIdempotencyKey", "userid": existing.UserID, "idempotency_key": existing.Key, "hash": tx.Hash, "request_id": r.Header.Get(util.RequestIDHeader)}).Warn("Completed abandoned idempotent request")
+	return false, idempotencyConflictError(existing.Key, "request with the idempotency key failed with an unknown outcome: "+existing.Error, existing.TxHash)
+}
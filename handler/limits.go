@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/policy"
+	"github.com/thetatoken/vault/util"
+)
+
+var errNoSpendingLimits = policy.ErrNoSpendingLimits
+
+// LimitAmount is a limit or usage in ThetaWei and GammaWei. Limits left empty are
+// not capped.
+type LimitAmount struct {
+	ThetaWei string `json:"thetawei,omitempty"`
+	GammaWei string `json:"gammawei,omitempty"`
+}
+
+type SpendingLimits struct {
+	PerTransaction LimitAmount `json:"per_transaction"`
+	Daily          LimitAmount `json:"daily"`          // Outflow per UTC day.
+	Monthly        LimitAmount `json:"monthly"`        // Outflow per UTC month.
+	ReservedFunds  *int64      `json:"reserved_funds"` // Reserved funds held at once.
+}
+
+// ------------------------------- GetSpendingLimits -----------------------------------
+
+type GetSpendingLimitsArgs struct{}
+
+type SpendingUsage struct {
+	Daily         LimitAmount `json:"daily"`
+	Monthly       LimitAmount `json:"monthly"`
+	ReservedFunds int64       `json:"reserved_funds"`
+}
+
+type GetSpendingLimitsResult struct {
+	Enabled bool           `json:"enabled"` // False if limits are not enforced.
+	Tier    string         `json:"tier"`
+	Limits  SpendingLimits `json:"limits"`
+	Usage   SpendingUsage  `json:"usage"`
+}
+
+// GetSpendingLimits returns the limits of the user in request header and what the
+// user spent of them.
+func (h *ThetaRPCHandler) GetSpendingLimits(r *http.Request, args *GetSpendingLimitsArgs, result *GetSpendingLimitsResult) error {
+	if h.Limits == nil {
+		return errNoSpendingLimits
+	}
+	record, err := h.getRecord(r)
+	if err != nil {
+		return err
+	}
+	tier, limits, err := policy.UserLimits(h.Limits, record.UserID)
+	if err != nil {
+		return err
+	}
+	usage, err := h.Limits.SpendingUsage(record.UserID, time.Now())
+	if err != nil {
+		return err
+	}
+	result.Enabled = viper.GetBool(util.CfgLimitsEnabled)
+	result.Tier = tier
+	result.Limits = spendingLimits(limits)
+	result.Usage = SpendingUsage{
+		Daily:         limitAmount(usage.Daily),
+		Monthly:       limitAmount(usage.Monthly),
+		ReservedFunds: usage.ReservedFunds,
+	}
+	return nil
+}
+
+// txSpending returns what tx is charged against the limits of the user. See
+// policy.TxSpending.
+func (h *ThetaRPCHandler) txSpending(userid string, tx ttypes.Tx) (*db.Spending, error) {
+	spending, err := policy.TxSpending(h.KeyManager, userid, tx)
+	if err != nil {
+		return nil, keyManagerError(userid, err)
+	}
+	return spending, nil
+}
+
+// chargeLimits charges the spending against the limits of its user, or returns a
+// limit exceeded error. A nil spending is not charged.
+func (h *ThetaRPCHandler) chargeLimits(spending *db.Spending) error {
+	return policyError(policy.ChargeLimits(h.Limits, spending))
+}
+
+// refundLimits reverts the charge of a transaction that was not sent.
+func (h *ThetaRPCHandler) refundLimits(r *http.Request, spending *db.Spending) {
+	if spending == nil {
+		return
+	}
+	if err := h.Limits.RefundSpending(*spending); err != nil {
+		log.WithFields(log.Fields{"method": "refundLimits", "userid": spending.UserID, "request_id": r.Header.Get(util.RequestIDHeader), "error": err}).Error("Failed to refund spending")
+	}
+}
+
+// releaseReservedFund stops counting a released fund toward the reserved funds
+// limit. Funds left on record expire on their own.
+func (h *ThetaRPCHandler) releaseReservedFund(r *http.Request, userid string, reserveSequence uint64) {
+	if !viper.GetBool(util.CfgLimitsEnabled) || h.Limits == nil {
+		return
+	}
+	if err := h.Limits.ReleaseReservedFund(userid, reserveSequence); err != nil {
+		log.WithFields(log.Fields{"method": "releaseReservedFund", "userid": userid, "reserve_sequence": reserveSequence, "request_id": r.Header.Get(util.RequestIDHeader), "error": err}).Error("Failed to release reserved fund")
+	}
+}
+
+func spendingLimits(limits db.SpendingLimits) SpendingLimits {
+	return SpendingLimits{
+		PerTransaction: limitAmount(limits.PerTransaction),
+		Daily:          limitAmount(limits.Daily),
+		Monthly:        limitAmount(limits.Monthly),
+		ReservedFunds:  limits.ReservedFunds,
+	}
+}
+
+func limitAmount(amount db.Amount) LimitAmount {
+	var res LimitAmount
+	if amount.ThetaWei != nil {
+		res.ThetaWei = amount.ThetaWei.String()
+	}
+	if amount.GammaWei != nil {
+		res.GammaWei = amount.GammaWei.String()
+	}
+	return res
+}
+
+// dbLimits parses limits given in a request. Empty amounts are left nil.
+func dbLimits(limits SpendingLimits) (db.SpendingLimits, error) {
+	res := db.SpendingLimits{ReservedFunds: limits.ReservedFunds}
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  **big.Int
+	}{
+		{"per_transaction.thetawei", limits.PerTransaction.ThetaWei, &res.PerTransaction.ThetaWei},
+		{"per_transaction.gammawei", limits.PerTransaction.GammaWei, &res.PerTransaction.GammaWei},
+		{"daily.thetawei", limits.Daily.ThetaWei, &res.Daily.ThetaWei},
+		{"daily.gammawei", limits.Daily.GammaWei, &res.Daily.GammaWei},
+		{"monthly.thetawei", limits.Monthly.ThetaWei, &res.Monthly.ThetaWei},
+		{"monthly.gammawei", limits.Monthly.GammaWei, &res.Monthly.GammaWei},
+	} {
+		amount, err := policy.ParseLimit(field.value)
+		if err != nil {
+			return db.SpendingLimits{}, errors.Wrapf(err, "Invalid %s", field.name)
+		}
+		*field.dest = amount
+	}
+	if res.ReservedFunds != nil && *res.ReservedFunds < 0 {
+		return db.SpendingLimits{}, errors.New("Invalid reserved_funds")
+	}
+	return res, nil
+}
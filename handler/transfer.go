@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/util"
+)
+
+// ------------------------------- TransferBetweenAccounts -----------------------------------
+
+type TransferBetweenAccountsArgs struct {
+	From           string          `json:"from"`            // Required. Account to transfer from, SA or RA. Funds go to the other account of the user.
+	Amount         ttypes.Coins    `json:"amount"`          // Required. The amount to transfer.
+	Fee            *tcmn.JSONBig   `json:"fee"`             // Optional. Transaction fee. Default to 0.
+	Sequence       tcmn.JSONUint64 `json:"sequence"`        // Optional. Sequence number of this transaction. Allocated by vault if omitted.
+	IdempotencyKey string          `json:"idempotency_key"` // Optional. Replays of the request with the same key return the original result.
+	DryRun         bool            `json:"dry_run"`         // Optional. Sign the transaction and return it without broadcasting it.
+}
+
+func (h *ThetaRPCHandler) TransferBetweenAccounts(r *http.Request, args *TransferBetweenAccountsArgs, result *BroadcastResult) (err error) {
+	var from keymanager.AccountRole
+	switch args.From {
+	case string(keymanager.SendAccount), string(keymanager.RecvAccount):
+		from = keymanager.AccountRole(args.From)
+	default:
+		return errors.Errorf("Invalid from account: %s", args.From)
+	}
+	if !args.Amount.NoNil().IsPositive() {
+		return errors.New("Invalid amount")
+	}
+	record, err := h.getRecord(r)
+	if err != nil {
+		return err
+	}
+	signer, err := h.getSigner(r, from)
+	if err != nil {
+		return err
+	}
+
+	sendArgs := &SendArgs{To: record.SaAddress.Hex(), Amount: args.Amount, Fee: args.Fee, Sequence: args.Sequence}
+	if from == keymanager.SendAccount {
+		sendArgs.To = record.RaAddress.Hex()
+	}
+	prepare := func() (ttypes.Tx, error) {
+		return prepareSendTx(sendArgs, signer)
+	}
+	if args.DryRun {
+		result.DryRun, err = h.dryRunTx(r, record.UserID, from, signer, &sendArgs.Sequence, prepare)
+		return err
+	}
+	return h.idempotent(r, record.UserID, "TransferBetweenAccounts", args.IdempotencyKey, args, result, func(r *http.Request) (err error) {
+		result.Retries, err = h.submitTx(r, record.UserID, from, signer, &sendArgs.Sequence, prepare, result)
+		return err
+	})
+}
+
+// ------------------------------- Auto top-up -----------------------------------
+
+// topUps remembers when the SA of each user was last topped up. Top-ups are not
+// part of the SA balance until confirmed, so new ones wait for a cooldown.
+type topUps struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// start reports whether a top-up of the user may start now, and records it.
+func (t *topUps) start(userid string, cooldown time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last == nil {
+		t.last = make(map[string]time.Time)
+	}
+	if time.Since(t.last[userid]) < cooldown {
+		return false
+	}
+	t.last[userid] = time.Now()
+	return true
+}
+
+// topUpPolicy returns the SA balance below which the SA is refilled from the RA,
+// and the balance refills aim for. It returns false if auto top-up is disabled.
+func topUpPolicy() (threshold, target ttypes.Coins, ok bool) {
+	if !viper.GetBool(util.CfgTopUpEnabled) {
+		return
+	}
+	parse := func(key string) *big.Int {
+		amount, valid := new(big.Int).SetString(viper.GetString(key), 10)
+		if !valid || amount.Sign() < 0 {
+			log.WithFields(log.Fields{"method": "topUpPolicy", "key": key, "value": viper.GetString(key)}).Error("Invalid top-up amount, auto top-up disabled")
+			return nil
+		}
+		return amount
+	}
+	threshold = ttypes.Coins{ThetaWei: parse(util.CfgTopUpThresholdThetaWei), GammaWei: parse(util.CfgTopUpThresholdGammaWei)}
+	target = ttypes.Coins{ThetaWei: parse(util.CfgTopUpTargetThetaWei), GammaWei: parse(util.CfgTopUpTargetGammaWei)}
+	ok = threshold.ThetaWei != nil && threshold.GammaWei != nil && target.ThetaWei != nil && target.GammaWei != nil
+	return
+}
+
+// topUpSendAccount refills the SA of the user from its RA, up to the target of
+// the top-up policy, when the available SA balance is below the threshold. The RA
+// keeps what it needs for the fee.
+func (h *ThetaRPCHandler) topUpSendAccount(r *http.Request, userid string) {
+	logger := log.WithFields(log.Fields{"method": "topUpSendAccount", "userid": userid, "request_id": r.Header.Get(util.RequestIDHeader)})
+
+	threshold, target, ok := topUpPolicy()
+	if !ok {
+		return
+	}
+	sa, err := h.KeyManager.GetSigner(userid, keymanager.SendAccount)
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Error("Failed to get send account")
+		return
+	}
+	saAlloc, err := h.Sequences.Peek(sa.Address())
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Warn("Failed to get send account balance")
+		return
+	}
+	available := saAlloc.Available.NoNil()
+	if available.IsGTE(threshold) {
+		return
+	}
+	if !h.topUps.start(userid, time.Duration(viper.GetInt64(util.CfgTopUpCooldown))*time.Second) {
+		return
+	}
+
+	ra, err := h.KeyManager.GetSigner(userid, keymanager.RecvAccount)
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Error("Failed to get receive account")
+		return
+	}
+	raAlloc, err := h.Sequences.Peek(ra.Address())
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Warn("Failed to get receive account balance")
+		return
+	}
+	fee := new(big.Int).SetUint64(ttypes.MinimumTransactionFeeGammaWei)
+	raSpendable := raAlloc.Available.NoNil().Minus(ttypes.Coins{ThetaWei: ttypes.Zero, GammaWei: fee})
+	amount := ttypes.Coins{
+		ThetaWei: minPositive(new(big.Int).Sub(target.ThetaWei, available.ThetaWei), raSpendable.ThetaWei),
+		GammaWei: minPositive(new(big.Int).Sub(target.GammaWei, available.GammaWei), raSpendable.GammaWei),
+	}
+	if amount.IsZero() {
+		logger.Info("Send account is low but receive account has nothing to top up with")
+		return
+	}
+
+	sendArgs := &SendArgs{To: sa.Address().Hex(), Amount: amount, Fee: (*tcmn.JSONBig)(fee)}
+	_, err = h.submitTx(r, userid, keymanager.RecvAccount, ra, &sendArgs.Sequence, func() (ttypes.Tx, error) {
+		return prepareSendTx(sendArgs, ra)
+	}, &BroadcastResult{})
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Error("Failed to top up send account")
+		return
+	}
+	logger.WithFields(log.Fields{"thetawei": amount.ThetaWei, "gammawei": amount.GammaWei}).Info("Topped up send account")
+}
+
+// minPositive returns the smaller of a and b, or 0 if it is negative.
+func minPositive(a, b *big.Int) *big.Int {
+	if a.Cmp(b) > 0 {
+		a = b
+	}
+	if a.Sign() < 0 {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(a)
+}
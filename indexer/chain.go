@@ -0,0 +1,125 @@
+package indexer
+
+import (
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/util"
+)
+
+// Transaction types as numbered by Theta nodes in block results.
+const (
+	txCoinbase byte = iota
+	txSlash
+	txSend
+	txReserveFund
+	txReleaseFund
+	txServicePayment
+	txSplitRule
+)
+
+// Block is a finalized block with the transactions vault knows how to index.
+// Transactions of other types are left out.
+type Block struct {
+	Height uint64
+	Time   time.Time
+	Txs    []BlockTx
+}
+
+type BlockTx struct {
+	Hash tcmn.Hash
+	Tx   ttypes.Tx
+}
+
+// Chain is the view of the blockchain the Indexer needs.
+type Chain interface {
+	GetFinalizedHeight() (uint64, error)
+	GetBlockByHeight(height uint64) (*Block, error)
+}
+
+type getStatusResult struct {
+	LatestFinalizedBlockHeight tcmn.JSONUint64 `json:"latest_finalized_block_height"`
+}
+
+type getBlockByHeightArgs struct {
+	Height tcmn.JSONUint64 `json:"height"`
+}
+
+type getBlockResult struct {
+	Height    tcmn.JSONUint64 `json:"height"`
+	Timestamp *tcmn.JSONBig   `json:"timestamp"`
+	Txs       []struct {
+		Raw  json.RawMessage `json:"raw"`
+		Type byte            `json:"type"`
+		Hash tcmn.Hash       `json:"hash"`
+	} `json:"transactions"`
+}
+
+// RPCChain talks to a Theta node.
+type RPCChain struct {
+	client util.RPCClient
+}
+
+func NewRPCChain(client util.RPCClient) *RPCChain {
+	return &RPCChain{client: client}
+}
+
+func (c *RPCChain) GetFinalizedHeight() (uint64, error) {
+	resp, err := c.client.Call("theta.GetStatus", struct{}{})
+	if err != nil {
+		return 0, err
+	}
+	if resp.Error != nil {
+		return 0, resp.Error
+	}
+	result := &getStatusResult{}
+	if err := resp.GetObject(result); err != nil {
+		return 0, err
+	}
+	return uint64(result.LatestFinalizedBlockHeight), nil
+}
+
+func (c *RPCChain) GetBlockByHeight(height uint64) (*Block, error) {
+	resp, err := c.client.Call("theta.GetBlockByHeight", getBlockByHeightArgs{Height: tcmn.JSONUint64(height)})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	result := &getBlockResult{}
+	if err := resp.GetObject(result); err != nil {
+		return nil, err
+	}
+
+	block := &Block{Height: uint64(result.Height)}
+	if result.Timestamp != nil {
+		block.Time = time.Unix((*big.Int)(result.Timestamp).Int64(), 0).UTC()
+	}
+	for _, t := range result.Txs {
+		var tx ttypes.Tx
+		switch t.Type {
+		case txSend:
+			tx = &ttypes.SendTx{}
+		case txReserveFund:
+			tx = &ttypes.ReserveFundTx{}
+		case txReleaseFund:
+			tx = &ttypes.ReleaseFundTx{}
+		case txServicePayment:
+			tx = &ttypes.ServicePaymentTx{}
+		case txSplitRule:
+			tx = &ttypes.SplitRuleTx{}
+		default:
+			continue
+		}
+		if err := json.Unmarshal(t.Raw, tx); err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode transaction %s", t.Hash.Hex())
+		}
+		block.Txs = append(block.Txs, BlockTx{Hash: t.Hash, Tx: tx})
+	}
+	return block, nil
+}
@@ -0,0 +1,179 @@
+package indexer
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/util"
+)
+
+// The Indexer walks finalized blocks in order and records every transaction
+// touching a SA or RA account managed by vault in the transaction history.
+
+// Store is the persistence the Indexer needs. db.DAO implements it.
+type Store interface {
+	IndexerHeight() (uint64, bool, error)
+	FindUserByAddress(address tcmn.Address) (userid string, role string, err error)
+	SaveIndexedBlock(height uint64, entries []db.HistoryEntry) error
+}
+
+// batchSize caps the number of blocks indexed per wakeup.
+const batchSize = 1000
+
+type Indexer struct {
+	store       Store
+	chain       Chain
+	startHeight uint64
+}
+
+func NewIndexer(store Store, chain Chain) *Indexer {
+	return &Indexer{
+		store:       store,
+		chain:       chain,
+		startHeight: uint64(viper.GetInt64(util.CfgIndexerStartHeight)),
+	}
+}
+
+// Process indexes newly finalized blocks periodically.
+func (ix *Indexer) Process() {
+	logger := log.WithFields(log.Fields{"method": "indexer.Process"})
+
+	sleepWakeup := viper.GetInt64(util.CfgIndexerWakeupInterval)
+	wakeupTicker := time.NewTicker(time.Duration(sleepWakeup) * time.Second)
+	defer wakeupTicker.Stop()
+
+	for range wakeupTicker.C {
+		indexed, err := ix.IndexNewBlocks()
+		if err != nil {
+			logger.WithFields(log.Fields{"error": err}).Error("Failed to index blocks")
+		} else if indexed > 0 {
+			logger.Debugf("Indexed %d blocks", indexed)
+		}
+	}
+}
+
+// IndexNewBlocks indexes the finalized blocks following the last block indexed,
+// and returns the number of blocks indexed. Without a block indexed before, it
+// starts from the configured start height, or from the latest finalized block.
+func (ix *Indexer) IndexNewBlocks() (int, error) {
+	finalized, err := ix.chain.GetFinalizedHeight()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get finalized height")
+	}
+
+	height, ok, err := ix.store.IndexerHeight()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get indexer height")
+	}
+	next := height + 1
+	if !ok {
+		next = ix.startHeight
+		if next == 0 {
+			next = finalized
+		}
+	}
+
+	indexed := 0
+	for ; next <= finalized && indexed < batchSize; next++ {
+		if err := ix.IndexBlock(next); err != nil {
+			return indexed, err
+		}
+		indexed++
+	}
+	return indexed, nil
+}
+
+// IndexBlock records the transactions of the block at the given height.
+func (ix *Indexer) IndexBlock(height uint64) error {
+	block, err := ix.chain.GetBlockByHeight(height)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get block %d", height)
+	}
+
+	var entries []db.HistoryEntry
+	for _, btx := range block.Txs {
+		txType, err := keymanager.TxType(btx.Tx)
+		if err != nil {
+			return err
+		}
+		for _, p := range participants(btx.Tx) {
+			userid, role, err := ix.store.FindUserByAddress(p.address)
+			if err == db.ErrNoRecord {
+				continue
+			}
+			if err != nil {
+				return errors.Wrap(err, "Failed to look up address")
+			}
+			coins := p.coins.NoNil()
+			entries = append(entries, db.HistoryEntry{
+				UserID:       userid,
+				Role:         role,
+				Address:      p.address,
+				TxHash:       btx.Hash.Hex(),
+				TxType:       txType,
+				BlockHeight:  block.Height,
+				BlockTime:    block.Time,
+				Direction:    p.direction,
+				ThetaWei:     coins.ThetaWei.String(),
+				GammaWei:     coins.GammaWei.String(),
+				Counterparty: p.counterparty,
+				ResourceID:   p.resourceID,
+			})
+		}
+	}
+	return ix.store.SaveIndexedBlock(height, entries)
+}
+
+// participant is an account taking part in a transaction.
+type participant struct {
+	address      tcmn.Address
+	direction    string
+	coins        ttypes.Coins
+	counterparty string
+	resourceID   string
+}
+
+func participants(tx ttypes.Tx) []participant {
+	var ps []participant
+	switch tx := tx.(type) {
+	case *ttypes.SendTx:
+		for _, in := range tx.Inputs {
+			p := participant{address: in.Address, direction: db.DirectionOut, coins: in.Coins}
+			if len(tx.Outputs) == 1 {
+				p.counterparty = tx.Outputs[0].Address.Hex()
+			}
+			ps = append(ps, p)
+		}
+		for _, out := range tx.Outputs {
+			p := participant{address: out.Address, direction: db.DirectionIn, coins: out.Coins}
+			if len(tx.Inputs) == 1 {
+				p.counterparty = tx.Inputs[0].Address.Hex()
+			}
+			ps = append(ps, p)
+		}
+	case *ttypes.ReserveFundTx:
+		p := participant{address: tx.Source.Address, direction: db.DirectionOut, coins: tx.Source.Coins}
+		if len(tx.ResourceIDs) > 0 {
+			p.resourceID = tx.ResourceIDs[0]
+		}
+		ps = append(ps, p)
+	case *ttypes.ReleaseFundTx:
+		ps = append(ps, participant{address: tx.Source.Address, direction: db.DirectionIn})
+	case *ttypes.ServicePaymentTx:
+		ps = append(ps,
+			participant{address: tx.Source.Address, direction: db.DirectionOut, coins: tx.Source.Coins, counterparty: tx.Target.Address.Hex(), resourceID: tx.ResourceID},
+			participant{address: tx.Target.Address, direction: db.DirectionIn, coins: tx.Source.Coins, counterparty: tx.Source.Address.Hex(), resourceID: tx.ResourceID})
+	case *ttypes.SplitRuleTx:
+		ps = append(ps, participant{address: tx.Initiator.Address, direction: db.DirectionOut, resourceID: tx.ResourceID})
+		for _, split := range tx.Splits {
+			ps = append(ps, participant{address: split.Address, direction: db.DirectionIn, counterparty: tx.Initiator.Address.Hex(), resourceID: tx.ResourceID})
+		}
+	}
+	return ps
+}
@@ -0,0 +1,112 @@
+package indexer
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+)
+
+type memStore struct {
+	height  uint64
+	indexed bool
+	users   map[tcmn.Address][2]string
+	entries []db.HistoryEntry
+}
+
+func (s *memStore) IndexerHeight() (uint64, bool, error) {
+	return s.height, s.indexed, nil
+}
+
+func (s *memStore) FindUserByAddress(address tcmn.Address) (string, string, error) {
+	user, ok := s.users[address]
+	if !ok {
+		return "", "", db.ErrNoRecord
+	}
+	return user[0], user[1], nil
+}
+
+func (s *memStore) SaveIndexedBlock(height uint64, entries []db.HistoryEntry) error {
+	s.height, s.indexed = height, true
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+type fakeChain struct {
+	blocks map[uint64]*Block
+}
+
+func (c *fakeChain) GetFinalizedHeight() (uint64, error) {
+	var height uint64
+	for h := range c.blocks {
+		if h > height {
+			height = h
+		}
+	}
+	return height, nil
+}
+
+func (c *fakeChain) GetBlockByHeight(height uint64) (*Block, error) {
+	if block, ok := c.blocks[height]; ok {
+		return block, nil
+	}
+	return &Block{Height: height}, nil
+}
+
+func TestIndexNewBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	alice := tcmn.BytesToAddress([]byte{1})
+	bob := tcmn.BytesToAddress([]byte{2})
+	stranger := tcmn.BytesToAddress([]byte{3})
+	coins := ttypes.Coins{ThetaWei: big.NewInt(10), GammaWei: big.NewInt(20)}
+
+	store := &memStore{users: map[tcmn.Address][2]string{
+		alice: {"alice", "SA"},
+		bob:   {"bob", "RA"},
+	}}
+	chain := &fakeChain{blocks: map[uint64]*Block{
+		5: {Height: 5, Time: time.Unix(1000, 0), Txs: []BlockTx{
+			{Hash: tcmn.BytesToHash([]byte{1}), Tx: &ttypes.SendTx{
+				Inputs:  []ttypes.TxInput{{Address: alice, Coins: coins}},
+				Outputs: []ttypes.TxOutput{{Address: stranger, Coins: coins}},
+			}},
+		}},
+		7: {Height: 7, Time: time.Unix(1010, 0), Txs: []BlockTx{
+			{Hash: tcmn.BytesToHash([]byte{2}), Tx: &ttypes.ServicePaymentTx{
+				Source:     ttypes.TxInput{Address: alice, Coins: coins},
+				Target:     ttypes.TxInput{Address: bob},
+				ResourceID: "video",
+			}},
+		}},
+	}}
+	ix := &Indexer{store: store, chain: chain, startHeight: 4}
+
+	indexed, err := ix.IndexNewBlocks()
+	assert.Nil(err)
+	assert.Equal(4, indexed)
+	assert.Equal(uint64(7), store.height)
+	assert.Equal(3, len(store.entries))
+
+	assert.Equal("alice", store.entries[0].UserID)
+	assert.Equal("send", store.entries[0].TxType)
+	assert.Equal(db.DirectionOut, store.entries[0].Direction)
+	assert.Equal("10", store.entries[0].ThetaWei)
+	assert.Equal(stranger.Hex(), store.entries[0].Counterparty)
+
+	assert.Equal("service_payment", store.entries[2].TxType)
+	assert.Equal("bob", store.entries[2].UserID)
+	assert.Equal("RA", store.entries[2].Role)
+	assert.Equal(db.DirectionIn, store.entries[2].Direction)
+	assert.Equal("video", store.entries[2].ResourceID)
+	assert.Equal(uint64(7), store.entries[2].BlockHeight)
+
+	// Nothing new to index.
+	indexed, err = ix.IndexNewBlocks()
+	assert.Nil(err)
+	assert.Equal(0, indexed)
+}
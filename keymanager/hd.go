@@ -0,0 +1,139 @@
+package keymanager
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"github.com/pkg/errors"
+	crypto "github.com/thetatoken/ukulele/crypto"
+)
+
+// HD keys follow BIP32 derivation on a BIP44-style path with Theta's registered coin
+// type 500:
+//
+//     m/44'/500'/0'/<role>'/<index>'
+//
+// where role is 0 for the receive account and 1 for the send account. Every level is
+// hardened since vault always derives from the seed and never needs public derivation.
+
+const (
+	hdPurpose      uint32 = 44
+	hdCoinType     uint32 = 500
+	hdAccount      uint32 = 0
+	hardenedOffset uint32 = 0x80000000
+
+	// MaxHDIndex is the largest per-user index that can be hardened.
+	MaxHDIndex uint32 = hardenedOffset - 1
+)
+
+var (
+	secp256k1N, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+	masterHMACKey = []byte("Bitcoin seed")
+
+	ErrInvalidHDKey = errors.New("HD: derived key is invalid")
+)
+
+// HDKeyDeriver derives user keys from a single master seed.
+type HDKeyDeriver struct {
+	seed []byte
+}
+
+func NewHDKeyDeriver(seed []byte) (*HDKeyDeriver, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, errors.Errorf("HD seed must be between 16 and 64 bytes, got %d", len(seed))
+	}
+	return &HDKeyDeriver{seed: seed}, nil
+}
+
+// LoadHDKeyDeriver reads a hex encoded seed from a file.
+func LoadHDKeyDeriver(path string) (*HDKeyDeriver, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "HD seed file %s is not hex encoded", path)
+	}
+	return NewHDKeyDeriver(seed)
+}
+
+// DerivationPath returns the path of the key of the given account and user index.
+func DerivationPath(role AccountRole, index uint32) string {
+	return fmt.Sprintf("m/%d'/%d'/%d'/%d'/%d'", hdPurpose, hdCoinType, hdAccount, roleBranch(role), index)
+}
+
+// DeriveKey derives the private key of the given account and user index.
+func (d *HDKeyDeriver) DeriveKey(role AccountRole, index uint32) (*crypto.PrivateKey, error) {
+	if index > MaxHDIndex {
+		return nil, errors.Errorf("HD index out of range: %d", index)
+	}
+	key, err := newMasterKey(d.seed)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range []uint32{hdPurpose, hdCoinType, hdAccount, roleBranch(role), index} {
+		key, err = key.hardenedChild(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return crypto.PrivateKeyFromBytes(key.key)
+}
+
+func roleBranch(role AccountRole) uint32 {
+	if role == SendAccount {
+		return 1
+	}
+	return 0
+}
+
+type extendedKey struct {
+	key       []byte
+	chainCode []byte
+}
+
+func newMasterKey(seed []byte) (*extendedKey, error) {
+	mac := hmac.New(sha512.New, masterHMACKey)
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+
+	k := new(big.Int).SetBytes(sum[:32])
+	if k.Sign() == 0 || k.Cmp(secp256k1N) >= 0 {
+		return nil, ErrInvalidHDKey
+	}
+	return &extendedKey{key: sum[:32], chainCode: sum[32:]}, nil
+}
+
+// hardenedChild implements BIP32 private parent to private child derivation for
+// hardened indices.
+func (k *extendedKey) hardenedChild(index uint32) (*extendedKey, error) {
+	data := make([]byte, 37)
+	copy(data[1:33], k.key)
+	binary.BigEndian.PutUint32(data[33:], index+hardenedOffset)
+
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+
+	il := new(big.Int).SetBytes(sum[:32])
+	if il.Cmp(secp256k1N) >= 0 {
+		return nil, ErrInvalidHDKey
+	}
+	child := il.Add(il, new(big.Int).SetBytes(k.key))
+	child.Mod(child, secp256k1N)
+	if child.Sign() == 0 {
+		return nil, ErrInvalidHDKey
+	}
+
+	childKey := make([]byte, 32)
+	b := child.Bytes()
+	copy(childKey[32-len(b):], b)
+	return &extendedKey{key: childKey, chainCode: sum[32:]}, nil
+}
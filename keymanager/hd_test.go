@@ -0,0 +1,31 @@
+package keymanager
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test vector 1 from BIP32.
+func TestHardenedDerivation(t *testing.T) {
+	assert := assert.New(t)
+
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	master, err := newMasterKey(seed)
+	assert.Nil(err)
+	assert.Equal("e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35", hex.EncodeToString(master.key))
+	assert.Equal("873dff81c02f525623fd1fe5167eac3a55a049de3d314bb42ee227ffed37d508", hex.EncodeToString(master.chainCode))
+
+	child, err := master.hardenedChild(0)
+	assert.Nil(err)
+	assert.Equal("edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea", hex.EncodeToString(child.key))
+	assert.Equal("47fdacbd0f1097043b78c63c20c34ef4ed9a111d980047ad16282c7ae6236141", hex.EncodeToString(child.chainCode))
+}
+
+func TestDerivationPath(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("m/44'/500'/0'/0'/7'", DerivationPath(RecvAccount, 7))
+	assert.Equal("m/44'/500'/0'/1'/7'", DerivationPath(SendAccount, 7))
+}
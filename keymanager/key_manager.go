@@ -3,63 +3,391 @@ package keymanager
 import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	crypto "github.com/thetatoken/ukulele/crypto"
 	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/util"
+)
+
+const (
+	KeyGenerationRandom = "random"
+	KeyGenerationHD     = "hd"
+)
+
+// Admin actions recorded in the audit trail.
+const (
+	AdminActionExportKeys = "export_keys"
+	AdminActionImportKeys = "import_keys"
+	AdminActionRotateKeys = "rotate_keys"
+)
+
+var (
+	ErrAccountNotFound = errors.New("KeyManager: account not found")
+	ErrAccountExists   = errors.New("KeyManager: account already exists")
 )
 
 type KeyManager interface {
 	Close()
+
+	// CreateAccount generates and stores the keys of a new user. It returns
+	// ErrAccountExists if the user already has an account.
+	CreateAccount(userid string) (db.Record, error)
+
+	// FindByUserId returns the public part of a user's record. Private keys are
+	// never included; use GetSigner to sign on behalf of the user. Unknown users
+	// get ErrAccountNotFound unless auto-creation is enabled.
 	FindByUserId(userid string) (db.Record, error)
+
+	// GetSigner returns a Signer bound to the given account of the user. Every
+	// transaction it signs is recorded in the signing audit log.
+	GetSigner(userid string, role AccountRole) (Signer, error)
+
+	// ExportKeys returns the keys of a user as keystores encrypted with the
+	// password. The actor requesting the export is recorded in the audit trail.
+	ExportKeys(userid, password, actor string) (ExportedKeys, error)
+
+	// ImportKeys creates the account of a user from keystores encrypted with the
+	// password. It returns ErrAccountExists if the user already has an account.
+	ImportKeys(userid string, keys ExportedKeys, password, actor string) (db.Record, error)
 }
 
 // ----------------- SQL KeyManager ---------------------
 
 var _ KeyManager = SqlKeyManager{}
 
+// recordStore is the part of db.Store the SqlKeyManager relies on.
+type recordStore interface {
+	Close()
+	FindByUserId(userid string) (db.Record, error)
+	CreateIfAbsent(record db.Record) (bool, error)
+	NextHDIndex() (uint32, error)
+}
+
+var (
+	errNoAdminAudit   = errors.New("Admin actions cannot be recorded by the database")
+	errNoSigningAudit = errors.New("Signatures cannot be recorded by the database")
+)
+
+// adminAuditor is implemented by stores that persist the audit trail of admin
+// actions.
+type adminAuditor interface {
+	RecordAdminAction(action db.AdminAction) error
+}
+
 type SqlKeyManager struct {
-	da *db.DAO
+	da         recordStore
+	deriver    *HDKeyDeriver // Nil if no HD seed is configured.
+	useHD      bool          // Whether keys of new users are derived from the seed.
+	autoCreate bool          // Whether lookups of unknown users create their accounts.
+}
+
+func NewSqlKeyManager(da db.Store) (*SqlKeyManager, error) {
+	km := &SqlKeyManager{
+		da:         da,
+		autoCreate: viper.GetBool(util.CfgKeyManagerAutoCreate),
+	}
+
+	// The seed is loaded whenever configured so HD records created earlier stay
+	// usable after switching back to random keys.
+	if seedFile := viper.GetString(util.CfgKeyManagerHDSeedFile); seedFile != "" {
+		deriver, err := LoadHDKeyDeriver(seedFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to load HD seed")
+		}
+		km.deriver = deriver
+	}
+
+	switch mode := viper.GetString(util.CfgKeyManagerKeyGeneration); mode {
+	case KeyGenerationRandom:
+	case KeyGenerationHD:
+		if km.deriver == nil {
+			return nil, errors.New("HD key generation requires an HD seed file")
+		}
+		km.useHD = true
+	default:
+		return nil, errors.Errorf("Unknown key generation mode: %s", mode)
+	}
+	return km, nil
 }
 
-func NewSqlKeyManager(da *db.DAO) (*SqlKeyManager, error) {
-	return &SqlKeyManager{da}, nil
+func (km SqlKeyManager) CreateAccount(userid string) (db.Record, error) {
+	_, err := km.da.FindByUserId(userid)
+	if err == nil {
+		return db.Record{}, ErrAccountExists
+	}
+	if err != db.ErrNoRecord {
+		return db.Record{}, errors.Wrap(err, "Failed to find user by id")
+	}
+	record, created, err := km.create(userid)
+	if err != nil {
+		return db.Record{}, err
+	}
+	if !created {
+		return db.Record{}, ErrAccountExists
+	}
+	return publicRecord(record), nil
 }
 
 func (km SqlKeyManager) FindByUserId(userid string) (db.Record, error) {
+	record, err := km.findOrCreate(userid)
+	if err != nil {
+		return db.Record{}, err
+	}
+	return publicRecord(record), nil
+}
+
+func (km SqlKeyManager) GetSigner(userid string, role AccountRole) (Signer, error) {
+	record, err := km.findOrCreate(userid)
+	if err != nil {
+		return nil, err
+	}
+	return km.signer(record, role)
+}
+
+// RecordSigner returns a Signer bound to the given account of a record read from
+// the database, such as the retired keys of a rotation.
+func (km SqlKeyManager) RecordSigner(record db.Record, role AccountRole) (Signer, error) {
+	if err := km.LoadPrivateKeys(&record); err != nil {
+		return nil, err
+	}
+	return km.signer(record, role)
+}
+
+// signer returns an AuditedSigner for the given account of a record holding its
+// private keys.
+func (km SqlKeyManager) signer(record db.Record, role AccountRole) (Signer, error) {
+	// Signers of stores without a signing audit log refuse to sign.
+	auditLog, _ := km.da.(db.SigningAuditLog)
+	switch role {
+	case SendAccount:
+		return NewAuditedSigner(record.SaPrivateKey, record.UserID, role, auditLog), nil
+	case RecvAccount:
+		return NewAuditedSigner(record.RaPrivateKey, record.UserID, role, auditLog), nil
+	default:
+		return nil, errors.Errorf("Unknown account role: %v", role)
+	}
+}
+
+func (km SqlKeyManager) ExportKeys(userid, password, actor string) (ExportedKeys, error) {
+	keys, err := km.exportKeys(userid, password)
+	// Keys are only released once the export is on record.
+	if auditErr := km.audit(AdminActionExportKeys, userid, actor, err); auditErr != nil {
+		return ExportedKeys{}, errors.Wrap(auditErr, "Failed to record admin action")
+	}
+	return keys, err
+}
+
+func (km SqlKeyManager) exportKeys(userid, password string) (ExportedKeys, error) {
+	record, err := km.da.FindByUserId(userid)
+	if err == db.ErrNoRecord {
+		return ExportedKeys{}, ErrAccountNotFound
+	}
+	if err != nil {
+		return ExportedKeys{}, errors.Wrap(err, "Failed to find user by id")
+	}
+	if err := km.LoadPrivateKeys(&record); err != nil {
+		return ExportedKeys{}, err
+	}
+
+	sendAccount, err := EncryptKey(record.SaPrivateKey, password)
+	if err != nil {
+		return ExportedKeys{}, errors.Wrap(err, "Failed to encrypt send account key")
+	}
+	recvAccount, err := EncryptKey(record.RaPrivateKey, password)
+	if err != nil {
+		return ExportedKeys{}, errors.Wrap(err, "Failed to encrypt receive account key")
+	}
+	return ExportedKeys{SendAccount: sendAccount, RecvAccount: recvAccount}, nil
+}
+
+func (km SqlKeyManager) ImportKeys(userid string, keys ExportedKeys, password, actor string) (db.Record, error) {
+	record, err := km.importKeys(userid, keys, password)
+	if auditErr := km.audit(AdminActionImportKeys, userid, actor, err); auditErr != nil {
+		return db.Record{}, errors.Wrap(auditErr, "Failed to record admin action")
+	}
+	return record, err
+}
+
+func (km SqlKeyManager) importKeys(userid string, keys ExportedKeys, password string) (db.Record, error) {
+	saPrivkey, err := DecryptKey(keys.SendAccount, password)
+	if err != nil {
+		return db.Record{}, errors.Wrap(err, "Failed to decrypt send account keystore")
+	}
+	raPrivkey, err := DecryptKey(keys.RecvAccount, password)
+	if err != nil {
+		return db.Record{}, errors.Wrap(err, "Failed to decrypt receive account keystore")
+	}
+
+	record := db.Record{
+		UserID:       userid,
+		RaPrivateKey: raPrivkey,
+		SaPrivateKey: saPrivkey,
+	}
+	record.RaPubKey = raPrivkey.PublicKey()
+	record.RaAddress = record.RaPubKey.Address()
+	record.SaPubKey = saPrivkey.PublicKey()
+	record.SaAddress = record.SaPubKey.Address()
+
+	created, err := km.da.CreateIfAbsent(record)
+	if err != nil {
+		return db.Record{}, err
+	}
+	if !created {
+		return db.Record{}, ErrAccountExists
+	}
+	return publicRecord(record), nil
+}
+
+// audit records the outcome of an admin action in the log and in the database.
+// It fails if the store does not keep an audit trail.
+func (km SqlKeyManager) audit(action, userid, actor string, err error) error {
+	entry := db.AdminAction{
+		Action:  action,
+		UserID:  userid,
+		Actor:   actor,
+		Success: err == nil,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	log.WithFields(log.Fields{"audit": true, "action": action, "userid": userid, "actor": actor, "success": entry.Success, "error": entry.Error}).Info("Admin action")
+
+	auditor, ok := km.da.(adminAuditor)
+	if !ok {
+		return errNoAdminAudit
+	}
+	return auditor.RecordAdminAction(entry)
+}
+
+// findOrCreate loads the full record of a user, generating keys on first use if
+// auto-creation is enabled.
+func (km SqlKeyManager) findOrCreate(userid string) (db.Record, error) {
 	record, err := km.da.FindByUserId(userid)
 
 	if err == db.ErrNoRecord {
+		if !km.autoCreate {
+			return db.Record{}, ErrAccountNotFound
+		}
 		log.Printf("No record with user ID: %s. Creating keys.", userid)
-		raPrivkey, raPubkey, err := crypto.GenerateKeyPair()
-		if err != nil {
+		record, _, err := km.create(userid)
+		return record, err
+	}
+
+	if err != nil {
+		log.Printf(err.Error())
+		return db.Record{}, errors.Wrap(err, "Failed to find user by id")
+	}
+
+	if record.HDIndex != nil {
+		if err := km.deriveKeys(&record); err != nil {
 			return db.Record{}, err
 		}
-		saPrivkey, saPubkey, err := crypto.GenerateKeyPair()
+	}
+	return record, nil
+}
+
+// create generates and stores the keys of a new user. Concurrent callers may race
+// to create the same user; only one insert wins and every caller returns the stored
+// record, so all of them see the same addresses. The returned flag reports whether
+// this call's keys were the ones stored.
+func (km SqlKeyManager) create(userid string) (db.Record, bool, error) {
+	record, err := km.newRecord(userid)
+	if err != nil {
+		return db.Record{}, false, err
+	}
+	created, err := km.da.CreateIfAbsent(record)
+	if err != nil {
+		log.WithError(err).WithField("userid", userid).Error("Failed to create address")
+		return db.Record{}, false, err
+	}
+	if created {
+		return record, true, nil
+	}
+
+	log.WithField("userid", userid).Info("Account was created concurrently. Using stored keys.")
+	record, err = km.da.FindByUserId(userid)
+	if err != nil {
+		return db.Record{}, false, errors.Wrap(err, "Failed to find user by id")
+	}
+	if record.HDIndex != nil {
+		if err := km.deriveKeys(&record); err != nil {
+			return db.Record{}, false, err
+		}
+	}
+	return record, false, nil
+}
+
+// newRecord generates the keys of a new user, either randomly or from the HD seed.
+func (km SqlKeyManager) newRecord(userid string) (db.Record, error) {
+	record := db.Record{UserID: userid}
+
+	if km.useHD {
+		index, err := km.da.NextHDIndex()
 		if err != nil {
 			return db.Record{}, err
 		}
-		record := db.Record{
-			RaAddress:    raPubkey.Address(),
-			RaPubKey:     raPubkey,
-			RaPrivateKey: raPrivkey,
-			SaAddress:    saPubkey.Address(),
-			SaPubKey:     saPubkey,
-			SaPrivateKey: saPrivkey,
-			UserID:       userid,
+		record.HDIndex = &index
+		if err := km.deriveKeys(&record); err != nil {
+			return db.Record{}, err
 		}
-		err = km.da.Create(record)
+	} else {
+		raPrivkey, _, err := crypto.GenerateKeyPair()
 		if err != nil {
-			log.WithError(err).WithField("userid", userid).Error("Failed to create address")
 			return db.Record{}, err
 		}
-		return record, nil
+		saPrivkey, _, err := crypto.GenerateKeyPair()
+		if err != nil {
+			return db.Record{}, err
+		}
+		record.RaPrivateKey = raPrivkey
+		record.SaPrivateKey = saPrivkey
 	}
 
+	record.RaPubKey = record.RaPrivateKey.PublicKey()
+	record.RaAddress = record.RaPubKey.Address()
+	record.SaPubKey = record.SaPrivateKey.PublicKey()
+	record.SaAddress = record.SaPubKey.Address()
+	return record, nil
+}
+
+// deriveKeys fills in the private keys of an HD record.
+func (km SqlKeyManager) deriveKeys(record *db.Record) error {
+	if km.deriver == nil {
+		return errors.Errorf("Record of user %s is derived from an HD seed, but no seed is configured", record.UserID)
+	}
+	raPrivkey, err := km.deriver.DeriveKey(RecvAccount, *record.HDIndex)
 	if err != nil {
-		log.Printf(err.Error())
-		return db.Record{}, errors.Wrap(err, "Failed to find user by id")
+		return err
+	}
+	saPrivkey, err := km.deriver.DeriveKey(SendAccount, *record.HDIndex)
+	if err != nil {
+		return err
 	}
+	record.RaPrivateKey = raPrivkey
+	record.SaPrivateKey = saPrivkey
+	return nil
+}
 
-	return record, nil
+// GenerateKeys generates, without storing them, a new set of keys for the user in
+// the configured key generation mode.
+func (km SqlKeyManager) GenerateKeys(userid string) (db.Record, error) {
+	return km.newRecord(userid)
+}
+
+// LoadPrivateKeys fills in the private keys of a record derived from the HD seed.
+// Other records are left as is.
+func (km SqlKeyManager) LoadPrivateKeys(record *db.Record) error {
+	if record.HDIndex == nil {
+		return nil
+	}
+	return km.deriveKeys(record)
+}
+
+// publicRecord strips the private keys from a record.
+func publicRecord(record db.Record) db.Record {
+	record.RaPrivateKey = nil
+	record.SaPrivateKey = nil
+	return record
 }
 
 func (km SqlKeyManager) Close() {
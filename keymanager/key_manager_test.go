@@ -0,0 +1,216 @@
+package keymanager
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	tcmn "github.com/thetatoken/ukulele/common"
+	crypto "github.com/thetatoken/ukulele/crypto"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+)
+
+// memStore is an in-memory recordStore with the same insert-if-absent semantics as
+// db.DAO.
+type memStore struct {
+	mu      sync.Mutex
+	records map[string]db.Record
+	inserts int
+
+	// If set, lookups that miss wait for each other, so that every concurrent
+	// caller is forced down the creation path.
+	misses *sync.WaitGroup
+}
+
+func newMemStore() *memStore {
+	return &memStore{records: make(map[string]db.Record)}
+}
+
+func (s *memStore) Close() {}
+
+func (s *memStore) FindByUserId(userid string) (db.Record, error) {
+	s.mu.Lock()
+	record, ok := s.records[userid]
+	s.mu.Unlock()
+	if ok {
+		return record, nil
+	}
+	if s.misses != nil {
+		s.misses.Done()
+		s.misses.Wait()
+	}
+	return db.Record{}, db.ErrNoRecord
+}
+
+func (s *memStore) CreateIfAbsent(record db.Record) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inserts++
+	if _, ok := s.records[record.UserID]; ok {
+		return false, nil
+	}
+	s.records[record.UserID] = record
+	return true, nil
+}
+
+func (s *memStore) NextHDIndex() (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uint32(len(s.records)), nil
+}
+
+func TestConcurrentAccountCreation(t *testing.T) {
+	assert := assert.New(t)
+
+	const callers = 50
+	store := newMemStore()
+	store.misses = &sync.WaitGroup{}
+	store.misses.Add(callers)
+	km := SqlKeyManager{da: store, autoCreate: true}
+
+	records := make([]db.Record, callers)
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			records[i], errs[i] = km.FindByUserId("alice")
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(callers, store.inserts)
+	assert.Equal(1, len(store.records))
+	stored := store.records["alice"]
+	for i := 0; i < callers; i++ {
+		assert.Nil(errs[i])
+		assert.Equal(stored.RaAddress, records[i].RaAddress)
+		assert.Equal(stored.SaAddress, records[i].SaAddress)
+		assert.Nil(records[i].RaPrivateKey)
+		assert.Nil(records[i].SaPrivateKey)
+	}
+
+	signer, err := km.GetSigner("alice", SendAccount)
+	assert.Nil(err)
+	assert.Equal(stored.SaAddress, signer.Address())
+}
+
+func TestCreateAccountReportsExisting(t *testing.T) {
+	assert := assert.New(t)
+
+	km := SqlKeyManager{da: newMemStore()}
+
+	_, err := km.CreateAccount("alice")
+	assert.Nil(err)
+	_, err = km.CreateAccount("alice")
+	assert.Equal(ErrAccountExists, err)
+	_, err = km.FindByUserId("bob")
+	assert.Equal(ErrAccountNotFound, err)
+}
+
+// auditedMemStore is a memStore whose admin audit trail fails with err, if set.
+type auditedMemStore struct {
+	*memStore
+	actions []db.AdminAction
+	err     error
+}
+
+func (s *auditedMemStore) RecordAdminAction(action db.AdminAction) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.actions = append(s.actions, action)
+	return nil
+}
+
+func TestImportKeysRequiresAuditTrail(t *testing.T) {
+	assert := assert.New(t)
+
+	keys := ExportedKeys{}
+	for _, dest := range []**Keystore{&keys.SendAccount, &keys.RecvAccount} {
+		privKey, _, err := crypto.GenerateKeyPair()
+		assert.Nil(err)
+		*dest, err = encryptKey(privKey, "correct horse", testScryptN, testScryptP)
+		assert.Nil(err)
+	}
+
+	// Stores without an audit trail refuse admin actions.
+	km := SqlKeyManager{da: newMemStore()}
+	_, err := km.ImportKeys("alice", keys, "correct horse", "ops")
+	assert.Equal(errNoAdminAudit, errors.Cause(err))
+
+	store := &auditedMemStore{memStore: newMemStore(), err: errors.New("disk full")}
+	km = SqlKeyManager{da: store}
+	_, err = km.ImportKeys("bob", keys, "correct horse", "ops")
+	assert.Equal("disk full", errors.Cause(err).Error())
+
+	store.err = nil
+	record, err := km.ImportKeys("carol", keys, "correct horse", "ops")
+	assert.Nil(err)
+	assert.Equal("carol", record.UserID)
+	if assert.Len(store.actions, 1) {
+		assert.Equal(AdminActionImportKeys, store.actions[0].Action)
+		assert.Equal("ops", store.actions[0].Actor)
+		assert.True(store.actions[0].Success)
+	}
+}
+
+// signingMemStore is a memStore that keeps a signing audit log.
+type signingMemStore struct {
+	*memStore
+	entries []db.SigningAuditEntry
+	err     error
+}
+
+func (s *signingMemStore) AppendSigningAudit(entry db.SigningAuditEntry) (db.SigningAuditEntry, error) {
+	if s.err != nil {
+		return db.SigningAuditEntry{}, s.err
+	}
+	entry.Seq = uint64(len(s.entries)) + 1
+	s.entries = append(s.entries, entry)
+	return entry, nil
+}
+
+func (s *signingMemStore) ListSigningAudit(afterSeq uint64, limit int) ([]db.SigningAuditEntry, error) {
+	return nil, nil
+}
+
+func TestSignTxRecordsSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	km := SqlKeyManager{da: newMemStore()}
+	_, err := km.CreateAccount("alice")
+	assert.Nil(err)
+	signer, err := km.GetSigner("alice", SendAccount)
+	assert.Nil(err)
+	tx := &ttypes.ReleaseFundTx{Source: ttypes.TxInput{Address: signer.Address(), Sequence: 1}, ReserveSequence: 1}
+	assert.Equal(errNoSigningAudit, signer.SignTx(tx, "req-1"))
+	assert.Nil(tx.Source.Signature)
+
+	store := &signingMemStore{memStore: km.da.(*memStore), err: errors.New("disk full")}
+	km = SqlKeyManager{da: store}
+	signer, err = km.GetSigner("alice", SendAccount)
+	assert.Nil(err)
+	assert.NotNil(signer.SignTx(tx, "req-1"))
+	assert.Nil(tx.Source.Signature)
+
+	store.err = nil
+	assert.Nil(signer.SignTx(tx, "req-1"))
+	assert.NotNil(tx.Source.Signature)
+	if assert.Len(store.entries, 1) {
+		raw, err := ttypes.TxToBytes(tx)
+		assert.Nil(err)
+		assert.Equal(crypto.Keccak256Hash(raw).Hex(), store.entries[0].TxHash)
+		assert.Equal("alice", store.entries[0].UserID)
+		assert.Equal("SA", store.entries[0].Role)
+		assert.Equal("req-1", store.entries[0].RequestID)
+	}
+
+	// Transactions without an input from the account are not signed.
+	other := &ttypes.ReleaseFundTx{Source: ttypes.TxInput{Address: tcmn.HexToAddress("0x01"), Sequence: 1}}
+	assert.NotNil(signer.SignTx(other, "req-2"))
+	assert.Len(store.entries, 1)
+}
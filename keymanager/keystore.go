@@ -0,0 +1,200 @@
+package keymanager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	crypto "github.com/thetatoken/ukulele/crypto"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Keystores follow the version 3 format of Theta and Ethereum wallets: the key is
+// encrypted with AES-128-CTR under a key derived from the password with scrypt,
+// and authenticated with a Keccak-256 MAC.
+const (
+	keystoreVersion = 3
+	keystoreCipher  = "aes-128-ctr"
+	keystoreKDF     = "scrypt"
+
+	StandardScryptN = 1 << 18
+	StandardScryptP = 1
+	scryptR         = 8
+	scryptDKLen     = 32
+)
+
+// MinKeystorePasswordLength is the shortest password accepted for exported keystores.
+const MinKeystorePasswordLength = 8
+
+var ErrKeystorePassword = errors.New("Keystore: could not decrypt key with given password")
+
+type Keystore struct {
+	Address string         `json:"address"` // Hex encoded, without 0x prefix.
+	Crypto  KeystoreCrypto `json:"crypto"`
+	ID      string         `json:"id"`
+	Version int            `json:"version"`
+}
+
+type KeystoreCrypto struct {
+	Cipher       string               `json:"cipher"`
+	CipherText   string               `json:"ciphertext"`
+	CipherParams KeystoreCipherParams `json:"cipherparams"`
+	KDF          string               `json:"kdf"`
+	KDFParams    KeystoreScryptParams `json:"kdfparams"`
+	MAC          string               `json:"mac"`
+}
+
+type KeystoreCipherParams struct {
+	IV string `json:"iv"`
+}
+
+type KeystoreScryptParams struct {
+	DKLen int    `json:"dklen"`
+	N     int    `json:"n"`
+	P     int    `json:"p"`
+	R     int    `json:"r"`
+	Salt  string `json:"salt"`
+}
+
+// ExportedKeys holds the keystores of both accounts of a user.
+type ExportedKeys struct {
+	SendAccount *Keystore `json:"send_account"`
+	RecvAccount *Keystore `json:"recv_account"`
+}
+
+// EncryptKey encrypts a private key into a keystore with standard scrypt
+// parameters.
+func EncryptKey(privKey *crypto.PrivateKey, password string) (*Keystore, error) {
+	return encryptKey(privKey, password, StandardScryptN, StandardScryptP)
+}
+
+func encryptKey(privKey *crypto.PrivateKey, password string, scryptN, scryptP int) (*Keystore, error) {
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	derivedKey, err := scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, scryptDKLen)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	cipherText, err := aesCTR(derivedKey[:16], iv, privKey.ToBytes())
+	if err != nil {
+		return nil, err
+	}
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	address := privKey.PublicKey().Address()
+	return &Keystore{
+		Address: hex.EncodeToString(address.Bytes()),
+		Crypto: KeystoreCrypto{
+			Cipher:       keystoreCipher,
+			CipherText:   hex.EncodeToString(cipherText),
+			CipherParams: KeystoreCipherParams{IV: hex.EncodeToString(iv)},
+			KDF:          keystoreKDF,
+			KDFParams: KeystoreScryptParams{
+				DKLen: scryptDKLen,
+				N:     scryptN,
+				P:     scryptP,
+				R:     scryptR,
+				Salt:  hex.EncodeToString(salt),
+			},
+			MAC: hex.EncodeToString(crypto.Keccak256(derivedKey[16:32], cipherText)),
+		},
+		ID:      id,
+		Version: keystoreVersion,
+	}, nil
+}
+
+// DecryptKey decrypts the private key of a keystore, and checks it matches the
+// address of the keystore.
+func DecryptKey(ks *Keystore, password string) (*crypto.PrivateKey, error) {
+	if ks == nil {
+		return nil, errors.New("Keystore is missing")
+	}
+	if ks.Version != keystoreVersion {
+		return nil, errors.Errorf("Unsupported keystore version: %d", ks.Version)
+	}
+	if ks.Crypto.Cipher != keystoreCipher {
+		return nil, errors.Errorf("Unsupported keystore cipher: %s", ks.Crypto.Cipher)
+	}
+	if ks.Crypto.KDF != keystoreKDF {
+		return nil, errors.Errorf("Unsupported keystore KDF: %s", ks.Crypto.KDF)
+	}
+	params := ks.Crypto.KDFParams
+	if params.DKLen != scryptDKLen {
+		return nil, errors.Errorf("Unsupported keystore key length: %d", params.DKLen)
+	}
+
+	salt, err := hex.DecodeString(params.Salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid keystore salt")
+	}
+	iv, err := hex.DecodeString(ks.Crypto.CipherParams.IV)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid keystore IV")
+	}
+	cipherText, err := hex.DecodeString(ks.Crypto.CipherText)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid keystore ciphertext")
+	}
+	mac, err := hex.DecodeString(ks.Crypto.MAC)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid keystore MAC")
+	}
+
+	derivedKey, err := scrypt.Key([]byte(password), salt, params.N, params.R, params.P, params.DKLen)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(crypto.Keccak256(derivedKey[16:32], cipherText), mac) != 1 {
+		return nil, ErrKeystorePassword
+	}
+	plainText, err := aesCTR(derivedKey[:16], iv, cipherText)
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := crypto.PrivateKeyFromBytes(plainText)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid private key in keystore")
+	}
+
+	address := hex.EncodeToString(privKey.PublicKey().Address().Bytes())
+	if address != strings.ToLower(strings.TrimPrefix(ks.Address, "0x")) {
+		return nil, errors.Errorf("Keystore key does not match address %s", ks.Address)
+	}
+	return privKey, nil
+}
+
+func aesCTR(key, iv, in []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(in))
+	cipher.NewCTR(block, iv).XORKeyStream(out, in)
+	return out, nil
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,32 @@
+package keymanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	crypto "github.com/thetatoken/ukulele/crypto"
+)
+
+// Light scrypt parameters keep the tests fast.
+const (
+	testScryptN = 1 << 4
+	testScryptP = 1
+)
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	privKey, _, err := crypto.GenerateKeyPair()
+	assert.Nil(err)
+
+	ks, err := encryptKey(privKey, "correct horse", testScryptN, testScryptP)
+	assert.Nil(err)
+	assert.Equal(3, ks.Version)
+
+	decrypted, err := DecryptKey(ks, "correct horse")
+	assert.Nil(err)
+	assert.Equal(privKey.ToBytes(), decrypted.ToBytes())
+
+	_, err = DecryptKey(ks, "wrong password")
+	assert.Equal(ErrKeystorePassword, err)
+}
@@ -14,6 +14,27 @@ func (_m *MockKeyManager) Close() {
 	_m.Called()
 }
 
+// CreateAccount provides a mock function with given fields: userid
+func (_m *MockKeyManager) CreateAccount(userid string) (db.Record, error) {
+	ret := _m.Called(userid)
+
+	var r0 db.Record
+	if rf, ok := ret.Get(0).(func(string) db.Record); ok {
+		r0 = rf(userid)
+	} else {
+		r0 = ret.Get(0).(db.Record)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(userid)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // FindByUserId provides a mock function with given fields: userid
 func (_m *MockKeyManager) FindByUserId(userid string) (db.Record, error) {
 	ret := _m.Called(userid)
@@ -34,3 +55,68 @@ func (_m *MockKeyManager) FindByUserId(userid string) (db.Record, error) {
 
 	return r0, r1
 }
+
+// GetSigner provides a mock function with given fields: userid, role
+func (_m *MockKeyManager) GetSigner(userid string, role AccountRole) (Signer, error) {
+	ret := _m.Called(userid, role)
+
+	var r0 Signer
+	if rf, ok := ret.Get(0).(func(string, AccountRole) Signer); ok {
+		r0 = rf(userid, role)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(Signer)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, AccountRole) error); ok {
+		r1 = rf(userid, role)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ExportKeys provides a mock function with given fields: userid, password, actor
+func (_m *MockKeyManager) ExportKeys(userid string, password string, actor string) (ExportedKeys, error) {
+	ret := _m.Called(userid, password, actor)
+
+	var r0 ExportedKeys
+	if rf, ok := ret.Get(0).(func(string, string, string) ExportedKeys); ok {
+		r0 = rf(userid, password, actor)
+	} else {
+		r0 = ret.Get(0).(ExportedKeys)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string, string) error); ok {
+		r1 = rf(userid, password, actor)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ImportKeys provides a mock function with given fields: userid, keys, password, actor
+func (_m *MockKeyManager) ImportKeys(userid string, keys ExportedKeys, password string, actor string) (db.Record, error) {
+	ret := _m.Called(userid, keys, password, actor)
+
+	var r0 db.Record
+	if rf, ok := ret.Get(0).(func(string, ExportedKeys, string, string) db.Record); ok {
+		r0 = rf(userid, keys, password, actor)
+	} else {
+		r0 = ret.Get(0).(db.Record)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, ExportedKeys, string, string) error); ok {
+		r1 = rf(userid, keys, password, actor)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
@@ -0,0 +1,58 @@
+// Code generated by mockery v1.0.0
+package keymanager
+
+import common "github.com/thetatoken/ukulele/common"
+import crypto "github.com/thetatoken/ukulele/crypto"
+import mock "github.com/stretchr/testify/mock"
+import types "github.com/thetatoken/ukulele/ledger/types"
+
+// MockSigner is an autogenerated mock type for the Signer type
+type MockSigner struct {
+	mock.Mock
+}
+
+// Address provides a mock function with given fields:
+func (_m *MockSigner) Address() common.Address {
+	ret := _m.Called()
+
+	var r0 common.Address
+	if rf, ok := ret.Get(0).(func() common.Address); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(common.Address)
+		}
+	}
+
+	return r0
+}
+
+// PublicKey provides a mock function with given fields:
+func (_m *MockSigner) PublicKey() *crypto.PublicKey {
+	ret := _m.Called()
+
+	var r0 *crypto.PublicKey
+	if rf, ok := ret.Get(0).(func() *crypto.PublicKey); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*crypto.PublicKey)
+		}
+	}
+
+	return r0
+}
+
+// SignTx provides a mock function with given fields: tx, requestID
+func (_m *MockSigner) SignTx(tx types.Tx, requestID string) error {
+	ret := _m.Called(tx, requestID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(types.Tx, string) error); ok {
+		r0 = rf(tx, requestID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
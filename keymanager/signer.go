@@ -0,0 +1,231 @@
+package keymanager
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/thetatoken/ukulele/common"
+	crypto "github.com/thetatoken/ukulele/crypto"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/util"
+)
+
+// AccountRole identifies one of the two accounts every user owns.
+type AccountRole string
+
+const (
+	SendAccount AccountRole = "SA" // Funds reserves and service payments.
+	RecvAccount AccountRole = "RA" // Collects earnings.
+)
+
+// Signer signs transactions on behalf of a single account of a user. The private
+// key never leaves the Signer.
+type Signer interface {
+	Address() common.Address
+	PublicKey() *crypto.PublicKey
+
+	// SignTx signs the input of tx belonging to the account and sets its
+	// signature. The transaction is recorded in the signing audit log, under
+	// requestID, before the signature is set; nothing is signed that cannot be
+	// recorded.
+	SignTx(tx ttypes.Tx, requestID string) error
+}
+
+// ----------------- Local Signer ---------------------
+
+// LocalSigner signs messages with a private key held in process memory. It keeps
+// no record of what it signs; transactions are signed with an AuditedSigner.
+type LocalSigner struct {
+	privKey *crypto.PrivateKey
+	pubKey  *crypto.PublicKey
+}
+
+func NewLocalSigner(privKey *crypto.PrivateKey) *LocalSigner {
+	return &LocalSigner{
+		privKey: privKey,
+		pubKey:  privKey.PublicKey(),
+	}
+}
+
+func (s *LocalSigner) Address() common.Address {
+	return s.pubKey.Address()
+}
+
+func (s *LocalSigner) PublicKey() *crypto.PublicKey {
+	return s.pubKey
+}
+
+func (s *LocalSigner) Sign(msg []byte) (*crypto.Signature, error) {
+	return s.privKey.Sign(msg)
+}
+
+// ----------------- Audited Signer ---------------------
+
+var _ Signer = &AuditedSigner{}
+
+// AuditedSigner signs transactions with a private key held in process memory,
+// appending each of them to the signing audit log first.
+type AuditedSigner struct {
+	key      *LocalSigner
+	userid   string
+	role     AccountRole
+	auditLog db.SigningAuditLog // Nil if the database keeps no signing audit log.
+}
+
+func NewAuditedSigner(privKey *crypto.PrivateKey, userid string, role AccountRole, auditLog db.SigningAuditLog) *AuditedSigner {
+	return &AuditedSigner{
+		key:      NewLocalSigner(privKey),
+		userid:   userid,
+		role:     role,
+		auditLog: auditLog,
+	}
+}
+
+func (s *AuditedSigner) Address() common.Address {
+	return s.key.Address()
+}
+
+func (s *AuditedSigner) PublicKey() *crypto.PublicKey {
+	return s.key.PublicKey()
+}
+
+func (s *AuditedSigner) SignTx(tx ttypes.Tx, requestID string) error {
+	if s.auditLog == nil {
+		return errNoSigningAudit
+	}
+	msg, err := TxSignBytes(tx, s.Address(), viper.GetString(util.CfgThetaChainId))
+	if err != nil {
+		return err
+	}
+	sig, err := s.key.Sign(msg)
+	if err != nil {
+		return err
+	}
+
+	// The entry hashes the transaction as broadcast, so it is built from a signed
+	// copy and the signature only set on tx once the entry is stored.
+	raw, err := ttypes.TxToBytes(tx)
+	if err != nil {
+		return err
+	}
+	signed, err := ttypes.TxFromBytes(raw)
+	if err != nil {
+		return err
+	}
+	if err := SetTxSignature(signed, s.Address(), sig); err != nil {
+		return err
+	}
+	entry, err := NewSigningAuditEntry(s.userid, s.role, signed, requestID)
+	if err != nil {
+		return err
+	}
+	fields := log.Fields{"audit": true, "userid": entry.UserID, "role": entry.Role, "tx_type": entry.TxType, "tx_hash": entry.TxHash, "request_id": entry.RequestID}
+	entry, err = s.auditLog.AppendSigningAudit(entry)
+	if err != nil {
+		return errors.Wrap(err, "Failed to record signature")
+	}
+	fields["seq"] = entry.Seq
+	log.WithFields(fields).Info("Signed transaction")
+	return SetTxSignature(tx, s.Address(), sig)
+}
+
+// TxSignBytes returns the bytes the account at address signs for its input of tx.
+func TxSignBytes(tx ttypes.Tx, address common.Address, chainID string) ([]byte, error) {
+	switch tx := tx.(type) {
+	case *ttypes.SendTx:
+		for _, input := range tx.Inputs {
+			if input.Address == address {
+				return tx.SignBytes(chainID), nil
+			}
+		}
+	case *ttypes.ReserveFundTx:
+		if tx.Source.Address == address {
+			return tx.SignBytes(chainID), nil
+		}
+	case *ttypes.ReleaseFundTx:
+		if tx.Source.Address == address {
+			return tx.SignBytes(chainID), nil
+		}
+	case *ttypes.ServicePaymentTx:
+		// The source signs the payment, the target its submission.
+		if tx.Source.Address == address {
+			return tx.SourceSignBytes(chainID), nil
+		}
+		if tx.Target.Address == address {
+			return tx.TargetSignBytes(chainID), nil
+		}
+	case *ttypes.SplitRuleTx:
+		if tx.Initiator.Address == address {
+			return tx.SignBytes(chainID), nil
+		}
+	default:
+		return nil, errors.Errorf("Unknown transaction type: %T", tx)
+	}
+	return nil, errors.Errorf("Transaction has no input from %v", address)
+}
+
+// SetTxSignature sets the signature of the input of tx from the account at
+// address.
+func SetTxSignature(tx ttypes.Tx, address common.Address, sig *crypto.Signature) error {
+	ok := false
+	switch tx := tx.(type) {
+	case *ttypes.SendTx:
+		ok = tx.SetSignature(address, sig)
+	case *ttypes.ReserveFundTx:
+		ok = tx.SetSignature(address, sig)
+	case *ttypes.ReleaseFundTx:
+		ok = tx.SetSignature(address, sig)
+	case *ttypes.ServicePaymentTx:
+		if tx.Source.Address == address {
+			tx.SetSourceSignature(sig)
+			ok = true
+		} else if tx.Target.Address == address {
+			tx.SetTargetSignature(sig)
+			ok = true
+		}
+	case *ttypes.SplitRuleTx:
+		ok = tx.SetSignature(address, sig)
+	default:
+		return errors.Errorf("Unknown transaction type: %T", tx)
+	}
+	if !ok {
+		return errors.Errorf("Transaction has no input from %v", address)
+	}
+	return nil
+}
+
+// TxSignature returns the signature of the input of tx from the account at
+// address, nil if it is unsigned.
+func TxSignature(tx ttypes.Tx, address common.Address) (*crypto.Signature, error) {
+	switch tx := tx.(type) {
+	case *ttypes.SendTx:
+		for _, input := range tx.Inputs {
+			if input.Address == address {
+				return input.Signature, nil
+			}
+		}
+	case *ttypes.ReserveFundTx:
+		if tx.Source.Address == address {
+			return tx.Source.Signature, nil
+		}
+	case *ttypes.ReleaseFundTx:
+		if tx.Source.Address == address {
+			return tx.Source.Signature, nil
+		}
+	case *ttypes.ServicePaymentTx:
+		if tx.Source.Address == address {
+			return tx.Source.Signature, nil
+		}
+		if tx.Target.Address == address {
+			return tx.Target.Signature, nil
+		}
+	case *ttypes.SplitRuleTx:
+		if tx.Initiator.Address == address {
+			return tx.Initiator.Signature, nil
+		}
+	default:
+		return nil, errors.Errorf("Unknown transaction type: %T", tx)
+	}
+	return nil, errors.Errorf("Transaction has no input from %v", address)
+}
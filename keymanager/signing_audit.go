@@ -0,0 +1,76 @@
+package keymanager
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	crypto "github.com/thetatoken/ukulele/crypto"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+)
+
+// NewSigningAuditEntry describes a transaction signed with the given account of
+// the user, as recorded in the signing audit log.
+func NewSigningAuditEntry(userid string, role AccountRole, tx ttypes.Tx, requestID string) (db.SigningAuditEntry, error) {
+	raw, err := ttypes.TxToBytes(tx)
+	if err != nil {
+		return db.SigningAuditEntry{}, err
+	}
+	entry := db.SigningAuditEntry{
+		UserID:    userid,
+		Role:      string(role),
+		TxHash:    crypto.Keccak256Hash(raw).Hex(),
+		RequestID: requestID,
+	}
+
+	entry.TxType, err = TxType(tx)
+	if err != nil {
+		return db.SigningAuditEntry{}, err
+	}
+
+	var amount, fee ttypes.Coins
+	switch tx := tx.(type) {
+	case *ttypes.SendTx:
+		// Multi-output sends are recorded with their total and every destination.
+		fee = tx.Fee
+		amount = ttypes.Coins{}.NoNil()
+		destinations := make([]string, len(tx.Outputs))
+		for i, output := range tx.Outputs {
+			amount = amount.Plus(output.Coins.NoNil())
+			destinations[i] = output.Address.Hex()
+		}
+		entry.Destination = strings.Join(destinations, ",")
+	case *ttypes.ReserveFundTx:
+		amount, fee = tx.Source.Coins, tx.Fee
+	case *ttypes.ReleaseFundTx:
+		fee = tx.Fee
+	case *ttypes.ServicePaymentTx:
+		amount, fee = tx.Source.Coins, tx.Fee
+		entry.Destination = tx.Target.Address.Hex()
+	case *ttypes.SplitRuleTx:
+		fee = tx.Fee
+	}
+	amount = amount.NoNil()
+	entry.ThetaWei = amount.ThetaWei.String()
+	entry.GammaWei = amount.GammaWei.String()
+	entry.FeeWei = fee.NoNil().GammaWei.String()
+	return entry, nil
+}
+
+// TxType returns the name vault records transactions of the type of tx under.
+func TxType(tx ttypes.Tx) (string, error) {
+	switch tx.(type) {
+	case *ttypes.SendTx:
+		return "send", nil
+	case *ttypes.ReserveFundTx:
+		return "reserve_fund", nil
+	case *ttypes.ReleaseFundTx:
+		return "release_fund", nil
+	case *ttypes.ServicePaymentTx:
+		return "service_payment", nil
+	case *ttypes.SplitRuleTx:
+		return "split_rule", nil
+	default:
+		return "", errors.Errorf("Unknown transaction type: %T", tx)
+	}
+}
@@ -0,0 +1,32 @@
+package keymanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+)
+
+func TestSigningAuditEntryRecordsEveryOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	bob := tcmn.HexToAddress("0x00000000000000000000000000000000000000b0")
+	carol := tcmn.HexToAddress("0x00000000000000000000000000000000000000c0")
+	tx := &ttypes.SendTx{
+		Fee:    ttypes.NewCoins(0, 20),
+		Inputs: []ttypes.TxInput{{Coins: ttypes.NewCoins(10, 320)}},
+		Outputs: []ttypes.TxOutput{
+			{Address: bob, Coins: ttypes.NewCoins(10, 100)},
+			{Address: carol, Coins: ttypes.NewCoins(0, 200)},
+		},
+	}
+
+	entry, err := NewSigningAuditEntry("alice", SendAccount, tx, "req-1")
+	assert.Nil(err)
+	assert.Equal("send", entry.TxType)
+	assert.Equal("10", entry.ThetaWei)
+	assert.Equal("300", entry.GammaWei)
+	assert.Equal("20", entry.FeeWei)
+	assert.Equal(bob.Hex()+","+carol.Hex(), entry.Destination)
+}
@@ -0,0 +1,150 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/util"
+)
+
+var ErrNoAllowlists = errors.New("Withdrawal allowlists are not supported by the database")
+
+// webhookTimeout bounds notifications of allowlist changes.
+const webhookTimeout = 10 * time.Second
+
+// AddressNotAllowed reports a payment to an external address that is not on the
+// allowlist of the user, or not active yet if ActiveAt is set.
+type AddressNotAllowed struct {
+	Address  tcmn.Address
+	ActiveAt *time.Time
+}
+
+func (e *AddressNotAllowed) Error() string {
+	if e.ActiveAt != nil {
+		return fmt.Sprintf("Withdrawal address %v is not active until %v", e.Address.Hex(), e.ActiveAt.UTC())
+	}
+	return fmt.Sprintf("Withdrawal address %v is not allowed", e.Address.Hex())
+}
+
+// AddWithdrawalAddress allows payments from the user to an external address once
+// the configured delay has passed. Adding an allowed address again does not reset
+// its delay; the existing entry is returned with added false.
+func AddWithdrawalAddress(allowlists db.AllowlistStore, userid string, address tcmn.Address, label string) (db.WithdrawalAddress, bool, error) {
+	if allowlists == nil {
+		return db.WithdrawalAddress{}, false, ErrNoAllowlists
+	}
+	now := time.Now().UTC()
+	entry := db.WithdrawalAddress{
+		UserID:    userid,
+		Address:   address,
+		Label:     label,
+		CreatedAt: now,
+		ActiveAt:  now.Add(time.Duration(viper.GetInt64(util.CfgAllowlistDelay)) * time.Second),
+	}
+	added, err := allowlists.AddWithdrawalAddress(entry)
+	if err != nil {
+		return db.WithdrawalAddress{}, false, err
+	}
+	if !added {
+		if entry, err = allowlists.FindWithdrawalAddress(userid, address); err != nil {
+			return db.WithdrawalAddress{}, false, err
+		}
+	}
+	return entry, added, nil
+}
+
+// NotifyWithdrawalAddressAdded posts the new allowlist entry to the configured
+// webhook, so that users can be warned of addresses they did not add before they
+// become usable.
+func NotifyWithdrawalAddressAdded(requestID string, entry db.WithdrawalAddress) {
+	url := viper.GetString(util.CfgAllowlistWebhookURL)
+	if url == "" {
+		return
+	}
+	logger := log.WithFields(log.Fields{"method": "NotifyWithdrawalAddressAdded", "userid": entry.UserID, "address": entry.Address.Hex(), "request_id": requestID})
+
+	body, err := json.Marshal(map[string]interface{}{
+		"event":      "withdrawal_address_added",
+		"user_id":    entry.UserID,
+		"address":    entry.Address.Hex(),
+		"label":      entry.Label,
+		"created_at": entry.CreatedAt.Unix(),
+		"active_at":  entry.ActiveAt.Unix(),
+	})
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Error("Failed to encode notification")
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Error("Failed to create notification")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(util.RequestIDHeader, requestID)
+	resp, err := (&http.Client{Timeout: webhookTimeout}).Do(req)
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Error("Failed to notify webhook")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logger.WithFields(log.Fields{"status": resp.StatusCode}).Error("Webhook rejected notification")
+	}
+}
+
+// CheckWithdrawalAddress returns an error unless the user may pay the address:
+// either the address belongs to a vault user, or it is on the allowlist of the user
+// and its delay has passed. Every address is allowed if allowlists are disabled.
+// allowlists is nil if the database does not support them.
+func CheckWithdrawalAddress(allowlists db.AllowlistStore, userid string, address tcmn.Address) error {
+	if !viper.GetBool(util.CfgAllowlistEnabled) {
+		return nil
+	}
+	if allowlists == nil {
+		return ErrNoAllowlists
+	}
+	_, _, err := allowlists.FindUserByAddress(address)
+	if err == nil {
+		return nil
+	}
+	if err != db.ErrNoRecord {
+		return err
+	}
+	entry, err := allowlists.FindWithdrawalAddress(userid, address)
+	if err == db.ErrNoRecord {
+		return &AddressNotAllowed{Address: address}
+	}
+	if err != nil {
+		return err
+	}
+	if time.Now().Before(entry.ActiveAt) {
+		return &AddressNotAllowed{Address: address, ActiveAt: &entry.ActiveAt}
+	}
+	return nil
+}
+
+// CheckTxDestinations checks every address tx pays against the allowlist of the
+// user.
+func CheckTxDestinations(allowlists db.AllowlistStore, userid string, tx ttypes.Tx) error {
+	switch tx := tx.(type) {
+	case *ttypes.SendTx:
+		for _, output := range tx.Outputs {
+			if err := CheckWithdrawalAddress(allowlists, userid, output.Address); err != nil {
+				return err
+			}
+		}
+	case *ttypes.ServicePaymentTx:
+		return CheckWithdrawalAddress(allowlists, userid, tx.Target.Address)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package policy
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/util"
+)
+
+var ErrNoSpendingLimits = errors.New("Spending limits are not supported by the database")
+
+// LimitExceeded reports a spending rejected by a limit of its user, with the
+// amount requested if the limit is on amounts.
+type LimitExceeded struct {
+	db.LimitExceeded
+	Requested *big.Int
+}
+
+func (e *LimitExceeded) Error() string {
+	if e.Currency == "" {
+		return fmt.Sprintf("Spending limit %s of %v exceeded", e.Limit, e.Max)
+	}
+	return fmt.Sprintf("Spending limit %s of %v %s exceeded", e.Limit, e.Max, e.Currency)
+}
+
+// RecordFinder looks up the accounts of users. keymanager.KeyManager implements it.
+type RecordFinder interface {
+	FindByUserId(userid string) (db.Record, error)
+}
+
+// UserLimits returns the tier of the user and its limits, with the overrides of
+// the user applied.
+func UserLimits(store db.LimitStore, userid string) (string, db.SpendingLimits, error) {
+	user, err := store.FindUserLimits(userid)
+	if err != nil && err != db.ErrNoRecord {
+		return "", db.SpendingLimits{}, err
+	}
+	tier := user.Tier
+	if tier == "" {
+		tier = viper.GetString(util.CfgLimitsDefaultTier)
+	}
+	limits, err := TierLimits(tier)
+	if err != nil {
+		return "", db.SpendingLimits{}, err
+	}
+
+	o := user.Overrides
+	for _, override := range []struct {
+		dest  **big.Int
+		value *big.Int
+	}{
+		{&limits.PerTransaction.ThetaWei, o.PerTransaction.ThetaWei},
+		{&limits.PerTransaction.GammaWei, o.PerTransaction.GammaWei},
+		{&limits.Daily.ThetaWei, o.Daily.ThetaWei},
+		{&limits.Daily.GammaWei, o.Daily.GammaWei},
+		{&limits.Monthly.ThetaWei, o.Monthly.ThetaWei},
+		{&limits.Monthly.GammaWei, o.Monthly.GammaWei},
+	} {
+		if override.value != nil {
+			*override.dest = override.value
+		}
+	}
+	if o.ReservedFunds != nil {
+		limits.ReservedFunds = o.ReservedFunds
+	}
+	return tier, limits, nil
+}
+
+// TierLimits reads the limits of a tier from the config. The default tier has no
+// limits unless configured; other tiers must be configured.
+func TierLimits(tier string) (db.SpendingLimits, error) {
+	key := util.CfgLimitsTiers + "." + tier
+	if !viper.IsSet(key) {
+		if tier == viper.GetString(util.CfgLimitsDefaultTier) {
+			return db.SpendingLimits{}, nil
+		}
+		return db.SpendingLimits{}, errors.Errorf("Unknown spending limit tier: %s", tier)
+	}
+
+	limits := db.SpendingLimits{}
+	for name, dest := range map[string]**big.Int{
+		"per_tx_thetawei":  &limits.PerTransaction.ThetaWei,
+		"per_tx_gammawei":  &limits.PerTransaction.GammaWei,
+		"daily_thetawei":   &limits.Daily.ThetaWei,
+		"daily_gammawei":   &limits.Daily.GammaWei,
+		"monthly_thetawei": &limits.Monthly.ThetaWei,
+		"monthly_gammawei": &limits.Monthly.GammaWei,
+	} {
+		amount, err := ParseLimit(viper.GetString(key + "." + name))
+		if err != nil {
+			return db.SpendingLimits{}, errors.Wrapf(err, "Invalid %s of spending limit tier %s", name, tier)
+		}
+		*dest = amount
+	}
+	if viper.IsSet(key + ".max_reserved_funds") {
+		max := viper.GetInt64(key + ".max_reserved_funds")
+		limits.ReservedFunds = &max
+	}
+	return limits, nil
+}
+
+// ParseLimit returns nil for an empty limit.
+func ParseLimit(value string) (*big.Int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	amount, ok := new(big.Int).SetString(value, 10)
+	if !ok || amount.Sign() < 0 {
+		return nil, errors.Errorf("amount %s", value)
+	}
+	return amount, nil
+}
+
+// TxSpending returns what tx is charged against the limits of the user, or nil if
+// limits are disabled or do not apply to tx. Sends count the amounts paid to
+// addresses other than the accounts of the user, and service payments the amount
+// paid from the SA. Fund reservations count toward the per-transaction and
+// reserved funds limits only, the funds leaving through service payments.
+func TxSpending(records RecordFinder, userid string, tx ttypes.Tx) (*db.Spending, error) {
+	if !viper.GetBool(util.CfgLimitsEnabled) {
+		return nil, nil
+	}
+	now := time.Now()
+	outflow := ttypes.Coins{}.NoNil()
+	switch tx := tx.(type) {
+	case *ttypes.SendTx:
+		record, err := records.FindByUserId(userid)
+		if err != nil {
+			return nil, err
+		}
+		for _, output := range tx.Outputs {
+			if output.Address != record.SaAddress && output.Address != record.RaAddress {
+				outflow = outflow.Plus(output.Coins.NoNil())
+			}
+		}
+	case *ttypes.ServicePaymentTx:
+		record, err := records.FindByUserId(userid)
+		if err != nil {
+			return nil, err
+		}
+		// Targets submitting payments they received are not charged.
+		if tx.Source.Address == record.SaAddress {
+			outflow = tx.Source.Coins.NoNil()
+		}
+	case *ttypes.ReserveFundTx:
+		blockTime := time.Duration(viper.GetInt64(util.CfgLimitsBlockTime)) * time.Second
+		fund := tx.Source.Coins.NoNil()
+		return &db.Spending{
+			UserID:           userid,
+			ThetaWei:         fund.ThetaWei,
+			GammaWei:         fund.GammaWei,
+			Time:             now,
+			Reserve:          true,
+			ReserveSequence:  tx.Source.Sequence,
+			ReserveExpiresAt: now.Add(time.Duration(tx.Duration) * blockTime),
+		}, nil
+	}
+	if outflow.IsZero() {
+		return nil, nil
+	}
+	return &db.Spending{UserID: userid, ThetaWei: outflow.ThetaWei, GammaWei: outflow.GammaWei, Time: now, Outflow: true}, nil
+}
+
+// ChargeLimits charges the spending against the limits of its user, or returns a
+// *LimitExceeded error. A nil spending is not charged.
+func ChargeLimits(store db.LimitStore, spending *db.Spending) error {
+	if spending == nil {
+		return nil
+	}
+	if store == nil {
+		return ErrNoSpendingLimits
+	}
+	_, limits, err := UserLimits(store, spending.UserID)
+	if err != nil {
+		return err
+	}
+	requested := func(currency string) *big.Int {
+		if currency == "thetawei" {
+			return spending.ThetaWei
+		}
+		return spending.GammaWei
+	}
+
+	for _, check := range []struct {
+		currency string
+		max      *big.Int
+	}{
+		{"thetawei", limits.PerTransaction.ThetaWei},
+		{"gammawei", limits.PerTransaction.GammaWei},
+	} {
+		if check.max != nil && requested(check.currency) != nil && requested(check.currency).Cmp(check.max) > 0 {
+			return &LimitExceeded{
+				LimitExceeded: db.LimitExceeded{Limit: db.LimitPerTransaction, Currency: check.currency, Max: check.max},
+				Requested:     requested(check.currency),
+			}
+		}
+	}
+
+	exceeded, err := store.ChargeSpending(*spending, limits)
+	if err != nil {
+		return err
+	}
+	if exceeded != nil {
+		if exceeded.Currency == "" {
+			return &LimitExceeded{LimitExceeded: *exceeded}
+		}
+		return &LimitExceeded{LimitExceeded: *exceeded, Requested: requested(exceeded.Currency)}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package rotation
+
+import (
+	"encoding/hex"
+
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	ukulele "github.com/thetatoken/ukulele/rpc"
+	"github.com/thetatoken/vault/util"
+)
+
+// Chain is the view of the blockchain the rotation Manager needs.
+type Chain interface {
+	// GetAccount returns the state of an account. Accounts unknown to the chain are
+	// returned empty.
+	GetAccount(address tcmn.Address) (*ttypes.Account, error)
+	Broadcast(tx ttypes.Tx) error
+}
+
+// RPCChain talks to a Theta node.
+type RPCChain struct {
+	client util.RPCClient
+}
+
+func NewRPCChain(client util.RPCClient) *RPCChain {
+	return &RPCChain{client: client}
+}
+
+func (c *RPCChain) GetAccount(address tcmn.Address) (*ttypes.Account, error) {
+	account, err := util.GetAccount(c.client, address)
+	if util.IsAccountNotFound(err) {
+		return ttypes.NewAccount(), nil
+	}
+	return account, err
+}
+
+func (c *RPCChain) Broadcast(tx ttypes.Tx) error {
+	raw, err := ttypes.TxToBytes(tx)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Call("theta.BroadcastRawTransaction", &ukulele.BroadcastRawTransactionArgs{TxBytes: hex.EncodeToString(raw)})
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	return nil
+}
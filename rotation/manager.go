@@ -0,0 +1,309 @@
+package rotation
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/util"
+)
+
+// A rotation moves through the following states, each persisted before the next
+// step starts, so it can be resumed from any point after a crash:
+//
+//   pending    New keys are stored alongside the rotation; the user still signs
+//              with the old keys.
+//   switched   Old keys are retired and the user signs with the new keys, so no
+//              new funds can be reserved from the old SA. The old RA balance is
+//              swept to the new RA.
+//   ra_swept   Waits until the old SA has no reserved funds, then sweeps its
+//              balance to the new SA.
+//   completed
+//
+// A retired account holding funds but too little gamma to pay the fee of its sweep
+// ends the rotation in the failed state, with the reason as its error; the funds
+// are left to be recovered manually. Retired keys are kept, so funds arriving at
+// old addresses later remain recoverable. A sweep always spends the next sequence
+// of the old account, so re-sending it after a crash can never move funds twice.
+
+var ErrRotationInProgress = errors.New("Rotation: user already has a rotation in progress")
+
+// Store is the persistence the rotation Manager needs. db.DAO implements it.
+type Store interface {
+	FindByUserId(userid string) (db.Record, error)
+	RecordAdminAction(action db.AdminAction) error
+	CreateRotation(userid string, newKeys db.Record) (db.Rotation, bool, error)
+	FindActiveRotations() ([]db.Rotation, error)
+	UpdateRotation(rotation db.Rotation, fromState string) (bool, error)
+	SwitchRotatedKeys(rotationID int64) (bool, error)
+	FindRetiredKeys(rotationID int64) (db.Record, error)
+}
+
+// KeySource generates keys and signs with stored ones. keymanager.SqlKeyManager
+// implements it.
+type KeySource interface {
+	GenerateKeys(userid string) (db.Record, error)
+	RecordSigner(record db.Record, role keymanager.AccountRole) (keymanager.Signer, error)
+}
+
+type Manager struct {
+	store Store
+	keys  KeySource
+	chain Chain
+}
+
+func NewManager(store Store, keys KeySource, chain Chain) *Manager {
+	return &Manager{
+		store: store,
+		keys:  keys,
+		chain: chain,
+	}
+}
+
+// Start creates a pending rotation with new keys for the user. Call Advance, or
+// run Process, to carry it out.
+func (m *Manager) Start(userid string) (db.Rotation, error) {
+	if _, err := m.store.FindByUserId(userid); err != nil {
+		if err == db.ErrNoRecord {
+			return db.Rotation{}, keymanager.ErrAccountNotFound
+		}
+		return db.Rotation{}, errors.Wrap(err, "Failed to find user by id")
+	}
+	newKeys, err := m.keys.GenerateKeys(userid)
+	if err != nil {
+		return db.Rotation{}, errors.Wrap(err, "Failed to generate keys")
+	}
+	rotation, created, err := m.store.CreateRotation(userid, newKeys)
+	if err != nil {
+		return db.Rotation{}, errors.Wrap(err, "Failed to create rotation")
+	}
+	if !created {
+		return rotation, ErrRotationInProgress
+	}
+	log.WithFields(log.Fields{"userid": userid, "rotation": rotation.ID, "send_address": newKeys.SaAddress, "recv_address": newKeys.RaAddress}).Info("Started key rotation")
+	return rotation, nil
+}
+
+// StartByAdmin starts a rotation like Start, on behalf of an admin, and records
+// the request in the audit trail of admin actions. It fails if the request could
+// not be recorded.
+func (m *Manager) StartByAdmin(userid, actor string) (db.Rotation, error) {
+	rotation, err := m.Start(userid)
+
+	entry := db.AdminAction{
+		Action:  keymanager.AdminActionRotateKeys,
+		UserID:  userid,
+		Actor:   actor,
+		Success: err == nil,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	log.WithFields(log.Fields{"audit": true, "action": entry.Action, "userid": userid, "actor": actor, "success": entry.Success, "error": entry.Error}).Info("Admin action")
+	if auditErr := m.store.RecordAdminAction(entry); auditErr != nil {
+		return db.Rotation{}, errors.Wrap(auditErr, "Failed to record admin action")
+	}
+	return rotation, err
+}
+
+// Advance carries the rotation forward until it completes or has to wait for the
+// chain. Errors are saved with the rotation, which is retried on the next call.
+func (m *Manager) Advance(rotation db.Rotation) (db.Rotation, error) {
+	logger := log.WithFields(log.Fields{"method": "rotation.Advance", "userid": rotation.UserID, "rotation": rotation.ID})
+
+	for !rotation.Done() {
+		next, wait, err := m.step(rotation)
+		if err != nil {
+			logger.WithFields(log.Fields{"state": rotation.State, "error": err}).Error("Key rotation step failed")
+			next = rotation
+			next.Error = err.Error()
+			wait = true
+		} else if next.State != db.RotationFailed {
+			next.Error = ""
+		}
+		if next.State != rotation.State {
+			logger.WithFields(log.Fields{"from": rotation.State, "to": next.State}).Info("Key rotation advanced")
+		}
+
+		// States reached inside the store transaction are already saved.
+		fromState := rotation.State
+		if next.State == db.RotationSwitched && fromState == db.RotationPending {
+			fromState = db.RotationSwitched
+		}
+		updated, uerr := m.store.UpdateRotation(next, fromState)
+		if uerr != nil {
+			return rotation, uerr
+		}
+		if !updated {
+			return rotation, errors.Errorf("Rotation %d was updated concurrently", rotation.ID)
+		}
+		rotation = next
+		if wait {
+			return rotation, err
+		}
+	}
+	return rotation, nil
+}
+
+// AdvanceAll advances every active rotation. It returns the number of rotations
+// still active.
+func (m *Manager) AdvanceAll() (int, error) {
+	rotations, err := m.store.FindActiveRotations()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to fetch rotations from database")
+	}
+	active := 0
+	for _, rotation := range rotations {
+		rotation, _ = m.Advance(rotation)
+		if !rotation.Done() {
+			active++
+		}
+	}
+	return active, nil
+}
+
+// Process advances the active rotations periodically.
+func (m *Manager) Process() {
+	logger := log.WithFields(log.Fields{"method": "rotation.Process"})
+
+	sleepWakeup := viper.GetInt64(util.CfgRotationWakeupInterval)
+	wakeupTicker := time.NewTicker(time.Duration(sleepWakeup) * time.Second)
+	defer wakeupTicker.Stop()
+
+	for range wakeupTicker.C {
+		active, err := m.AdvanceAll()
+		if err != nil {
+			logger.WithFields(log.Fields{"error": err}).Error("Failed to advance key rotations")
+		} else if active > 0 {
+			logger.Infof("%d key rotations in progress", active)
+		}
+	}
+}
+
+// step performs the work of the current state. It returns the rotation in its new
+// state, and whether it has to wait for the chain before going further.
+func (m *Manager) step(rotation db.Rotation) (db.Rotation, bool, error) {
+	switch rotation.State {
+	case db.RotationPending:
+		return m.switchKeys(rotation)
+	case db.RotationSwitched:
+		return m.sweep(rotation, keymanager.RecvAccount, db.RotationRaSwept)
+	case db.RotationRaSwept:
+		return m.sweep(rotation, keymanager.SendAccount, db.RotationCompleted)
+	default:
+		return rotation, true, errors.Errorf("Unknown rotation state: %s", rotation.State)
+	}
+}
+
+// switchKeys retires the old keys. Switching comes first so that no transaction
+// from the old SA, and in particular no fund reservation, is signed once sweep
+// checks its reserved funds.
+func (m *Manager) switchKeys(rotation db.Rotation) (db.Rotation, bool, error) {
+	switched, err := m.store.SwitchRotatedKeys(rotation.ID)
+	if err != nil {
+		return rotation, true, errors.Wrap(err, "Failed to switch keys")
+	}
+	if !switched {
+		return rotation, true, errors.Errorf("Rotation %d is no longer pending", rotation.ID)
+	}
+	rotation.State = db.RotationSwitched
+	return rotation, false, nil
+}
+
+// sweep moves the balance of a retired account to its replacement, then moves the
+// rotation to doneState. The old SA is only swept once its reserved funds have
+// been released, so that no service payment is still expected from it.
+func (m *Manager) sweep(rotation db.Rotation, role keymanager.AccountRole, doneState string) (db.Rotation, bool, error) {
+	retired, err := m.store.FindRetiredKeys(rotation.ID)
+	if err != nil {
+		return rotation, true, errors.Wrap(err, "Failed to find retired keys")
+	}
+	signer, err := m.keys.RecordSigner(retired, role)
+	if err != nil {
+		return rotation, true, err
+	}
+	var from, to tcmn.Address
+	if role == keymanager.SendAccount {
+		from, to = retired.SaAddress, rotation.NewKeys.SaAddress
+	} else {
+		from, to = retired.RaAddress, rotation.NewKeys.RaAddress
+	}
+
+	account, err := m.chain.GetAccount(from)
+	if err != nil {
+		return rotation, true, errors.Wrap(err, "Failed to get retired account")
+	}
+	pending := rotation.SweepSequence != 0 && account.Sequence < rotation.SweepSequence
+	if !pending && len(account.ReservedFunds) > 0 {
+		log.WithFields(log.Fields{"userid": rotation.UserID, "reserved_funds": len(account.ReservedFunds)}).Info("Waiting for reserved funds to be released")
+		return rotation, true, nil
+	}
+
+	fee := new(big.Int).SetUint64(ttypes.MinimumTransactionFeeGammaWei)
+	balance := account.Balance.NoNil()
+	if !pending && balance.ThetaWei.Sign() == 0 && balance.GammaWei.Cmp(fee) <= 0 {
+		// Nothing left that is worth a transaction fee.
+		rotation.State = doneState
+		rotation.SweepSequence = 0
+		return rotation, false, nil
+	}
+	if balance.GammaWei.Cmp(fee) < 0 {
+		if pending {
+			return rotation, true, nil
+		}
+		// Retrying cannot help until someone pays for the fee.
+		rotation.State = db.RotationFailed
+		rotation.SweepSequence = 0
+		rotation.Error = fmt.Sprintf("Retired %s %v holds %v thetawei but only %v gammawei, short of the %v gammawei fee to sweep it; recover it manually", role, from, balance.ThetaWei, balance.GammaWei, fee)
+		log.WithFields(log.Fields{"userid": rotation.UserID, "rotation": rotation.ID, "error": rotation.Error}).Error("Key rotation needs manual action")
+		return rotation, false, nil
+	}
+
+	// Until the previous sweep is confirmed, re-send it with the same sequence. Only
+	// one transaction per sequence can ever be committed.
+	sequence := account.Sequence + 1
+	tx := prepareSweepTx(signer, to, balance, fee, sequence)
+	if err := signer.SignTx(tx, ""); err != nil {
+		return rotation, true, err
+	}
+	err = m.chain.Broadcast(tx)
+	if err != nil && !pending {
+		return rotation, true, errors.Wrap(err, "Failed to broadcast sweep transaction")
+	}
+	log.WithFields(log.Fields{"userid": rotation.UserID, "from": from, "to": to, "sequence": sequence, "error": err}).Info("Sent sweep transaction")
+	rotation.SweepSequence = sequence
+	return rotation, true, nil
+}
+
+func prepareSweepTx(signer keymanager.Signer, to tcmn.Address, balance ttypes.Coins, fee *big.Int, sequence uint64) *ttypes.SendTx {
+	input := ttypes.TxInput{
+		Address:  signer.Address(),
+		Coins:    balance,
+		Sequence: sequence,
+	}
+	if sequence == 1 {
+		input.PubKey = signer.PublicKey()
+	}
+	tx := &ttypes.SendTx{
+		Fee: ttypes.Coins{
+			ThetaWei: ttypes.Zero,
+			GammaWei: fee,
+		},
+		Inputs: []ttypes.TxInput{input},
+		Outputs: []ttypes.TxOutput{{
+			Address: to,
+			Coins: ttypes.Coins{
+				ThetaWei: balance.ThetaWei,
+				GammaWei: new(big.Int).Sub(balance.GammaWei, fee),
+			},
+		}},
+	}
+	return tx
+}
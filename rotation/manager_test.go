@@ -0,0 +1,246 @@
+package rotation
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+)
+
+// memStore is an in-memory Store with the same state checks as db.DAO.
+type memStore struct {
+	records   map[string]db.Record
+	rotations map[int64]*db.Rotation
+	retired   map[int64]db.Record
+	actions   []db.AdminAction
+	nextID    int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		records:   make(map[string]db.Record),
+		rotations: make(map[int64]*db.Rotation),
+		retired:   make(map[int64]db.Record),
+	}
+}
+
+func (s *memStore) FindByUserId(userid string) (db.Record, error) {
+	record, ok := s.records[userid]
+	if !ok {
+		return db.Record{}, db.ErrNoRecord
+	}
+	return record, nil
+}
+
+func (s *memStore) CreateRotation(userid string, newKeys db.Record) (db.Rotation, bool, error) {
+	for _, rotation := range s.rotations {
+		if rotation.UserID == userid && !rotation.Done() {
+			return *rotation, false, nil
+		}
+	}
+	s.nextID++
+	rotation := &db.Rotation{ID: s.nextID, UserID: userid, State: db.RotationPending, NewKeys: newKeys}
+	s.rotations[rotation.ID] = rotation
+	return *rotation, true, nil
+}
+
+func (s *memStore) FindActiveRotations() ([]db.Rotation, error) {
+	var rotations []db.Rotation
+	for id := int64(1); id <= s.nextID; id++ {
+		if rotation := s.rotations[id]; !rotation.Done() {
+			rotations = append(rotations, *rotation)
+		}
+	}
+	return rotations, nil
+}
+
+func (s *memStore) UpdateRotation(rotation db.Rotation, fromState string) (bool, error) {
+	if s.rotations[rotation.ID].State != fromState {
+		return false, nil
+	}
+	*s.rotations[rotation.ID] = rotation
+	return true, nil
+}
+
+func (s *memStore) SwitchRotatedKeys(rotationID int64) (bool, error) {
+	rotation := s.rotations[rotationID]
+	if rotation.State != db.RotationPending {
+		return false, nil
+	}
+	s.retired[rotationID] = s.records[rotation.UserID]
+	s.records[rotation.UserID] = rotation.NewKeys
+	rotation.State = db.RotationSwitched
+	return true, nil
+}
+
+func (s *memStore) FindRetiredKeys(rotationID int64) (db.Record, error) {
+	record, ok := s.retired[rotationID]
+	if !ok {
+		return db.Record{}, db.ErrNoRecord
+	}
+	return record, nil
+}
+
+func (s *memStore) RecordAdminAction(action db.AdminAction) error {
+	s.actions = append(s.actions, action)
+	return nil
+}
+
+type fixedKeys struct {
+	record db.Record
+}
+
+func (k fixedKeys) GenerateKeys(userid string) (db.Record, error) {
+	record := k.record
+	record.UserID = userid
+	return record, nil
+}
+
+func (k fixedKeys) RecordSigner(record db.Record, role keymanager.AccountRole) (keymanager.Signer, error) {
+	address := record.RaAddress
+	if role == keymanager.SendAccount {
+		address = record.SaAddress
+	}
+	signer := &keymanager.MockSigner{}
+	signer.On("Address").Return(address)
+	signer.On("PublicKey").Return(nil)
+	signer.On("SignTx", mock.Anything, "").Return(nil)
+	return signer, nil
+}
+
+type fakeChain struct {
+	accounts   map[tcmn.Address]*ttypes.Account
+	broadcasts int
+}
+
+func (c *fakeChain) GetAccount(address tcmn.Address) (*ttypes.Account, error) {
+	if account, ok := c.accounts[address]; ok {
+		return account, nil
+	}
+	return &ttypes.Account{Balance: coins(0, 0)}, nil
+}
+
+func (c *fakeChain) Broadcast(tx ttypes.Tx) error {
+	c.broadcasts++
+	return nil
+}
+
+func coins(theta, gamma int64) ttypes.Coins {
+	return ttypes.Coins{ThetaWei: big.NewInt(theta), GammaWei: big.NewInt(gamma)}
+}
+
+func address(b ...byte) tcmn.Address {
+	return tcmn.BytesToAddress(b)
+}
+
+func TestKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	oldKeys := db.Record{UserID: "alice", RaAddress: address(1, 1), SaAddress: address(1, 2)}
+	newKeys := db.Record{RaAddress: address(2, 1), SaAddress: address(2, 2)}
+	store := newMemStore()
+	store.records["alice"] = oldKeys
+	chain := &fakeChain{accounts: map[tcmn.Address]*ttypes.Account{
+		oldKeys.RaAddress: {Balance: coins(5, 10)},
+		oldKeys.SaAddress: {Balance: coins(0, 100), ReservedFunds: []ttypes.ReservedFund{{ReserveSequence: 1}}},
+	}}
+	m := NewManager(store, fixedKeys{newKeys}, chain)
+
+	rotation, err := m.Start("alice")
+	require.Nil(t, err)
+	_, err = m.Start("alice")
+	assert.Equal(ErrRotationInProgress, err)
+
+	// Keys are switched right away and the old RA is swept.
+	rotation, err = m.Advance(rotation)
+	assert.Nil(err)
+	assert.Equal(db.RotationSwitched, rotation.State)
+	assert.Equal(uint64(1), rotation.SweepSequence)
+	assert.Equal(newKeys.SaAddress, store.records["alice"].SaAddress)
+	assert.Equal(oldKeys.SaAddress, store.retired[rotation.ID].SaAddress)
+	assert.Equal(1, chain.broadcasts)
+
+	// An unconfirmed sweep is re-sent with the same sequence.
+	rotation, err = m.Advance(rotation)
+	assert.Nil(err)
+	assert.Equal(db.RotationSwitched, rotation.State)
+	assert.Equal(uint64(1), rotation.SweepSequence)
+	assert.Equal(2, chain.broadcasts)
+
+	// After confirmation, the old SA is not swept while it has reserved funds.
+	chain.accounts[oldKeys.RaAddress] = &ttypes.Account{Sequence: 1, Balance: coins(0, 0)}
+	rotation, err = m.Advance(rotation)
+	assert.Nil(err)
+	assert.Equal(db.RotationRaSwept, rotation.State)
+	assert.Equal(2, chain.broadcasts)
+
+	// Once released, it is.
+	chain.accounts[oldKeys.SaAddress].ReservedFunds = nil
+	rotation, err = m.Advance(rotation)
+	assert.Nil(err)
+	assert.Equal(db.RotationRaSwept, rotation.State)
+	assert.Equal(3, chain.broadcasts)
+
+	chain.accounts[oldKeys.SaAddress] = &ttypes.Account{Sequence: 1, Balance: coins(0, 0)}
+	active, err := m.AdvanceAll()
+	assert.Nil(err)
+	assert.Equal(0, active)
+	assert.Equal(db.RotationCompleted, store.rotations[rotation.ID].State)
+	assert.Equal(uint64(0), store.rotations[rotation.ID].SweepSequence)
+}
+
+func TestSweepWithoutFeeFails(t *testing.T) {
+	assert := assert.New(t)
+
+	oldKeys := db.Record{UserID: "bob", RaAddress: address(3, 1), SaAddress: address(3, 2)}
+	store := newMemStore()
+	store.records["bob"] = oldKeys
+	chain := &fakeChain{accounts: map[tcmn.Address]*ttypes.Account{
+		oldKeys.RaAddress: {Balance: coins(5, 0)},
+	}}
+	m := NewManager(store, fixedKeys{db.Record{RaAddress: address(4, 1), SaAddress: address(4, 2)}}, chain)
+
+	// The rotation stops for manual action instead of being retried forever.
+	rotation, err := m.Start("bob")
+	require.Nil(t, err)
+	rotation, err = m.Advance(rotation)
+	assert.Nil(err)
+	assert.Equal(db.RotationFailed, rotation.State)
+	assert.Contains(store.rotations[rotation.ID].Error, oldKeys.RaAddress.String())
+	assert.Equal(0, chain.broadcasts)
+	active, err := m.AdvanceAll()
+	assert.Nil(err)
+	assert.Equal(0, active)
+}
+
+func TestStartByAdminIsAudited(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newMemStore()
+	store.records["alice"] = db.Record{UserID: "alice", RaAddress: address(1, 1), SaAddress: address(1, 2)}
+	m := NewManager(store, fixedKeys{db.Record{RaAddress: address(2, 1), SaAddress: address(2, 2)}}, &fakeChain{})
+
+	rotation, err := m.StartByAdmin("alice", "ops@192.0.2.1:1234")
+	assert.Nil(err)
+	assert.Equal(db.RotationPending, rotation.State)
+	_, err = m.StartByAdmin("alice", "ops@192.0.2.1:1234")
+	assert.Equal(ErrRotationInProgress, err)
+	_, err = m.StartByAdmin("bob", "ops@192.0.2.1:1234")
+	assert.Equal(keymanager.ErrAccountNotFound, err)
+
+	if assert.Len(store.actions, 3) {
+		assert.Equal(keymanager.AdminActionRotateKeys, store.actions[0].Action)
+		assert.Equal("alice", store.actions[0].UserID)
+		assert.Equal("ops@192.0.2.1:1234", store.actions[0].Actor)
+		assert.True(store.actions[0].Success)
+		assert.False(store.actions[1].Success)
+		assert.Equal(ErrRotationInProgress.Error(), store.actions[1].Error)
+		assert.False(store.actions[2].Success)
+	}
+}
@@ -0,0 +1,160 @@
+package sequence
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/util"
+)
+
+// Manager allocates the sequences of transactions sent from vault addresses. The
+// next sequence of an address follows both the last sequence confirmed on chain
+// and the ones vault submitted since, so callers no longer need to query the chain
+// and race each other. Submissions from the same address are serialized.
+//
+// The Manager also keeps the amounts spent by pending transactions, so that the
+// balance available to the next transaction accounts for them.
+//
+// Sequences are tracked in memory, per vault process.
+type Manager struct {
+	getAccount     func(address tcmn.Address) (*ttypes.Account, error)
+	pendingTimeout time.Duration
+
+	mu        sync.Mutex
+	addresses map[tcmn.Address]*addressState
+}
+
+type addressState struct {
+	mu            sync.Mutex   // Held for the whole submission.
+	confirmed     uint64       // Last sequence confirmed on chain.
+	balance       ttypes.Coins // Balance on chain, as of the confirmed sequence.
+	lastSubmitted uint64       // Last sequence successfully submitted.
+	submittedAt   time.Time
+	pendingSpends map[uint64]ttypes.Coins // Amounts spent by pending transactions, by sequence.
+}
+
+// Allocation is handed to the submission of a transaction.
+type Allocation struct {
+	Sequence  uint64
+	Available ttypes.Coins // Balance left once pending transactions are confirmed.
+}
+
+// pending returns the number of submitted transactions not yet confirmed.
+func (s *addressState) pending() uint64 {
+	if s.lastSubmitted <= s.confirmed {
+		return 0
+	}
+	return s.lastSubmitted - s.confirmed
+}
+
+func NewManager(client util.RPCClient) *Manager {
+	return &Manager{
+		getAccount: func(address tcmn.Address) (*ttypes.Account, error) {
+			return util.GetAccount(client, address)
+		},
+		pendingTimeout: time.Duration(viper.GetInt(util.CfgSequencePendingTimeout)) * time.Second,
+		addresses:      make(map[tcmn.Address]*addressState),
+	}
+}
+
+// Submit calls submit with the sequence of the next transaction from the address
+// and the balance available to it, and returns that sequence. An explicit
+// sequence, if not 0, is used as is. The sequence is only consumed if submit
+// succeeds, in which case the amount it reports spent is held until the
+// transaction is confirmed.
+func (m *Manager) Submit(address tcmn.Address, explicit uint64, submit func(alloc Allocation) (spent ttypes.Coins, err error)) (uint64, error) {
+	state := m.getState(address)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	alloc, err := m.allocate(address, state)
+	if err != nil {
+		return 0, err
+	}
+	if explicit != 0 {
+		alloc.Sequence = explicit
+	}
+	spent, err := submit(alloc)
+	if err != nil {
+		return alloc.Sequence, err
+	}
+	if alloc.Sequence > state.lastSubmitted {
+		state.lastSubmitted = alloc.Sequence
+	}
+	state.submittedAt = time.Now()
+	state.pendingSpends[alloc.Sequence] = spent.NoNil()
+	return alloc.Sequence, nil
+}
+
+// Peek returns the allocation Submit would hand to the next transaction from the
+// address, without consuming it.
+func (m *Manager) Peek(address tcmn.Address) (Allocation, error) {
+	state := m.getState(address)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return m.allocate(address, state)
+}
+
+// Reset forgets the transactions submitted from the address, so the next sequence
+// follows the one confirmed on chain.
+func (m *Manager) Reset(address tcmn.Address) {
+	state := m.getState(address)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.lastSubmitted = 0
+	state.pendingSpends = make(map[uint64]ttypes.Coins)
+}
+
+// allocate refreshes the confirmed sequence and balance of the address, and
+// allocates the sequence following all pending transactions.
+func (m *Manager) allocate(address tcmn.Address, state *addressState) (Allocation, error) {
+	account, err := m.getAccount(address)
+	switch {
+	case util.IsAccountNotFound(err):
+		state.confirmed = 0
+		state.balance = ttypes.Coins{}
+	case err != nil:
+		return Allocation{}, errors.Wrap(err, "Failed to get account")
+	default:
+		state.confirmed = account.Sequence
+		state.balance = account.Balance
+	}
+	for sequence := range state.pendingSpends {
+		if sequence <= state.confirmed {
+			delete(state.pendingSpends, sequence)
+		}
+	}
+
+	if state.pending() > 0 && time.Since(state.submittedAt) > m.pendingTimeout {
+		// Nothing was confirmed for a while, so the pending transactions were most
+		// likely dropped. Fill the gap they left instead of queueing behind it.
+		log.WithFields(log.Fields{"address": address, "confirmed": state.confirmed, "pending": state.pending()}).Warn("Discarding stale pending sequences")
+		state.lastSubmitted = state.confirmed
+		state.pendingSpends = make(map[uint64]ttypes.Coins)
+	}
+
+	alloc := Allocation{Sequence: state.confirmed + 1, Available: state.balance.NoNil()}
+	if state.lastSubmitted > state.confirmed {
+		alloc.Sequence = state.lastSubmitted + 1
+	}
+	for _, spent := range state.pendingSpends {
+		alloc.Available = alloc.Available.Minus(spent)
+	}
+	return alloc, nil
+}
+
+func (m *Manager) getState(address tcmn.Address) *addressState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.addresses[address]
+	if !ok {
+		state = &addressState{pendingSpends: make(map[uint64]ttypes.Coins)}
+		m.addresses[address] = state
+	}
+	return state
+}
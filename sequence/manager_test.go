@@ -0,0 +1,112 @@
+package sequence
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	tcmn "github.com/thetatoken/ukulele/common"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+)
+
+func newTestManager(confirmed *uint64) *Manager {
+	return &Manager{
+		getAccount: func(address tcmn.Address) (*ttypes.Account, error) {
+			return &ttypes.Account{Sequence: *confirmed, Balance: ttypes.NewCoins(100, 1000)}, nil
+		},
+		pendingTimeout: time.Minute,
+		addresses:      make(map[tcmn.Address]*addressState),
+	}
+}
+
+func TestSubmitAllocatesSequences(t *testing.T) {
+	assert := assert.New(t)
+
+	confirmed := uint64(4)
+	m := newTestManager(&confirmed)
+	address := tcmn.HexToAddress("0x01")
+	noop := func(Allocation) (ttypes.Coins, error) { return ttypes.Coins{}, nil }
+
+	seq, err := m.Submit(address, 0, noop)
+	assert.Nil(err)
+	assert.Equal(uint64(5), seq)
+
+	// Pending transactions are counted until confirmed.
+	seq, _ = m.Submit(address, 0, noop)
+	assert.Equal(uint64(6), seq)
+
+	// A failed submission doesn't consume its sequence.
+	seq, err = m.Submit(address, 0, func(Allocation) (ttypes.Coins, error) { return ttypes.Coins{}, errors.New("rejected") })
+	assert.NotNil(err)
+	assert.Equal(uint64(7), seq)
+	seq, _ = m.Submit(address, 0, noop)
+	assert.Equal(uint64(7), seq)
+
+	// Explicit sequences override allocation and are tracked.
+	seq, _ = m.Submit(address, 10, noop)
+	assert.Equal(uint64(10), seq)
+	seq, _ = m.Submit(address, 0, noop)
+	assert.Equal(uint64(11), seq)
+
+	// Stale pending transactions are assumed dropped.
+	m.getState(address).submittedAt = time.Now().Add(-time.Hour)
+	confirmed = 6
+	seq, _ = m.Submit(address, 0, noop)
+	assert.Equal(uint64(7), seq)
+}
+
+func TestSubmitSerializesAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	confirmed := uint64(0)
+	m := newTestManager(&confirmed)
+	address := tcmn.HexToAddress("0x01")
+
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Submit(address, 0, func(alloc Allocation) (ttypes.Coins, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				seen[alloc.Sequence] = true
+				return ttypes.Coins{}, nil
+			})
+		}()
+	}
+	wg.Wait()
+	assert.Equal(20, len(seen))
+	for seq := uint64(1); seq <= 20; seq++ {
+		assert.True(seen[seq])
+	}
+}
+
+func TestSubmitHoldsPendingSpends(t *testing.T) {
+	assert := assert.New(t)
+
+	confirmed := uint64(0)
+	m := newTestManager(&confirmed)
+	address := tcmn.HexToAddress("0x01")
+	spend := func(alloc Allocation) (ttypes.Coins, error) { return ttypes.NewCoins(10, 100), nil }
+
+	m.Submit(address, 0, spend)
+	m.Submit(address, 0, spend)
+	alloc, err := m.Peek(address)
+	assert.Nil(err)
+	assert.Equal(uint64(3), alloc.Sequence)
+	assert.Equal(ttypes.NewCoins(80, 800), alloc.Available)
+
+	// Confirmed transactions are part of the balance on chain.
+	confirmed = 1
+	alloc, _ = m.Peek(address)
+	assert.Equal(ttypes.NewCoins(90, 900), alloc.Available)
+
+	m.Reset(address)
+	alloc, _ = m.Peek(address)
+	assert.Equal(ttypes.NewCoins(100, 1000), alloc.Available)
+}
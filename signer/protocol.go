@@ -0,0 +1,51 @@
+package signer
+
+import (
+	"time"
+
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/policy"
+)
+
+// ServiceName is the name the signer service is registered under.
+const ServiceName = "Signer"
+
+type FindByUserIdArgs struct {
+	UserID string
+}
+
+type RecordReply struct {
+	UserID       string
+	RaAddress    []byte
+	RaPubKey     []byte
+	SaAddress    []byte
+	SaPubKey     []byte
+	CreatedAt    time.Time
+	FaucetFunded bool
+}
+
+type GetSignerArgs struct {
+	UserID string
+	Role   keymanager.AccountRole
+}
+
+type GetSignerReply struct {
+	Address []byte
+	PubKey  []byte
+}
+
+type SignTxArgs struct {
+	UserID    string
+	Role      keymanager.AccountRole
+	Tx        []byte // The transaction to sign, encoded.
+	RequestID string // Recorded in the signing audit log.
+}
+
+// SignTxReply holds the signature, or the policy check that rejected the
+// transaction. net/rpc only transports error messages, so rejections are
+// returned as values for the client to rebuild.
+type SignTxReply struct {
+	Signature     []byte
+	NotAllowed    *policy.AddressNotAllowed
+	LimitExceeded *policy.LimitExceeded
+}
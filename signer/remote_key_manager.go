@@ -0,0 +1,233 @@
+package signer
+
+import (
+	"crypto/tls"
+	"net"
+	"net/rpc"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/thetatoken/ukulele/common"
+	crypto "github.com/thetatoken/ukulele/crypto"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/policy"
+	"github.com/thetatoken/vault/util"
+)
+
+// ----------------- Remote KeyManager ---------------------
+
+var ErrKeystoresOnSignerHost = errors.New("Keystores are exported and imported with vault-signer export-keys and import-keys on the signer host")
+var ErrAccountsOnSignerHost = errors.New("Accounts are created by vault-signer on first use, or with vault-signer create-accounts on the signer host")
+
+var _ keymanager.KeyManager = &RemoteKeyManager{}
+
+// RemoteKeyManager is a KeyManager backed by a vault-signer process. It holds no
+// database credentials and no key material.
+type RemoteKeyManager struct {
+	socketPath string
+	tlsConfig  *tls.Config
+
+	mu     sync.Mutex
+	client *rpc.Client
+}
+
+func NewRemoteKeyManager(socketPath string, tlsConfig *tls.Config) (*RemoteKeyManager, error) {
+	km := &RemoteKeyManager{
+		socketPath: socketPath,
+		tlsConfig:  tlsConfig,
+	}
+	if _, err := km.getClient(); err != nil {
+		return nil, err
+	}
+	return km, nil
+}
+
+// NewRemoteKeyManagerFromConfig connects to the signer configured in config file.
+func NewRemoteKeyManagerFromConfig() (*RemoteKeyManager, error) {
+	tlsConfig, err := LoadTLSConfig(viper.GetString(util.CfgSignerTLSCert), viper.GetString(util.CfgSignerTLSKey), viper.GetString(util.CfgSignerTLSCA))
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = viper.GetString(util.CfgSignerServerName)
+	return NewRemoteKeyManager(viper.GetString(util.CfgSignerSocket), tlsConfig)
+}
+
+// CreateAccount always fails: the signer creates accounts on first use when
+// keymanager.auto_create is set, and with vault-signer create-accounts otherwise.
+func (km *RemoteKeyManager) CreateAccount(userid string) (db.Record, error) {
+	return db.Record{}, ErrAccountsOnSignerHost
+}
+
+func (km *RemoteKeyManager) FindByUserId(userid string) (db.Record, error) {
+	reply := &RecordReply{}
+	if err := km.call("FindByUserId", &FindByUserIdArgs{UserID: userid}, reply); err != nil {
+		return db.Record{}, err
+	}
+	return recordFromReply(reply)
+}
+
+func recordFromReply(reply *RecordReply) (db.Record, error) {
+	raPubKey, err := crypto.PublicKeyFromBytes(reply.RaPubKey)
+	if err != nil {
+		return db.Record{}, err
+	}
+	saPubKey, err := crypto.PublicKeyFromBytes(reply.SaPubKey)
+	if err != nil {
+		return db.Record{}, err
+	}
+	return db.Record{
+		UserID:       reply.UserID,
+		RaAddress:    common.BytesToAddress(reply.RaAddress),
+		RaPubKey:     raPubKey,
+		SaAddress:    common.BytesToAddress(reply.SaAddress),
+		SaPubKey:     saPubKey,
+		CreatedAt:    reply.CreatedAt,
+		FaucetFunded: reply.FaucetFunded,
+	}, nil
+}
+
+func (km *RemoteKeyManager) GetSigner(userid string, role keymanager.AccountRole) (keymanager.Signer, error) {
+	reply := &GetSignerReply{}
+	if err := km.call("GetSigner", &GetSignerArgs{UserID: userid, Role: role}, reply); err != nil {
+		return nil, err
+	}
+	pubKey, err := crypto.PublicKeyFromBytes(reply.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteSigner{
+		km:      km,
+		userid:  userid,
+		role:    role,
+		address: common.BytesToAddress(reply.Address),
+		pubKey:  pubKey,
+	}, nil
+}
+
+// ExportKeys always fails: keystores never leave the signer process over the socket.
+func (km *RemoteKeyManager) ExportKeys(userid, password, actor string) (keymanager.ExportedKeys, error) {
+	return keymanager.ExportedKeys{}, ErrKeystoresOnSignerHost
+}
+
+// ImportKeys always fails: keystores are only imported on the signer host.
+func (km *RemoteKeyManager) ImportKeys(userid string, keys keymanager.ExportedKeys, password, actor string) (db.Record, error) {
+	return db.Record{}, ErrKeystoresOnSignerHost
+}
+
+func (km *RemoteKeyManager) Close() {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	if km.client != nil {
+		km.client.Close()
+		km.client = nil
+	}
+}
+
+// call invokes a signer method, reconnecting once if the connection was lost.
+func (km *RemoteKeyManager) call(method string, args interface{}, reply interface{}) error {
+	client, err := km.getClient()
+	if err != nil {
+		return err
+	}
+	err = client.Call(ServiceName+"."+method, args, reply)
+	if err != rpc.ErrShutdown {
+		return translateError(err)
+	}
+
+	km.resetClient(client)
+	client, err = km.getClient()
+	if err != nil {
+		return err
+	}
+	return translateError(client.Call(ServiceName+"."+method, args, reply))
+}
+
+// translateError maps errors returned by the signer back to the KeyManager errors
+// callers compare against, since net/rpc only transports error messages.
+func translateError(err error) error {
+	serverErr, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	for _, known := range []error{keymanager.ErrAccountNotFound, policy.ErrNoAllowlists, policy.ErrNoSpendingLimits} {
+		if string(serverErr) == known.Error() {
+			return known
+		}
+	}
+	return err
+}
+
+func (km *RemoteKeyManager) getClient() (*rpc.Client, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	if km.client != nil {
+		return km.client, nil
+	}
+	conn, err := net.Dial("unix", km.socketPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to connect to signer")
+	}
+	tlsConn := tls.Client(conn, km.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Failed to authenticate with signer")
+	}
+	km.client = rpc.NewClient(tlsConn)
+	return km.client, nil
+}
+
+func (km *RemoteKeyManager) resetClient(client *rpc.Client) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	if km.client == client {
+		km.client.Close()
+		km.client = nil
+	}
+}
+
+// ----------------- Remote Signer ---------------------
+
+var _ keymanager.Signer = &remoteSigner{}
+
+type remoteSigner struct {
+	km      *RemoteKeyManager
+	userid  string
+	role    keymanager.AccountRole
+	address common.Address
+	pubKey  *crypto.PublicKey
+}
+
+func (s *remoteSigner) Address() common.Address {
+	return s.address
+}
+
+func (s *remoteSigner) PublicKey() *crypto.PublicKey {
+	return s.pubKey
+}
+
+// SignTx returns a *policy.AddressNotAllowed or *policy.LimitExceeded error if the
+// signer rejects tx.
+func (s *remoteSigner) SignTx(tx ttypes.Tx, requestID string) error {
+	raw, err := ttypes.TxToBytes(tx)
+	if err != nil {
+		return err
+	}
+	reply := &SignTxReply{}
+	if err := s.km.call("SignTx", &SignTxArgs{UserID: s.userid, Role: s.role, Tx: raw, RequestID: requestID}, reply); err != nil {
+		return err
+	}
+	if reply.NotAllowed != nil {
+		return reply.NotAllowed
+	}
+	if reply.LimitExceeded != nil {
+		return reply.LimitExceeded
+	}
+	sig, err := crypto.SignatureFromBytes(reply.Signature)
+	if err != nil {
+		return err
+	}
+	return keymanager.SetTxSignature(tx, s.address, sig)
+}
@@ -0,0 +1,183 @@
+package signer
+
+import (
+	"crypto/tls"
+	"net"
+	"net/rpc"
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/policy"
+)
+
+// Service exposes a KeyManager to the vault RPC server. Only public keys and
+// signatures ever leave the process; keystores are exported and imported with the
+// vault-signer CLI. Transactions are checked against the withdrawal allowlists and
+// spending limits of their user before being signed, so a compromised RPC server
+// cannot get around them.
+type Service struct {
+	km         keymanager.KeyManager
+	allowlists db.AllowlistStore // Nil if the database does not support withdrawal allowlists.
+	limits     db.LimitStore     // Nil if the database does not support spending limits.
+}
+
+// NewService serves the key manager, enforcing the policies of the database it
+// supports.
+func NewService(km keymanager.KeyManager, da db.Store) *Service {
+	s := &Service{km: km}
+	s.allowlists, _ = da.(db.AllowlistStore)
+	s.limits, _ = da.(db.LimitStore)
+	return s
+}
+
+func (s *Service) FindByUserId(args *FindByUserIdArgs, reply *RecordReply) error {
+	record, err := s.km.FindByUserId(args.UserID)
+	if err != nil {
+		return err
+	}
+	reply.UserID = record.UserID
+	reply.RaAddress = record.RaAddress.Bytes()
+	reply.RaPubKey = record.RaPubKey.ToBytes()
+	reply.SaAddress = record.SaAddress.Bytes()
+	reply.SaPubKey = record.SaPubKey.ToBytes()
+	reply.CreatedAt = record.CreatedAt
+	reply.FaucetFunded = record.FaucetFunded
+	return nil
+}
+
+func (s *Service) GetSigner(args *GetSignerArgs, reply *GetSignerReply) error {
+	signer, err := s.km.GetSigner(args.UserID, args.Role)
+	if err != nil {
+		return err
+	}
+	reply.Address = signer.Address().Bytes()
+	reply.PubKey = signer.PublicKey().ToBytes()
+	return nil
+}
+
+// SignTx signs a transaction with the given account of the user, once it passed
+// the allowlist of the user and was charged against the limits of the user. The
+// key manager records it in the signing audit log before the signature is
+// returned. Charges are only refunded if signing fails, as the signer cannot tell
+// whether a signed transaction gets broadcast.
+func (s *Service) SignTx(args *SignTxArgs, reply *SignTxReply) error {
+	logger := log.WithFields(log.Fields{"method": "Signer.SignTx", "userid": args.UserID, "role": args.Role, "request_id": args.RequestID})
+
+	tx, err := ttypes.TxFromBytes(args.Tx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to decode transaction")
+	}
+	signer, err := s.km.GetSigner(args.UserID, args.Role)
+	if err != nil {
+		return err
+	}
+	if err := policy.CheckTxDestinations(s.allowlists, args.UserID, tx); err != nil {
+		if notAllowed, ok := err.(*policy.AddressNotAllowed); ok {
+			logger.WithFields(log.Fields{"address": notAllowed.Address.Hex()}).Warn("Rejected transaction to address off the allowlist")
+			reply.NotAllowed = notAllowed
+			return nil
+		}
+		return err
+	}
+	spending, err := policy.TxSpending(s.km, args.UserID, tx)
+	if err != nil {
+		return err
+	}
+	if err := policy.ChargeLimits(s.limits, spending); err != nil {
+		if exceeded, ok := err.(*policy.LimitExceeded); ok {
+			logger.WithFields(log.Fields{"limit": exceeded.Limit}).Warn("Rejected transaction over spending limit")
+			reply.LimitExceeded = exceeded
+			return nil
+		}
+		return err
+	}
+	if err := signer.SignTx(tx, args.RequestID); err != nil {
+		logger.WithFields(log.Fields{"error": err}).Error("Failed to sign")
+		if spending != nil {
+			if refundErr := s.limits.RefundSpending(*spending); refundErr != nil {
+				logger.WithFields(log.Fields{"error": refundErr}).Error("Failed to refund spending")
+			}
+		}
+		return err
+	}
+	sig, err := keymanager.TxSignature(tx, signer.Address())
+	if err != nil {
+		return err
+	}
+	logger.Debug("Signed transaction")
+	reply.Signature = sig.ToBytes()
+	return nil
+}
+
+// Server serves a Service on a Unix socket. Connections are wrapped in TLS and
+// must present a client certificate signed by the configured CA.
+type Server struct {
+	socketPath string
+	tlsConfig  *tls.Config
+	rpcServer  *rpc.Server
+	listener   net.Listener
+}
+
+func NewServer(socketPath string, tlsConfig *tls.Config, service *Service) (*Server, error) {
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName(ServiceName, service); err != nil {
+		return nil, err
+	}
+	return &Server{
+		socketPath: socketPath,
+		tlsConfig:  tlsConfig,
+		rpcServer:  rpcServer,
+	}, nil
+}
+
+// Serve listens on the socket and blocks until the listener is closed.
+func (s *Server) Serve() error {
+	logger := log.WithFields(log.Fields{"method": "Signer.Serve", "socket": s.socketPath})
+
+	// Remove the socket left behind by a previous run.
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Failed to remove stale socket")
+	}
+	l, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to listen")
+	}
+	if err := os.Chmod(s.socketPath, 0600); err != nil {
+		l.Close()
+		return errors.Wrap(err, "Failed to restrict socket permissions")
+	}
+	s.listener = tls.NewListener(l, s.tlsConfig)
+
+	logger.Info("Signer listening")
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn.(*tls.Conn))
+	}
+}
+
+func (s *Server) serveConn(conn *tls.Conn) {
+	logger := log.WithFields(log.Fields{"method": "Signer.serveConn"})
+
+	// Complete the handshake up front so unauthenticated peers are rejected
+	// before any request is read.
+	if err := conn.Handshake(); err != nil {
+		logger.WithFields(log.Fields{"error": err}).Warn("Rejected connection")
+		conn.Close()
+		return
+	}
+	s.rpcServer.ServeConn(conn)
+}
+
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
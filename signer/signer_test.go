@@ -0,0 +1,314 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tcmn "github.com/thetatoken/ukulele/common"
+	crypto "github.com/thetatoken/ukulele/crypto"
+	ttypes "github.com/thetatoken/ukulele/ledger/types"
+
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/keymanager"
+	"github.com/thetatoken/vault/policy"
+	"github.com/thetatoken/vault/util"
+)
+
+const testServerName = "vault-signer"
+
+// testCA issues certificates into a temporary directory.
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	writePEM(t, filepath.Join(dir, name+".crt"), "CERTIFICATE", der)
+	return &testCA{dir: dir, cert: cert, key: key}
+}
+
+// issue writes a certificate and key for name and returns a TLS config loaded from
+// them that trusts the CA.
+func (ca *testCA) issue(t *testing.T, name string) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	certFile := filepath.Join(ca.dir, name+".crt")
+	keyFile := filepath.Join(ca.dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+	tlsConfig, err := LoadTLSConfig(certFile, keyFile, filepath.Join(ca.dir, ca.cert.Subject.CommonName+".crt"))
+	require.Nil(t, err)
+	tlsConfig.ServerName = testServerName
+	return tlsConfig
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	require.Nil(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
+
+// startTestServer serves the service on a socket in dir, with a certificate issued
+// by ca.
+func startTestServer(t *testing.T, dir string, ca *testCA, service *Service) (*Server, string) {
+	socketPath := filepath.Join(dir, "signer.sock")
+	server, err := NewServer(socketPath, ca.issue(t, testServerName), service)
+	require.Nil(t, err)
+	go server.Serve()
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(socketPath); err == nil {
+			return server, socketPath
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Signer did not start listening")
+	return nil, ""
+}
+
+func newTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "vault-signer")
+	require.Nil(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestRemoteKeyManager(t *testing.T) {
+	assert := assert.New(t)
+
+	privKey, pubKey, err := crypto.GenerateKeyPair()
+	require.Nil(t, err)
+	auditLog := &memAuditLog{}
+	local := keymanager.NewAuditedSigner(privKey, "alice", keymanager.SendAccount, auditLog)
+	record := db.Record{UserID: "alice", RaAddress: pubKey.Address(), RaPubKey: pubKey, SaAddress: pubKey.Address(), SaPubKey: pubKey, FaucetFunded: true}
+	km := &keymanager.MockKeyManager{}
+	km.On("FindByUserId", "alice").Return(record, nil)
+	km.On("FindByUserId", "bob").Return(db.Record{}, keymanager.ErrAccountNotFound)
+	km.On("GetSigner", "alice", keymanager.SendAccount).Return(local, nil)
+
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	ca := newTestCA(t, dir, "ca")
+	server, socketPath := startTestServer(t, dir, ca, &Service{km: km})
+	defer server.Close()
+	remote, err := NewRemoteKeyManager(socketPath, ca.issue(t, "vault"))
+	require.Nil(t, err)
+	defer remote.Close()
+
+	found, err := remote.FindByUserId("alice")
+	assert.Nil(err)
+	assert.Equal("alice", found.UserID)
+	assert.Equal(pubKey.Address(), found.SaAddress)
+	assert.True(found.FaucetFunded)
+
+	// Errors callers compare against survive the round trip.
+	_, err = remote.FindByUserId("bob")
+	assert.Equal(keymanager.ErrAccountNotFound, err)
+
+	signer, err := remote.GetSigner("alice", keymanager.SendAccount)
+	assert.Nil(err)
+	assert.Equal(local.Address(), signer.Address())
+	assert.Equal(local.PublicKey().ToBytes(), signer.PublicKey().ToBytes())
+
+	// Transactions are recorded by the signer before their signature is returned.
+	tx := &ttypes.ReleaseFundTx{Source: ttypes.TxInput{Address: pubKey.Address(), Sequence: 1}, ReserveSequence: 1}
+	assert.Nil(signer.SignTx(tx, "req-1"))
+	if assert.NotNil(tx.Source.Signature) {
+		assert.True(pubKey.VerifySignature(tx.SignBytes(viper.GetString(util.CfgThetaChainId)), tx.Source.Signature))
+	}
+	if assert.Len(auditLog.entries, 1) {
+		raw, err := ttypes.TxToBytes(tx)
+		assert.Nil(err)
+		assert.Equal(crypto.Keccak256Hash(raw).Hex(), auditLog.entries[0].TxHash)
+		assert.Equal("req-1", auditLog.entries[0].RequestID)
+	}
+
+	km.AssertExpectations(t)
+}
+
+func TestSignerRejectsUntrustedClients(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	ca := newTestCA(t, dir, "ca")
+	server, socketPath := startTestServer(t, dir, ca, &Service{km: &keymanager.MockKeyManager{}})
+	defer server.Close()
+
+	// A certificate from another CA is refused, at the latest on the first call.
+	otherDir, otherCleanup := newTestDir(t)
+	defer otherCleanup()
+	other := newTestCA(t, otherDir, "other-ca")
+	tlsConfig := other.issue(t, "vault")
+	tlsConfig.RootCAs = x509.NewCertPool()
+	tlsConfig.RootCAs.AddCert(ca.cert)
+	remote, err := NewRemoteKeyManager(socketPath, tlsConfig)
+	if err == nil {
+		_, err = remote.FindByUserId("alice")
+		remote.Close()
+	}
+	assert.NotNil(t, err)
+
+	// So is a client without certificate.
+	tlsConfig = ca.issue(t, "vault")
+	tlsConfig.Certificates = nil
+	remote, err = NewRemoteKeyManager(socketPath, tlsConfig)
+	if err == nil {
+		_, err = remote.FindByUserId("alice")
+		remote.Close()
+	}
+	assert.NotNil(t, err)
+}
+
+// memAuditLog keeps the signing audit log in memory.
+type memAuditLog struct {
+	entries []db.SigningAuditEntry
+}
+
+func (l *memAuditLog) AppendSigningAudit(entry db.SigningAuditEntry) (db.SigningAuditEntry, error) {
+	entry.Seq = uint64(len(l.entries)) + 1
+	l.entries = append(l.entries, entry)
+	return entry, nil
+}
+
+func (l *memAuditLog) ListSigningAudit(afterSeq uint64, limit int) ([]db.SigningAuditEntry, error) {
+	return nil, nil
+}
+
+// memStore keeps allowlists and spending in memory. Methods the tests do not use
+// are left to the embedded nil interfaces.
+type memStore struct {
+	db.AllowlistStore
+	db.LimitStore
+
+	allowed  map[tcmn.Address]db.WithdrawalAddress
+	spending []db.Spending
+}
+
+func (s *memStore) FindUserByAddress(address tcmn.Address) (string, string, error) {
+	return "", "", db.ErrNoRecord
+}
+
+func (s *memStore) FindWithdrawalAddress(userid string, address tcmn.Address) (db.WithdrawalAddress, error) {
+	entry, ok := s.allowed[address]
+	if !ok {
+		return db.WithdrawalAddress{}, db.ErrNoRecord
+	}
+	return entry, nil
+}
+
+func (s *memStore) FindUserLimits(userid string) (db.UserLimits, error) {
+	return db.UserLimits{}, db.ErrNoRecord
+}
+
+func (s *memStore) ChargeSpending(spending db.Spending, limits db.SpendingLimits) (*db.LimitExceeded, error) {
+	if limits.Daily.GammaWei != nil && spending.GammaWei.Cmp(limits.Daily.GammaWei) > 0 {
+		return &db.LimitExceeded{Limit: db.LimitDaily, Currency: "gammawei", Max: limits.Daily.GammaWei, Used: big.NewInt(0)}, nil
+	}
+	s.spending = append(s.spending, spending)
+	return nil, nil
+}
+
+func TestRemoteSignerEnforcesPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	viper.Set(util.CfgAllowlistEnabled, true)
+	viper.Set(util.CfgLimitsEnabled, true)
+	viper.Set(util.CfgLimitsDefaultTier, "default")
+	viper.Set(util.CfgLimitsTiers+".default.daily_gammawei", "100")
+	defer viper.Reset()
+
+	privKey, pubKey, err := crypto.GenerateKeyPair()
+	require.Nil(t, err)
+	auditLog := &memAuditLog{}
+	local := keymanager.NewAuditedSigner(privKey, "alice", keymanager.SendAccount, auditLog)
+	record := db.Record{UserID: "alice", RaAddress: pubKey.Address(), RaPubKey: pubKey, SaAddress: pubKey.Address(), SaPubKey: pubKey}
+	km := &keymanager.MockKeyManager{}
+	km.On("FindByUserId", "alice").Return(record, nil)
+	km.On("GetSigner", "alice", keymanager.SendAccount).Return(local, nil)
+
+	exchange := tcmn.HexToAddress("0x2e833968e5bb786ae419c4d13189fb081cc43bab")
+	store := &memStore{allowed: map[tcmn.Address]db.WithdrawalAddress{}}
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	ca := newTestCA(t, dir, "ca")
+	server, socketPath := startTestServer(t, dir, ca, &Service{km: km, allowlists: store, limits: store})
+	defer server.Close()
+	remote, err := NewRemoteKeyManager(socketPath, ca.issue(t, "vault"))
+	require.Nil(t, err)
+	defer remote.Close()
+	signer, err := remote.GetSigner("alice", keymanager.SendAccount)
+	require.Nil(t, err)
+
+	send := func(gammaWei int64) *ttypes.SendTx {
+		return &ttypes.SendTx{
+			Inputs:  []ttypes.TxInput{{Address: pubKey.Address(), Coins: ttypes.NewCoins(0, gammaWei), Sequence: 1}},
+			Outputs: []ttypes.TxOutput{{Address: exchange, Coins: ttypes.NewCoins(0, gammaWei)}},
+		}
+	}
+
+	// Addresses off the allowlist are refused by the signer itself.
+	tx := send(60)
+	err = signer.SignTx(tx, "req-1")
+	if notAllowed, ok := err.(*policy.AddressNotAllowed); assert.True(ok) {
+		assert.Equal(exchange, notAllowed.Address)
+	}
+	assert.Nil(tx.Inputs[0].Signature)
+
+	store.allowed[exchange] = db.WithdrawalAddress{UserID: "alice", Address: exchange, ActiveAt: time.Now().Add(-time.Hour)}
+	assert.Nil(signer.SignTx(tx, "req-2"))
+	assert.NotNil(tx.Inputs[0].Signature)
+	if assert.Len(store.spending, 1) {
+		assert.Equal(int64(60), store.spending[0].GammaWei.Int64())
+	}
+
+	// So are transactions over the limits of the user.
+	tx = send(160)
+	err = signer.SignTx(tx, "req-3")
+	if exceeded, ok := err.(*policy.LimitExceeded); assert.True(ok) {
+		assert.Equal(db.LimitDaily, exceeded.Limit)
+		assert.Equal(int64(100), exceeded.Max.Int64())
+		assert.Equal(int64(160), exceeded.Requested.Int64())
+	}
+	assert.Nil(tx.Inputs[0].Signature)
+	assert.Len(auditLog.entries, 1)
+}
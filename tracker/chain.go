@@ -0,0 +1,62 @@
+package tracker
+
+import (
+	tcmn "github.com/thetatoken/ukulele/common"
+	"github.com/thetatoken/vault/util"
+)
+
+// Transaction statuses reported by Theta nodes.
+const (
+	NodeTxNotFound  = "not_found"
+	NodeTxPending   = "pending" // In the mempool, or in a block not finalized yet.
+	NodeTxFinalized = "finalized"
+	NodeTxAbandoned = "abandoned"
+)
+
+type NodeTxStatus struct {
+	Status      string
+	BlockHeight uint64 // 0 unless the transaction is in a block.
+}
+
+// Chain is the view of the blockchain the Tracker needs.
+type Chain interface {
+	GetTransactionStatus(hash tcmn.Hash) (NodeTxStatus, error)
+}
+
+type getTransactionArgs struct {
+	Hash string `json:"hash"`
+}
+
+type getTransactionResult struct {
+	BlockHash   tcmn.Hash       `json:"block_hash"`
+	BlockHeight tcmn.JSONUint64 `json:"block_height"`
+	Status      string          `json:"status"`
+}
+
+// RPCChain talks to a Theta node.
+type RPCChain struct {
+	client util.RPCClient
+}
+
+func NewRPCChain(client util.RPCClient) *RPCChain {
+	return &RPCChain{client: client}
+}
+
+func (c *RPCChain) GetTransactionStatus(hash tcmn.Hash) (NodeTxStatus, error) {
+	resp, err := c.client.Call("theta.GetTransaction", getTransactionArgs{Hash: hash.Hex()})
+	if err != nil {
+		return NodeTxStatus{}, err
+	}
+	if resp.Error != nil {
+		return NodeTxStatus{}, resp.Error
+	}
+	result := &getTransactionResult{}
+	if err := resp.GetObject(result); err != nil {
+		return NodeTxStatus{}, err
+	}
+	status := NodeTxStatus{Status: result.Status}
+	if result.BlockHash != (tcmn.Hash{}) {
+		status.BlockHeight = uint64(result.BlockHeight)
+	}
+	return status, nil
+}
@@ -0,0 +1,121 @@
+package tracker
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tcmn "github.com/thetatoken/ukulele/common"
+	"github.com/thetatoken/vault/db"
+	"github.com/thetatoken/vault/util"
+)
+
+// A tracked transaction moves from pending to included once the node reports it
+// in a block, then to finalized once that block is finalized. Transactions the
+// node abandons, or no longer knows about after the drop timeout, are failed.
+
+// Store is the persistence the Tracker needs. db.DAO, db.BoltStore and
+// db.DynamoStore implement it.
+type Store interface {
+	FindUnsettledTransactions(after db.Transaction, limit int) ([]db.Transaction, error)
+	UpdateTransactionStatus(tx db.Transaction, fromStatus string) (bool, error)
+}
+
+// batchSize caps the number of transactions loaded at once.
+const batchSize = 500
+
+type Tracker struct {
+	store       Store
+	chain       Chain
+	dropTimeout time.Duration
+}
+
+func NewTracker(store Store, chain Chain) *Tracker {
+	return &Tracker{
+		store:       store,
+		chain:       chain,
+		dropTimeout: time.Duration(viper.GetInt64(util.CfgTrackerDropTimeout)) * time.Second,
+	}
+}
+
+// Process polls the node for the status of unsettled transactions periodically.
+func (t *Tracker) Process() {
+	logger := log.WithFields(log.Fields{"method": "tracker.Process"})
+
+	sleepWakeup := viper.GetInt64(util.CfgTrackerWakeupInterval)
+	wakeupTicker := time.NewTicker(time.Duration(sleepWakeup) * time.Second)
+	defer wakeupTicker.Stop()
+
+	for range wakeupTicker.C {
+		updated, err := t.UpdateAll()
+		if err != nil {
+			logger.WithFields(log.Fields{"error": err}).Error("Failed to update transaction statuses")
+		} else if updated > 0 {
+			logger.Infof("Updated the status of %d transactions", updated)
+		}
+	}
+}
+
+// UpdateAll refreshes the status of every unsettled transaction, a batch at a
+// time, and returns the number of transactions whose status changed.
+func (t *Tracker) UpdateAll() (int, error) {
+	updated := 0
+	var after db.Transaction
+	for {
+		txs, err := t.store.FindUnsettledTransactions(after, batchSize)
+		if err != nil {
+			return updated, errors.Wrap(err, "Failed to fetch transactions from database")
+		}
+		for _, tx := range txs {
+			changed, err := t.Update(tx)
+			if err != nil {
+				log.WithFields(log.Fields{"method": "tracker.UpdateAll", "hash": tx.Hash, "error": err}).Warn("Failed to update transaction status")
+				continue
+			}
+			if changed {
+				updated++
+			}
+		}
+		if len(txs) < batchSize {
+			return updated, nil
+		}
+		after = txs[len(txs)-1]
+	}
+}
+
+// Update refreshes the status of a transaction from the node and reports whether
+// it changed.
+func (t *Tracker) Update(tx db.Transaction) (bool, error) {
+	status, err := t.chain.GetTransactionStatus(tcmn.HexToHash(tx.Hash))
+	if err != nil {
+		return false, err
+	}
+
+	fromStatus := tx.Status
+	switch status.Status {
+	case NodeTxFinalized:
+		tx.Status = db.TxFinalized
+		tx.BlockHeight = status.BlockHeight
+	case NodeTxPending:
+		if status.BlockHeight > 0 {
+			tx.Status = db.TxIncluded
+			tx.BlockHeight = status.BlockHeight
+		}
+	case NodeTxAbandoned:
+		tx.Status = db.TxFailed
+		tx.Error = "abandoned by the node"
+	case NodeTxNotFound:
+		// Freshly broadcast transactions may not have propagated yet.
+		if time.Since(tx.CreatedAt) > t.dropTimeout {
+			tx.Status = db.TxFailed
+			tx.Error = "dropped by the node"
+		}
+	default:
+		return false, errors.Errorf("Unknown transaction status: %s", status.Status)
+	}
+	if tx.Status == fromStatus && tx.BlockHeight == status.BlockHeight {
+		return false, nil
+	}
+	return t.store.UpdateTransactionStatus(tx, fromStatus)
+}
@@ -0,0 +1,134 @@
+package tracker
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	tcmn "github.com/thetatoken/ukulele/common"
+	"github.com/thetatoken/vault/db"
+)
+
+type memStore struct {
+	txs map[string]db.Transaction
+}
+
+func (s *memStore) FindUnsettledTransactions(after db.Transaction, limit int) ([]db.Transaction, error) {
+	var txs []db.Transaction
+	for _, tx := range s.txs {
+		if !tx.IsSettled() && (after.Hash == "" || txBefore(after, tx)) {
+			txs = append(txs, tx)
+		}
+	}
+	sort.Slice(txs, func(i, j int) bool { return txBefore(txs[i], txs[j]) })
+	if len(txs) > limit {
+		txs = txs[:limit]
+	}
+	return txs, nil
+}
+
+func txBefore(a, b db.Transaction) bool {
+	if a.CreatedAt.Equal(b.CreatedAt) {
+		return a.Hash < b.Hash
+	}
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+func (s *memStore) UpdateTransactionStatus(tx db.Transaction, fromStatus string) (bool, error) {
+	if s.txs[tx.Hash].Status != fromStatus {
+		return false, nil
+	}
+	s.txs[tx.Hash] = tx
+	return true, nil
+}
+
+type fakeChain struct {
+	statuses map[tcmn.Hash]NodeTxStatus
+}
+
+func (c *fakeChain) GetTransactionStatus(hash tcmn.Hash) (NodeTxStatus, error) {
+	if status, ok := c.statuses[hash]; ok {
+		return status, nil
+	}
+	return NodeTxStatus{Status: NodeTxNotFound}, nil
+}
+
+func TestTrackerUpdatesStatuses(t *testing.T) {
+	assert := assert.New(t)
+
+	hash := func(b byte) string { return tcmn.BytesToHash([]byte{b}).Hex() }
+	store := &memStore{txs: map[string]db.Transaction{}}
+	for i, createdAt := range []time.Time{time.Now(), time.Now(), time.Now(), time.Now(), time.Now().Add(-time.Hour)} {
+		h := hash(byte(i + 1))
+		store.txs[h] = db.Transaction{Hash: h, Status: db.TxPending, CreatedAt: createdAt}
+	}
+	chain := &fakeChain{statuses: map[tcmn.Hash]NodeTxStatus{
+		tcmn.HexToHash(hash(1)): {Status: NodeTxPending},
+		tcmn.HexToHash(hash(2)): {Status: NodeTxPending, BlockHeight: 10},
+		tcmn.HexToHash(hash(3)): {Status: NodeTxFinalized, BlockHeight: 11},
+		tcmn.HexToHash(hash(4)): {Status: NodeTxAbandoned},
+	}}
+	tracker := &Tracker{store: store, chain: chain, dropTimeout: time.Minute}
+
+	updated, err := tracker.UpdateAll()
+	assert.Nil(err)
+	assert.Equal(4, updated)
+	assert.Equal(db.TxPending, store.txs[hash(1)].Status)
+	assert.Equal(db.TxIncluded, store.txs[hash(2)].Status)
+	assert.Equal(uint64(10), store.txs[hash(2)].BlockHeight)
+	assert.Equal(db.TxFinalized, store.txs[hash(3)].Status)
+	assert.Equal(db.TxFailed, store.txs[hash(4)].Status)
+	assert.Equal(db.TxFailed, store.txs[hash(5)].Status)
+	assert.Equal("dropped by the node", store.txs[hash(5)].Error)
+}
+
+func TestTrackerFinalizesIncludedTransactions(t *testing.T) {
+	assert := assert.New(t)
+
+	hash := tcmn.BytesToHash([]byte{1}).Hex()
+	store := &memStore{txs: map[string]db.Transaction{
+		hash: {Hash: hash, Status: db.TxIncluded, BlockHeight: 10, CreatedAt: time.Now()},
+	}}
+	chain := &fakeChain{statuses: map[tcmn.Hash]NodeTxStatus{}}
+	tracker := &Tracker{store: store, chain: chain, dropTimeout: time.Minute}
+
+	chain.statuses[tcmn.HexToHash(hash)] = NodeTxStatus{Status: NodeTxPending, BlockHeight: 10}
+	updated, err := tracker.UpdateAll()
+	assert.Nil(err)
+	assert.Equal(0, updated)
+	assert.Equal(db.TxIncluded, store.txs[hash].Status)
+
+	chain.statuses[tcmn.HexToHash(hash)] = NodeTxStatus{Status: NodeTxFinalized, BlockHeight: 10}
+	updated, err = tracker.UpdateAll()
+	assert.Nil(err)
+	assert.Equal(1, updated)
+	assert.Equal(db.TxFinalized, store.txs[hash].Status)
+	assert.Equal(uint64(10), store.txs[hash].BlockHeight)
+}
+
+func TestTrackerChecksEveryBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	// More transactions than fit in a batch, all still pending on the node, and a
+	// newest one that got finalized.
+	store := &memStore{txs: map[string]db.Transaction{}}
+	chain := &fakeChain{statuses: map[tcmn.Hash]NodeTxStatus{}}
+	start := time.Now()
+	for i := 0; i < 2*batchSize+1; i++ {
+		h := tcmn.BytesToHash([]byte(fmt.Sprintf("tx-%d", i))).Hex()
+		// Pairs of transactions share a creation time, to page through ties.
+		store.txs[h] = db.Transaction{Hash: h, Status: db.TxPending, CreatedAt: start.Add(time.Duration(i/2) * time.Millisecond)}
+		chain.statuses[tcmn.HexToHash(h)] = NodeTxStatus{Status: NodeTxPending}
+	}
+	newest := tcmn.BytesToHash([]byte("newest")).Hex()
+	store.txs[newest] = db.Transaction{Hash: newest, Status: db.TxPending, CreatedAt: start.Add(time.Hour)}
+	chain.statuses[tcmn.HexToHash(newest)] = NodeTxStatus{Status: NodeTxFinalized, BlockHeight: 12}
+	tracker := &Tracker{store: store, chain: chain, dropTimeout: time.Minute}
+
+	updated, err := tracker.UpdateAll()
+	assert.Nil(err)
+	assert.Equal(1, updated)
+	assert.Equal(db.TxFinalized, store.txs[newest].Status)
+}
@@ -8,11 +8,16 @@ import (
 )
 
 const (
+	CfgDbDriver                        = "db.driver"
+	CfgDbPath                          = "db.path"
 	CfgDbHost                          = "db.host"
 	CfgDbUser                          = "db.user"
 	CfgDbPass                          = "db.pass"
 	CfgDbDatabase                      = "db.database"
 	CfgDbTable                         = "db.table"
+	CfgDbAutoMigrate                   = "db.auto_migrate"
+	CfgDbDynamoDBRegion                = "db.dynamodb.region"
+	CfgDbDynamoDBEndpoint              = "db.dynamodb.endpoint"
 	CfgDebug                           = "debug"
 	CfgServerPort                      = "server.port"
 	CfgServerMaxConnections            = "server.max_connections"
@@ -25,14 +30,52 @@ const (
 	CfgFaucetThetaAmount               = "faucet.theta"
 	CfgFaucetGammaAmount               = "faucet.gamma"
 	CfgFaucetAddress                   = "faucet.address"
+	CfgEncryptionProvider              = "encryption.provider"
+	CfgEncryptionKeyFile               = "encryption.key_file"
+	CfgEncryptionPassphrase            = "encryption.passphrase"
+	CfgEncryptionSalt                  = "encryption.salt"
+	CfgSignerSocket                    = "signer.socket"
+	CfgSignerTLSCert                   = "signer.tls_cert"
+	CfgSignerTLSKey                    = "signer.tls_key"
+	CfgSignerTLSCA                     = "signer.tls_ca"
+	CfgSignerServerName                = "signer.server_name"
+	CfgKeyManagerKeyGeneration         = "keymanager.key_generation"
+	CfgKeyManagerHDSeedFile            = "keymanager.hd_seed_file"
+	CfgKeyManagerAutoCreate            = "keymanager.auto_create"
+	CfgRotationWakeupInterval          = "rotation.sleep_between_wakeups_secs"
+	CfgAdminToken                      = "admin.token"
+	CfgSequencePendingTimeout          = "sequence.pending_timeout_secs"
+	CfgBroadcastMaxAttempts            = "broadcast.max_attempts"
+	CfgBroadcastBackoffMs              = "broadcast.backoff_ms"
+	CfgBatchSendMaxTxBytes             = "batch_send.max_tx_bytes"
+	CfgTopUpEnabled                    = "topup.enabled"
+	CfgTopUpThresholdThetaWei          = "topup.threshold_thetawei"
+	CfgTopUpThresholdGammaWei          = "topup.threshold_gammawei"
+	CfgTopUpTargetThetaWei             = "topup.target_thetawei"
+	CfgTopUpTargetGammaWei             = "topup.target_gammawei"
+	CfgTopUpCooldown                   = "topup.cooldown_secs"
+	CfgIdempotencyClaimTimeout         = "idempotency.claim_timeout_secs"
+	CfgTrackerWakeupInterval           = "tracker.sleep_between_wakeups_secs"
+	CfgTrackerDropTimeout              = "tracker.drop_timeout_secs"
+	CfgIndexerWakeupInterval           = "indexer.sleep_between_wakeups_secs"
+	CfgIndexerStartHeight              = "indexer.start_height"
+	CfgAllowlistEnabled                = "allowlist.enabled"
+	CfgAllowlistDelay                  = "allowlist.delay_secs"
+	CfgAllowlistWebhookURL             = "allowlist.webhook_url"
+	CfgLimitsEnabled                   = "limits.enabled"
+	CfgLimitsDefaultTier               = "limits.default_tier"
+	CfgLimitsTiers                     = "limits.tiers"
+	CfgLimitsBlockTime                 = "limits.block_time_secs"
 )
 
 func ReadConfig() {
 	logger := log.WithFields(log.Fields{"method": "readConfig"})
 
+	viper.SetDefault(CfgDbDriver, "postgres")
 	viper.SetDefault(CfgDbHost, "localhost")
 	viper.SetDefault(CfgDbDatabase, "sliver_video_serving")
 	viper.SetDefault(CfgDbTable, "user_theta_native_wallet")
+	viper.SetDefault(CfgDbAutoMigrate, true)
 	viper.SetDefault(CfgDebug, false)
 	viper.SetDefault(CfgServerPort, "20000")
 	viper.SetDefault(CfgServerMaxConnections, 200)
@@ -41,6 +84,27 @@ func ReadConfig() {
 	viper.SetDefault(CfgFaucetGrantsPerBatch, 100)
 	viper.SetDefault(CfgFaucetBatchDuration, 3600)
 	viper.SetDefault(CfgFaucetWakeupInterval, 10)
+	viper.SetDefault(CfgEncryptionProvider, "none")
+	viper.SetDefault(CfgSignerServerName, "vault-signer")
+	viper.SetDefault(CfgKeyManagerKeyGeneration, "random")
+	viper.SetDefault(CfgKeyManagerAutoCreate, true)
+	viper.SetDefault(CfgRotationWakeupInterval, 60)
+	viper.SetDefault(CfgSequencePendingTimeout, 120)
+	viper.SetDefault(CfgBroadcastMaxAttempts, 3)
+	viper.SetDefault(CfgBroadcastBackoffMs, 500)
+	viper.SetDefault(CfgBatchSendMaxTxBytes, 8192)
+	viper.SetDefault(CfgTopUpThresholdThetaWei, "0")
+	viper.SetDefault(CfgTopUpThresholdGammaWei, "0")
+	viper.SetDefault(CfgTopUpTargetThetaWei, "0")
+	viper.SetDefault(CfgTopUpTargetGammaWei, "0")
+	viper.SetDefault(CfgTopUpCooldown, 60)
+	viper.SetDefault(CfgIdempotencyClaimTimeout, 900)
+	viper.SetDefault(CfgTrackerWakeupInterval, 5)
+	viper.SetDefault(CfgTrackerDropTimeout, 600)
+	viper.SetDefault(CfgIndexerWakeupInterval, 5)
+	viper.SetDefault(CfgAllowlistDelay, 86400)
+	viper.SetDefault(CfgLimitsDefaultTier, "default")
+	viper.SetDefault(CfgLimitsBlockTime, 6)
 
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
@@ -2,6 +2,9 @@ package util
 
 import (
 	"errors"
+	"os"
+	"os/user"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/thetatoken/ukulele/common"
@@ -15,23 +18,52 @@ type RPCClient interface {
 }
 
 func GetSequence(client RPCClient, address common.Address) (sequence uint64, err error) {
+	account, err := GetAccount(client, address)
+	if err != nil {
+		return 0, err
+	}
+	return account.Sequence, nil
+}
+
+// IsAccountNotFound reports whether err is the error the Theta node returns for
+// accounts it has never seen.
+func IsAccountNotFound(err error) bool {
+	rpcErr, ok := err.(*rpcc.RPCError)
+	return ok && strings.Contains(rpcErr.Message, "not found")
+}
+
+// GetAccount queries the current state of an account from the blockchain.
+func GetAccount(client RPCClient, address common.Address) (*types.Account, error) {
 	resp, err := client.Call("theta.GetAccount", ukulele.GetAccountArgs{Address: address.String()})
 	if err != nil {
 		log.WithFields(log.Fields{"address": address, "error": err}).Error("Error in RPC call: theta.GetAccount()")
-		return 0, err
+		return nil, err
 	}
 	if resp.Error != nil {
-		return 0, resp.Error
+		return nil, resp.Error
 	}
 	result := &ukulele.GetAccountResult{Account: types.NewAccount()}
 	err = resp.GetObject(result)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	if result.Account == nil {
 		log.WithFields(log.Fields{"address": address, "error": err, "res": resp}).Error("No result from RPC call: theta.GetAccount()")
-		err = errors.New("Error in getting account sequence number")
-		return 0, err
+		return nil, errors.New("Error in getting account")
+	}
+	return result.Account, nil
+}
+
+// CLIActor names the operator of a command line tool in audit trails, after the
+// user running it and the host.
+func CLIActor() string {
+	name := "unknown"
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
 	}
-	return result.Sequence, err
+	return "cli:" + name + "@" + host
 }
@@ -2,6 +2,8 @@ package util
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"io/ioutil"
 	"net/http"
 	"time"
@@ -55,3 +57,26 @@ func LoggerMiddleware(handler http.Handler) http.Handler {
 		logger.WithFields(log.Fields{"time": elapsed, "body": responseBody, "headers": w.Header()}).Debug("RPC Response")
 	})
 }
+
+// RequestIDHeader carries the ID that ties log lines and signing audit entries to
+// the request that caused them.
+const RequestIDHeader = "X-Request-Id"
+
+// RequestIDMiddleware assigns an ID to requests that come without one, and echoes
+// it in the response.
+func RequestIDMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				http.Error(w, "can't generate request id", http.StatusInternalServerError)
+				return
+			}
+			requestID = hex.EncodeToString(b)
+			r.Header.Set(RequestIDHeader, requestID)
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		handler.ServeHTTP(w, r)
+	})
+}